@@ -17,11 +17,13 @@ type TestModel struct {
 	flags    uint32
 	options  []Option
 	closedCh chan bool
+	updates  chan []FileDownloadProgressUpdate
 }
 
 func newTestModel() *TestModel {
 	return &TestModel{
 		closedCh: make(chan bool),
+		updates:  make(chan []FileDownloadProgressUpdate, 1),
 	}
 }
 
@@ -46,9 +48,18 @@ func (t *TestModel) Close(deviceID DeviceID, err error) {
 	close(t.closedCh)
 }
 
+func (t *TestModel) ExtraClosed(conn Connection, err error) {
+	close(t.closedCh)
+}
+
 func (t *TestModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessage) {
 }
 
+func (t *TestModel) DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) {
+	t.folder = folder
+	t.updates <- updates
+}
+
 func (t *TestModel) isClosed() bool {
 	select {
 	case <-t.closedCh:
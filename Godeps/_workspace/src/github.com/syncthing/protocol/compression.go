@@ -2,7 +2,16 @@
 
 package protocol
 
-import "fmt"
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+)
 
 type Compression int
 
@@ -51,3 +60,160 @@ func (c *Compression) UnmarshalText(bs []byte) error {
 	*c = compressionUnmarshal[string(bs)]
 	return nil
 }
+
+// A CompressionAlgorithm is the algorithm used for compressed messages. The
+// algorithm is negotiated when the connection is set up; peers that do not
+// announce support for anything else get LZ4.
+type CompressionAlgorithm int
+
+const (
+	CompressionLZ4     CompressionAlgorithm = iota // zero value is the default, understood by all peers
+	CompressionDeflate                             // better ratio than LZ4, at a higher CPU cost
+
+	compressionOptionKey = "compression" // ClusterConfig option listing the algorithms we can decompress
+)
+
+var compressionAlgorithmMarshal = map[CompressionAlgorithm]string{
+	CompressionLZ4:     "lz4",
+	CompressionDeflate: "deflate",
+}
+
+var compressionAlgorithmUnmarshal = map[string]CompressionAlgorithm{
+	"lz4":     CompressionLZ4,
+	"deflate": CompressionDeflate,
+}
+
+// supportedCompressionAlgorithms is announced to the peer, comma separated,
+// in the compressionOptionKey option.
+var supportedCompressionAlgorithms = []CompressionAlgorithm{CompressionLZ4, CompressionDeflate}
+
+func (c CompressionAlgorithm) String() string {
+	s, ok := compressionAlgorithmMarshal[c]
+	if !ok {
+		return fmt.Sprintf("unknown:%d", c)
+	}
+	return s
+}
+
+func (c CompressionAlgorithm) GoString() string {
+	return fmt.Sprintf("%q", c.String())
+}
+
+func (c CompressionAlgorithm) MarshalText() ([]byte, error) {
+	return []byte(compressionAlgorithmMarshal[c]), nil
+}
+
+func (c *CompressionAlgorithm) UnmarshalText(bs []byte) error {
+	*c = compressionAlgorithmUnmarshal[string(bs)]
+	return nil
+}
+
+func compressionOption() Option {
+	names := make([]string, len(supportedCompressionAlgorithms))
+	for i, algo := range supportedCompressionAlgorithms {
+		names[i] = algo.String()
+	}
+	return Option{Key: compressionOptionKey, Value: strings.Join(names, ",")}
+}
+
+// peerSupportsCompression returns true if the options sent by the peer in
+// its ClusterConfig announce support for the algorithm. LZ4 is always
+// supported.
+func peerSupportsCompression(options []Option, algo CompressionAlgorithm) bool {
+	if algo == CompressionLZ4 {
+		return true
+	}
+	for _, opt := range options {
+		if opt.Key != compressionOptionKey {
+			continue
+		}
+		for _, name := range strings.Split(opt.Value, ",") {
+			if a, ok := compressionAlgorithmUnmarshal[strings.TrimSpace(name)]; ok && a == algo {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A compressor compresses messages, keeping the state that can be reused
+// between messages.
+type compressor struct {
+	fw *flate.Writer
+}
+
+// appendCompressed appends the compressed form of src to dst.
+func (c *compressor) appendCompressed(algo CompressionAlgorithm, dst, src []byte) ([]byte, error) {
+	switch algo {
+	case CompressionLZ4:
+		offset := len(dst)
+		if maxLen := offset + lz4.CompressBound(len(src)); maxLen > cap(dst) {
+			nd := make([]byte, offset, maxLen)
+			copy(nd, dst)
+			dst = nd
+		}
+		bs, err := lz4.Encode(dst[offset:cap(dst)], src)
+		if err != nil {
+			return nil, err
+		}
+		return dst[:offset+len(bs)], nil
+
+	case CompressionDeflate:
+		buf := bytes.NewBuffer(dst)
+		if c.fw == nil {
+			fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+			if err != nil {
+				return nil, err
+			}
+			c.fw = fw
+		} else {
+			c.fw.Reset(buf)
+		}
+		if _, err := c.fw.Write(src); err != nil {
+			return nil, err
+		}
+		if err := c.fw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %d", algo)
+	}
+}
+
+// A decompressor decompresses messages, keeping the state that can be
+// reused between messages.
+type decompressor struct {
+	fr io.ReadCloser
+}
+
+// decompress returns the decompressed form of src, reusing the space in dst
+// if possible. An error is returned if it would be longer than max bytes.
+func (d *decompressor) decompress(algo CompressionAlgorithm, dst, src []byte, max int) ([]byte, error) {
+	switch algo {
+	case CompressionLZ4:
+		if len(src) >= 4 && int64(binary.LittleEndian.Uint32(src)) > int64(max) {
+			return nil, errMessageTooLarge
+		}
+		return lz4.Decode(dst[:cap(dst)], src)
+
+	case CompressionDeflate:
+		if d.fr == nil {
+			d.fr = flate.NewReader(bytes.NewReader(src))
+		} else if err := d.fr.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(dst[:0])
+		if _, err := buf.ReadFrom(io.LimitReader(d.fr, int64(max)+1)); err != nil {
+			return nil, err
+		}
+		if buf.Len() > max {
+			return nil, errMessageTooLarge
+		}
+		return buf.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %d", algo)
+	}
+}
@@ -2,7 +2,13 @@
 
 package protocol
 
-import "testing"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"testing"
+)
 
 func TestCompressionMarshal(t *testing.T) {
 	uTestcases := []struct {
@@ -47,3 +53,239 @@ func TestCompressionMarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressionAlgorithmMarshal(t *testing.T) {
+	for _, tc := range []struct {
+		s string
+		c CompressionAlgorithm
+	}{
+		{"lz4", CompressionLZ4},
+		{"deflate", CompressionDeflate},
+	} {
+		bs, err := tc.c.MarshalText()
+		if err != nil {
+			t.Error(err)
+		}
+		if s := string(bs); s != tc.s {
+			t.Errorf("%d marshalled to %q, not %q", tc.c, s, tc.s)
+		}
+		var c CompressionAlgorithm
+		if err := c.UnmarshalText([]byte(tc.s)); err != nil {
+			t.Error(err)
+		}
+		if c != tc.c {
+			t.Errorf("%s unmarshalled to %d, not %d", tc.s, c, tc.c)
+		}
+	}
+
+	var c CompressionAlgorithm = CompressionDeflate
+	c.UnmarshalText([]byte("whatever"))
+	if c != CompressionLZ4 {
+		t.Errorf("unknown algorithm unmarshalled to %d, not LZ4", c)
+	}
+}
+
+func TestCompressionRoundtrip(t *testing.T) {
+	var comp compressor
+	var dec decompressor
+	var cbuf, dbuf []byte
+
+	for _, algo := range supportedCompressionAlgorithms {
+		// Several messages of different sizes, to exercise the reuse of
+		// buffers and state.
+		for _, data := range [][]byte{blockPayload(), indexPayload(), []byte("short message"), blockPayload()[:1000]} {
+			var err error
+			cbuf, err = comp.appendCompressed(algo, cbuf[:0], data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbuf, err = dec.decompress(algo, dbuf, cbuf, MaxMessageLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dbuf, data) {
+				t.Errorf("%v: roundtrip of %d bytes failed", algo, len(data))
+			}
+		}
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	var comp compressor
+	var dec decompressor
+	data := make([]byte, 1<<20)
+
+	for _, algo := range supportedCompressionAlgorithms {
+		cbuf, err := comp.appendCompressed(algo, nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dec.decompress(algo, nil, cbuf, len(data)-1); err != errMessageTooLarge {
+			t.Errorf("%v: decompressing beyond the limit returned %v, not %v", algo, err, errMessageTooLarge)
+		}
+		if bs, err := dec.decompress(algo, nil, cbuf, len(data)); err != nil || len(bs) != len(data) {
+			t.Errorf("%v: decompressing up to the limit returned %d bytes, %v", algo, len(bs), err)
+		}
+	}
+}
+
+func TestCompressionAppends(t *testing.T) {
+	var comp compressor
+	for _, algo := range supportedCompressionAlgorithms {
+		bs, err := comp.appendCompressed(algo, []byte("header"), blockPayload())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs[:6]) != "header" {
+			t.Errorf("%v: prefix was overwritten: %q", algo, bs[:6])
+		}
+	}
+}
+
+func TestCompressionHeader(t *testing.T) {
+	for _, algo := range supportedCompressionAlgorithms {
+		h0 := header{msgID: 42, msgType: messageTypeIndex, compression: true, algorithm: algo}
+		if h1 := decodeHeader(encodeHeader(h0)); h1 != h0 {
+			t.Errorf("header %v decoded to %v", h0, h1)
+		}
+	}
+
+	// LZ4 must be encoded the way older peers expect it.
+	if u := encodeHeader(header{compression: true, algorithm: CompressionLZ4}); u != 1 {
+		t.Errorf("LZ4 compressed header encoded as %#x, not 0x1", u)
+	}
+}
+
+func TestPeerSupportsCompression(t *testing.T) {
+	testcases := []struct {
+		options []Option
+		algo    CompressionAlgorithm
+		ok      bool
+	}{
+		// Older peers announce nothing but understand LZ4
+		{nil, CompressionLZ4, true},
+		{nil, CompressionDeflate, false},
+		{[]Option{{Key: "name", Value: "deflate"}}, CompressionDeflate, false},
+		{[]Option{compressionOption()}, CompressionDeflate, true},
+		{[]Option{{Key: compressionOptionKey, Value: "lz4, deflate"}}, CompressionDeflate, true},
+		{[]Option{{Key: compressionOptionKey, Value: "lz4,zstd"}}, CompressionDeflate, false},
+	}
+
+	for _, tc := range testcases {
+		if ok := peerSupportsCompression(tc.options, tc.algo); ok != tc.ok {
+			t.Errorf("peerSupportsCompression(%v, %v) = %v, expected %v", tc.options, tc.algo, ok, tc.ok)
+		}
+	}
+}
+
+// indexPayload returns an encoded index message for a tree of build
+// artifacts; names compress well, block hashes not at all.
+func indexPayload() []byte {
+	var files []FileInfo
+	for i := 0; i < 500; i++ {
+		f := FileInfo{
+			Name:     fmt.Sprintf("build/obj/module%03d/src/component%d.o", i/10, i),
+			Flags:    0644,
+			Modified: 1431000000 + int64(i),
+			Version:  Vector{{ID: 0x1234567890, Value: uint64(i)}},
+		}
+		for j := 0; j < 1+i%4; j++ {
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%d-%d", i, j)))
+			f.Blocks = append(f.Blocks, BlockInfo{Size: BlockSize, Hash: hash[:]})
+		}
+		files = append(files, f)
+	}
+	bs, err := IndexMessage{Folder: "default", Files: files}.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// blockPayload returns a block of something that looks like a compiled
+// build artifact; runs of padding and repeated symbol names mixed with
+// pseudo random machine code.
+func blockPayload() []byte {
+	rnd := rand.New(rand.NewSource(42))
+	symbols := []string{"runtime.mallocgc", "main.init", "syscall.Syscall", "fmt.Sprintf", "reflect.Value.Call"}
+	buf := make([]byte, 0, BlockSize)
+	for len(buf) < BlockSize {
+		switch rnd.Intn(3) {
+		case 0:
+			buf = append(buf, make([]byte, rnd.Intn(64))...)
+		case 1:
+			buf = append(buf, symbols[rnd.Intn(len(symbols))]...)
+			buf = append(buf, 0)
+		default:
+			for i := rnd.Intn(48); i > 0; i-- {
+				buf = append(buf, byte(rnd.Intn(256)))
+			}
+		}
+	}
+	return buf[:BlockSize]
+}
+
+func benchmarkCompress(b *testing.B, algo CompressionAlgorithm, data []byte) {
+	var comp compressor
+	var buf []byte
+	var err error
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err = comp.appendCompressed(algo, buf[:0], data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(data))/float64(len(buf)), "ratio")
+}
+
+func benchmarkDecompress(b *testing.B, algo CompressionAlgorithm, data []byte) {
+	var comp compressor
+	var dec decompressor
+	cbuf, err := comp.appendCompressed(algo, nil, data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf []byte
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err = dec.decompress(algo, buf, cbuf, MaxMessageLen)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressIndexLZ4(b *testing.B) {
+	benchmarkCompress(b, CompressionLZ4, indexPayload())
+}
+
+func BenchmarkCompressIndexDeflate(b *testing.B) {
+	benchmarkCompress(b, CompressionDeflate, indexPayload())
+}
+
+func BenchmarkCompressBlockLZ4(b *testing.B) {
+	benchmarkCompress(b, CompressionLZ4, blockPayload())
+}
+
+func BenchmarkCompressBlockDeflate(b *testing.B) {
+	benchmarkCompress(b, CompressionDeflate, blockPayload())
+}
+
+func BenchmarkDecompressIndexLZ4(b *testing.B) {
+	benchmarkDecompress(b, CompressionLZ4, indexPayload())
+}
+
+func BenchmarkDecompressIndexDeflate(b *testing.B) {
+	benchmarkDecompress(b, CompressionDeflate, indexPayload())
+}
+
+func BenchmarkDecompressBlockLZ4(b *testing.B) {
+	benchmarkDecompress(b, CompressionLZ4, blockPayload())
+}
+
+func BenchmarkDecompressBlockDeflate(b *testing.B) {
+	benchmarkDecompress(b, CompressionDeflate, blockPayload())
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// A Group is a Connection to a device made up of a primary connection and
+// zero or more extra connections. Cluster config and index messages are
+// always sent over the primary connection, while requests are spread over
+// the extra connections when there are any.
+type Group struct {
+	Connection // the primary connection
+
+	extras []Connection
+	next   int
+	mut    sync.Mutex
+}
+
+// NewGroup returns a Group with the given primary connection and no extra
+// connections.
+func NewGroup(primary Connection) *Group {
+	return &Group{
+		Connection: primary,
+	}
+}
+
+// AddExtra adds an extra connection to the group.
+func (g *Group) AddExtra(c Connection) {
+	g.mut.Lock()
+	g.extras = append(g.extras, c)
+	g.mut.Unlock()
+}
+
+// RemoveExtra removes the given extra connection from the group and returns
+// whether it was a member.
+func (g *Group) RemoveExtra(c Connection) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	for i := range g.extras {
+		if g.extras[i] == c {
+			g.extras = append(g.extras[:i:i], g.extras[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Extras returns the extra connections in the group.
+func (g *Group) Extras() []Connection {
+	g.mut.Lock()
+	extras := make([]Connection, len(g.extras))
+	copy(extras, g.extras)
+	g.mut.Unlock()
+	return extras
+}
+
+// Primary returns the primary connection of the group.
+func (g *Group) Primary() Connection {
+	return g.Connection
+}
+
+// Len returns the total number of connections in the group, including the
+// primary.
+func (g *Group) Len() int {
+	g.mut.Lock()
+	n := len(g.extras) + 1
+	g.mut.Unlock()
+	return n
+}
+
+// Request sends the request over the next extra connection in turn, or over
+// the primary connection when there are no extra connections. A request
+// that fails because the extra connection has closed is retried over the
+// primary connection, and the closed connection is dropped from the group.
+func (g *Group) Request(folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error) {
+	g.mut.Lock()
+	var conn Connection
+	if len(g.extras) > 0 {
+		g.next = (g.next + 1) % len(g.extras)
+		conn = g.extras[g.next]
+	}
+	g.mut.Unlock()
+
+	if conn != nil {
+		data, err := conn.Request(folder, name, offset, size, hash, flags, options)
+		if err != ErrClosed {
+			return data, err
+		}
+		g.RemoveExtra(conn)
+	}
+
+	return g.Connection.Request(folder, name, offset, size, hash, flags, options)
+}
+
+// Statistics returns the sum of the statistics of all connections in the
+// group.
+func (g *Group) Statistics() Statistics {
+	stats := g.Connection.Statistics()
+	for _, c := range g.Extras() {
+		s := c.Statistics()
+		stats.InBytesTotal += s.InBytesTotal
+		stats.OutBytesTotal += s.OutBytesTotal
+	}
+	stats.At = time.Now()
+	return stats
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2015 The Protocol Authors.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// primaryConnection is a Connection that counts the requests sent over it.
+type primaryConnection struct {
+	Connection
+	requests int
+}
+
+func (c *primaryConnection) Request(folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error) {
+	c.requests++
+	return []byte("primary"), nil
+}
+
+func (c *primaryConnection) Statistics() Statistics {
+	return Statistics{InBytesTotal: 1, OutBytesTotal: 2}
+}
+
+func TestGroupRequestWithoutExtras(t *testing.T) {
+	p := &primaryConnection{}
+	g := NewGroup(p)
+
+	data, err := g.Request("default", "foo", 0, 8, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "primary" || p.requests != 1 {
+		t.Errorf("request not sent over primary connection")
+	}
+	if g.Len() != 1 {
+		t.Errorf("unexpected group length %d != 1", g.Len())
+	}
+}
+
+func TestGroupRequestOverExtra(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("extra")
+
+	c0 := NewExtraConnection(c0ID, ar, bw, m0, "name", CompressAlways)
+	NewExtraConnection(c1ID, br, aw, m1, "name", CompressAlways)
+
+	p := &primaryConnection{}
+	g := NewGroup(p)
+	g.AddExtra(c0)
+
+	data, err := g.Request("default", "foo", 0, 8, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, m1.data) {
+		t.Errorf("unexpected response %q", data)
+	}
+	if p.requests != 0 {
+		t.Errorf("request unexpectedly sent over primary connection")
+	}
+	if m1.name != "foo" {
+		t.Errorf("unexpected request name %q", m1.name)
+	}
+
+	if stats := g.Statistics(); stats.InBytesTotal <= 1 || stats.OutBytesTotal <= 2 {
+		t.Errorf("statistics not aggregated: %+v", stats)
+	}
+
+	if !g.RemoveExtra(c0) {
+		t.Error("extra connection not removed")
+	}
+	if g.RemoveExtra(c0) {
+		t.Error("extra connection removed twice")
+	}
+	if g.Len() != 1 {
+		t.Errorf("unexpected group length %d != 1", g.Len())
+	}
+}
+
+func TestExtraConnectionRejectsIndex(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4)
+	NewExtraConnection(c1ID, br, aw, m1, "name", CompressAlways)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	if !m1.isClosed() {
+		t.Error("extra connection did not close on cluster config message")
+	}
+}
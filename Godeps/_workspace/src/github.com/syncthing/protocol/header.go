@@ -9,6 +9,7 @@ type header struct {
 	msgID       int
 	msgType     int
 	compression bool
+	algorithm   CompressionAlgorithm // only meaningful when compression is set
 }
 
 func (h header) encodeXDR(xw *xdr.Writer) (int, error) {
@@ -26,6 +27,9 @@ func encodeHeader(h header) uint32 {
 	var isComp uint32
 	if h.compression {
 		isComp = 1 << 0 // the zeroth bit is the compression bit
+		// Bits one to three are the compression algorithm; zero is LZ4,
+		// which is what older peers send and expect.
+		isComp |= uint32(h.algorithm&0x7) << 1
 	}
 	return uint32(h.version&0xf)<<28 +
 		uint32(h.msgID&0xfff)<<16 +
@@ -39,5 +43,6 @@ func decodeHeader(u uint32) header {
 		msgID:       int(u>>16) & 0xfff,
 		msgType:     int(u>>8) & 0xff,
 		compression: u&1 == 1,
+		algorithm:   CompressionAlgorithm(u>>1) & 0x7,
 	}
 }
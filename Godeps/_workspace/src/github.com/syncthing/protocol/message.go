@@ -123,4 +123,21 @@ type CloseMessage struct {
 	Code   int32
 }
 
+// A DownloadProgressMessage announces which blocks of files that are being
+// pulled are already present in the temporary files, so that other devices
+// can request them with FlagRequestTemporary.
+type DownloadProgressMessage struct {
+	Folder  string // max:64
+	Updates []FileDownloadProgressUpdate
+	Flags   uint32
+	Options []Option // max:64
+}
+
+type FileDownloadProgressUpdate struct {
+	UpdateType   uint32
+	Name         string // max:8192
+	Version      Vector
+	BlockIndexes []int32
+}
+
 type EmptyMessage struct{}
@@ -9,24 +9,28 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	lz4 "github.com/bkaradzic/go-lz4"
 )
 
 const (
 	BlockSize = 128 * 1024
+
+	// MaxMessageLen is the largest message that is accepted, before and
+	// after decompression.
+	MaxMessageLen = 500 * 1000 * 1000
 )
 
 const (
-	messageTypeClusterConfig = 0
-	messageTypeIndex         = 1
-	messageTypeRequest       = 2
-	messageTypeResponse      = 3
-	messageTypePing          = 4
-	messageTypePong          = 5
-	messageTypeIndexUpdate   = 6
-	messageTypeClose         = 7
+	messageTypeClusterConfig    = 0
+	messageTypeIndex            = 1
+	messageTypeRequest          = 2
+	messageTypeResponse         = 3
+	messageTypePing             = 4
+	messageTypePong             = 5
+	messageTypeIndexUpdate      = 6
+	messageTypeClose            = 7
+	messageTypeDownloadProgress = 8
 )
 
 const (
@@ -59,6 +63,15 @@ const (
 	FlagRequestTemporary uint32 = 1 << iota
 )
 
+// FileDownloadProgressUpdate update types
+const (
+	// The blocks are present in the temporary file, in addition to those
+	// announced before for the same version of the file
+	UpdateTypeAppend uint32 = iota
+	// The temporary file is gone; it was finished or abandoned
+	UpdateTypeForget
+)
+
 // ClusterConfigMessage.Folders.Devices flags
 const (
 	FlagShareTrusted  uint32 = 1 << 0
@@ -70,6 +83,8 @@ const (
 var (
 	ErrClusterHash = fmt.Errorf("configuration error: mismatched cluster hash")
 	ErrClosed      = errors.New("connection closed")
+
+	errMessageTooLarge = errors.New("message too large")
 )
 
 // Specific variants of empty messages...
@@ -85,10 +100,21 @@ type Model interface {
 	Request(deviceID DeviceID, folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(deviceID DeviceID, config ClusterConfigMessage)
+	// Download progress was received from the peer device
+	DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option)
 	// The peer device closed the connection
 	Close(deviceID DeviceID, err error)
 }
 
+// ExtraModel is the receiver of an extra connection. Extra connections only
+// carry requests and responses, so apart from serving requests the receiver
+// is only told when the extra connection closes.
+type ExtraModel interface {
+	Model
+	// The extra connection to the peer device was closed
+	ExtraClosed(conn Connection, err error)
+}
+
 type Connection interface {
 	ID() DeviceID
 	Name() string
@@ -96,6 +122,7 @@ type Connection interface {
 	IndexUpdate(folder string, files []FileInfo, flags uint32, options []Option) error
 	Request(folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) error
 	Statistics() Statistics
 }
 
@@ -105,6 +132,13 @@ type rawConnection struct {
 	receiver Model
 	state    int
 
+	// Download progress received before the index, handed to the receiver
+	// once the index has been. Only used by the reader loop.
+	pendingProgress []DownloadProgressMessage
+
+	extra         bool       // only requests and responses are allowed
+	extraReceiver ExtraModel // set for extra connections
+
 	cr *countingReader
 	cw *countingWriter
 
@@ -119,9 +153,12 @@ type rawConnection struct {
 	once   sync.Once
 
 	compression Compression
+	algorithm   CompressionAlgorithm // the algorithm we would like to compress with
+	sendAlgo    int32                // atomic; the algorithm we compress with, LZ4 until the peer announces support for c.algorithm
 
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
+	dec    decompressor
 }
 
 type asyncResult struct {
@@ -145,9 +182,14 @@ type isEofer interface {
 const (
 	pingTimeout  = 30 * time.Second
 	pingIdleTime = 60 * time.Second
+
+	maxPendingProgress = 1024 // download progress messages kept until the index is received
 )
 
-func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression) Connection {
+// NewConnection returns a connection to the device. Messages are compressed
+// according to compress, using the algorithm if the device announces support
+// for it in its cluster config, and LZ4 otherwise.
+func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression, algorithm CompressionAlgorithm) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
@@ -162,6 +204,40 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		nextID:      make(chan int),
 		closed:      make(chan struct{}),
 		compression: compress,
+		algorithm:   algorithm,
+	}
+
+	go c.readerLoop()
+	go c.writerLoop()
+	go c.pingerLoop()
+	go c.idGenerator()
+
+	return wireFormatConnection{&c}
+}
+
+// NewExtraConnection returns a connection to a device that we already have a
+// regular connection to. No cluster config or index exchange happens on an
+// extra connection; it is only used for requests and responses. When the
+// connection fails, receiver.ExtraClosed is called instead of
+// receiver.Close. As there is no cluster config to negotiate with, messages
+// on an extra connection are always compressed with LZ4.
+func NewExtraConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver ExtraModel, name string, compress Compression) Connection {
+	cr := &countingReader{Reader: reader}
+	cw := &countingWriter{Writer: writer}
+
+	c := rawConnection{
+		id:            deviceID,
+		name:          name,
+		receiver:      nativeModel{receiver},
+		state:         stateIdxRcvd,
+		extra:         true,
+		extraReceiver: receiver,
+		cr:            cr,
+		cw:            cw,
+		outbox:        make(chan hdrMsg),
+		nextID:        make(chan int),
+		closed:        make(chan struct{}),
+		compression:   compress,
 	}
 
 	go c.readerLoop()
@@ -255,9 +331,31 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	// Announce the compression algorithms we understand, without touching
+	// the caller's options slice.
+	options := make([]Option, len(config.Options), len(config.Options)+1)
+	copy(options, config.Options)
+	config.Options = append(options, compressionOption())
 	c.send(-1, messageTypeClusterConfig, config)
 }
 
+// DownloadProgress sends the progress of temporary files to the peer. Only
+// peers that announced support for it understand the message.
+func (c *rawConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+	c.send(-1, messageTypeDownloadProgress, DownloadProgressMessage{
+		Folder:  folder,
+		Updates: updates,
+		Flags:   flags,
+		Options: options,
+	})
+	return nil
+}
+
 func (c *rawConnection) ping() bool {
 	var id int
 	select {
@@ -299,6 +397,9 @@ func (c *rawConnection) readerLoop() (err error) {
 
 		switch msg := msg.(type) {
 		case IndexMessage:
+			if c.extra {
+				return fmt.Errorf("protocol error: index message on extra connection")
+			}
 			switch hdr.msgType {
 			case messageTypeIndex:
 				if c.state < stateCCRcvd {
@@ -306,6 +407,10 @@ func (c *rawConnection) readerLoop() (err error) {
 				}
 				c.handleIndex(msg)
 				c.state = stateIdxRcvd
+				for _, dp := range c.pendingProgress {
+					c.handleDownloadProgress(dp)
+				}
+				c.pendingProgress = nil
 
 			case messageTypeIndexUpdate:
 				if c.state < stateIdxRcvd {
@@ -334,12 +439,37 @@ func (c *rawConnection) readerLoop() (err error) {
 			c.handlePong(hdr.msgID)
 
 		case ClusterConfigMessage:
+			if c.extra {
+				return fmt.Errorf("protocol error: cluster config message on extra connection")
+			}
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
+			if c.algorithm != CompressionLZ4 && peerSupportsCompression(msg.Options, c.algorithm) {
+				if debug {
+					l.Debugf("%s: compressing with %v", c.id, c.algorithm)
+				}
+				atomic.StoreInt32(&c.sendAlgo, int32(c.algorithm))
+			}
 			go c.receiver.ClusterConfig(c.id, msg)
 			c.state = stateCCRcvd
 
+		case DownloadProgressMessage:
+			if c.extra {
+				return fmt.Errorf("protocol error: download progress message on extra connection")
+			}
+			if c.state < stateIdxRcvd {
+				// Progress may overtake the index right after connecting.
+				// Only what changed is sent, so it is kept until the index
+				// is in, rather than dropped.
+				if len(c.pendingProgress) >= maxPendingProgress {
+					return fmt.Errorf("protocol error: too many download progress messages in state %d", c.state)
+				}
+				c.pendingProgress = append(c.pendingProgress, msg)
+				continue
+			}
+			c.handleDownloadProgress(msg)
+
 		case CloseMessage:
 			return errors.New(msg.Reason)
 
@@ -372,6 +502,11 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		return
 	}
 
+	if msglen > MaxMessageLen {
+		err = errMessageTooLarge
+		return
+	}
+
 	if cap(c.rdbuf0) < msglen {
 		c.rdbuf0 = make([]byte, msglen)
 	} else {
@@ -388,8 +523,7 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 
 	msgBuf := c.rdbuf0
 	if hdr.compression {
-		c.rdbuf1 = c.rdbuf1[:cap(c.rdbuf1)]
-		c.rdbuf1, err = lz4.Decode(c.rdbuf1, c.rdbuf0)
+		c.rdbuf1, err = c.dec.decompress(hdr.algorithm, c.rdbuf1, c.rdbuf0, MaxMessageLen)
 		if err != nil {
 			return
 		}
@@ -461,6 +595,14 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		}
 		msg = cm
 
+	case messageTypeDownloadProgress:
+		var dp DownloadProgressMessage
+		err = dp.UnmarshalXDR(msgBuf)
+		if xdrErr, ok := err.(isEofer); ok && xdrErr.IsEOF() {
+			err = nil
+		}
+		msg = dp
+
 	default:
 		err = fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 	}
@@ -482,6 +624,13 @@ func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
 	c.receiver.IndexUpdate(c.id, im.Folder, filterIndexMessageFiles(im.Files), im.Flags, im.Options)
 }
 
+func (c *rawConnection) handleDownloadProgress(dp DownloadProgressMessage) {
+	if debug {
+		l.Debugf("DownloadProgress(%v, %v, %d updates, flags %x, opts: %s)", c.id, dp.Folder, len(dp.Updates), dp.Flags, dp.Options)
+	}
+	c.receiver.DownloadProgress(c.id, dp.Folder, dp.Updates, dp.Flags, dp.Options)
+}
+
 func filterIndexMessageFiles(fs []FileInfo) []FileInfo {
 	var out []FileInfo
 	for i, f := range fs {
@@ -564,8 +713,8 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 func (c *rawConnection) writerLoop() {
 	var msgBuf = make([]byte, 8) // buffer for wire format message, kept and reused
 	var uncBuf []byte            // buffer for uncompressed message, kept and reused
+	var comp compressor
 	for {
-		var tempBuf []byte
 		var err error
 
 		select {
@@ -589,20 +738,18 @@ func (c *rawConnection) writerLoop() {
 				if compress && len(uncBuf) >= compressionThreshold {
 					// Use compression for large messages
 					hm.hdr.compression = true
+					hm.hdr.algorithm = CompressionAlgorithm(atomic.LoadInt32(&c.sendAlgo))
 
-					// Make sure we have enough space for the compressed message plus header in msgBug
-					msgBuf = msgBuf[:cap(msgBuf)]
-					if maxLen := lz4.CompressBound(len(uncBuf)) + 8; maxLen > len(msgBuf) {
-						msgBuf = make([]byte, maxLen)
+					// Compressed is appended to the header space in msgBuf
+					msgBuf, err = comp.appendCompressed(hm.hdr.algorithm, msgBuf[:8], uncBuf)
+					if err != nil {
+						c.close(err)
+						return
 					}
-
-					// Compressed is written to msgBuf, we keep tb for the length only
-					tempBuf, err = lz4.Encode(msgBuf[8:], uncBuf)
-					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(tempBuf)))
-					msgBuf = msgBuf[0 : len(tempBuf)+8]
+					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(msgBuf)-8))
 
 					if debug {
-						l.Debugf("write compressed message; %v (len=%d)", hm.hdr, len(tempBuf))
+						l.Debugf("write compressed message; %v (len=%d)", hm.hdr, len(msgBuf)-8)
 					}
 				} else {
 					// No point in compressing very short messages
@@ -661,6 +808,10 @@ func (c *rawConnection) close(err error) {
 		}
 		c.awaitingMut.Unlock()
 
+		if c.extra {
+			go c.extraReceiver.ExtraClosed(wireFormatConnection{c}, err)
+			return
+		}
 		go c.receiver.Close(c.id, err)
 	})
 }
@@ -725,6 +876,7 @@ type Statistics struct {
 	At            time.Time
 	InBytesTotal  int64
 	OutBytesTotal int64
+	Compression   CompressionAlgorithm // used for the messages we send
 }
 
 func (c *rawConnection) Statistics() Statistics {
@@ -732,5 +884,6 @@ func (c *rawConnection) Statistics() Statistics {
 		At:            time.Now(),
 		InBytesTotal:  c.cr.Tot(),
 		OutBytesTotal: c.cw.Tot(),
+		Compression:   CompressionAlgorithm(atomic.LoadInt32(&c.sendAlgo)),
 	}
 }
@@ -11,10 +11,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/calmh/xdr"
 )
@@ -67,8 +69,8 @@ func TestPing(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, nil, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	c1 := NewConnection(c1ID, br, aw, nil, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
+	c0 := NewConnection(c0ID, ar, bw, nil, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, nil, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -91,8 +93,8 @@ func TestPingErr(t *testing.T) {
 			eaw := &ErrPipe{PipeWriter: *aw, max: i, err: e}
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
-			c0 := NewConnection(c0ID, ar, ebw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-			NewConnection(c1ID, br, eaw, m1, "name", CompressAlways)
+			c0 := NewConnection(c0ID, ar, ebw, m0, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
+			NewConnection(c1ID, br, eaw, m1, "name", CompressAlways, CompressionLZ4)
 
 			res := c0.ping()
 			if (i < 8 || j < 8) && res {
@@ -167,8 +169,8 @@ func TestVersionErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4)
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -190,8 +192,8 @@ func TestTypeErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4)
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -213,8 +215,8 @@ func TestClose(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4)
 
 	c0.close(nil)
 
@@ -237,6 +239,116 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestDownloadProgress(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4)
+	NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil, 0, nil)
+
+	updates := []FileDownloadProgressUpdate{
+		{UpdateType: UpdateTypeAppend, Name: "a/file", Version: Vector{{ID: 1, Value: 2}}, BlockIndexes: []int32{0, 3, 4}},
+		{UpdateType: UpdateTypeForget, Name: "other"},
+	}
+	if err := c0.DownloadProgress("default", updates, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case received := <-m1.updates:
+		if m1.folder != "default" {
+			t.Errorf("Incorrect folder %q", m1.folder)
+		}
+		if len(received) != 2 || received[0].Name != filepath.FromSlash("a/file") || len(received[0].BlockIndexes) != 3 || received[1].UpdateType != UpdateTypeForget {
+			t.Errorf("Incorrect updates %+v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Download progress not received")
+	}
+}
+
+func TestDownloadProgressBeforeIndex(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4)
+	NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4)
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	updates := []FileDownloadProgressUpdate{
+		{UpdateType: UpdateTypeAppend, Name: "file", Version: Vector{{ID: 1, Value: 2}}, BlockIndexes: []int32{0}},
+	}
+	if err := c0.DownloadProgress("default", updates, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-m1.updates:
+		t.Fatal("Download progress delivered before the index")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c0.Index("default", nil, 0, nil)
+
+	select {
+	case received := <-m1.updates:
+		if len(received) != 1 || received[0].Name != "file" {
+			t.Errorf("Incorrect updates %+v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Download progress not received after the index")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = blockPayload()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionDeflate)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionDeflate)
+
+	if algo := c0.Statistics().Compression; algo != CompressionLZ4 {
+		t.Errorf("Compressing with %v before negotiation", algo)
+	}
+
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil, 0, nil)
+	c1.Index("default", nil, 0, nil)
+
+	for _, c := range []Connection{c0, c1} {
+		t0 := time.Now()
+		for c.Statistics().Compression != CompressionDeflate {
+			if time.Since(t0) > time.Second {
+				t.Fatal("Deflate was not negotiated")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The response is deflated by c1 and inflated by c0
+	bs, err := c0.Request("default", "file", 0, len(m1.data), nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, m1.data) {
+		t.Error("Incorrect response data")
+	}
+}
+
 func TestElementSizeExceededNested(t *testing.T) {
 	m := ClusterConfigMessage{
 		Folders: []Folder{
@@ -336,6 +448,21 @@ func TestMarshalCloseMessage(t *testing.T) {
 	}
 }
 
+func TestMarshalDownloadProgressMessage(t *testing.T) {
+	var quickCfg = &quick.Config{MaxCountScale: 10}
+	if testing.Short() {
+		quickCfg = nil
+	}
+
+	f := func(m1 DownloadProgressMessage) bool {
+		return testMarshal(t, "downloadprogress", &m1, &DownloadProgressMessage{})
+	}
+
+	if err := quick.Check(f, quickCfg); err != nil {
+		t.Error(err)
+	}
+}
+
 type message interface {
 	EncodeXDR(io.Writer) (int, error)
 	DecodeXDR(io.Reader) error
@@ -51,6 +51,17 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
 
+func (c wireFormatConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) error {
+	var myUpdates = make([]FileDownloadProgressUpdate, len(updates))
+	copy(myUpdates, updates)
+
+	for i := range updates {
+		myUpdates[i].Name = norm.NFC.String(filepath.ToSlash(myUpdates[i].Name))
+	}
+
+	return c.next.DownloadProgress(folder, myUpdates, flags, options)
+}
+
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
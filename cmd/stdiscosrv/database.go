@@ -0,0 +1,135 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var (
+	errCorruptRecord = errors.New("corrupt database record")
+	errBadDeviceID   = errors.New("bad device ID length")
+)
+
+// The database stores the addresses announced by each device, keyed by
+// device ID, together with the time of the announcement.
+//
+// A record is the announcement time in Unix seconds (8 bytes), followed by
+// each address as the IP length (1 byte), the IP and the port (2 bytes).
+type database struct {
+	ldb      *leveldb.DB
+	lifetime time.Duration
+}
+
+type record struct {
+	seen      time.Time
+	addresses []discover.Address
+}
+
+func newDatabase(ldb *leveldb.DB, lifetime time.Duration) *database {
+	return &database{
+		ldb:      ldb,
+		lifetime: lifetime,
+	}
+}
+
+// put stores the addresses announced by the device at the given time.
+func (d *database) put(id []byte, addresses []discover.Address, seen time.Time) error {
+	rec := record{
+		seen:      seen,
+		addresses: addresses,
+	}
+	return d.ldb.Put(id, rec.marshal(), nil)
+}
+
+// get returns the addresses announced by the device, or nil if the device
+// is unknown or its announcement has expired.
+func (d *database) get(id []byte, now time.Time) ([]discover.Address, error) {
+	bs, err := d.ldb.Get(id, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rec record
+	if err := rec.unmarshal(bs); err != nil {
+		return nil, err
+	}
+	if d.expired(rec, now) {
+		return nil, nil
+	}
+	return rec.addresses, nil
+}
+
+// clean removes expired and unreadable records. It returns the number of
+// records that were kept and removed.
+func (d *database) clean(now time.Time) (kept, removed int, err error) {
+	batch := new(leveldb.Batch)
+
+	it := d.ldb.NewIterator(nil, nil)
+	for it.Next() {
+		var rec record
+		if err := rec.unmarshal(it.Value()); err != nil || d.expired(rec, now) {
+			batch.Delete(it.Key())
+			removed++
+			continue
+		}
+		kept++
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return 0, 0, err
+	}
+
+	return kept, removed, d.ldb.Write(batch, nil)
+}
+
+func (d *database) expired(rec record, now time.Time) bool {
+	return now.Sub(rec.seen) > d.lifetime
+}
+
+func (r record) marshal() []byte {
+	bs := make([]byte, 8, 8+len(r.addresses)*19)
+	binary.BigEndian.PutUint64(bs, uint64(r.seen.Unix()))
+	for _, addr := range r.addresses {
+		bs = append(bs, byte(len(addr.IP)))
+		bs = append(bs, addr.IP...)
+		bs = append(bs, byte(addr.Port>>8), byte(addr.Port))
+	}
+	return bs
+}
+
+func (r *record) unmarshal(bs []byte) error {
+	if len(bs) < 8 {
+		return errCorruptRecord
+	}
+	r.seen = time.Unix(int64(binary.BigEndian.Uint64(bs)), 0)
+	r.addresses = nil
+
+	bs = bs[8:]
+	for len(bs) > 0 {
+		l := int(bs[0])
+		if len(bs) < 1+l+2 {
+			return errCorruptRecord
+		}
+		ip := make([]byte, l)
+		copy(ip, bs[1:1+l])
+		r.addresses = append(r.addresses, discover.Address{
+			IP:   ip,
+			Port: binary.BigEndian.Uint16(bs[1+l:]),
+		})
+		bs = bs[1+l+2:]
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// A limiter keeps a token bucket per client IP. Only the most recently seen
+// clients are tracked, so a client that has been quiet for a while starts
+// afresh.
+type limiter struct {
+	avg     float64
+	burst   int64
+	max     int
+	clients map[string]*client
+	mut     sync.Mutex
+}
+
+type client struct {
+	bucket *ratelimit.Bucket
+	seen   time.Time
+}
+
+func newLimiter(avg float64, burst int64, max int) *limiter {
+	return &limiter{
+		avg:     avg,
+		burst:   burst,
+		max:     max,
+		clients: make(map[string]*client),
+	}
+}
+
+// allow returns whether a packet from the given IP should be handled.
+func (l *limiter) allow(ip string, now time.Time) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	c, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= l.max {
+			l.evict()
+		}
+		c = &client{
+			bucket: ratelimit.NewBucketWithRate(l.avg, l.burst),
+		}
+		l.clients[ip] = c
+	}
+	c.seen = now
+
+	return c.bucket.TakeAvailable(1) == 1
+}
+
+// evict forgets the least recently seen half of the clients. Doing it in
+// bulk keeps the cost of the scan low.
+func (l *limiter) evict() {
+	var times []time.Time
+	for _, c := range l.clients {
+		times = append(times, c.seen)
+	}
+	cutoff := median(times)
+	for ip, c := range l.clients {
+		if !c.seen.After(cutoff) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+func median(times []time.Time) time.Time {
+	sort.Sort(timeList(times))
+	return times[len(times)/2]
+}
+
+type timeList []time.Time
+
+func (l timeList) Len() int {
+	return len(l)
+}
+func (l timeList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+func (l timeList) Less(a, b int) bool {
+	return l[a].Before(l[b])
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command stdiscosrv is a global discovery server. It answers the announce
+// and query packets sent by syncthing's global discovery client, so that a
+// cluster can run its own discovery service.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime)
+	log.SetOutput(os.Stdout)
+
+	var (
+		listen        string
+		dbDir         string
+		httpListen    string
+		lifetime      time.Duration
+		statsInterval time.Duration
+		limitAvg      float64
+		limitBurst    int64
+		limitClients  int
+	)
+
+	flag.StringVar(&listen, "listen", ":22026", "UDP listen address")
+	flag.StringVar(&dbDir, "db", "discosrv.db", "Database directory")
+	flag.StringVar(&httpListen, "http", "", "HTTP listen address for statistics (disabled when empty)")
+	flag.DurationVar(&lifetime, "lifetime", time.Hour, "How long an announcement is valid")
+	flag.DurationVar(&statsInterval, "stats-interval", 5*time.Minute, "Interval between statistics log lines (0 to disable)")
+	flag.Float64Var(&limitAvg, "limit-avg", 1, "Allowed average packets per second, per client")
+	flag.Int64Var(&limitBurst, "limit-burst", 10, "Allowed burst of packets, per client")
+	flag.IntVar(&limitClients, "limit-clients", 10240, "Number of clients to keep rate limiting state for")
+	flag.Parse()
+
+	ldb, err := leveldb.OpenFile(dbDir, &opt.Options{OpenFilesCacheCapacity: 100})
+	if err != nil {
+		log.Fatalln("Opening database:", err)
+	}
+	defer ldb.Close()
+
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		log.Fatalln("Listen address:", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalln("Listen:", err)
+	}
+
+	srv := newServer(conn, newDatabase(ldb, lifetime), newLimiter(limitAvg, limitBurst, limitClients))
+	log.Println("Listening on", conn.LocalAddr())
+
+	go srv.cleaner(lifetime / 4)
+
+	if statsInterval > 0 {
+		go srv.statsLogger(statsInterval)
+	}
+
+	if httpListen != "" {
+		go func() {
+			http.Handle("/stats", srv)
+			log.Fatalln("HTTP:", http.ListenAndServe(httpListen, nil))
+		}()
+	}
+
+	if err := srv.Serve(); err != nil {
+		log.Fatalln("Serve:", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/discover"
+)
+
+// The server answers announce and query packets on a UDP socket.
+type server struct {
+	conn    *net.UDPConn
+	db      *database
+	limiter *limiter
+	stats   stats
+	started time.Time
+}
+
+// The stats are updated atomically and may be read at any time.
+type stats struct {
+	Announces int64 `json:"announces"`
+	Queries   int64 `json:"queries"`
+	Answered  int64 `json:"answered"`
+	Limited   int64 `json:"limited"`
+	Errors    int64 `json:"errors"`
+	Devices   int64 `json:"devices"`
+}
+
+func newServer(conn *net.UDPConn, db *database, limiter *limiter) *server {
+	return &server{
+		conn:    conn,
+		db:      db,
+		limiter: limiter,
+		started: time.Now(),
+	}
+}
+
+// Serve handles incoming packets until the socket is closed.
+func (s *server) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		if !s.limiter.allow(addr.IP.String(), time.Now()) {
+			atomic.AddInt64(&s.stats.Limited, 1)
+			continue
+		}
+
+		s.handle(buf[:n], addr)
+	}
+}
+
+func (s *server) handle(pkt []byte, addr *net.UDPAddr) {
+	if len(pkt) < 4 {
+		atomic.AddInt64(&s.stats.Errors, 1)
+		return
+	}
+
+	var err error
+	switch magic := binary.BigEndian.Uint32(pkt); magic {
+	case discover.AnnouncementMagic:
+		atomic.AddInt64(&s.stats.Announces, 1)
+		err = s.handleAnnounce(pkt, addr)
+	case discover.QueryMagic:
+		atomic.AddInt64(&s.stats.Queries, 1)
+		err = s.handleQuery(pkt, addr)
+	default:
+		atomic.AddInt64(&s.stats.Errors, 1)
+		return
+	}
+
+	if err != nil {
+		atomic.AddInt64(&s.stats.Errors, 1)
+		log.Printf("%s: %v", addr, err)
+	}
+}
+
+func (s *server) handleAnnounce(pkt []byte, addr *net.UDPAddr) error {
+	var ann discover.Announce
+	if err := ann.UnmarshalXDR(pkt); err != nil {
+		return err
+	}
+	if len(ann.This.ID) != len(protocol.DeviceID{}) {
+		return errBadDeviceID
+	}
+
+	// Addresses without an IP refer to the address the announcement came
+	// from.
+	addresses := make([]discover.Address, 0, len(ann.This.Addresses))
+	for _, a := range ann.This.Addresses {
+		ip := a.IP
+		if len(ip) == 0 {
+			ip = addr.IP.To4()
+			if ip == nil {
+				ip = addr.IP
+			}
+		}
+		addresses = append(addresses, discover.Address{IP: ip, Port: a.Port})
+	}
+
+	return s.db.put(ann.This.ID, addresses, time.Now())
+}
+
+func (s *server) handleQuery(pkt []byte, addr *net.UDPAddr) error {
+	var query discover.Query
+	if err := query.UnmarshalXDR(pkt); err != nil {
+		return err
+	}
+	if len(query.DeviceID) != len(protocol.DeviceID{}) {
+		return errBadDeviceID
+	}
+
+	addresses, err := s.db.get(query.DeviceID, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		// Unknown devices get no answer; the client times out.
+		return nil
+	}
+
+	ann := discover.Announce{
+		Magic: discover.AnnouncementMagic,
+		This: discover.Device{
+			ID:        query.DeviceID,
+			Addresses: addresses,
+		},
+	}
+	bs, err := ann.MarshalXDR()
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn.WriteToUDP(bs, addr); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.stats.Answered, 1)
+	return nil
+}
+
+// cleaner periodically removes expired announcements from the database.
+func (s *server) cleaner(interval time.Duration) {
+	for {
+		kept, removed, err := s.db.clean(time.Now())
+		if err != nil {
+			log.Println("Cleaning database:", err)
+		} else {
+			atomic.StoreInt64(&s.stats.Devices, int64(kept))
+			if removed > 0 {
+				log.Printf("Removed %d expired announcements", removed)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (s *server) statsLogger(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		st := s.currentStats()
+		log.Printf("Stats: %d announces, %d queries (%d answered), %d rate limited, %d errors, %d devices",
+			st.Announces, st.Queries, st.Answered, st.Limited, st.Errors, st.Devices)
+	}
+}
+
+func (s *server) currentStats() stats {
+	return stats{
+		Announces: atomic.LoadInt64(&s.stats.Announces),
+		Queries:   atomic.LoadInt64(&s.stats.Queries),
+		Answered:  atomic.LoadInt64(&s.stats.Answered),
+		Limited:   atomic.LoadInt64(&s.stats.Limited),
+		Errors:    atomic.LoadInt64(&s.stats.Errors),
+		Devices:   atomic.LoadInt64(&s.stats.Devices),
+	}
+}
+
+// ServeHTTP returns the statistics as JSON.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{
+		"uptime": int64(time.Since(s.started) / time.Second),
+		"stats":  s.currentStats(),
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/discover"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var device1, _ = protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+
+func newTestServer(t *testing.T, limiter *limiter) (*server, *net.UDPConn) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(conn, newDatabase(ldb, time.Hour), limiter)
+	go srv.Serve()
+
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func query(t *testing.T, client *net.UDPConn, id protocol.DeviceID) []discover.Address {
+	pkt := discover.Query{Magic: discover.QueryMagic, DeviceID: id[:]}
+	if _, err := client.Write(pkt.MustMarshalXDR()); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil {
+		return nil
+	}
+
+	var ann discover.Announce
+	if err := ann.UnmarshalXDR(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if ann.Magic != discover.AnnouncementMagic {
+		t.Errorf("Unexpected magic %x", ann.Magic)
+	}
+	if protocol.DeviceIDFromBytes(ann.This.ID) != id {
+		t.Errorf("Answer for wrong device %x", ann.This.ID)
+	}
+	return ann.This.Addresses
+}
+
+func TestAnnounceQuery(t *testing.T) {
+	srv, client := newTestServer(t, newLimiter(1000, 1000, 100))
+	defer srv.conn.Close()
+	defer client.Close()
+
+	if addrs := query(t, client, device1); addrs != nil {
+		t.Errorf("Unexpected answer for unknown device: %v", addrs)
+	}
+
+	ann := discover.Announce{
+		Magic: discover.AnnouncementMagic,
+		This: discover.Device{
+			ID: device1[:],
+			Addresses: []discover.Address{
+				{Port: 22000},
+				{IP: net.IPv4(192, 0, 2, 42).To4(), Port: 22001},
+			},
+		},
+	}
+	if _, err := client.Write(ann.MustMarshalXDR()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	expected := []discover.Address{
+		{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 22000},
+		{IP: net.IPv4(192, 0, 2, 42).To4(), Port: 22001},
+	}
+	if addrs := query(t, client, device1); !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("Unexpected addresses %v != %v", addrs, expected)
+	}
+
+	if _, err := client.Write([]byte{1, 2, 3, 4, 5}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	st := srv.currentStats()
+	if st.Announces != 1 || st.Queries != 2 || st.Answered != 1 || st.Errors != 1 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv, client := newTestServer(t, newLimiter(0.001, 2, 100))
+	defer srv.conn.Close()
+	defer client.Close()
+
+	for i := 0; i < 4; i++ {
+		query(t, client, device1)
+	}
+
+	st := srv.currentStats()
+	if st.Queries != 2 || st.Limited != 2 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	l := newLimiter(0.001, 1, 4)
+	now := time.Now()
+
+	if !l.allow("192.0.2.1", now) {
+		t.Error("First packet should be allowed")
+	}
+	if l.allow("192.0.2.1", now) {
+		t.Error("Second packet should be limited")
+	}
+
+	for i, ip := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5"} {
+		l.allow(ip, now.Add(time.Duration(i+1)*time.Second))
+	}
+	if len(l.clients) > 4 {
+		t.Errorf("Too many clients tracked: %d", len(l.clients))
+	}
+	if _, ok := l.clients["192.0.2.1"]; ok {
+		t.Error("Oldest client should have been evicted")
+	}
+	if !l.allow("192.0.2.1", now.Add(time.Minute)) {
+		t.Error("Evicted client should start afresh")
+	}
+}
+
+func TestDatabaseExpiry(t *testing.T) {
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := newDatabase(ldb, time.Hour)
+
+	now := time.Now()
+	addrs := []discover.Address{{IP: []byte{192, 0, 2, 1}, Port: 22000}}
+	if err := db.put(device1[:], addrs, now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put([]byte("other device id that is 32 bytes"), addrs, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, err := db.get(device1[:], now); err != nil || res != nil {
+		t.Errorf("Expected no addresses for expired announcement, got %v, %v", res, err)
+	}
+	if res, err := db.get(device1[:], now.Add(-90*time.Minute)); err != nil || !reflect.DeepEqual(res, addrs) {
+		t.Errorf("Expected %v before expiry, got %v, %v", addrs, res, err)
+	}
+
+	kept, removed, err := db.clean(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept != 1 || removed != 1 {
+		t.Errorf("Unexpected clean result, %d kept and %d removed", kept, removed)
+	}
+}
+
+func TestRecordMarshal(t *testing.T) {
+	rec := record{
+		seen: time.Unix(1234567890, 0),
+		addresses: []discover.Address{
+			{IP: []byte{192, 0, 2, 1}, Port: 22000},
+			{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+		},
+	}
+
+	var res record
+	if err := res.unmarshal(rec.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec, res) {
+		t.Errorf("Unmarshalled record differs; %+v != %+v", res, rec)
+	}
+
+	if err := res.unmarshal([]byte{1, 2, 3}); err != errCorruptRecord {
+		t.Errorf("Unexpected error %v for short record", err)
+	}
+	if err := res.unmarshal(append(rec.marshal(), 4, 1)); err != errCorruptRecord {
+		t.Errorf("Unexpected error %v for truncated record", err)
+	}
+}
@@ -46,12 +46,12 @@ func main() {
 			copy(dev[:], devBytes)
 			fmt.Printf("[device] F:%q N:%q D:%v\n", folder, name, dev)
 
-			var f protocol.FileInfo
+			var f db.FileInfoTruncated
 			err := f.UnmarshalXDR(it.Value())
 			if err != nil {
 				log.Fatal(err)
 			}
-			fmt.Printf("  N:%q\n  F:%#o\n  M:%d\n  V:%v\n  S:%d\n  B:%d\n", f.Name, f.Flags, f.Modified, f.Version, f.Size(), len(f.Blocks))
+			fmt.Printf("  N:%q\n  F:%#o\n  M:%d\n  V:%v\n  S:%d\n", f.Name, f.Flags, f.Modified, f.Version, f.Size())
 
 		case db.KeyTypeGlobal:
 			folder := nulString(key[1 : 1+64])
@@ -64,6 +64,9 @@ func main() {
 			name := nulString(key[1+64+32:])
 			fmt.Printf("[block] F:%q H:%x N:%q I:%d\n", folder, hash, name, binary.BigEndian.Uint32(it.Value()))
 
+		case db.KeyTypeBlockList:
+			fmt.Printf("[blocklist] H:%x L:%d\n", key[1:], len(it.Value()))
+
 		case db.KeyTypeDeviceStatistic:
 			fmt.Printf("[dstat]\n  %x\n  %x\n", it.Key(), it.Value())
 
@@ -8,6 +8,7 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -18,6 +19,7 @@ import (
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
+	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/thejerf/suture"
 )
 
@@ -30,6 +32,11 @@ type connectionSvc struct {
 	model  *model.Model
 	tlsCfg *tls.Config
 	conns  chan *tls.Conn
+
+	extraTLSCfg *tls.Config // tlsCfg, but for dialing extra connections
+
+	listeners map[string]suture.ServiceToken // listen address -> listenSvc
+	lisMut    sync.Mutex                     // protects listeners
 }
 
 func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.Model, tlsCfg *tls.Config) *connectionSvc {
@@ -40,8 +47,15 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 		model:      model,
 		tlsCfg:     tlsCfg,
 		conns:      make(chan *tls.Conn),
+		listeners:  make(map[string]suture.ServiceToken),
+		lisMut:     sync.NewMutex(),
 	}
 
+	// Extra connections are told apart from primary ones by the protocol
+	// negotiated during the TLS handshake.
+	svc.extraTLSCfg = tlsCfg.Clone()
+	svc.extraTLSCfg.NextProtos = []string{bepExtraProtocolName}
+
 	// There are several moving parts here; one routine per listening address
 	// to handle incoming connections, one routine to periodically attempt
 	// outgoing connections, and lastly one routine to the the common handling
@@ -72,24 +86,53 @@ func newConnectionSvc(cfg *config.Wrapper, myID protocol.DeviceID, model *model.
 	//                               |                 |
 	//                               +-----------------+
 	//
-	// TODO: Clean shutdown, and/or handling config changes on the fly. We
-	// partly do this now - new devices and addresses will be picked up, but
-	// not new listen addresses and we don't support disconnecting devices
-	// that are removed and so on...
+	// Configuration changes are handled on the fly. New devices and
+	// addresses are picked up by svc.connect, listen addresses are started
+	// and stopped by svc.Changed, and the model disconnects devices that
+	// are removed.
 
 	svc.Add(serviceFunc(svc.connect))
-	for _, addr := range svc.cfg.Options().ListenAddress {
-		addr := addr
-		listener := serviceFunc(func() {
-			svc.listen(addr)
-		})
-		svc.Add(listener)
-	}
+	svc.Changed(cfg.Raw())
 	svc.Add(serviceFunc(svc.handle))
 
+	cfg.Subscribe(svc)
+
 	return svc
 }
 
+// Changed implements config.Handler. It starts listening on new listen
+// addresses and stops listening on the ones that were removed.
+func (s *connectionSvc) Changed(cfg config.Configuration) error {
+	s.lisMut.Lock()
+	defer s.lisMut.Unlock()
+
+	wanted := make(map[string]bool, len(cfg.Options.ListenAddress))
+	for _, addr := range cfg.Options.ListenAddress {
+		wanted[addr] = true
+		if _, ok := s.listeners[addr]; !ok {
+			if debugNet {
+				l.Debugln("adding listener for", addr)
+			}
+			s.listeners[addr] = s.Add(&listenSvc{
+				addr: addr,
+				svc:  s,
+				stop: make(chan struct{}),
+				mut:  sync.NewMutex(),
+			})
+		}
+	}
+
+	for addr, token := range s.listeners {
+		if !wanted[addr] {
+			l.Infoln("No longer listening on", addr)
+			s.Remove(token)
+			delete(s.listeners, addr)
+		}
+	}
+
+	return nil
+}
+
 func (s *connectionSvc) handle() {
 next:
 	for conn := range s.conns {
@@ -98,8 +141,10 @@ next:
 		// We should have negotiated the next level protocol "bep/1.0" as part
 		// of the TLS handshake. Unfortunately this can't be a hard error,
 		// because there are implementations out there that don't support
-		// protocol negotiation (iOS for one...).
-		if !cs.NegotiatedProtocolIsMutual || cs.NegotiatedProtocol != bepProtocolName {
+		// protocol negotiation (iOS for one...). Extra connections to an
+		// already connected device negotiate "bep-extra/1.0" instead.
+		extra := cs.NegotiatedProtocolIsMutual && cs.NegotiatedProtocol == bepExtraProtocolName
+		if !extra && (!cs.NegotiatedProtocolIsMutual || cs.NegotiatedProtocol != bepProtocolName) {
 			l.Infof("Peer %s did not negotiate bep/1.0", conn.RemoteAddr())
 		}
 
@@ -130,7 +175,7 @@ next:
 		// this one. But in case we are two devices connecting to each other
 		// in parallel we don't want to do that or we end up with no
 		// connections still established...
-		if s.model.ConnectedTo(remoteID) {
+		if !extra && s.model.ConnectedTo(remoteID) {
 			l.Infof("Connected to already connected device (%s)", remoteID)
 			conn.Close()
 			continue
@@ -171,7 +216,31 @@ next:
 				}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
-				protoConn := protocol.NewConnection(remoteID, rd, wr, s.model, name, deviceCfg.Compression)
+
+				if extra {
+					// Extra connections are only kept while we have a
+					// primary connection to the device, and only up to the
+					// number of connections we want to it. Both sides need
+					// to allow more than one connection for this to happen.
+					if n := s.model.Connections(remoteID); n == 0 || n >= wantedConnections(deviceCfg) {
+						if debugNet {
+							l.Debugf("rejecting extra connection to %s at %s; have %d connections", remoteID, name, n)
+						}
+						conn.Close()
+						continue next
+					}
+
+					protoConn := protocol.NewExtraConnection(remoteID, rd, wr, s.model, name, deviceCfg.Compression)
+					if err := s.model.AddExtraConnection(conn, protoConn); err != nil {
+						l.Infof("Extra connection to %s at %s: %v", remoteID, name, err)
+						conn.Close()
+						continue next
+					}
+					l.Infof("Established extra connection to %s at %s", remoteID, name)
+					continue next
+				}
+
+				protoConn := protocol.NewConnection(remoteID, rd, wr, s.model, name, deviceCfg.Compression, deviceCfg.CompressionAlgorithm)
 
 				l.Infof("Established secure connection to %s at %s", remoteID, name)
 				if debugNet {
@@ -201,23 +270,90 @@ next:
 	}
 }
 
-func (s *connectionSvc) listen(addr string) {
+// A listenSvc accepts incoming connections on one listen address and passes
+// them on to the connection service.
+type listenSvc struct {
+	addr     string
+	svc      *connectionSvc
+	stop     chan struct{}
+	listener *net.TCPListener
+	mut      sync.Mutex // protects listener
+}
+
+func (s *listenSvc) Serve() {
 	if debugNet {
-		l.Debugln("listening on", addr)
+		l.Debugln("listening on", s.addr)
 	}
 
-	tcaddr, err := net.ResolveTCPAddr("tcp", addr)
+	for {
+		listener, err := s.listen()
+		if err == nil {
+			s.accept(listener)
+			return
+		}
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		// The address may become available later on, so we keep trying
+		// rather than giving up for good.
+		l.Warnln("listen (BEP):", err)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func (s *listenSvc) Stop() {
+	close(s.stop)
+
+	s.mut.Lock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mut.Unlock()
+}
+
+func (s *listenSvc) listen() (*net.TCPListener, error) {
+	tcaddr, err := net.ResolveTCPAddr("tcp", s.addr)
 	if err != nil {
-		l.Fatalln("listen (BEP):", err)
+		return nil, err
 	}
 	listener, err := net.ListenTCP("tcp", tcaddr)
 	if err != nil {
-		l.Fatalln("listen (BEP):", err)
+		return nil, err
 	}
 
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	select {
+	case <-s.stop:
+		// We were stopped while setting up the listener.
+		listener.Close()
+		return nil, errors.New("listener stopped")
+	default:
+	}
+	s.listener = listener
+	return listener, nil
+}
+
+func (s *listenSvc) accept(listener *net.TCPListener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.stop:
+				if debugNet {
+					l.Debugln("stopped listening on", s.addr)
+				}
+				return
+			default:
+			}
 			l.Warnln("Accepting connection:", err)
 			continue
 		}
@@ -227,9 +363,9 @@ func (s *connectionSvc) listen(addr string) {
 		}
 
 		tcpConn := conn.(*net.TCPConn)
-		s.setTCPOptions(tcpConn)
+		s.svc.setTCPOptions(tcpConn)
 
-		tc := tls.Server(conn, s.tlsCfg)
+		tc := tls.Server(conn, s.svc.tlsCfg)
 		err = tc.Handshake()
 		if err != nil {
 			l.Infoln("TLS handshake:", err)
@@ -237,20 +373,28 @@ func (s *connectionSvc) listen(addr string) {
 			continue
 		}
 
-		s.conns <- tc
+		s.svc.conns <- tc
 	}
 }
 
 func (s *connectionSvc) connect() {
 	delay := time.Second
 	for {
-	nextDevice:
 		for deviceID, deviceCfg := range s.cfg.Devices() {
 			if deviceID == myID {
 				continue
 			}
 
+			// Without a connection to the device we dial a primary
+			// connection. With one, we dial extra connections until we have
+			// as many as we want.
+			tlsCfg := s.tlsCfg
+			dials := 1
 			if s.model.ConnectedTo(deviceID) {
+				tlsCfg = s.extraTLSCfg
+				dials = wantedConnections(deviceCfg) - s.model.Connections(deviceID)
+			}
+			if dials <= 0 {
 				continue
 			}
 
@@ -269,47 +413,12 @@ func (s *connectionSvc) connect() {
 				}
 			}
 
-			for _, addr := range addrs {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-					// addr is on the form "1.2.3.4"
-					addr = net.JoinHostPort(addr, "22000")
-				} else if err == nil && port == "" {
-					// addr is on the form "1.2.3.4:"
-					addr = net.JoinHostPort(host, "22000")
+			for i := 0; i < dials; i++ {
+				tc := s.dial(deviceCfg.DeviceID, addrs, tlsCfg)
+				if tc == nil {
+					break
 				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
-				}
-
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
-					continue
-				}
-
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
-					continue
-				}
-
-				s.setTCPOptions(conn)
-
-				tc := tls.Client(conn, s.tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
-				}
-
 				s.conns <- tc
-				continue nextDevice
 			}
 		}
 
@@ -321,6 +430,56 @@ func (s *connectionSvc) connect() {
 	}
 }
 
+// dial attempts to connect to the device at each of the given addresses in
+// turn and returns the first successful connection, or nil.
+func (s *connectionSvc) dial(deviceID protocol.DeviceID, addrs []string, tlsCfg *tls.Config) *tls.Conn {
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+			// addr is on the form "1.2.3.4"
+			addr = net.JoinHostPort(addr, "22000")
+		} else if err == nil && port == "" {
+			// addr is on the form "1.2.3.4:"
+			addr = net.JoinHostPort(host, "22000")
+		}
+		if debugNet {
+			l.Debugln("dial", deviceID, addr)
+		}
+
+		conn, err := outgoing.Dial("tcp", addr)
+		if err != nil {
+			if debugNet {
+				l.Debugln(err)
+			}
+			continue
+		}
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			s.setTCPOptions(tcpConn)
+		}
+
+		tc := tls.Client(conn, tlsCfg)
+		err = tc.Handshake()
+		if err != nil {
+			l.Infoln("TLS handshake:", err)
+			tc.Close()
+			continue
+		}
+
+		return tc
+	}
+	return nil
+}
+
+// wantedConnections returns the number of connections, primary plus extra,
+// that we want to keep to the given device.
+func wantedConnections(deviceCfg config.DeviceConfiguration) int {
+	if deviceCfg.Connections < 1 {
+		return 1
+	}
+	return deviceCfg.Connections
+}
+
 func (*connectionSvc) setTCPOptions(conn *net.TCPConn) {
 	var err error
 	if err = conn.SetLinger(0); err != nil {
@@ -0,0 +1,241 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// Block lists that no file refers to any more are removed this often.
+const blockListGCInterval = time.Hour
+
+// The dbMaintSvc compacts the database when requested and at the interval
+// set by the databaseCompactIntervalH option, and removes unused block lists
+// every blockListGCInterval.
+type dbMaintSvc struct {
+	db      db.Storage
+	cfg     *config.Wrapper
+	trigger chan struct{}
+	stop    chan struct{}
+
+	mut     sync.Mutex
+	running bool
+	last    *dbCompaction
+}
+
+// A dbCompaction is the outcome of a compaction of the database.
+type dbCompaction struct {
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration"` // seconds
+	SizeBefore int64     `json:"sizeBefore"`
+	SizeAfter  int64     `json:"sizeAfter"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func newDBMaintSvc(ldb db.Storage, cfg *config.Wrapper) *dbMaintSvc {
+	return &dbMaintSvc{
+		db:      ldb,
+		cfg:     cfg,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		mut:     sync.NewMutex(),
+	}
+}
+
+func (s *dbMaintSvc) Serve() {
+	last := time.Now()
+	lastGC := time.Now()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.trigger:
+		case <-ticker.C:
+			if time.Since(lastGC) >= blockListGCInterval {
+				gcBlockLists(s.db)
+				lastGC = time.Now()
+			}
+			interval := time.Duration(s.cfg.Options().DBCompactIntervalH) * time.Hour
+			if interval <= 0 || time.Since(last) < interval {
+				continue
+			}
+		}
+
+		s.compact()
+		last = time.Now()
+	}
+}
+
+func (s *dbMaintSvc) Stop() {
+	close(s.stop)
+}
+
+// Compact requests a compaction of the database, and returns false if one
+// is already running or requested.
+func (s *dbMaintSvc) Compact() bool {
+	s.mut.Lock()
+	running := s.running
+	s.mut.Unlock()
+	if running {
+		return false
+	}
+
+	select {
+	case s.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *dbMaintSvc) compact() {
+	s.mut.Lock()
+	s.running = true
+	s.mut.Unlock()
+
+	c := compactDB(s.db)
+
+	s.mut.Lock()
+	s.running = false
+	s.last = &c
+	s.mut.Unlock()
+}
+
+// Status returns the current size of the database and the state of the
+// last compaction.
+func (s *dbMaintSvc) Status() map[string]interface{} {
+	size := dbSize()
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	res := map[string]interface{}{
+		"size":       size,
+		"compacting": s.running,
+	}
+	if s.last != nil {
+		res["lastCompaction"] = *s.last
+	}
+	return res
+}
+
+// compactDB compacts the database, if the backend supports it.
+func compactDB(ldb db.Storage) dbCompaction {
+	c := dbCompaction{
+		Started:    time.Now(),
+		SizeBefore: dbSize(),
+	}
+
+	gcBlockLists(ldb)
+	if cdb, ok := ldb.(db.Compacter); ok {
+		l.Infoln("Compacting database")
+		if err := cdb.Compact(); err != nil {
+			l.Warnln("Compacting database:", err)
+			c.Error = err.Error()
+		}
+	} else {
+		c.Error = "the database backend does not support compaction"
+	}
+
+	c.Duration = time.Since(c.Started).Seconds()
+	c.SizeAfter = dbSize()
+	if c.Error == "" {
+		l.Infof("Compacted database from %d to %d bytes in %.1f s", c.SizeBefore, c.SizeAfter, c.Duration)
+	}
+	return c
+}
+
+// gcBlockLists removes the block lists that are no longer used.
+func gcBlockLists(ldb db.Storage) {
+	if _, err := db.GCBlockLists(ldb); err != nil {
+		l.Warnln("Removing unused block lists:", err)
+	}
+}
+
+// dbSize returns the size of the database on disk.
+func dbSize() int64 {
+	var size int64
+	filepath.Walk(dbPath(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// backupDB writes a snapshot of the database to the file.
+func backupDB(ldb db.Storage, file string) error {
+	tmp := file + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = db.WriteSnapshot(fd, ldb)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = osutil.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// restoreDB replaces the database with the snapshot in the file.
+func restoreDB(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	// Opening the database makes sure that no one else is using it, as
+	// far as the backend can tell.
+	ldb, err := openDB()
+	if err != nil {
+		return fmt.Errorf("%v - is another copy of Syncthing already running?", err)
+	}
+	ldb.Close()
+
+	path := dbPath()
+	tmp := path + ".restore"
+	os.RemoveAll(tmp)
+	rdb, err := openDBAt(tmp)
+	if err != nil {
+		return err
+	}
+	err = db.ReadSnapshot(bufio.NewReader(fd), rdb)
+	rdb.Close()
+	if err == nil {
+		err = os.RemoveAll(path)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return err
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syncthing/syncthing/internal/upgrade"
 	"github.com/vitrun/qart/qr"
@@ -127,14 +128,20 @@ func (s *apiSvc) Serve() {
 
 	// The GET handlers
 	getRestMux := http.NewServeMux()
+	getRestMux.HandleFunc("/rest/db/backup", s.getDBBackup)                      // -
 	getRestMux.HandleFunc("/rest/db/completion", s.getDBCompletion)              // device folder
+	getRestMux.HandleFunc("/rest/db/errors", s.getDBErrors)                      // folder
 	getRestMux.HandleFunc("/rest/db/file", s.getDBFile)                          // folder file
 	getRestMux.HandleFunc("/rest/db/ignores", s.getDBIgnores)                    // folder
+	getRestMux.HandleFunc("/rest/db/ignores/explain", s.getDBIgnoresExplain)     // folder file
 	getRestMux.HandleFunc("/rest/db/need", s.getDBNeed)                          // folder [perpage] [page]
+	getRestMux.HandleFunc("/rest/db/queue", s.getDBQueue)                        // folder
+	getRestMux.HandleFunc("/rest/db/scrub", s.getDBScrub)                        // folder
+	getRestMux.HandleFunc("/rest/db/selection", s.getDBSelection)                // folder
 	getRestMux.HandleFunc("/rest/db/status", s.getDBStatus)                      // folder
 	getRestMux.HandleFunc("/rest/db/browse", s.getDBBrowse)                      // folder [prefix] [dirsonly] [levels]
 	getRestMux.HandleFunc("/rest/events", s.getEvents)                           // since [limit]
-	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // -
+	getRestMux.HandleFunc("/rest/stats/device", s.getDeviceStats)                // [from] [to]
 	getRestMux.HandleFunc("/rest/stats/folder", s.getFolderStats)                // -
 	getRestMux.HandleFunc("/rest/svc/deviceid", s.getDeviceID)                   // id
 	getRestMux.HandleFunc("/rest/svc/lang", s.getLang)                           // -
@@ -146,16 +153,20 @@ func (s *apiSvc) Serve() {
 	getRestMux.HandleFunc("/rest/system/discovery", s.getSystemDiscovery)        // -
 	getRestMux.HandleFunc("/rest/system/error", s.getSystemError)                // -
 	getRestMux.HandleFunc("/rest/system/ping", s.restPing)                       // -
+	getRestMux.HandleFunc("/rest/system/portmapping", s.getSystemPortMapping)    // -
 	getRestMux.HandleFunc("/rest/system/status", s.getSystemStatus)              // -
 	getRestMux.HandleFunc("/rest/system/upgrade", s.getSystemUpgrade)            // -
 	getRestMux.HandleFunc("/rest/system/version", s.getSystemVersion)            // -
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
+	postRestMux.HandleFunc("/rest/db/compact", s.postDBCompact)                // -
 	postRestMux.HandleFunc("/rest/db/prio", s.postDBPrio)                      // folder file [perpage] [page]
 	postRestMux.HandleFunc("/rest/db/ignores", s.postDBIgnores)                // folder
 	postRestMux.HandleFunc("/rest/db/override", s.postDBOverride)              // folder
 	postRestMux.HandleFunc("/rest/db/scan", s.postDBScan)                      // folder [sub...] [delay]
+	postRestMux.HandleFunc("/rest/db/scrub", s.postDBScrub)                    // folder
+	postRestMux.HandleFunc("/rest/db/selection", s.postDBSelection)            // folder [add...] [remove...] [clear]
 	postRestMux.HandleFunc("/rest/system/config", s.postSystemConfig)          // <body>
 	postRestMux.HandleFunc("/rest/system/discovery", s.postSystemDiscovery)    // device addr
 	postRestMux.HandleFunc("/rest/system/error", s.postSystemError)            // <body>
@@ -377,6 +388,12 @@ func folderSummary(m *model.Model, folder string) map[string]interface{} {
 
 	res["version"] = m.CurrentLocalVersion(folder) + m.RemoteLocalVersion(folder)
 
+	readOnlyBy := []string{}
+	for _, device := range m.ReadOnlyBy(folder) {
+		readOnlyBy = append(readOnlyBy, device.String())
+	}
+	res["readOnlyBy"] = readOnlyBy
+
 	ignorePatterns, _, _ := m.GetIgnores(folder)
 	res["ignorePatterns"] = false
 	for _, line := range ignorePatterns {
@@ -425,6 +442,22 @@ func (s *apiSvc) getDBNeed(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+func (s *apiSvc) getDBQueue(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.PullQueue(folder))
+}
+
+func (s *apiSvc) getDBErrors(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(s.model.FolderErrors(folder))
+}
+
 func (s *apiSvc) getSystemConnections(w http.ResponseWriter, r *http.Request) {
 	var res = s.model.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -432,7 +465,28 @@ func (s *apiSvc) getSystemConnections(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *apiSvc) getDeviceStats(w http.ResponseWriter, r *http.Request) {
-	var res = s.model.DeviceStatistics()
+	qs := r.URL.Query()
+	var res map[string]stats.DeviceStatistics
+	if qs.Get("from") == "" && qs.Get("to") == "" {
+		res = s.model.DeviceStatistics()
+	} else {
+		// The hourly history between the given times, in RFC 3339 format
+		from, to := time.Time{}, time.Now()
+		var err error
+		if v := qs.Get("from"); v != "" {
+			if from, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if v := qs.Get("to"); v != "" {
+			if to, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		res = s.model.DeviceHistory(from, to)
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
 }
@@ -465,7 +519,13 @@ func (s *apiSvc) getSystemConfig(w http.ResponseWriter, r *http.Request) {
 
 func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 	var newCfg config.Configuration
-	err := json.NewDecoder(r.Body).Decode(&newCfg)
+	bs, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(bs, &newCfg)
+	}
+	if err == nil {
+		err = keepOmittedShareFields(bs, cfg.Raw(), &newCfg)
+	}
 	if err != nil {
 		l.Warnln("decoding posted config:", err)
 		http.Error(w, err.Error(), 500)
@@ -497,6 +557,10 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 		newCfg.Options.URUniqueID = ""
 	}
 
+	// Devices edited by the user are no longer managed by their introducer
+
+	config.ForgetEditedIntroductions(cfg.Raw(), &newCfg)
+
 	// Activate and save
 
 	configInSync = !config.ChangeRequiresRestart(cfg.Raw(), newCfg)
@@ -504,6 +568,57 @@ func (s *apiSvc) postSystemConfig(w http.ResponseWriter, r *http.Request) {
 	cfg.Save()
 }
 
+// keepOmittedShareFields sets the fields of the folder shares that the
+// posted configuration in bs leaves out to their current value in cur, so
+// that a client unaware of them does not clear them by accident.
+func keepOmittedShareFields(bs []byte, cur config.Configuration, newCfg *config.Configuration) error {
+	var posted struct {
+		Folders []struct {
+			Devices []map[string]json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(bs, &posted); err != nil {
+		return err
+	}
+
+	curShares := make(map[string]map[protocol.DeviceID]config.FolderDeviceConfiguration, len(cur.Folders))
+	for _, fld := range cur.Folders {
+		shares := make(map[protocol.DeviceID]config.FolderDeviceConfiguration, len(fld.Devices))
+		for _, dev := range fld.Devices {
+			shares[dev.DeviceID] = dev
+		}
+		curShares[fld.ID] = shares
+	}
+
+	for i, fld := range posted.Folders {
+		for j, fields := range fld.Devices {
+			dev := &newCfg.Folders[i].Devices[j]
+			orig, ok := curShares[newCfg.Folders[i].ID][dev.DeviceID]
+			if !ok {
+				continue
+			}
+			if !hasJSONField(fields, "readOnly") {
+				dev.ReadOnly = orig.ReadOnly
+			}
+			if !hasJSONField(fields, "introducedBy") {
+				dev.IntroducedBy = orig.IntroducedBy
+			}
+		}
+	}
+	return nil
+}
+
+// hasJSONField returns true if fields contains name, matched without regard
+// to case the same way encoding/json does.
+func hasJSONField(fields map[string]json.RawMessage, name string) bool {
+	for field := range fields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *apiSvc) getSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
@@ -572,6 +687,9 @@ func (s *apiSvc) getSystemStatus(w http.ResponseWriter, r *http.Request) {
 	res["cpuPercent"] = cpusum / float64(len(cpuUsagePercent)) / float64(runtime.NumCPU())
 	res["pathSeparator"] = string(filepath.Separator)
 	res["uptime"] = int(time.Since(startTime).Seconds())
+	if dbMaint != nil {
+		res["database"] = dbMaint.Status()
+	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(res)
@@ -630,6 +748,16 @@ func (s *apiSvc) getSystemDiscovery(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(devices)
 }
 
+func (s *apiSvc) getSystemPortMapping(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	var status portMapStatus
+	if portMapper != nil {
+		// The port mapper is nil when both UPnP and NAT-PMP are disabled.
+		status = portMapper.Status()
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
 func (s *apiSvc) getReport(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	json.NewEncoder(w).Encode(reportData(s.model))
@@ -651,6 +779,19 @@ func (s *apiSvc) getDBIgnores(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *apiSvc) getDBIgnoresExplain(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	exp, err := s.model.ExplainIgnore(qs.Get("folder"), osutil.NativeFilename(qs.Get("file")))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(exp)
+}
+
 func (s *apiSvc) postDBIgnores(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 
@@ -672,6 +813,106 @@ func (s *apiSvc) postDBIgnores(w http.ResponseWriter, r *http.Request) {
 	s.getDBIgnores(w, r)
 }
 
+func (s *apiSvc) getDBSelection(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	folderCfg, ok := cfg.Folders()[qs.Get("folder")]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	selected := folderCfg.SelectedPaths
+	if selected == nil {
+		selected = []string{}
+	}
+	json.NewEncoder(w).Encode(map[string][]string{
+		"selectedPaths": selected,
+	})
+}
+
+// postDBSelection adds paths to and removes paths from the selective sync
+// list of the folder. Removing the last selected path is refused, as that
+// would sync the whole folder; clearing the list, and adding any new paths,
+// is done with clear=true instead.
+func (s *apiSvc) postDBSelection(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	folderCfg, ok := cfg.Folders()[qs.Get("folder")]
+	if !ok {
+		http.Error(w, "No such folder", 404)
+		return
+	}
+
+	clear := false
+	if v := qs.Get("clear"); v != "" {
+		var err error
+		if clear, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid clear value", 400)
+			return
+		}
+	}
+
+	remove := make(map[string]bool)
+	for _, path := range qs["remove"] {
+		path, ok := selectionPath(path)
+		if !ok {
+			http.Error(w, "Invalid path", 400)
+			return
+		}
+		remove[path] = true
+	}
+
+	var paths []string
+	if !clear {
+		paths = append(paths, folderCfg.SelectedPaths...)
+	}
+	var selected []string
+	present := make(map[string]bool)
+	for _, path := range append(paths, qs["add"]...) {
+		path, ok := selectionPath(path)
+		if !ok {
+			http.Error(w, "Invalid path", 400)
+			return
+		}
+		if present[path] {
+			continue
+		}
+		present[path] = true
+		if !remove[path] {
+			selected = append(selected, path)
+		}
+	}
+
+	for path := range remove {
+		if !present[path] {
+			http.Error(w, "Path not selected: "+path, 404)
+			return
+		}
+	}
+	if len(selected) == 0 && len(folderCfg.SelectedPaths) > 0 && !clear {
+		http.Error(w, "Cannot remove the last selected path; clear the selection to sync the whole folder", 400)
+		return
+	}
+
+	folderCfg.SelectedPaths = selected
+	cfg.SetFolder(folderCfg)
+	if err := cfg.Save(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	s.getDBSelection(w, r)
+}
+
+// selectionPath returns the path in the form it is kept in the selective
+// sync list, and whether it is a valid path to select.
+func selectionPath(path string) (string, bool) {
+	path = strings.Trim(filepath.ToSlash(path), "/")
+	return path, path != "" && path != "."
+}
+
 func (s *apiSvc) getEvents(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	sinceStr := qs.Get("since")
@@ -791,6 +1032,45 @@ func (s *apiSvc) postDBScan(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *apiSvc) getDBBackup(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("syncthing-%s.dbsnapshot", time.Now().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if err := db.WriteSnapshot(w, dbMaint.db); err != nil {
+		// It's too late to change the response; the snapshot lacks its
+		// end marker and will not be restored.
+		l.Warnln("Database backup:", err)
+	}
+}
+
+func (s *apiSvc) postDBCompact(w http.ResponseWriter, r *http.Request) {
+	if !dbMaint.Compact() {
+		http.Error(w, "Compaction already running", http.StatusConflict)
+	}
+}
+
+func (s *apiSvc) getDBScrub(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	status, err := s.model.ScrubStatus(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (s *apiSvc) postDBScrub(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	folder := qs.Get("folder")
+	if err := s.model.ScrubFolder(folder); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+}
+
 func (s *apiSvc) postDBPrio(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	folder := qs.Get("folder")
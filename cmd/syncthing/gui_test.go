@@ -0,0 +1,157 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// postConfigRoundTrip gets the configuration the way the GUI does, lets edit
+// change the decoded JSON and posts it back.
+func postConfigRoundTrip(t *testing.T, edit func(folder map[string]interface{})) {
+	req, _ := http.NewRequest("GET", "/rest/system/config", nil)
+	rec := httptest.NewRecorder()
+	(&apiSvc{}).getSystemConfig(rec, req)
+
+	var posted map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &posted); err != nil {
+		t.Fatal(err)
+	}
+	edit(posted["folders"].([]interface{})[0].(map[string]interface{}))
+	bs, err := json.Marshal(posted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest("POST", "/rest/system/config", bytes.NewReader(bs))
+	rec = httptest.NewRecorder()
+	(&apiSvc{}).postSystemConfig(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPostConfigKeepsShareFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-gui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	device1 := protocol.DeviceID{1}
+	device2 := protocol.DeviceID{2}
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Folders: []config.FolderConfiguration{{
+			ID:      "default",
+			RawPath: dir,
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, ReadOnly: true, IntroducedBy: &device1},
+			},
+		}},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1, Introducer: true}, {DeviceID: device2, IntroducedBy: &device1}},
+	})
+
+	readOnly := func() bool {
+		return cfg.Folders()["default"].DeviceReadOnly(device2)
+	}
+	introduced := func() bool {
+		return cfg.Folders()["default"].Devices[1].IntroducedBy != nil
+	}
+
+	// An edit of the folder that leaves the shares alone
+
+	postConfigRoundTrip(t, func(folder map[string]interface{}) {
+		folder["rescanIntervalS"] = 120
+	})
+	if cfg.Folders()["default"].RescanIntervalS != 120 || !readOnly() || !introduced() {
+		t.Errorf("Incorrect folder after edit: %+v", cfg.Folders()["default"])
+	}
+
+	// A client that only knows the device IDs of the shares
+
+	postConfigRoundTrip(t, func(folder map[string]interface{}) {
+		folder["devices"] = []interface{}{
+			map[string]interface{}{"deviceID": device1.String()},
+			map[string]interface{}{"deviceID": device2.String()},
+		}
+	})
+	if !readOnly() || !introduced() {
+		t.Error("Share settings cleared by a client leaving out the fields")
+	}
+
+	// Clearing the field explicitly
+
+	postConfigRoundTrip(t, func(folder map[string]interface{}) {
+		for _, dev := range folder["devices"].([]interface{}) {
+			dev.(map[string]interface{})["readOnly"] = false
+		}
+	})
+	if readOnly() {
+		t.Error("Read only share not cleared")
+	}
+	if introduced() {
+		t.Error("Share changed by the user still managed by its introducer")
+	}
+}
+
+func TestPostDBSelection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-gui")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Folders: []config.FolderConfiguration{{
+			ID:            "default",
+			RawPath:       dir,
+			SelectedPaths: []string{"a", "b/c"},
+		}},
+	})
+
+	cases := []struct {
+		query    string
+		code     int
+		selected []string
+	}{
+		{"remove=/a/", 200, []string{"b/c"}},
+		{"remove=a", 404, []string{"b/c"}},
+		{"remove=b/c", 400, []string{"b/c"}},
+		{"remove=.", 400, []string{"b/c"}},
+		{"add=d/&remove=b/c/", 200, []string{"d"}},
+		{"clear=yes", 400, []string{"d"}},
+		{"clear=true&add=e", 200, []string{"e"}},
+		{"clear=true", 200, nil},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest("POST", "/rest/db/selection?folder=default&"+tc.query, nil)
+		rec := httptest.NewRecorder()
+		(&apiSvc{}).postDBSelection(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, expected %d: %s", tc.query, rec.Code, tc.code, rec.Body.String())
+		}
+		if sel := cfg.Folders()["default"].SelectedPaths; fmt.Sprint(sel) != fmt.Sprint(tc.selected) {
+			t.Errorf("%s: selected %q, expected %q", tc.query, sel, tc.selected)
+		}
+	}
+}
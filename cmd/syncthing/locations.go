@@ -21,17 +21,18 @@ type locationEnum string
 // Use strings as keys to make printout and serialization of the locations map
 // more meaningful.
 const (
-	locConfigFile    locationEnum = "config"
-	locCertFile                   = "certFile"
-	locKeyFile                    = "keyFile"
-	locHTTPSCertFile              = "httpsCertFile"
-	locHTTPSKeyFile               = "httpsKeyFile"
-	locDatabase                   = "database"
-	locLogFile                    = "logFile"
-	locCsrfTokens                 = "csrfTokens"
-	locPanicLog                   = "panicLog"
-	locAuditLog                   = "auditLog"
-	locDefFolder                  = "defFolder"
+	locConfigFile      locationEnum = "config"
+	locCertFile                     = "certFile"
+	locKeyFile                      = "keyFile"
+	locHTTPSCertFile                = "httpsCertFile"
+	locHTTPSKeyFile                 = "httpsKeyFile"
+	locDatabase                     = "database"
+	locJournalDatabase              = "journalDatabase"
+	locLogFile                      = "logFile"
+	locCsrfTokens                   = "csrfTokens"
+	locPanicLog                     = "panicLog"
+	locAuditLog                     = "auditLog"
+	locDefFolder                    = "defFolder"
 )
 
 // Platform dependent directories
@@ -42,17 +43,18 @@ var baseDirs = map[string]string{
 
 // Use the variables from baseDirs here
 var locations = map[locationEnum]string{
-	locConfigFile:    "${config}/config.xml",
-	locCertFile:      "${config}/cert.pem",
-	locKeyFile:       "${config}/key.pem",
-	locHTTPSCertFile: "${config}/https-cert.pem",
-	locHTTPSKeyFile:  "${config}/https-key.pem",
-	locDatabase:      "${config}/index-v0.11.0.db",
-	locLogFile:       "${config}/syncthing.log", // -logfile on Windows
-	locCsrfTokens:    "${config}/csrftokens.txt",
-	locPanicLog:      "${config}/panic-${timestamp}.log",
-	locAuditLog:      "${config}/audit-${timestamp}.log",
-	locDefFolder:     "${home}/Sync",
+	locConfigFile:      "${config}/config.xml",
+	locCertFile:        "${config}/cert.pem",
+	locKeyFile:         "${config}/key.pem",
+	locHTTPSCertFile:   "${config}/https-cert.pem",
+	locHTTPSKeyFile:    "${config}/https-key.pem",
+	locDatabase:        "${config}/index-v0.11.0.db",
+	locJournalDatabase: "${config}/index-v0.11.0.journal",
+	locLogFile:         "${config}/syncthing.log", // -logfile on Windows
+	locCsrfTokens:      "${config}/csrftokens.txt",
+	locPanicLog:        "${config}/panic-${timestamp}.log",
+	locAuditLog:        "${config}/audit-${timestamp}.log",
+	locDefFolder:       "${home}/Sync",
 }
 
 // expandLocations replaces the variables in the location map with actual
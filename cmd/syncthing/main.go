@@ -30,6 +30,7 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/dialer"
 	"github.com/syncthing/syncthing/internal/discover"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
@@ -64,8 +65,9 @@ const (
 )
 
 const (
-	bepProtocolName   = "bep/1.0"
-	pingEventInterval = time.Minute
+	bepProtocolName      = "bep/1.0"
+	bepExtraProtocolName = "bep-extra/1.0" // negotiated for extra connections to an already connected device
+	pingEventInterval    = time.Minute
 )
 
 var l = logger.DefaultLogger
@@ -109,6 +111,9 @@ var (
 	readRateLimit  *ratelimit.Bucket
 	stop           = make(chan int)
 	discoverer     *discover.Discoverer
+	dbMaint        *dbMaintSvc
+	portMapper     *portMapSvc
+	outgoing       = &dialer.Dialer{} // dials directly until set up by syncthingMain
 	cert           tls.Certificate
 	lans           []*net.IPNet
 )
@@ -146,6 +151,7 @@ are mostly useful for developers. Use with care.
                  facility strings are:
 
                  - "beacon"   (the beacon package)
+                 - "dialer"   (the dialer package; proxy connections)
                  - "discover" (the discover package)
                  - "events"   (the events package)
                  - "files"    (the files package)
@@ -153,6 +159,7 @@ are mostly useful for developers. Use with care.
                  - "locks"    (the sync package; trace long held locks)
                  - "net"      (the main package; connections & network messages)
                  - "model"    (the model package)
+                 - "natpmp"   (the natpmp package)
                  - "scanner"  (the scanner package)
                  - "stats"    (the stats package)
                  - "upnp"     (the upnp package)
@@ -175,6 +182,13 @@ are mostly useful for developers. Use with care.
 
  STNOUPGRADE     Disable automatic upgrades.
 
+ STDBBACKEND     Select the database backend. The default is "leveldb"; set
+                 to "journal" to keep the database in memory, backed by an
+                 append only journal file. The journal is read in full on
+                 every start and is only suited to small setups; databases
+                 over 256 MiB, roughly a hundred thousand files, are
+                 refused.
+
  GOMAXPROCS      Set the maximum number of CPU cores to use. Defaults to all
                  available CPU cores.
 
@@ -186,6 +200,9 @@ are mostly useful for developers. Use with care.
 // Command line and environment options
 var (
 	reset             bool
+	dbBackupFile      string
+	dbRestoreFile     string
+	dbCompact         bool
 	showVersion       bool
 	doUpgrade         bool
 	doUpgradeCheck    bool
@@ -206,6 +223,7 @@ var (
 	cpuProfile        = os.Getenv("STCPUPROFILE") != ""
 	stRestarting      = os.Getenv("STRESTART") != ""
 	innerProcess      = os.Getenv("STNORESTART") != "" || os.Getenv("STMONITORED") != ""
+	dbBackend         = os.Getenv("STDBBACKEND")
 )
 
 func main() {
@@ -228,6 +246,9 @@ func main() {
 	flag.BoolVar(&noBrowser, "no-browser", false, "Do not start browser")
 	flag.BoolVar(&noRestart, "no-restart", noRestart, "Do not restart; just exit")
 	flag.BoolVar(&reset, "reset", false, "Reset the database")
+	flag.StringVar(&dbBackupFile, "db-backup", "", "Write a snapshot of the database to the file, then exit")
+	flag.StringVar(&dbRestoreFile, "db-restore", "", "Replace the database with the snapshot in the file, then start")
+	flag.BoolVar(&dbCompact, "db-compact", false, "Compact the database, then exit")
 	flag.BoolVar(&doUpgrade, "upgrade", false, "Perform upgrade")
 	flag.BoolVar(&doUpgradeCheck, "upgrade-check", false, "Check for available upgrade")
 	flag.BoolVar(&showVersion, "version", false, "Show version")
@@ -324,6 +345,14 @@ func main() {
 	// Ensure that our home directory exists.
 	ensureDir(baseDirs["config"], 0700)
 
+	// Release checks done from the command line honour the proxy
+	// environment variables.
+	if d, err := dialer.New("", false); err != nil {
+		l.Warnln("Proxy:", err)
+	} else {
+		upgrade.SetHTTPClient(d.HTTPClient())
+	}
+
 	if upgradeTo != "" {
 		err := upgrade.ToURL(upgradeTo)
 		if err != nil {
@@ -374,6 +403,35 @@ func main() {
 		return
 	}
 
+	if dbBackupFile != "" || dbCompact {
+		ldb, err := openDB()
+		if err != nil {
+			l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
+		}
+		if dbBackupFile != "" {
+			if err := backupDB(ldb, dbBackupFile); err != nil {
+				l.Fatalln("Backing up database:", err)
+			}
+			l.Infoln("Wrote database snapshot to", dbBackupFile)
+		}
+		if dbCompact {
+			if c := compactDB(ldb); c.Error != "" {
+				l.Fatalln("Compacting database:", c.Error)
+			}
+		}
+		ldb.Close()
+		return
+	}
+
+	// The monitored process is restarted with the same arguments; the
+	// database is restored only once, before it is started.
+	if dbRestoreFile != "" && os.Getenv("STMONITORED") == "" {
+		if err := restoreDB(dbRestoreFile); err != nil {
+			l.Fatalln("Restoring database:", err)
+		}
+		l.Infoln("Restored database from", dbRestoreFile)
+	}
+
 	if noRestart {
 		syncthingMain()
 	} else {
@@ -527,7 +585,7 @@ func syncthingMain() {
 
 	tlsCfg := &tls.Config{
 		Certificates:           []tls.Certificate{cert},
-		NextProtos:             []string{bepProtocolName},
+		NextProtos:             []string{bepProtocolName, bepExtraProtocolName},
 		ClientAuth:             tls.RequestClientCert,
 		SessionTicketsDisabled: true,
 		InsecureSkipVerify:     true,
@@ -551,6 +609,17 @@ func syncthingMain() {
 		symlinks.Supported = false
 	}
 
+	// Outgoing connections to devices, release checks and usage reports go
+	// through the configured proxy, or the one given by the environment.
+	outgoing, err = dialer.New(opts.ProxyAddress, opts.ProxyFallback)
+	if err != nil {
+		l.Fatalln("Proxy:", err)
+	}
+	if proxy := outgoing.Proxy(); proxy != "" {
+		l.Infoln("Using proxy", proxy, "for outgoing connections")
+	}
+	upgrade.SetHTTPClient(outgoing.HTTPClient())
+
 	if opts.MaxSendKbps > 0 {
 		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
 	}
@@ -567,14 +636,13 @@ func syncthingMain() {
 		l.Infoln("Local networks:", strings.Join(networks, ", "))
 	}
 
-	dbFile := locations[locDatabase]
-	ldb, err := leveldb.OpenFile(dbFile, dbOpts())
-	if err != nil && errors.IsCorrupted(err) {
-		ldb, err = leveldb.RecoverFile(dbFile, dbOpts())
-	}
+	ldb, err := openDB()
 	if err != nil {
 		l.Fatalln("Cannot open database:", err, "- Is another copy of Syncthing already running?")
 	}
+	if err := migrateDB(ldb, opts.DBMigrationBackup); err != nil {
+		l.Fatalln("Cannot migrate database:", err)
+	}
 
 	// Remove database entries for folders that no longer exist in the config
 	folders := cfg.Folders()
@@ -586,6 +654,10 @@ func syncthingMain() {
 	}
 
 	m := model.NewModel(cfg, myID, myName, "syncthing", Version, ldb)
+	cfg.Subscribe(m)
+
+	dbMaint = newDBMaintSvc(ldb, cfg)
+	mainSvc.Add(dbMaint)
 
 	if t := os.Getenv("STDEADLOCKTIMEOUT"); len(t) > 0 {
 		it, err := strconv.Atoi(t)
@@ -613,7 +685,8 @@ func syncthingMain() {
 		}
 	}
 
-	// The default port we announce, possibly modified by setupUPnP next.
+	// The default port we announce, possibly modified by the port mapping
+	// service next.
 
 	addr, err := net.ResolveTCPAddr("tcp", opts.ListenAddress[0])
 	if err != nil {
@@ -624,13 +697,14 @@ func syncthingMain() {
 
 	localPort := addr.Port
 	discoverer = discovery(localPort)
+	cfg.Subscribe(discoverer)
 
-	// Start UPnP. The UPnP service will restart global discovery if the
-	// external port changes.
+	// Start port mapping. The port mapping service will restart global
+	// discovery if the external port changes.
 
-	if opts.UPnPEnabled {
-		upnpSvc := newUPnPSvc(cfg, localPort)
-		mainSvc.Add(upnpSvc)
+	if opts.UPnPEnabled || opts.NATPMPEnabled {
+		portMapper = newPortMapSvc(cfg, localPort)
+		mainSvc.Add(portMapper)
 	}
 
 	connectionSvc := newConnectionSvc(cfg, myID, m, tlsCfg)
@@ -688,6 +762,12 @@ func syncthingMain() {
 		go standbyMonitor()
 	}
 
+	dbDir := dbPath()
+	if dbBackend == "journal" {
+		dbDir = filepath.Dir(dbDir)
+	}
+	go databaseSpaceMonitor(m, dbDir)
+
 	if opts.AutoUpgradeIntervalH > 0 {
 		if noUpgrade {
 			l.Infof("No automatic upgrades; STNOUPGRADE environment variable defined.")
@@ -705,12 +785,76 @@ func syncthingMain() {
 
 	code := <-stop
 
+	m.Stop()
 	mainSvc.Stop()
 
 	l.Okln("Exiting")
 	os.Exit(code)
 }
 
+// openDB opens the database using the backend selected by STDBBACKEND.
+func openDB() (db.Storage, error) {
+	return openDBAt(dbPath())
+}
+
+// dbPath returns the location of the database of the selected backend.
+func dbPath() string {
+	if dbBackend == "journal" {
+		return locations[locJournalDatabase]
+	}
+	return locations[locDatabase]
+}
+
+// openDBAt opens, or creates, a database of the selected backend at the
+// path.
+func openDBAt(path string) (db.Storage, error) {
+	switch dbBackend {
+	case "", "leveldb":
+		return db.OpenLevelDB(path, dbOpts())
+	case "journal":
+		return db.OpenJournalStorage(path)
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", dbBackend)
+	}
+}
+
+// migrateDB brings the database to the current schema version, first
+// copying it aside when so configured.
+func migrateDB(ldb db.Storage, backup bool) error {
+	version, needed, err := db.MigrationNeeded(ldb)
+	if err != nil {
+		return err
+	}
+
+	if needed && backup {
+		// An existing backup is from an earlier, interrupted, attempt and
+		// holds the database from before that attempt changed it.
+		path := fmt.Sprintf("%s.schema-v%d.backup", dbPath(), version)
+		if _, err := os.Stat(path); err == nil {
+			l.Infoln("Keeping existing database backup", path)
+		} else {
+			l.Infoln("Backing up database to", path)
+			tmp := path + ".tmp"
+			os.RemoveAll(tmp)
+			bdb, err := openDBAt(tmp)
+			if err != nil {
+				return err
+			}
+			err = db.Copy(bdb, ldb)
+			bdb.Close()
+			if err == nil {
+				err = os.Rename(tmp, path)
+			}
+			if err != nil {
+				os.RemoveAll(tmp)
+				return err
+			}
+		}
+	}
+
+	return db.Migrate(ldb)
+}
+
 func dbOpts() *opt.Options {
 	// Calculate a suitable database block cache capacity.
 
@@ -721,9 +865,10 @@ func dbOpts() *opt.Options {
 	// ... which we reach when the box has this much RAM:
 	const maxAtRAM = 8 << 30
 
-	if v := cfg.Options().DatabaseBlockCacheMiB; v != 0 {
-		// Use the value from the config, if it's set.
-		blockCacheCapacity = v << 20
+	if cfg != nil && cfg.Options().DatabaseBlockCacheMiB != 0 {
+		// Use the value from the config, if it's set. The config isn't
+		// loaded when the database is opened for -db-backup and friends.
+		blockCacheCapacity = cfg.Options().DatabaseBlockCacheMiB << 20
 	} else if bytes, err := memorySize(); err == nil {
 		// We start at the default of 8 MiB and use larger values for machines
 		// with more memory.
@@ -847,6 +992,9 @@ func generatePingEvents() {
 }
 
 func resetDB() error {
+	if err := os.RemoveAll(locations[locJournalDatabase]); err != nil {
+		return err
+	}
 	return os.RemoveAll(locations[locDatabase])
 }
 
@@ -976,6 +1124,16 @@ func standbyMonitor() {
 	}
 }
 
+// databaseSpaceMonitor periodically checks that the disk holding the
+// database has the minimum free space. The model stops the folders while it
+// doesn't.
+func databaseSpaceMonitor(m *model.Model, dir string) {
+	for {
+		m.CheckDatabaseSpace(dir)
+		time.Sleep(time.Minute)
+	}
+}
+
 func autoUpgrade() {
 	timer := time.NewTimer(0)
 	sub := events.Default.Subscribe(events.DeviceConnected)
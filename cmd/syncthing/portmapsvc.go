@@ -0,0 +1,362 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/natpmp"
+	"github.com/syncthing/syncthing/internal/sync"
+	"github.com/syncthing/syncthing/internal/upnp"
+)
+
+var errNoIGD = errors.New("no UPnP device detected")
+
+// The port mapping service runs a loop for discovery of gateways and
+// setup/renewal of a port mapping, using UPnP IGDs (Internet Gateway
+// Devices) or gateways speaking PCP/NAT-PMP, whichever works.
+type portMapSvc struct {
+	cfg       *config.Wrapper
+	localPort int
+	changed   chan struct{} // the local port has changed
+	stop      chan struct{}
+	status    portMapStatus
+	mut       sync.Mutex // protects localPort and status
+}
+
+// portMapStatus is the state of the port mapping, as shown over REST.
+type portMapStatus struct {
+	Method       string    `json:"method"` // "upnp", "pcp" or "nat-pmp"; empty when there is no mapping
+	Gateway      string    `json:"gateway"`
+	ExternalIP   string    `json:"externalIP"`
+	ExternalPort int       `json:"externalPort"`
+	LocalPort    int       `json:"localPort"`
+	Renewed      time.Time `json:"renewed"`
+	Error        string    `json:"error"` // why the last attempt failed
+}
+
+// A mapper sets up or renews a mapping of an external port to the local
+// port, preferably keeping the external port of the previous mapping, and
+// removes the mapping when it is no longer wanted.
+type mapper interface {
+	mapPort(localPort, prevExtPort int) (portMapping, error)
+	unmapPort() error
+}
+
+type portMapping struct {
+	method   string
+	gateway  string
+	extIP    net.IP
+	extPort  int
+	lifetime time.Duration // zero if unknown
+}
+
+func newPortMapSvc(cfg *config.Wrapper, localPort int) *portMapSvc {
+	svc := &portMapSvc{
+		cfg:       cfg,
+		localPort: localPort,
+		changed:   make(chan struct{}, 1),
+		status:    portMapStatus{LocalPort: localPort},
+		mut:       sync.NewMutex(),
+	}
+	cfg.Subscribe(svc)
+	return svc
+}
+
+// Changed implements config.Handler. A change of the first listen address
+// triggers an immediate update of the port mapping.
+func (s *portMapSvc) Changed(cfg config.Configuration) error {
+	if len(cfg.Options.ListenAddress) == 0 {
+		return nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", cfg.Options.ListenAddress[0])
+	if err != nil {
+		return err
+	}
+
+	s.mut.Lock()
+	changed := addr.Port != s.localPort
+	s.localPort = addr.Port
+	s.mut.Unlock()
+
+	if changed {
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *portMapSvc) getLocalPort() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.localPort
+}
+
+// Status returns the current state of the port mapping.
+func (s *portMapSvc) Status() portMapStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.status
+}
+
+func (s *portMapSvc) Serve() {
+	s.stop = make(chan struct{})
+
+	var mappers []mapper
+	opts := s.cfg.Options()
+	if opts.UPnPEnabled {
+		mappers = append(mappers, &upnpMapper{cfg: s.cfg, found: true})
+	}
+	if opts.NATPMPEnabled {
+		mappers = append(mappers, &natpmpMapper{cfg: s.cfg})
+	}
+
+	extPort := 0
+	preferred := 0 // the mapper that last succeeded is tried first
+	mapped := -1   // the mapper holding the current mapping, if any
+
+	unmap := func() {
+		if mapped < 0 {
+			return
+		}
+		if err := mappers[mapped].unmapPort(); err != nil {
+			l.Infof("Failed to remove port mapping for external port %d: %v", extPort, err)
+		} else if debugNet {
+			l.Debugf("Removed port mapping for external port %d.", extPort)
+		}
+		mapped = -1
+	}
+
+	for {
+		localPort := s.getLocalPort()
+
+		var mapping portMapping
+		var err error
+		for i := range mappers {
+			idx := (preferred + i) % len(mappers)
+			mapping, err = mappers[idx].mapPort(localPort, extPort)
+			if err == nil {
+				if mapped != idx {
+					// Another gateway held the mapping before
+					unmap()
+				}
+				preferred = idx
+				mapped = idx
+				break
+			}
+			if debugNet {
+				l.Debugf("Port mapping attempt %d failed: %v", idx, err)
+			}
+		}
+
+		if err == nil {
+			if mapping.extPort != extPort {
+				// External port changed; refresh the discovery announcement.
+				l.Infof("New %s port mapping on %s: external port %d to local port %d.", mapping.method, mapping.gateway, mapping.extPort, localPort)
+				discoverer.SetExternalPort(uint16(mapping.extPort))
+			}
+			if debugNet {
+				l.Debugf("Created/updated %s port mapping for external port %d on %s.", mapping.method, mapping.extPort, mapping.gateway)
+			}
+			extPort = mapping.extPort
+		} else if extPort != 0 {
+			// We lost the mapping; announce the local port again.
+			l.Infof("Lost port mapping for external port %d: %v", extPort, err)
+			discoverer.SetExternalPort(uint16(localPort))
+			extPort = 0
+			mapped = -1
+		}
+		s.setStatus(mapping, localPort, err)
+
+		d := time.Duration(s.cfg.Options().UPnPRenewalM) * time.Minute
+		if d == 0 {
+			// We always want to do renewal so lets just pick a nice sane number.
+			d = 30 * time.Minute
+		}
+		if mapping.lifetime > 0 && mapping.lifetime/2 < d {
+			// Renew well before the gateway drops the mapping.
+			d = mapping.lifetime / 2
+		}
+
+		select {
+		case <-s.stop:
+			unmap()
+			return
+		case <-s.changed:
+		case <-time.After(d):
+		}
+	}
+}
+
+func (s *portMapSvc) Stop() {
+	close(s.stop)
+}
+
+func (s *portMapSvc) setStatus(m portMapping, localPort int, err error) {
+	status := portMapStatus{
+		LocalPort: localPort,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Method = m.method
+		status.Gateway = m.gateway
+		status.ExternalPort = m.extPort
+		status.Renewed = time.Now()
+		if m.extIP != nil {
+			status.ExternalIP = m.extIP.String()
+		}
+	}
+
+	s.mut.Lock()
+	s.status = status
+	s.mut.Unlock()
+}
+
+// The upnpMapper discovers IGDs on every attempt and uses the first one
+// that accepts a mapping.
+type upnpMapper struct {
+	cfg     *config.Wrapper
+	found   bool     // an IGD was found on the previous attempt
+	igd     upnp.IGD // the IGD holding the mapping, if extPort is set
+	extPort int
+}
+
+func (m *upnpMapper) mapPort(localPort, prevExtPort int) (portMapping, error) {
+	igds := upnp.Discover(time.Duration(m.cfg.Options().UPnPTimeoutS) * time.Second)
+	if len(igds) == 0 {
+		if m.found {
+			// Only print a notice if we've previously found an IGD or this is
+			// the first time around.
+			l.Infof("No UPnP device detected")
+		}
+		m.found = false
+		return portMapping{}, errNoIGD
+	}
+	m.found = true
+
+	// Lets try all the IGDs we found and use the first one that works.
+	// TODO: Use all of them, and sort out the resulting mess to the
+	// discovery announcement code...
+	var err error
+	for _, igd := range igds {
+		var extPort int
+		extPort, err = m.tryIGD(igd, localPort, prevExtPort)
+		if err != nil {
+			l.Warnf("Failed to set UPnP port mapping: external port %d on device %s.", extPort, igd.FriendlyIdentifier())
+			continue
+		}
+
+		m.igd = igd
+		m.extPort = extPort
+		extIP, _ := igd.GetExternalIPAddress()
+		return portMapping{
+			method:   "upnp",
+			gateway:  igd.FriendlyIdentifier(),
+			extIP:    extIP,
+			extPort:  extPort,
+			lifetime: time.Duration(m.cfg.Options().UPnPLeaseM) * time.Minute,
+		}, nil
+	}
+
+	return portMapping{}, err
+}
+
+func (m *upnpMapper) unmapPort() error {
+	if m.extPort == 0 {
+		return nil
+	}
+	err := m.igd.DeletePortMapping(upnp.TCP, m.extPort)
+	m.extPort = 0
+	return err
+}
+
+func (m *upnpMapper) tryIGD(igd upnp.IGD, localPort, suggestedPort int) (int, error) {
+	var err error
+	leaseTime := m.cfg.Options().UPnPLeaseM * 60
+
+	if suggestedPort != 0 {
+		// First try renewing our existing mapping.
+		name := fmt.Sprintf("syncthing-%d", suggestedPort)
+		err = igd.AddPortMapping(upnp.TCP, suggestedPort, localPort, name, leaseTime)
+		if err == nil {
+			return suggestedPort, nil
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		// Then try up to ten random ports.
+		extPort := 1024 + predictableRandom.Intn(65535-1024)
+		name := fmt.Sprintf("syncthing-%d", extPort)
+		err = igd.AddPortMapping(upnp.TCP, extPort, localPort, name, leaseTime)
+		if err == nil {
+			return extPort, nil
+		}
+	}
+
+	return 0, err
+}
+
+// The natpmpMapper sets up mappings on the default gateway using PCP or
+// NAT-PMP. The client is kept between attempts, as a PCP gateway only lets
+// the client that created a mapping renew it.
+type natpmpMapper struct {
+	cfg     *config.Wrapper
+	client  *natpmp.Client
+	mapping *natpmp.Mapping // the current mapping, if any
+}
+
+func (m *natpmpMapper) mapPort(localPort, prevExtPort int) (portMapping, error) {
+	opts := m.cfg.Options()
+
+	if m.client == nil {
+		gw, err := natpmp.DefaultGateway()
+		if err != nil {
+			return portMapping{}, err
+		}
+		m.client = natpmp.NewClient(gw, time.Duration(opts.UPnPTimeoutS)*time.Second)
+	}
+
+	lease := time.Duration(opts.UPnPLeaseM) * time.Minute
+	if lease == 0 {
+		// A zero lifetime would delete the mapping; use the lifetime
+		// recommended by RFC 6886 instead of a permanent one.
+		lease = 2 * time.Hour
+	}
+
+	mapping, err := m.client.Map(natpmp.TCP, localPort, prevExtPort, lease)
+	if err != nil {
+		// Look for the gateway again next time, in case it has changed.
+		m.client = nil
+		m.mapping = nil
+		return portMapping{}, err
+	}
+	m.mapping = &mapping
+
+	return portMapping{
+		method:   mapping.Method,
+		gateway:  m.client.Gateway().String(),
+		extIP:    mapping.ExternalIP,
+		extPort:  mapping.ExternalPort,
+		lifetime: mapping.Lifetime,
+	}, nil
+}
+
+func (m *natpmpMapper) unmapPort() error {
+	if m.client == nil || m.mapping == nil {
+		return nil
+	}
+	err := m.client.Unmap(*m.mapping)
+	m.mapping = nil
+	return err
+}
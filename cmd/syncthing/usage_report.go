@@ -124,7 +124,7 @@ func (s *usageReportingService) sendUsageReport() error {
 	var b bytes.Buffer
 	json.NewEncoder(&b).Encode(d)
 
-	var client = http.DefaultClient
+	var client = outgoing.HTTPClient()
 	if BuildEnv == "android" {
 		// This works around the lack of DNS resolution on Android... :(
 		tr := &http.Transport{
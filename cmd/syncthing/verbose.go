@@ -10,6 +10,7 @@ import (
 	"fmt"
 
 	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/model"
 )
 
 // The verbose logging service subscribes to events and prints these in
@@ -113,6 +114,16 @@ func (s *verboseSvc) formatEvent(ev events.Event) string {
 	case events.FolderCompletion:
 		data := ev.Data.(map[string]interface{})
 		return fmt.Sprintf("Completion for folder %q on device %v is %v%%", data["folder"], data["device"], data["completion"])
+	case events.FolderErrors:
+		data := ev.Data.(map[string]interface{})
+		errs := data["errors"].([]model.FileError)
+		return fmt.Sprintf("Folder %q has %d files that failed to sync", data["folder"], len(errs))
+	case events.FolderScrubProgress:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Scrub of folder %q: %v of %v files checked, %v corrupted", data["folder"], data["filesChecked"], data["filesTotal"], data["corrupted"])
+	case events.FileCorrupted:
+		data := ev.Data.(map[string]interface{})
+		return fmt.Sprintf("Corrupted file %q / %q (repaired: %v): %v", data["folder"], data["item"], data["repaired"], data["error"])
 	case events.FolderSummary:
 		data := ev.Data.(map[string]interface{})
 		sum := data["summary"].(map[string]interface{})
@@ -1071,11 +1071,16 @@ angular.module('syncthing.core')
 
             $('#editFolder').modal('hide');
             folderCfg = $scope.currentFolder;
+            // Keep the settings of the shares that remain, such as read only
+            var shares = {};
+            (folderCfg.devices || []).forEach(function (n) {
+                shares[n.deviceID] = n;
+            });
             folderCfg.devices = [];
             folderCfg.selectedDevices[$scope.myID] = true;
             for (var deviceID in folderCfg.selectedDevices) {
                 if (folderCfg.selectedDevices[deviceID] === true) {
-                    folderCfg.devices.push({
+                    folderCfg.devices.push(shares[deviceID] || {
                         deviceID: deviceID
                     });
                 }
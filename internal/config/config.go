@@ -82,6 +82,15 @@ type FolderConfiguration struct {
 	Pullers         int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
 	Hashers         int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
 	Order           PullOrder                   `xml:"order" json:"order"`
+	SelectedPaths   []string                    `xml:"selectedPath" json:"selectedPaths"`                 // Sync only these paths and what is below them; everything when empty
+	SharedIgnores   string                      `xml:"sharedIgnores,attr,omitempty" json:"sharedIgnores"` // Synced file, relative to the folder, whose patterns are used by every device in addition to .stignore
+	MinDiskFree     string                      `xml:"minDiskFree,omitempty" json:"minDiskFree"`          // Free space to keep on the folder's disk, as for the option of the same name; the option applies when empty
+	Priorities      []PullPriority              `xml:"priority" json:"priorities"`                        // Pull files matching these patterns before or after the others, regardless of the pull order
+	ScrubIntervalS  int                         `xml:"scrubIntervalS,attr" json:"scrubIntervalS"`         // Rehash the unchanged files this often to find corruption on disk; zero to scrub only on request
+	ScrubRepair     bool                        `xml:"scrubRepair,attr" json:"scrubRepair"`               // Pull the corrupted blocks found by a scrub again from devices with the same version of the file
+	ScrubMaxKbps    int                         `xml:"scrubMaxKbps,attr" json:"scrubMaxKbps"`             // Limit the rate files are read at when scrubbing; zero for no limit
+	Fsync           bool                        `xml:"fsync,attr" json:"fsync"`                           // Flush pulled files to disk before moving them into place, and their directories after
+	VerifyPulled    bool                        `xml:"verifyPulled,attr" json:"verifyPulled"`             // Rehash pulled files against their blocks before moving them into place and into the index
 
 	Invalid string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 
@@ -92,9 +101,28 @@ func (f FolderConfiguration) Copy() FolderConfiguration {
 	c := f
 	c.Devices = make([]FolderDeviceConfiguration, len(f.Devices))
 	copy(c.Devices, f.Devices)
+	if f.SelectedPaths != nil {
+		c.SelectedPaths = make([]string, len(f.SelectedPaths))
+		copy(c.SelectedPaths, f.SelectedPaths)
+	}
+	if f.Priorities != nil {
+		c.Priorities = make([]PullPriority, len(f.Priorities))
+		copy(c.Priorities, f.Priorities)
+	}
 	return c
 }
 
+// DeviceReadOnly returns true if the folder is shared read only with the
+// given device.
+func (f FolderConfiguration) DeviceReadOnly(device protocol.DeviceID) bool {
+	for _, n := range f.Devices {
+		if n.DeviceID == device {
+			return n.ReadOnly
+		}
+	}
+	return false
+}
+
 func (f FolderConfiguration) Path() string {
 	// This is intentionally not a pointer method, because things like
 	// cfg.Folders["default"].Path() should be valid.
@@ -196,12 +224,15 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 }
 
 type DeviceConfiguration struct {
-	DeviceID    protocol.DeviceID    `xml:"id,attr" json:"deviceID"`
-	Name        string               `xml:"name,attr,omitempty" json:"name"`
-	Addresses   []string             `xml:"address,omitempty" json:"addresses"`
-	Compression protocol.Compression `xml:"compression,attr" json:"compression"`
-	CertName    string               `xml:"certName,attr,omitempty" json:"certName"`
-	Introducer  bool                 `xml:"introducer,attr" json:"introducer"`
+	DeviceID             protocol.DeviceID             `xml:"id,attr" json:"deviceID"`
+	Name                 string                        `xml:"name,attr,omitempty" json:"name"`
+	Addresses            []string                      `xml:"address,omitempty" json:"addresses"`
+	Compression          protocol.Compression          `xml:"compression,attr" json:"compression"`
+	CompressionAlgorithm protocol.CompressionAlgorithm `xml:"compressionAlgorithm,attr,omitempty" json:"compressionAlgorithm"` // Preferred, used if the device supports it
+	CertName             string                        `xml:"certName,attr,omitempty" json:"certName"`
+	Introducer           bool                          `xml:"introducer,attr" json:"introducer"`
+	IntroducedBy         *protocol.DeviceID            `xml:"introducedBy,attr,omitempty" json:"introducedBy"` // The introducer that added this device, if any
+	Connections          int                           `xml:"connections,attr,omitempty" json:"connections"`   // The number of parallel connections to keep to the device
 }
 
 func (orig DeviceConfiguration) Copy() DeviceConfiguration {
@@ -211,8 +242,19 @@ func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 	return c
 }
 
+// A PullPriority gives the files matching a glob pattern a pull priority.
+// Files with a higher priority are pulled first; files that match no pattern
+// have priority zero. Patterns without a slash match the file name in any
+// directory, like ignore patterns.
+type PullPriority struct {
+	Pattern  string `xml:"pattern,attr" json:"pattern"`
+	Priority int    `xml:"priority,attr" json:"priority"`
+}
+
 type FolderDeviceConfiguration struct {
-	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	DeviceID     protocol.DeviceID  `xml:"id,attr" json:"deviceID"`
+	IntroducedBy *protocol.DeviceID `xml:"introducedBy,attr,omitempty" json:"introducedBy"` // The introducer that shared this folder with the device, if any
+	ReadOnly     bool               `xml:"readOnly,attr,omitempty" json:"readOnly"`         // The device receives the folder, but changes it makes are not accepted
 }
 
 type OptionsConfiguration struct {
@@ -230,6 +272,7 @@ type OptionsConfiguration struct {
 	UPnPLeaseM              int      `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"60"`
 	UPnPRenewalM            int      `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
 	UPnPTimeoutS            int      `xml:"upnpTimeoutSeconds" json:"upnpTimeoutSeconds" default:"10"`
+	NATPMPEnabled           bool     `xml:"natpmpEnabled" json:"natpmpEnabled" default:"true"`
 	URAccepted              int      `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
 	URUniqueID              string   `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
 	RestartOnWakeup         bool     `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
@@ -240,6 +283,11 @@ type OptionsConfiguration struct {
 	SymlinksEnabled         bool     `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
 	LimitBandwidthInLan     bool     `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
 	DatabaseBlockCacheMiB   int      `xml:"databaseBlockCacheMiB" json:"databaseBlockCacheMiB" default:"0"`
+	ProxyAddress            string   `xml:"proxyAddress" json:"proxyAddress"`                                      // socks5://host:port or http://host:port; empty to use the environment
+	ProxyFallback           bool     `xml:"proxyFallback" json:"proxyFallback" default:"false"`                    // dial directly when the proxy fails
+	MinDiskFree             string   `xml:"minDiskFree" json:"minDiskFree" default:"1%"`                           // free space to keep on the disks of folders and the database, absolute ("500 MB") or relative ("1%"); "0" for off
+	DBMigrationBackup       bool     `xml:"databaseMigrationBackup" json:"databaseMigrationBackup" default:"true"` // copy the database aside before migrating it to a new layout
+	DBCompactIntervalH      int      `xml:"databaseCompactIntervalH" json:"databaseCompactIntervalH" default:"0"`  // 0 for off
 }
 
 func (orig OptionsConfiguration) Copy() OptionsConfiguration {
@@ -410,6 +458,16 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		if cfg.Folders[i].Pullers == 0 {
 			cfg.Folders[i].Pullers = 16
 		}
+		if _, err := ParseSize(cfg.Folders[i].MinDiskFree); err != nil {
+			l.Warnf("Folder %q: minDiskFree: %v; using the global setting", cfg.Folders[i].ID, err)
+			cfg.Folders[i].MinDiskFree = ""
+		}
+		if cfg.Folders[i].ScrubIntervalS < 0 {
+			cfg.Folders[i].ScrubIntervalS = 0
+		}
+		if cfg.Folders[i].ScrubMaxKbps < 0 {
+			cfg.Folders[i].ScrubMaxKbps = 0
+		}
 		sort.Sort(FolderDeviceConfigurationList(cfg.Folders[i].Devices))
 	}
 
@@ -426,6 +484,11 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		cfg.Options.ReconnectIntervalS = 5
 	}
 
+	if _, err := ParseSize(cfg.Options.MinDiskFree); err != nil {
+		l.Warnf("minDiskFree: %v; using the default", err)
+		cfg.Options.MinDiskFree = "1%"
+	}
+
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
 
@@ -437,27 +500,43 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 // ChangeRequiresRestart returns true if updating the configuration requires a
 // complete restart.
 func ChangeRequiresRestart(from, to Configuration) bool {
-	// Adding, removing or changing folders requires restart
-	if !reflect.DeepEqual(from.Folders, to.Folders) {
-		return true
-	}
-
-	// Removing a device requres restart
-	toDevs := make(map[protocol.DeviceID]bool, len(from.Devices))
-	for _, dev := range to.Devices {
-		toDevs[dev.DeviceID] = true
-	}
-	for _, dev := range from.Devices {
-		if _, ok := toDevs[dev.DeviceID]; !ok {
+	// Adding or changing folders requires restart. Removing folders,
+	// unsharing them with devices and changing the selected paths is
+	// handled on the fly.
+	fromFolders := make(map[string]FolderConfiguration, len(from.Folders))
+	for _, fld := range from.Folders {
+		fromFolders[fld.ID] = fld
+	}
+	for _, fld := range to.Folders {
+		orig, ok := fromFolders[fld.ID]
+		if !ok {
+			return true
+		}
+		if !deviceSubset(fld.Devices, orig.Devices) {
+			return true
+		}
+		fld.Devices, orig.Devices = nil, nil
+		fld.SelectedPaths, orig.SelectedPaths = nil, nil
+		fld.deviceIDs, orig.deviceIDs = nil, nil
+		if !reflect.DeepEqual(fld, orig) {
 			return true
 		}
 	}
 
+	// Adding, changing, removing and ignoring devices does not require a
+	// restart.
+
 	// Changing usage reporting to on or off does not require a restart.
 	to.Options.URAccepted = from.Options.URAccepted
 	to.Options.URUniqueID = from.Options.URUniqueID
 
-	// All of the generic options require restart
+	// Listen addresses and global discovery settings are picked up on the
+	// fly.
+	to.Options.ListenAddress = from.Options.ListenAddress
+	to.Options.GlobalAnnServers = from.Options.GlobalAnnServers
+	to.Options.GlobalAnnEnabled = from.Options.GlobalAnnEnabled
+
+	// All of the other generic options require restart
 	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
 		return true
 	}
@@ -465,6 +544,86 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 	return false
 }
 
+// deviceSubset returns true if all devices in sub are also present in set,
+// and shared read only or not in the same way. The model only learns of a
+// change of the read only flag on restart.
+func deviceSubset(sub, set []FolderDeviceConfiguration) bool {
+	present := make(map[protocol.DeviceID]FolderDeviceConfiguration, len(set))
+	for _, dev := range set {
+		present[dev.DeviceID] = dev
+	}
+	for _, dev := range sub {
+		orig, ok := present[dev.DeviceID]
+		if !ok || orig.ReadOnly != dev.ReadOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// ForgetEditedIntroductions clears the IntroducedBy field of devices and
+// folder shares in to that differ from their counterpart in from. These
+// have been edited by the user and are no longer managed by their
+// introducer.
+func ForgetEditedIntroductions(from Configuration, to *Configuration) {
+	fromDevs := make(map[protocol.DeviceID]DeviceConfiguration, len(from.Devices))
+	for _, dev := range from.Devices {
+		fromDevs[dev.DeviceID] = dev
+	}
+
+	for i := range to.Devices {
+		dev := &to.Devices[i]
+		if dev.IntroducedBy == nil {
+			continue
+		}
+		orig, ok := fromDevs[dev.DeviceID]
+		if !ok || !sameIntroducer(orig.IntroducedBy, dev.IntroducedBy) {
+			// Added manually, or the introducer was set by hand.
+			continue
+		}
+		// Compare everything but the introducer itself.
+		a, b := orig.Copy(), dev.Copy()
+		a.IntroducedBy, b.IntroducedBy = nil, nil
+		if !reflect.DeepEqual(a, b) {
+			dev.IntroducedBy = nil
+		}
+	}
+
+	fromShares := make(map[string]map[protocol.DeviceID]FolderDeviceConfiguration, len(from.Folders))
+	for _, fld := range from.Folders {
+		shares := make(map[protocol.DeviceID]FolderDeviceConfiguration, len(fld.Devices))
+		for _, dev := range fld.Devices {
+			shares[dev.DeviceID] = dev
+		}
+		fromShares[fld.ID] = shares
+	}
+
+	for i := range to.Folders {
+		for j := range to.Folders[i].Devices {
+			dev := &to.Folders[i].Devices[j]
+			if dev.IntroducedBy == nil {
+				continue
+			}
+			orig, ok := fromShares[to.Folders[i].ID][dev.DeviceID]
+			if !ok || !sameIntroducer(orig.IntroducedBy, dev.IntroducedBy) {
+				continue
+			}
+			if orig.ReadOnly != dev.ReadOnly {
+				dev.IntroducedBy = nil
+			}
+		}
+	}
+}
+
+// sameIntroducer returns true if both introducers are unset, or set to the
+// same device.
+func sameIntroducer(a, b *protocol.DeviceID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
 func convertV9V10(cfg *Configuration) {
 	// Enable auto normalization on existing folders.
 	for i := range cfg.Folders {
@@ -45,6 +45,7 @@ func TestDefaultValues(t *testing.T) {
 		UPnPLeaseM:              60,
 		UPnPRenewalM:            30,
 		UPnPTimeoutS:            10,
+		NATPMPEnabled:           true,
 		RestartOnWakeup:         true,
 		AutoUpgradeIntervalH:    12,
 		KeepTemporariesH:        24,
@@ -53,6 +54,11 @@ func TestDefaultValues(t *testing.T) {
 		SymlinksEnabled:         true,
 		LimitBandwidthInLan:     false,
 		DatabaseBlockCacheMiB:   0,
+		ProxyAddress:            "",
+		ProxyFallback:           false,
+		MinDiskFree:             "1%",
+		DBMigrationBackup:       true,
+		DBCompactIntervalH:      0,
 	}
 
 	cfg := New(device1)
@@ -152,6 +158,7 @@ func TestOverriddenValues(t *testing.T) {
 		UPnPLeaseM:              90,
 		UPnPRenewalM:            15,
 		UPnPTimeoutS:            15,
+		NATPMPEnabled:           false,
 		RestartOnWakeup:         false,
 		AutoUpgradeIntervalH:    24,
 		KeepTemporariesH:        48,
@@ -160,6 +167,11 @@ func TestOverriddenValues(t *testing.T) {
 		SymlinksEnabled:         false,
 		LimitBandwidthInLan:     true,
 		DatabaseBlockCacheMiB:   42,
+		ProxyAddress:            "socks5://127.0.0.1:1080",
+		ProxyFallback:           true,
+		MinDiskFree:             "10 GB",
+		DBMigrationBackup:       false,
+		DBCompactIntervalH:      168,
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -436,8 +448,14 @@ func TestRequiresRestart(t *testing.T) {
 
 	newCfg = cfg
 	newCfg.Devices = newCfg.Devices[:len(newCfg.Devices)-1]
-	if !ChangeRequiresRestart(cfg, newCfg) {
-		t.Error("Removing a device requires restart")
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Removing a device does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.IgnoredDevices = []protocol.DeviceID{device3}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Ignoring a device does not require restart")
 	}
 
 	newCfg = cfg
@@ -451,8 +469,29 @@ func TestRequiresRestart(t *testing.T) {
 
 	newCfg = cfg
 	newCfg.Folders = newCfg.Folders[:len(newCfg.Folders)-1]
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Removing a folder does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Folders = []FolderConfiguration{cfg.Folders[0].Copy()}
+	newCfg.Folders[0].Devices = newCfg.Folders[0].Devices[:1]
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Unsharing a folder does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Folders = []FolderConfiguration{cfg.Folders[0].Copy()}
+	newCfg.Folders[0].Devices = append(newCfg.Folders[0].Devices, FolderDeviceConfiguration{DeviceID: device3})
+	if !ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Sharing a folder with a new device requires restart")
+	}
+
+	newCfg = cfg
+	newCfg.Folders = []FolderConfiguration{cfg.Folders[0].Copy()}
+	newCfg.Folders[0].Devices[0].ReadOnly = !newCfg.Folders[0].Devices[0].ReadOnly
 	if !ChangeRequiresRestart(cfg, newCfg) {
-		t.Error("Removing a folder requires restart")
+		t.Error("Sharing a folder read only, or no longer, requires restart")
 	}
 
 	newCfg = cfg
@@ -480,7 +519,14 @@ func TestRequiresRestart(t *testing.T) {
 	}
 
 	newCfg = cfg
+	newCfg.Options.ListenAddress = []string{"127.0.0.1:22001"}
 	newCfg.Options.GlobalAnnEnabled = !cfg.Options.GlobalAnnEnabled
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing listen addresses or global discovery does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.LocalAnnEnabled = !cfg.Options.LocalAnnEnabled
 	if !ChangeRequiresRestart(cfg, newCfg) {
 		t.Error("Changing general options requires restart")
 	}
@@ -578,3 +624,108 @@ func TestPullOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestForgetEditedIntroductions(t *testing.T) {
+	from := Configuration{
+		Devices: []DeviceConfiguration{
+			{DeviceID: device1, Introducer: true},
+			{DeviceID: device2, IntroducedBy: &device1},
+			{DeviceID: device3, IntroducedBy: &device1},
+		},
+		Folders: []FolderConfiguration{
+			{
+				ID: "f1",
+				Devices: []FolderDeviceConfiguration{
+					{DeviceID: device2, IntroducedBy: &device1},
+					{DeviceID: device3, IntroducedBy: &device1},
+				},
+			},
+		},
+	}
+
+	to := from.Copy()
+	to.Devices[2].Name = "edited"
+	to.Folders[0].Devices[1].ReadOnly = true
+	// Edits of the folder itself leave its shares alone
+	to.Folders[0].RescanIntervalS = 120
+
+	ForgetEditedIntroductions(from, &to)
+
+	if to.Devices[1].IntroducedBy == nil || *to.Devices[1].IntroducedBy != device1 {
+		t.Error("Unedited device should still be managed by its introducer")
+	}
+	if to.Devices[2].IntroducedBy != nil {
+		t.Error("Edited device should no longer be managed by its introducer")
+	}
+	if to.Folders[0].Devices[0].IntroducedBy == nil || *to.Folders[0].Devices[0].IntroducedBy != device1 {
+		t.Error("Unedited share should still be managed by its introducer")
+	}
+	if to.Folders[0].Devices[1].IntroducedBy != nil {
+		t.Error("Edited share should no longer be managed by its introducer")
+	}
+}
+
+func TestIntroducedByXML(t *testing.T) {
+	cfg := New(device1)
+	cfg.Devices = append(cfg.Devices, DeviceConfiguration{DeviceID: device2, IntroducedBy: &device1})
+	cfg.Folders = []FolderConfiguration{
+		{
+			ID: "f1",
+			Devices: []FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, IntroducedBy: &device1},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.WriteXML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Only the two introduced entries have the attribute
+	if n := strings.Count(buf.String(), "introducedBy="); n != 2 {
+		t.Errorf("%d introducedBy attributes, expected 2:\n%s", n, buf.String())
+	}
+
+	read, err := ReadXML(&buf, device1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev := read.Devices[1]; dev.IntroducedBy == nil || *dev.IntroducedBy != device1 {
+		t.Errorf("Device introducer not read back: %v", dev.IntroducedBy)
+	}
+	if dev := read.Devices[0]; dev.IntroducedBy != nil {
+		t.Errorf("Device without introducer read back as introduced by %v", dev.IntroducedBy)
+	}
+	shares := read.Folders[0].Devices
+	if shares[0].IntroducedBy != nil || shares[1].IntroducedBy == nil || *shares[1].IntroducedBy != device1 {
+		t.Errorf("Share introducers not read back: %+v", shares)
+	}
+}
+
+func TestRemoveDevice(t *testing.T) {
+	cfg := New(device1)
+	cfg.Devices = append(cfg.Devices, DeviceConfiguration{DeviceID: device2})
+	cfg.Folders = []FolderConfiguration{
+		{
+			ID: "f1",
+			Devices: []FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2},
+			},
+		},
+	}
+
+	wrapper := Wrap("/tmp/test", cfg)
+	defer wrapper.Stop()
+
+	wrapper.RemoveDevice(device2)
+
+	if _, ok := wrapper.Devices()[device2]; ok {
+		t.Error("Device should have been removed")
+	}
+	fld := wrapper.Folders()["f1"]
+	if ids := fld.DeviceIDs(); !reflect.DeepEqual(ids, []protocol.DeviceID{device1}) {
+		t.Errorf("Incorrect folder devices after removal: %v", ids)
+	}
+}
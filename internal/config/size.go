@@ -0,0 +1,95 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Size is an amount of disk space, either absolute or as a percentage of
+// the size of the disk.
+type Size struct {
+	Value   float64 // bytes, or percent
+	Percent bool
+}
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses sizes such as "1%", "500 MB" or "2GiB". A number without
+// unit is a number of bytes. The empty string is the zero size.
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Size{}, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(s)
+	}
+
+	val, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return Size{}, fmt.Errorf("invalid size %q", s)
+	}
+
+	unit := strings.ToLower(strings.TrimSpace(s[i:]))
+	if unit == "%" {
+		if val > 100 {
+			return Size{}, fmt.Errorf("invalid size %q: more than 100%%", s)
+		}
+		return Size{Value: val, Percent: true}, nil
+	}
+
+	mult, ok := sizeUnits[unit]
+	if !ok {
+		return Size{}, fmt.Errorf("invalid size %q: unknown unit %q", s, s[i:])
+	}
+	return Size{Value: val * mult}, nil
+}
+
+// Bytes returns the size in bytes, given the total size of the disk.
+func (s Size) Bytes(total int64) int64 {
+	if s.Percent {
+		return int64(s.Value / 100 * float64(total))
+	}
+	return int64(s.Value)
+}
+
+func (s Size) String() string {
+	if s.Percent {
+		return strconv.FormatFloat(s.Value, 'f', -1, 64) + "%"
+	}
+	for _, u := range []struct {
+		name string
+		mult float64
+	}{{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"kB", 1e3}} {
+		if s.Value >= u.mult {
+			return strconv.FormatFloat(s.Value/u.mult, 'f', -1, 64) + " " + u.name
+		}
+	}
+	return strconv.FormatFloat(s.Value, 'f', -1, 64) + " B"
+}
@@ -0,0 +1,61 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in    string
+		bytes int64 // of a disk of 1 TB
+		str   string
+	}{
+		{"", 0, "0 B"},
+		{"0", 0, "0 B"},
+		{"1%", 1e10, "1%"},
+		{" 2.5 % ", 2.5e10, "2.5%"},
+		{"1234", 1234, "1.234 kB"},
+		{"500 MB", 5e8, "500 MB"},
+		{"500mb", 5e8, "500 MB"},
+		{"2GiB", 2 << 30, "2.147483648 GB"},
+		{"1.5 T", 1.5e12, "1.5 TB"},
+	}
+
+	for _, tc := range cases {
+		s, err := ParseSize(tc.in)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.in, err)
+			continue
+		}
+		if b := s.Bytes(1e12); b != tc.bytes {
+			t.Errorf("%q is %d bytes, expected %d", tc.in, b, tc.bytes)
+		}
+		if str := s.String(); str != tc.str {
+			t.Errorf("%q formats as %q, expected %q", tc.in, str, tc.str)
+		}
+	}
+
+	for _, in := range []string{"%", "MB", "1 XB", "101%", "1.2.3 GB", "-1"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("Unexpected nil error for %q", in)
+		}
+	}
+}
+
+func TestInvalidMinDiskFree(t *testing.T) {
+	cfg := New(device1)
+	cfg.Options.MinDiskFree = "lots"
+	cfg.Folders = []FolderConfiguration{{ID: "f", RawPath: "testdata", MinDiskFree: "5 zorks"}}
+	cfg.prepare(device1)
+
+	if cfg.Options.MinDiskFree != "1%" {
+		t.Errorf("Invalid global minDiskFree should revert to the default, not %q", cfg.Options.MinDiskFree)
+	}
+	if cfg.Folders[0].MinDiskFree != "" {
+		t.Errorf("Invalid folder minDiskFree should be cleared, not %q", cfg.Folders[0].MinDiskFree)
+	}
+}
@@ -156,6 +156,42 @@ func (w *Wrapper) SetDevice(dev DeviceConfiguration) {
 	w.replaces <- w.cfg.Copy()
 }
 
+// RemoveDevice removes the device with the given ID from the configuration,
+// including any folder shares with it. It is a no-op if there is no such
+// device.
+func (w *Wrapper) RemoveDevice(id protocol.DeviceID) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	for i := range w.cfg.Devices {
+		if w.cfg.Devices[i].DeviceID != id {
+			continue
+		}
+
+		w.deviceMap = nil
+		w.folderMap = nil
+
+		devices := make([]DeviceConfiguration, 0, len(w.cfg.Devices)-1)
+		devices = append(devices, w.cfg.Devices[:i]...)
+		w.cfg.Devices = append(devices, w.cfg.Devices[i+1:]...)
+
+		for j := range w.cfg.Folders {
+			fld := &w.cfg.Folders[j]
+			shares := make([]FolderDeviceConfiguration, 0, len(fld.Devices))
+			for _, dev := range fld.Devices {
+				if dev.DeviceID != id {
+					shares = append(shares, dev)
+				}
+			}
+			fld.Devices = shares
+			fld.deviceIDs = nil
+		}
+
+		w.replaces <- w.cfg.Copy()
+		return
+	}
+}
+
 // Folders returns a map of folders. Folder structures should not be changed,
 // other than for the purpose of updating via SetFolder().
 func (w *Wrapper) Folders() map[string]FolderConfiguration {
@@ -0,0 +1,271 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/calmh/xdr"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// The file records are stored with this format byte in front of the
+// fileRecord. Before schema version 2 the record was the FileInfo itself,
+// which starts with the high byte of the name length, that is, with a zero.
+const fileRecordFormat = 1
+
+// The block lists are written without any bookkeeping of who refers to
+// them, and unreferenced lists are removed by GCBlockLists. The collector
+// finds the unreferenced lists in a snapshot, without blocking writers, and
+// then removes them a few at a time. Batches that write file records hold
+// blockListMut for reading, and the collector holds it for writing while it
+// removes lists, skipping those that batches have written since the
+// snapshot, as a new record may refer to them again.
+var (
+	blockListMut = sync.NewRWMutex()
+	gcMut        = sync.NewMutex() // one collection at a time
+
+	gcWritten    map[string]struct{} // hashes of the lists written during a collection
+	gcWrittenMut = sync.NewMutex()   // protects gcWritten
+)
+
+// blockListKey returns a byte slice encoding the following information:
+//	   keyTypeBlockList (1 byte)
+//	   block list hash (32 bytes)
+func blockListKey(hash []byte) []byte {
+	k := make([]byte, 1+32)
+	k[0] = KeyTypeBlockList
+	copy(k[1:], hash)
+	return k
+}
+
+// A blockList is the blocks of a file as stored in the database.
+type blockList []protocol.BlockInfo
+
+func (bl blockList) MarshalXDR() ([]byte, error) {
+	var aw = xdr.AppendWriter(make([]byte, 0, 4+len(bl)*(4+4+32)))
+	var xw = xdr.NewWriter(&aw)
+	xw.WriteUint32(uint32(len(bl)))
+	for i := range bl {
+		if _, err := bl[i].EncodeXDRInto(xw); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(aw), xw.Error()
+}
+
+func (bl *blockList) UnmarshalXDR(bs []byte) error {
+	var xr = xdr.NewReader(bytes.NewReader(bs))
+	n := int(xr.ReadUint32())
+	if n < 0 || n > len(bs)/8 {
+		return fmt.Errorf("block list: bad number of blocks %d", n)
+	}
+	*bl = make(blockList, n)
+	for i := range *bl {
+		(&(*bl)[i]).DecodeXDRFrom(xr)
+	}
+	return xr.Error()
+}
+
+// ldbMarshalFile returns the record to store for the file, and puts the
+// block list of the file in the batch.
+func ldbMarshalFile(batch dbWriter, f protocol.FileInfo) []byte {
+	rec := fileRecord{
+		name:         f.Name,
+		flags:        f.Flags,
+		modified:     f.Modified,
+		version:      f.Version,
+		localVersion: f.LocalVersion,
+		size:         f.Size(),
+	}
+	if len(f.Blocks) > 0 {
+		bs, err := blockList(f.Blocks).MarshalXDR()
+		if err != nil {
+			panic(err)
+		}
+		hash := sha256.Sum256(bs)
+		rec.blockList = hash[:]
+		batch.Put(blockListKey(hash[:]), bs)
+	}
+
+	bs, err := rec.AppendXDR([]byte{fileRecordFormat})
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+// ldbUnmarshalFile returns the file of the record, with the block list
+// read from db.
+func ldbUnmarshalFile(db dbReader, bs []byte) (protocol.FileInfo, error) {
+	if len(bs) == 0 || bs[0] != fileRecordFormat {
+		// A record from before schema version 2
+		var f protocol.FileInfo
+		err := f.UnmarshalXDR(bs)
+		return f, err
+	}
+
+	var rec fileRecord
+	if err := rec.UnmarshalXDR(bs[1:]); err != nil {
+		return protocol.FileInfo{}, err
+	}
+	f := rec.fileInfo()
+	if len(rec.blockList) > 0 {
+		lbs, err := db.Get(blockListKey(rec.blockList))
+		if err != nil {
+			return protocol.FileInfo{}, fmt.Errorf("block list %x of %q: %v", rec.blockList, rec.name, err)
+		}
+		var bl blockList
+		if err := bl.UnmarshalXDR(lbs); err != nil {
+			return protocol.FileInfo{}, err
+		}
+		f.Blocks = bl
+	}
+	return f, nil
+}
+
+// fileInfo returns the file of the record, without the blocks.
+func (rec fileRecord) fileInfo() protocol.FileInfo {
+	return protocol.FileInfo{
+		Name:         rec.name,
+		Flags:        rec.flags,
+		Modified:     rec.modified,
+		Version:      rec.version,
+		LocalVersion: rec.localVersion,
+	}
+}
+
+// recordBlockList returns the hash of the block list the record refers to,
+// or nil.
+func recordBlockList(bs []byte) []byte {
+	if len(bs) == 0 || bs[0] != fileRecordFormat {
+		return nil
+	}
+	var rec fileRecord
+	if err := rec.UnmarshalXDR(bs[1:]); err != nil {
+		panic(err)
+	}
+	return rec.blockList
+}
+
+// ldbWriteFiles writes a batch carrying file records.
+func ldbWriteFiles(db Storage, batch *Batch) error {
+	blockListMut.RLock()
+	defer blockListMut.RUnlock()
+	if err := db.Write(batch); err != nil {
+		return err
+	}
+
+	gcWrittenMut.Lock()
+	if gcWritten != nil {
+		for _, op := range batch.ops {
+			if !op.delete && len(op.key) > 0 && op.key[0] == KeyTypeBlockList {
+				gcWritten[string(op.key[1:])] = struct{}{}
+			}
+		}
+	}
+	gcWrittenMut.Unlock()
+	return nil
+}
+
+// GCBlockLists removes the block lists that no file refers to any more, and
+// returns the number of lists removed.
+func GCBlockLists(db Storage) (int, error) {
+	gcMut.Lock()
+	defer gcMut.Unlock()
+
+	defer func() {
+		gcWrittenMut.Lock()
+		gcWritten = nil
+		gcWrittenMut.Unlock()
+	}()
+
+	unused, err := unreferencedBlockLists(db)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := removeBlockLists(db, unused)
+
+	if debugDB {
+		l.Debugf("removed %d unreferenced block lists", removed)
+	}
+	return removed, err
+}
+
+// unreferencedBlockLists returns the keys of the block lists that no file
+// refers to in a snapshot of the database, and starts noting the lists
+// written after the snapshot was taken.
+func unreferencedBlockLists(db Storage) ([][]byte, error) {
+	blockListMut.Lock()
+	gcWrittenMut.Lock()
+	gcWritten = make(map[string]struct{})
+	gcWrittenMut.Unlock()
+	snap, err := db.NewSnapshot()
+	blockListMut.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	used := make(map[string]struct{})
+	dbi := snap.NewIterator(PrefixRange([]byte{KeyTypeDevice}))
+	for dbi.Next() {
+		if hash := recordBlockList(dbi.Value()); hash != nil {
+			used[string(hash)] = struct{}{}
+		}
+	}
+	err = dbi.Error()
+	dbi.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	var unused [][]byte
+	dbi = snap.NewIterator(PrefixRange([]byte{KeyTypeBlockList}))
+	defer dbi.Release()
+	for dbi.Next() {
+		if _, ok := used[string(dbi.Key()[1:])]; !ok {
+			unused = append(unused, append([]byte(nil), dbi.Key()...))
+		}
+	}
+	return unused, dbi.Error()
+}
+
+// removeBlockLists removes the block lists with the given keys, except those
+// written since unreferencedBlockLists was called, in batches that each
+// hold blockListMut. It returns the number of lists removed.
+func removeBlockLists(db Storage, keys [][]byte) (int, error) {
+	removed := 0
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchFlushSize {
+			n = batchFlushSize
+		}
+
+		batch := new(Batch)
+		blockListMut.Lock()
+		gcWrittenMut.Lock()
+		for _, key := range keys[:n] {
+			if _, ok := gcWritten[string(key[1:])]; !ok {
+				batch.Delete(key)
+			}
+		}
+		gcWrittenMut.Unlock()
+		err := db.Write(batch)
+		blockListMut.Unlock()
+		if err != nil {
+			return removed, err
+		}
+
+		removed += batch.Len()
+		keys = keys[n:]
+	}
+	return removed, nil
+}
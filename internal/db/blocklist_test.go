@@ -0,0 +1,236 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+var remoteDevice = protocol.DeviceID{1}
+
+// testFiles returns n files of the given number of blocks each, where no
+// two files have the same blocks.
+func testFiles(n, blocks int) []protocol.FileInfo {
+	fs := make([]protocol.FileInfo, n)
+	for i := range fs {
+		fs[i] = protocol.FileInfo{
+			Name:     fmt.Sprintf("file%d", i),
+			Modified: 1000,
+			Version:  protocol.Vector{{ID: 1, Value: 1000}},
+			Blocks:   make([]protocol.BlockInfo, blocks),
+		}
+		for j := range fs[i].Blocks {
+			h := make([]byte, 32)
+			h[0], h[1], h[2] = byte(i), byte(j), byte(j>>8)
+			fs[i].Blocks[j] = protocol.BlockInfo{Size: protocol.BlockSize, Hash: h}
+		}
+	}
+	return fs
+}
+
+func countKeys(db Storage, keyType byte) int {
+	n := 0
+	it := db.NewIterator(PrefixRange([]byte{keyType}))
+	defer it.Release()
+	for it.Next() {
+		n++
+	}
+	return n
+}
+
+func TestBlockListDedup(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := testFiles(3, 10)
+	devices := []protocol.DeviceID{protocol.LocalDeviceID, remoteDevice, {2}}
+	s := NewFileSet("test", ldb)
+	for _, dev := range devices {
+		s.Replace(dev, fs)
+	}
+
+	if n := countKeys(ldb, KeyTypeBlockList); n != len(fs) {
+		t.Errorf("%d block lists for %d distinct files", n, len(fs))
+	}
+
+	for _, dev := range devices {
+		for _, f := range fs {
+			g, ok := s.Get(dev, f.Name)
+			if !ok {
+				t.Fatalf("%v: %s missing", dev, f.Name)
+			}
+			if !reflect.DeepEqual(g.Blocks, f.Blocks) {
+				t.Errorf("%v: %s has blocks %v, expected %v", dev, f.Name, g.Blocks, f.Blocks)
+			}
+		}
+	}
+
+	tf, ok := s.GetGlobalTruncated("file0")
+	if !ok || tf.Size() != 10*protocol.BlockSize {
+		t.Errorf("truncated global file0 has size %d, expected %d", tf.Size(), 10*protocol.BlockSize)
+	}
+}
+
+func TestGCBlockLists(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := testFiles(4, 5)
+	s := NewFileSet("test", ldb)
+	s.Replace(protocol.LocalDeviceID, fs)
+	s.Replace(remoteDevice, fs[:2])
+
+	if n, err := GCBlockLists(ldb); n != 0 || err != nil {
+		t.Errorf("removed %d lists (err %v) while all are in use", n, err)
+	}
+
+	// The lists of file2 and file3 are still used by the remote device,
+	// and file1 is changed to the blocks of file0.
+
+	changed := fs[1]
+	changed.Version = changed.Version.Update(1)
+	changed.Blocks = fs[0].Blocks
+	s.Replace(protocol.LocalDeviceID, []protocol.FileInfo{fs[0], changed})
+	s.Replace(remoteDevice, fs[2:])
+
+	if n, err := GCBlockLists(ldb); n != 1 || err != nil {
+		t.Errorf("removed %d lists (err %v), expected 1", n, err)
+	}
+	if n := countKeys(ldb, KeyTypeBlockList); n != 3 {
+		t.Errorf("%d block lists left, expected 3", n)
+	}
+
+	if f, ok := s.Get(protocol.LocalDeviceID, "file1"); !ok || !reflect.DeepEqual(f.Blocks, fs[0].Blocks) {
+		t.Errorf("file1 not as expected after GC: %v", f)
+	}
+	for _, f := range fs[2:] {
+		if g, ok := s.Get(remoteDevice, f.Name); !ok || !reflect.DeepEqual(g.Blocks, f.Blocks) {
+			t.Errorf("%s not as expected after GC: %v", f.Name, g)
+		}
+	}
+}
+
+func TestGCBlockListsConcurrentWrite(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := testFiles(2, 3)
+	s := NewFileSet("test", ldb)
+	s.Replace(protocol.LocalDeviceID, fs)
+	s.Replace(protocol.LocalDeviceID, fs[:1])
+
+	// The list of file1 is unreferenced in the snapshot, but a file
+	// referring to it again is written before the lists are removed.
+	gcMut.Lock()
+	unused, err := unreferencedBlockLists(ldb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unused) != 1 {
+		t.Fatalf("%d unreferenced lists, expected 1", len(unused))
+	}
+	s.Replace(remoteDevice, fs[1:])
+	n, err := removeBlockLists(ldb, unused)
+	gcWrittenMut.Lock()
+	gcWritten = nil
+	gcWrittenMut.Unlock()
+	gcMut.Unlock()
+
+	if n != 0 || err != nil {
+		t.Errorf("removed %d lists (err %v), expected none", n, err)
+	}
+	if f, ok := s.Get(remoteDevice, "file1"); !ok || !reflect.DeepEqual(f.Blocks, fs[1].Blocks) {
+		t.Errorf("file1 not as expected after GC: %v", f)
+	}
+}
+
+func TestMigrateV1V2(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records as written before schema version 2
+	fs := testFiles(2, 3)
+	for _, dev := range []protocol.DeviceID{protocol.LocalDeviceID, remoteDevice} {
+		for _, f := range fs {
+			ldb.Put(deviceKey([]byte("test"), dev[:], []byte(f.Name)), f.MustMarshalXDR())
+		}
+	}
+
+	if err := migrateV1V2(ldb); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countKeys(ldb, KeyTypeBlockList); n != len(fs) {
+		t.Errorf("%d block lists after migration, expected %d", n, len(fs))
+	}
+	it := ldb.NewIterator(PrefixRange([]byte{KeyTypeDevice}))
+	defer it.Release()
+	for it.Next() {
+		if it.Value()[0] != fileRecordFormat {
+			t.Errorf("record %x not migrated", it.Key())
+		}
+	}
+
+	f, ok := ldbGet(ldb, []byte("test"), remoteDevice[:], []byte("file1"))
+	if !ok || !reflect.DeepEqual(f, fs[1]) {
+		t.Errorf("file1 after migration: %v != %v", f, fs[1])
+	}
+}
+
+// BenchmarkBlockListDedup announces the same files from eight devices, and
+// reports the size of the database compared to one with the block list in
+// every file record.
+func BenchmarkBlockListDedup(b *testing.B) {
+	fs := testFiles(100, 1000)
+
+	var ldb Storage
+	for i := 0; i < b.N; i++ {
+		var err error
+		ldb, err = OpenTestStorage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		s := NewFileSet("test", ldb)
+		for d := 0; d < 8; d++ {
+			s.Replace(protocol.DeviceID{byte(d)}, fs)
+		}
+	}
+	b.StopTimer()
+
+	var size, inline int64
+	it := ldb.NewIterator(Range{})
+	defer it.Release()
+	for it.Next() {
+		size += int64(len(it.Key()) + len(it.Value()))
+		switch it.Key()[0] {
+		case KeyTypeBlockList:
+			continue
+		case KeyTypeDevice:
+			f, err := ldbUnmarshalFile(ldb, it.Value())
+			if err != nil {
+				b.Fatal(err)
+			}
+			inline += int64(len(it.Key()) + len(f.MustMarshalXDR()))
+		default:
+			inline += int64(len(it.Key()) + len(it.Value()))
+		}
+	}
+
+	b.Logf("%d bytes with block lists in every record, %d bytes deduplicated (%.1f%% saved)", inline, size, 100-100*float64(size)/float64(inline))
+}
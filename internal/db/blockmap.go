@@ -21,19 +21,16 @@ import (
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var blockFinder *BlockFinder
 
 type BlockMap struct {
-	db     *leveldb.DB
+	db     Storage
 	folder string
 }
 
-func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
+func NewBlockMap(db Storage, folder string) *BlockMap {
 	return &BlockMap{
 		db:     db,
 		folder: folder,
@@ -42,7 +39,7 @@ func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
 
 // Add files to the block map, ignoring any deleted or invalid files.
 func (m *BlockMap) Add(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	buf := make([]byte, 4)
 	for _, file := range files {
 		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
@@ -54,12 +51,12 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 			batch.Put(m.blockKey(block.Hash, file.Name), buf)
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Update block map state, removing any deleted or invalid files.
 func (m *BlockMap) Update(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	buf := make([]byte, 4)
 	for _, file := range files {
 		if file.IsDirectory() {
@@ -78,24 +75,24 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 			batch.Put(m.blockKey(block.Hash, file.Name), buf)
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Discard block map state, removing the given files
 func (m *BlockMap) Discard(files []protocol.FileInfo) error {
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	for _, file := range files {
 		for _, block := range file.Blocks {
 			batch.Delete(m.blockKey(block.Hash, file.Name))
 		}
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 // Drop block map, removing all entries related to this block map from the db.
 func (m *BlockMap) Drop() error {
-	batch := new(leveldb.Batch)
-	iter := m.db.NewIterator(util.BytesPrefix(m.blockKey(nil, "")[:1+64]), nil)
+	batch := new(Batch)
+	iter := m.db.NewIterator(PrefixRange(m.blockKey(nil, "")[:1+64]))
 	defer iter.Release()
 	for iter.Next() {
 		batch.Delete(iter.Key())
@@ -103,7 +100,7 @@ func (m *BlockMap) Drop() error {
 	if iter.Error() != nil {
 		return iter.Error()
 	}
-	return m.db.Write(batch, nil)
+	return m.db.Write(batch)
 }
 
 func (m *BlockMap) blockKey(hash []byte, file string) []byte {
@@ -111,12 +108,12 @@ func (m *BlockMap) blockKey(hash []byte, file string) []byte {
 }
 
 type BlockFinder struct {
-	db      *leveldb.DB
+	db      Storage
 	folders []string
 	mut     sync.RWMutex
 }
 
-func NewBlockFinder(db *leveldb.DB, cfg *config.Wrapper) *BlockFinder {
+func NewBlockFinder(db Storage, cfg *config.Wrapper) *BlockFinder {
 	if blockFinder != nil {
 		return blockFinder
 	}
@@ -157,7 +154,7 @@ func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32) bo
 	f.mut.RUnlock()
 	for _, folder := range folders {
 		key := toBlockKey(hash, folder, "")
-		iter := f.db.NewIterator(util.BytesPrefix(key), nil)
+		iter := f.db.NewIterator(PrefixRange(key))
 		defer iter.Release()
 
 		for iter.Next() && iter.Error() == nil {
@@ -177,10 +174,10 @@ func (f *BlockFinder) Fix(folder, file string, index int32, oldHash, newHash []b
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, uint32(index))
 
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	batch.Delete(toBlockKey(oldHash, folder, file))
 	batch.Put(toBlockKey(newHash, folder, file), buf)
-	return f.db.Write(batch, nil)
+	return f.db.Write(batch)
 }
 
 // m.blockKey returns a byte slice encoding the following information:
@@ -11,9 +11,6 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 func genBlocks(n int) []protocol.BlockInfo {
@@ -50,10 +47,10 @@ func init() {
 	}
 }
 
-func setup() (*leveldb.DB, *BlockFinder) {
+func setup() (Storage, *BlockFinder) {
 	// Setup
 
-	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	db, err := OpenTestStorage()
 	if err != nil {
 		panic(err)
 	}
@@ -69,8 +66,8 @@ func setup() (*leveldb.DB, *BlockFinder) {
 	return db, NewBlockFinder(db, wrapper)
 }
 
-func dbEmpty(db *leveldb.DB) bool {
-	iter := db.NewIterator(nil, nil)
+func dbEmpty(db Storage) bool {
+	iter := db.NewIterator(Range{})
 	defer iter.Release()
 	if iter.Next() {
 		return false
@@ -0,0 +1,41 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:generate -command genxdr go run ../../Godeps/_workspace/src/github.com/calmh/xdr/cmd/genxdr/main.go
+//go:generate genxdr -o counts_xdr.go counts.go
+
+package db
+
+// Counts are the number of files of each kind in a set of files, and their
+// total size.
+type Counts struct {
+	Files       int64
+	Directories int64
+	Symlinks    int64
+	Deleted     int64
+	Bytes       int64
+}
+
+// add adds (sign 1) or removes (sign -1) the file to the counts.
+func (c *Counts) add(f FileIntf, sign int64) {
+	switch {
+	case f.IsDeleted():
+		c.Deleted += sign
+	case f.IsSymlink():
+		c.Symlinks += sign
+	case f.IsDirectory():
+		c.Directories += sign
+	default:
+		c.Files += sign
+	}
+	c.Bytes += sign * f.Size()
+}
+
+// Items returns the number of files, directories and symlinks that are not
+// deleted.
+func (c Counts) Items() int64 {
+	return c.Files + c.Directories + c.Symlinks
+}
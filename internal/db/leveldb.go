@@ -17,10 +17,6 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/sync"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/syndtr/goleveldb/leveldb/opt"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 var (
@@ -46,6 +42,9 @@ const (
 	KeyTypeDeviceStatistic
 	KeyTypeFolderStatistic
 	KeyTypeVirtualMtime
+	KeyTypeSizes
+	KeyTypeMiscData
+	KeyTypeBlockList
 )
 
 type fileVersion struct {
@@ -72,6 +71,18 @@ func (l versionList) String() string {
 	return b.String()
 }
 
+// A fileRecord is a file as stored in the database. The block list is
+// stored apart, once for all the files with the same blocks, under its hash.
+type fileRecord struct {
+	name         string // max:8192
+	flags        uint32
+	modified     int64
+	version      protocol.Vector
+	localVersion int64
+	size         int64
+	blockList    []byte // max:32
+}
+
 type fileList []protocol.FileInfo
 
 func (l fileList) Len() int {
@@ -87,7 +98,7 @@ func (l fileList) Less(a, b int) bool {
 }
 
 type dbReader interface {
-	Get([]byte, *opt.ReadOptions) ([]byte, error)
+	Get([]byte) ([]byte, error)
 }
 
 type dbWriter interface {
@@ -167,9 +178,9 @@ func globalKeyFolder(key []byte) []byte {
 	return folder[:izero]
 }
 
-type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64
+type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi StorageIterator) int64
 
-func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo, deleteFn deletionHandler) int64 {
+func ldbGenericReplace(db Storage, sizes *folderSizes, folder, device []byte, fs []protocol.FileInfo, deleteFn deletionHandler) int64 {
 	runtime.GC()
 
 	sort.Sort(fileList(fs)) // sort list on name, same as in the database
@@ -177,11 +188,11 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 	start := deviceKey(folder, device, nil)                            // before all folder/device files
 	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
 
-	batch := new(leveldb.Batch)
+	batch := newSizeBatch(db, sizes)
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -195,7 +206,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(Range{Start: start, Limit: limit})
 	defer dbi.Release()
 
 	moreDb := dbi.Next()
@@ -230,6 +241,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				l.Debugln("generic replace; missing - insert")
 			}
 			// Database is missing this file. Insert it.
+			batch.fileChanging(device, newName)
 			if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
@@ -238,6 +250,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			} else {
 				ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
 			}
+			batch.fileChanged(device, newName)
 			fsi++
 
 		case moreFs && moreDb && cmp == 0:
@@ -253,6 +266,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				if debugDB {
 					l.Debugln("generic replace; differs - insert")
 				}
+				batch.fileChanging(device, newName)
 				if lv := ldbInsert(batch, folder, device, fs[fsi]); lv > maxLocalVer {
 					maxLocalVer = lv
 				}
@@ -261,6 +275,7 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 				} else {
 					ldbUpdateGlobal(snap, batch, folder, device, newName, fs[fsi].Version)
 				}
+				batch.fileChanged(device, newName)
 			} else if debugDB {
 				l.Debugln("generic replace; equal - ignore")
 			}
@@ -272,42 +287,29 @@ func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.File
 			if debugDB {
 				l.Debugln("generic replace; exists - remove")
 			}
+			batch.fileChanging(device, oldName)
 			if lv := deleteFn(snap, batch, folder, device, oldName, dbi); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
+			batch.fileChanged(device, oldName)
 			moreDb = dbi.Next()
 		}
 
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
-				l.Debugf("db.Write %p", batch)
-			}
-
-			err = db.Write(batch, nil)
-			if err != nil {
-				panic(err)
-			}
-
-			batch.Reset()
+			batch.write()
 		}
 	}
 
-	if debugDB {
-		l.Debugf("db.Write %p", batch)
-	}
-	err = db.Write(batch, nil)
-	if err != nil {
-		panic(err)
-	}
+	batch.write()
 
 	return maxLocalVer
 }
 
-func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) int64 {
+func ldbReplace(db Storage, sizes *folderSizes, folder, device []byte, fs []protocol.FileInfo) int64 {
 	// TODO: Return the remaining maxLocalVer?
-	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
+	return ldbGenericReplace(db, sizes, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi StorageIterator) int64 {
 		// Database has a file that we are missing. Remove it.
 		if debugDB {
 			l.Debugf("delete; folder=%q device=%v name=%q", folder, protocol.DeviceIDFromBytes(device), name)
@@ -321,10 +323,10 @@ func ldbReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) i
 	})
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo, myID uint64) int64 {
+func ldbReplaceWithDelete(db Storage, sizes *folderSizes, folder, device []byte, fs []protocol.FileInfo, myID uint64) int64 {
 	mtimeRepo := NewVirtualMtimeRepo(db, string(folder))
 
-	return ldbGenericReplace(db, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64 {
+	return ldbGenericReplace(db, sizes, folder, device, fs, func(db dbReader, batch dbWriter, folder, device, name []byte, dbi StorageIterator) int64 {
 		var tf FileInfoTruncated
 		err := tf.UnmarshalXDR(dbi.Value())
 		if err != nil {
@@ -342,11 +344,10 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 				Flags:        tf.Flags | protocol.FlagDeleted,
 				Modified:     tf.Modified,
 			}
-			bs, _ := f.MarshalXDR()
 			if debugDB {
 				l.Debugf("batch.Put %p %x", batch, dbi.Key())
 			}
-			batch.Put(dbi.Key(), bs)
+			batch.Put(dbi.Key(), ldbMarshalFile(batch, f))
 			mtimeRepo.DeleteMtime(tf.Name)
 			ldbUpdateGlobal(db, batch, folder, device, deviceKeyName(dbi.Key()), f.Version)
 			return ts
@@ -355,14 +356,14 @@ func ldbReplaceWithDelete(db *leveldb.DB, folder, device []byte, fs []protocol.F
 	})
 }
 
-func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) int64 {
+func ldbUpdate(db Storage, sizes *folderSizes, folder, device []byte, fs []protocol.FileInfo) int64 {
 	runtime.GC()
 
-	batch := new(leveldb.Batch)
+	batch := newSizeBatch(db, sizes)
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -384,8 +385,9 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		if debugDB {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
-		bs, err := snap.Get(fk, nil)
-		if err == leveldb.ErrNotFound {
+		bs, err := snap.Get(fk)
+		if err == ErrNotFound {
+			batch.fileChanging(device, name)
 			if lv := ldbInsert(batch, folder, device, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
@@ -394,6 +396,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 			} else {
 				ldbUpdateGlobal(snap, batch, folder, device, name, f.Version)
 			}
+			batch.fileChanged(device, name)
 			continue
 		}
 
@@ -405,6 +408,7 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 		// Flags might change without the version being bumped when we set the
 		// invalid flag on an existing file.
 		if !ef.Version.Equal(f.Version) || ef.Flags != f.Flags {
+			batch.fileChanging(device, name)
 			if lv := ldbInsert(batch, folder, device, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
@@ -413,31 +417,17 @@ func ldbUpdate(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo) in
 			} else {
 				ldbUpdateGlobal(snap, batch, folder, device, name, f.Version)
 			}
+			batch.fileChanged(device, name)
 		}
 
 		// Write out and reuse the batch every few records, to avoid the batch
 		// growing too large and thus allocating unnecessarily much memory.
 		if batch.Len() > batchFlushSize {
-			if debugDB {
-				l.Debugf("db.Write %p", batch)
-			}
-
-			err = db.Write(batch, nil)
-			if err != nil {
-				panic(err)
-			}
-
-			batch.Reset()
+			batch.write()
 		}
 	}
 
-	if debugDB {
-		l.Debugf("db.Write %p", batch)
-	}
-	err = db.Write(batch, nil)
-	if err != nil {
-		panic(err)
-	}
+	batch.write()
 
 	return maxLocalVer
 }
@@ -456,7 +446,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 	if debugDB {
 		l.Debugf("batch.Put %p %x", batch, nk)
 	}
-	batch.Put(nk, file.MustMarshalXDR())
+	batch.Put(nk, ldbMarshalFile(batch, file))
 
 	return file.LocalVersion
 }
@@ -469,8 +459,8 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, folder, device, file []byte, v
 		l.Debugf("update global; folder=%q device=%v file=%q version=%d", folder, protocol.DeviceIDFromBytes(device), file, version)
 	}
 	gk := globalKey(folder, file)
-	svl, err := db.Get(gk, nil)
-	if err != nil && err != leveldb.ErrNotFound {
+	svl, err := db.Get(gk)
+	if err != nil && err != ErrNotFound {
 		panic(err)
 	}
 
@@ -533,7 +523,7 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	}
 
 	gk := globalKey(folder, file)
-	svl, err := db.Get(gk, nil)
+	svl, err := db.Get(gk)
 	if err != nil {
 		// We might be called to "remove" a global version that doesn't exist
 		// if the first update for the file is already marked invalid.
@@ -567,10 +557,10 @@ func ldbRemoveFromGlobal(db dbReader, batch dbWriter, folder, device, file []byt
 	}
 }
 
-func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterator) {
+func ldbWithHave(db Storage, folder, device []byte, truncate bool, fn Iterator) {
 	start := deviceKey(folder, device, nil)                            // before all folder/device files
 	limit := deviceKey(folder, device, []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -584,11 +574,11 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(Range{Start: start, Limit: limit})
 	defer dbi.Release()
 
 	for dbi.Next() {
-		f, err := unmarshalTrunc(dbi.Value(), truncate)
+		f, err := unmarshalTrunc(snap, dbi.Value(), truncate)
 		if err != nil {
 			panic(err)
 		}
@@ -598,12 +588,12 @@ func ldbWithHave(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 	}
 }
 
-func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []byte, f FileInfoTruncated) bool) {
+func ldbWithAllFolderTruncated(db Storage, folder []byte, fn func(device []byte, f FileInfoTruncated) bool) {
 	runtime.GC()
 
 	start := deviceKey(folder, nil, nil)                                                  // before all folder/device files
 	limit := deviceKey(folder, protocol.LocalDeviceID[:], []byte{0xff, 0xff, 0xff, 0xff}) // after all folder/device files
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -617,9 +607,13 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(Range{Start: start, Limit: limit})
 	defer dbi.Release()
 
+	// The size counters of the folder, once loaded, when it has any yet.
+	var sizes *folderSizes
+	counted, loaded := false, false
+
 	for dbi.Next() {
 		device := deviceKeyDevice(dbi.Key())
 		var f FileInfoTruncated
@@ -631,10 +625,24 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 		switch f.Name {
 		case "", ".", "..", "/": // A few obviously invalid filenames
 			l.Infof("Dropping invalid filename %q from database", f.Name)
-			batch := new(leveldb.Batch)
-			ldbRemoveFromGlobal(db, batch, folder, device, nil)
-			batch.Delete(dbi.Key())
-			db.Write(batch, nil)
+			if !loaded {
+				sizes, counted = ldbLoadSizes(db, folder)
+				loaded = true
+			}
+			name := deviceKeyName(dbi.Key())
+			if counted {
+				batch := newSizeBatch(db, sizes)
+				batch.fileChanging(device, name)
+				ldbRemoveFromGlobal(batch, batch, folder, device, name)
+				batch.Delete(dbi.Key())
+				batch.fileChanged(device, name)
+				batch.write()
+			} else {
+				batch := new(Batch)
+				ldbRemoveFromGlobal(db, batch, folder, device, name)
+				batch.Delete(dbi.Key())
+				db.Write(batch)
+			}
 			continue
 		}
 
@@ -644,27 +652,32 @@ func ldbWithAllFolderTruncated(db *leveldb.DB, folder []byte, fn func(device []b
 	}
 }
 
-func ldbGet(db *leveldb.DB, folder, device, file []byte) (protocol.FileInfo, bool) {
+func ldbGet(db Storage, folder, device, file []byte) (protocol.FileInfo, bool) {
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+
 	nk := deviceKey(folder, device, file)
-	bs, err := db.Get(nk, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := snap.Get(nk)
+	if err == ErrNotFound {
 		return protocol.FileInfo{}, false
 	}
 	if err != nil {
 		panic(err)
 	}
 
-	var f protocol.FileInfo
-	err = f.UnmarshalXDR(bs)
+	f, err := ldbUnmarshalFile(snap, bs)
 	if err != nil {
 		panic(err)
 	}
 	return f, true
 }
 
-func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf, bool) {
+func ldbGetGlobal(db Storage, folder, file []byte, truncate bool) (FileIntf, bool) {
 	k := globalKey(folder, file)
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -681,8 +694,8 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if debugDB {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
-	bs, err := snap.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := snap.Get(k)
+	if err == ErrNotFound {
 		return nil, false
 	}
 	if err != nil {
@@ -703,22 +716,22 @@ func ldbGetGlobal(db *leveldb.DB, folder, file []byte, truncate bool) (FileIntf,
 	if debugDB {
 		l.Debugf("snap.Get %p %x", snap, k)
 	}
-	bs, err = snap.Get(k, nil)
+	bs, err = snap.Get(k)
 	if err != nil {
 		panic(err)
 	}
 
-	fi, err := unmarshalTrunc(bs, truncate)
+	fi, err := unmarshalTrunc(snap, bs, truncate)
 	if err != nil {
 		panic(err)
 	}
 	return fi, true
 }
 
-func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iterator) {
+func ldbWithGlobal(db Storage, folder, prefix []byte, truncate bool, fn Iterator) {
 	runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -732,7 +745,7 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(util.BytesPrefix(globalKey(folder, prefix)), nil)
+	dbi := snap.NewIterator(PrefixRange(globalKey(folder, prefix)))
 	defer dbi.Release()
 
 	var fk []byte
@@ -751,7 +764,7 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 		if debugDB {
 			l.Debugf("snap.Get %p %x", snap, fk)
 		}
-		bs, err := snap.Get(fk, nil)
+		bs, err := snap.Get(fk)
 		if err != nil {
 			l.Debugf("folder: %q (%x)", folder, folder)
 			l.Debugf("key: %q (%x)", dbi.Key(), dbi.Key())
@@ -763,7 +776,7 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 			panic(err)
 		}
 
-		f, err := unmarshalTrunc(bs, truncate)
+		f, err := unmarshalTrunc(snap, bs, truncate)
 		if err != nil {
 			panic(err)
 		}
@@ -774,10 +787,10 @@ func ldbWithGlobal(db *leveldb.DB, folder, prefix []byte, truncate bool, fn Iter
 	}
 }
 
-func ldbAvailability(db *leveldb.DB, folder, file []byte) []protocol.DeviceID {
+func ldbAvailability(db Storage, folder, file []byte) []protocol.DeviceID {
 	k := globalKey(folder, file)
-	bs, err := db.Get(k, nil)
-	if err == leveldb.ErrNotFound {
+	bs, err := db.Get(k)
+	if err == ErrNotFound {
 		return nil
 	}
 	if err != nil {
@@ -802,12 +815,12 @@ func ldbAvailability(db *leveldb.DB, folder, file []byte) []protocol.DeviceID {
 	return devices
 }
 
-func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterator) {
+func ldbWithNeed(db Storage, folder, device []byte, truncate bool, sel selection, fn Iterator) {
 	runtime.GC()
 
 	start := globalKey(folder, nil)
 	limit := globalKey(folder, []byte{0xff, 0xff, 0xff, 0xff})
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -821,7 +834,7 @@ func ldbWithNeed(db *leveldb.DB, folder, device []byte, truncate bool, fn Iterat
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(Range{Start: start, Limit: limit})
 	defer dbi.Release()
 
 	var fk []byte
@@ -854,6 +867,10 @@ nextFile:
 
 		if need || !have {
 			name := globalKeyName(dbi.Key())
+			if !sel.selects(string(name)) {
+				// Outside of what the device syncs.
+				continue nextFile
+			}
 			needVersion := vl.versions[0].version
 
 		nextVersion:
@@ -866,7 +883,7 @@ nextFile:
 				if debugDB {
 					l.Debugf("snap.Get %p %x", snap, fk)
 				}
-				bs, err := snap.Get(fk, nil)
+				bs, err := snap.Get(fk)
 				if err != nil {
 					var id protocol.DeviceID
 					copy(id[:], device)
@@ -880,7 +897,7 @@ nextFile:
 					panic(err)
 				}
 
-				gf, err := unmarshalTrunc(bs, truncate)
+				gf, err := unmarshalTrunc(snap, bs, truncate)
 				if err != nil {
 					panic(err)
 				}
@@ -910,10 +927,10 @@ nextFile:
 	}
 }
 
-func ldbListFolders(db *leveldb.DB) []string {
+func ldbListFolders(db Storage) []string {
 	runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -927,7 +944,7 @@ func ldbListFolders(db *leveldb.DB) []string {
 		snap.Release()
 	}()
 
-	dbi := snap.NewIterator(util.BytesPrefix([]byte{KeyTypeGlobal}), nil)
+	dbi := snap.NewIterator(PrefixRange([]byte{KeyTypeGlobal}))
 	defer dbi.Release()
 
 	folderExists := make(map[string]bool)
@@ -947,10 +964,10 @@ func ldbListFolders(db *leveldb.DB) []string {
 	return folders
 }
 
-func ldbDropFolder(db *leveldb.DB, folder []byte) {
+func ldbDropFolder(db Storage, folder []byte) {
 	runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -965,42 +982,47 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 	}()
 
 	// Remove all items related to the given folder from the device->file bucket
-	dbi := snap.NewIterator(util.BytesPrefix([]byte{KeyTypeDevice}), nil)
+	dbi := snap.NewIterator(PrefixRange([]byte{KeyTypeDevice}))
 	for dbi.Next() {
 		itemFolder := deviceKeyFolder(dbi.Key())
 		if bytes.Compare(folder, itemFolder) == 0 {
-			db.Delete(dbi.Key(), nil)
+			db.Delete(dbi.Key())
 		}
 	}
 	dbi.Release()
 
 	// Remove all items related to the given folder from the global bucket
-	dbi = snap.NewIterator(util.BytesPrefix([]byte{KeyTypeGlobal}), nil)
+	dbi = snap.NewIterator(PrefixRange([]byte{KeyTypeGlobal}))
 	for dbi.Next() {
 		itemFolder := globalKeyFolder(dbi.Key())
 		if bytes.Compare(folder, itemFolder) == 0 {
-			db.Delete(dbi.Key(), nil)
+			db.Delete(dbi.Key())
 		}
 	}
 	dbi.Release()
+
+	// Remove the size counters of the folder
+	batch := new(Batch)
+	ldbDropSizes(db, batch, folder)
+	db.Write(batch)
 }
 
-func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
+func unmarshalTrunc(db dbReader, bs []byte, truncate bool) (FileIntf, error) {
 	if truncate {
 		var tf FileInfoTruncated
 		err := tf.UnmarshalXDR(bs)
 		return tf, err
 	}
 
-	var tf protocol.FileInfo
-	err := tf.UnmarshalXDR(bs)
-	return tf, err
+	return ldbUnmarshalFile(db, bs)
 }
 
-func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
+// ldbCheckGlobals repairs the global version lists of the folder, and
+// returns true if any of them had to be rewritten.
+func ldbCheckGlobals(db Storage, folder []byte) bool {
 	defer runtime.GC()
 
-	snap, err := db.GetSnapshot()
+	snap, err := db.NewSnapshot()
 	if err != nil {
 		panic(err)
 	}
@@ -1016,15 +1038,16 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 
 	start := globalKey(folder, nil)
 	limit := globalKey(folder, []byte{0xff, 0xff, 0xff, 0xff})
-	dbi := snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	dbi := snap.NewIterator(Range{Start: start, Limit: limit})
 	defer dbi.Release()
 
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	if debugDB {
 		l.Debugf("new batch %p", batch)
 	}
 
 	var fk []byte
+	repaired := false
 	for dbi.Next() {
 		gk := dbi.Key()
 		var vl versionList
@@ -1045,8 +1068,8 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 			if debugDB {
 				l.Debugf("snap.Get %p %x", snap, fk)
 			}
-			_, err := snap.Get(fk, nil)
-			if err == leveldb.ErrNotFound {
+			_, err := snap.Get(fk)
+			if err == ErrNotFound {
 				continue
 			}
 			if err != nil {
@@ -1058,10 +1081,12 @@ func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 		if len(newVL.versions) != len(vl.versions) {
 			l.Infof("db repair: rewriting global version list for %x %x", gk[1:1+64], gk[1+64:])
 			batch.Put(dbi.Key(), newVL.MustMarshalXDR())
+			repaired = true
 		}
 	}
 	if debugDB {
 		l.Infoln("db check completed for %q", folder)
 	}
-	db.Write(batch, nil)
+	db.Write(batch)
+	return repaired
 }
@@ -9,6 +9,8 @@ package db
 import (
 	"bytes"
 	"testing"
+
+	"github.com/syncthing/protocol"
 )
 
 func TestDeviceKey(t *testing.T) {
@@ -47,3 +49,41 @@ func TestGlobalKey(t *testing.T) {
 		t.Errorf("wrong name %q != %q", name2, name)
 	}
 }
+
+func TestDropInvalidNameCounted(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+
+	remote := protocol.DeviceID{1, 2, 3}
+	s := NewFileSet("test", ldb)
+	s.Update(remote, []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}},
+		{Name: ".", Version: protocol.Vector{{ID: 1, Value: 1}}},
+	})
+
+	// Dropping the invalid file keeps the stored counters up to date
+	var device protocol.DeviceID
+	have := make(map[protocol.DeviceID]Counts)
+	ldbWithAllFolderTruncated(ldb, []byte("test"), func(dev []byte, f FileInfoTruncated) bool {
+		copy(device[:], dev)
+		c := have[device]
+		c.add(f, 1)
+		have[device] = c
+		return true
+	})
+
+	stored, ok := ldbLoadSizes(ldb, []byte("test"))
+	if !ok {
+		t.Fatal("no size counters")
+	}
+	fresh := ldbRebuildSizes(ldb, []byte("test"), have)
+	if stored.globalCounts() != fresh.globalCounts() || stored.needCounts() != fresh.needCounts() || !stored.haveEquals(fresh.have) {
+		t.Errorf("counters %+v after dropping, expected %+v", stored, fresh)
+	}
+	if c := fresh.globalCounts(); c.Files != 1 {
+		t.Errorf("global counts %+v, expected one file", c)
+	}
+}
@@ -165,3 +165,120 @@ func (o *versionList) DecodeXDRFrom(xr *xdr.Reader) error {
 	}
 	return xr.Error()
 }
+
+/*
+
+fileRecord Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of name                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    name (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                             flags                             |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                      modified (64 bits)                       +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                       Vector Structure                        \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                    local Version (64 bits)                    +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                        size (64 bits)                         +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                     Length of block List                      |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                 block List (variable length)                  \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct fileRecord {
+	string name<8192>;
+	unsigned int flags;
+	hyper modified;
+	Vector version;
+	hyper localVersion;
+	hyper size;
+	opaque blockList<32>;
+}
+
+*/
+
+func (o fileRecord) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.EncodeXDRInto(xw)
+}
+
+func (o fileRecord) MarshalXDR() ([]byte, error) {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o fileRecord) MustMarshalXDR() []byte {
+	bs, err := o.MarshalXDR()
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (o fileRecord) AppendXDR(bs []byte) ([]byte, error) {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	_, err := o.EncodeXDRInto(xw)
+	return []byte(aw), err
+}
+
+func (o fileRecord) EncodeXDRInto(xw *xdr.Writer) (int, error) {
+	if l := len(o.name); l > 8192 {
+		return xw.Tot(), xdr.ElementSizeExceeded("name", l, 8192)
+	}
+	xw.WriteString(o.name)
+	xw.WriteUint32(o.flags)
+	xw.WriteUint64(uint64(o.modified))
+	_, err := o.version.EncodeXDRInto(xw)
+	if err != nil {
+		return xw.Tot(), err
+	}
+	xw.WriteUint64(uint64(o.localVersion))
+	xw.WriteUint64(uint64(o.size))
+	if l := len(o.blockList); l > 32 {
+		return xw.Tot(), xdr.ElementSizeExceeded("blockList", l, 32)
+	}
+	xw.WriteBytes(o.blockList)
+	return xw.Tot(), xw.Error()
+}
+
+func (o *fileRecord) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.DecodeXDRFrom(xr)
+}
+
+func (o *fileRecord) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.DecodeXDRFrom(xr)
+}
+
+func (o *fileRecord) DecodeXDRFrom(xr *xdr.Reader) error {
+	o.name = xr.ReadStringMax(8192)
+	o.flags = xr.ReadUint32()
+	o.modified = int64(xr.ReadUint64())
+	(&o.version).DecodeXDRFrom(xr)
+	o.localVersion = int64(xr.ReadUint64())
+	o.size = int64(xr.ReadUint64())
+	o.blockList = xr.ReadBytesMax(32)
+	return xr.Error()
+}
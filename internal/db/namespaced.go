@@ -9,21 +9,18 @@ package db
 import (
 	"encoding/binary"
 	"time"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // NamespacedKV is a simple key-value store using a specific namespace within
-// a leveldb.
+// a Storage.
 type NamespacedKV struct {
-	db     *leveldb.DB
+	db     Storage
 	prefix []byte
 }
 
 // NewNamespacedKV returns a new NamespacedKV that lives in the namespace
 // specified by the prefix.
-func NewNamespacedKV(db *leveldb.DB, prefix string) *NamespacedKV {
+func NewNamespacedKV(db Storage, prefix string) *NamespacedKV {
 	return &NamespacedKV{
 		db:     db,
 		prefix: []byte(prefix),
@@ -32,20 +29,20 @@ func NewNamespacedKV(db *leveldb.DB, prefix string) *NamespacedKV {
 
 // Reset removes all entries in this namespace.
 func (n *NamespacedKV) Reset() {
-	it := n.db.NewIterator(util.BytesPrefix(n.prefix), nil)
+	it := n.db.NewIterator(PrefixRange(n.prefix))
 	defer it.Release()
-	batch := new(leveldb.Batch)
+	batch := new(Batch)
 	for it.Next() {
 		batch.Delete(it.Key())
 		if batch.Len() > batchFlushSize {
-			if err := n.db.Write(batch, nil); err != nil {
+			if err := n.db.Write(batch); err != nil {
 				panic(err)
 			}
 			batch.Reset()
 		}
 	}
 	if batch.Len() > 0 {
-		if err := n.db.Write(batch, nil); err != nil {
+		if err := n.db.Write(batch); err != nil {
 			panic(err)
 		}
 	}
@@ -57,14 +54,14 @@ func (n *NamespacedKV) PutInt64(key string, val int64) {
 	keyBs := append(n.prefix, []byte(key)...)
 	var valBs [8]byte
 	binary.BigEndian.PutUint64(valBs[:], uint64(val))
-	n.db.Put(keyBs, valBs[:], nil)
+	n.db.Put(keyBs, valBs[:])
 }
 
 // Int64 returns the stored value interpreted as an int64 and a boolean that
 // is false if no value was stored at the key.
 func (n *NamespacedKV) Int64(key string) (int64, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return 0, false
 	}
@@ -77,7 +74,7 @@ func (n *NamespacedKV) Int64(key string) (int64, bool) {
 func (n *NamespacedKV) PutTime(key string, val time.Time) {
 	keyBs := append(n.prefix, []byte(key)...)
 	valBs, _ := val.MarshalBinary() // never returns an error
-	n.db.Put(keyBs, valBs, nil)
+	n.db.Put(keyBs, valBs)
 }
 
 // Time returns the stored value interpreted as a time.Time and a boolean
@@ -85,7 +82,7 @@ func (n *NamespacedKV) PutTime(key string, val time.Time) {
 func (n NamespacedKV) Time(key string) (time.Time, bool) {
 	var t time.Time
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return t, false
 	}
@@ -97,14 +94,14 @@ func (n NamespacedKV) Time(key string) (time.Time, bool) {
 // is overwritten.
 func (n *NamespacedKV) PutString(key, val string) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Put(keyBs, []byte(val), nil)
+	n.db.Put(keyBs, []byte(val))
 }
 
 // String returns the stored value interpreted as a string and a boolean that
 // is false if no value was stored at the key.
 func (n NamespacedKV) String(key string) (string, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return "", false
 	}
@@ -115,23 +112,42 @@ func (n NamespacedKV) String(key string) (string, bool) {
 // is overwritten.
 func (n *NamespacedKV) PutBytes(key string, val []byte) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Put(keyBs, val, nil)
+	n.db.Put(keyBs, val)
 }
 
 // Bytes returns the stored value as a raw byte slice and a boolean that
 // is false if no value was stored at the key.
 func (n NamespacedKV) Bytes(key string) ([]byte, bool) {
 	keyBs := append(n.prefix, []byte(key)...)
-	valBs, err := n.db.Get(keyBs, nil)
+	valBs, err := n.db.Get(keyBs)
 	if err != nil {
 		return nil, false
 	}
 	return valBs, true
 }
 
+// Iterate calls fn with each key, and its value, from start (inclusive) to
+// limit (exclusive) in key order, for as long as fn returns true. An empty
+// limit means the end of the namespace. The value is only valid until fn
+// returns.
+func (n NamespacedKV) Iterate(start, limit string, fn func(key string, val []byte) bool) {
+	r := PrefixRange(n.prefix)
+	r.Start = append(append([]byte(nil), n.prefix...), start...)
+	if limit != "" {
+		r.Limit = append(append([]byte(nil), n.prefix...), limit...)
+	}
+	it := n.db.NewIterator(r)
+	defer it.Release()
+	for it.Next() {
+		if !fn(string(it.Key()[len(n.prefix):]), it.Value()) {
+			return
+		}
+	}
+}
+
 // Delete deletes the specified key. It is allowed to delete a nonexistent
 // key.
 func (n NamespacedKV) Delete(key string) {
 	keyBs := append(n.prefix, []byte(key)...)
-	n.db.Delete(keyBs, nil)
+	n.db.Delete(keyBs)
 }
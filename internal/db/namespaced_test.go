@@ -7,15 +7,13 @@
 package db
 
 import (
+	"fmt"
 	"testing"
 	"time"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 func TestNamespacedInt(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +51,7 @@ func TestNamespacedInt(t *testing.T) {
 }
 
 func TestNamespacedTime(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +71,7 @@ func TestNamespacedTime(t *testing.T) {
 }
 
 func TestNamespacedString(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,7 +90,7 @@ func TestNamespacedString(t *testing.T) {
 }
 
 func TestNamespacedReset(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,3 +123,44 @@ func TestNamespacedReset(t *testing.T) {
 		t.Errorf("Incorrect return v %q != \"\" || ok %v != false", v, ok)
 	}
 }
+
+func TestNamespacedIterate(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n1 := NewNamespacedKV(ldb, "foo")
+	n2 := NewNamespacedKV(ldb, "fop")
+
+	n1.PutString("a", "1")
+	n1.PutString("b", "2")
+	n1.PutString("c", "3")
+	n2.PutString("a", "other")
+
+	var keys []string
+	collect := func(key string, val []byte) bool {
+		keys = append(keys, key+"="+string(val))
+		return true
+	}
+
+	n1.Iterate("", "", collect)
+	if fmt.Sprint(keys) != "[a=1 b=2 c=3]" {
+		t.Errorf("Incorrect iteration of the whole namespace: %v", keys)
+	}
+
+	keys = nil
+	n1.Iterate("b", "c", collect)
+	if fmt.Sprint(keys) != "[b=2]" {
+		t.Errorf("Incorrect iteration of [b, c): %v", keys)
+	}
+
+	keys = nil
+	n1.Iterate("", "", func(key string, val []byte) bool {
+		collect(key, val)
+		return false
+	})
+	if fmt.Sprint(keys) != "[a=1]" {
+		t.Errorf("Iteration should stop when fn returns false: %v", keys)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+// SchemaVersion is the version of the database layout used by this version
+// of Syncthing. It must be increased, and a migration added, whenever the
+// encoding of keys or values changes.
+const SchemaVersion = 2
+
+// A migration brings a database at the previous schema version to the given
+// one.
+type migration struct {
+	version     int
+	description string
+	migrate     func(db Storage) error
+}
+
+// The migrations, in order. Databases from before the schema version was
+// recorded are at version zero.
+var migrations = []migration{
+	{1, "count the files of each folder", migrateV0V1},
+	{2, "store each block list once", migrateV1V2},
+}
+
+const schemaVersionKey = "dbVersion"
+
+func miscData(db Storage) *NamespacedKV {
+	return NewNamespacedKV(db, string([]byte{KeyTypeMiscData}))
+}
+
+// schemaVersion returns the schema version recorded in the database, and
+// whether the database is empty.
+func schemaVersion(db Storage) (int, bool) {
+	if v, ok := miscData(db).Int64(schemaVersionKey); ok {
+		return int(v), false
+	}
+
+	it := db.NewIterator(Range{})
+	defer it.Release()
+	return 0, !it.Next()
+}
+
+// MigrationNeeded returns the schema version of the database and whether it
+// must be migrated to the current version. An error is returned if the
+// database is from a newer version of Syncthing.
+func MigrationNeeded(db Storage) (int, bool, error) {
+	version, empty := schemaVersion(db)
+	if empty {
+		return SchemaVersion, false, nil
+	}
+	if version > SchemaVersion {
+		return version, false, fmt.Errorf("database schema version %d is newer than the supported version %d", version, SchemaVersion)
+	}
+	return version, version < SchemaVersion, nil
+}
+
+// Migrate brings the database to the current schema version. The version is
+// recorded after each step, so that an interrupted migration resumes where
+// it stopped.
+func Migrate(db Storage) error {
+	version, empty := schemaVersion(db)
+	if empty {
+		return setSchemaVersion(db, SchemaVersion)
+	}
+	return migrate(db, version, migrations)
+}
+
+func migrate(db Storage, version int, migrations []migration) error {
+	if len(migrations) > 0 && version > migrations[len(migrations)-1].version {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, migrations[len(migrations)-1].version)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		l.Infof("Migrating database to schema version %d: %s", m.version, m.description)
+		t0 := time.Now()
+		if err := m.migrate(db); err != nil {
+			return fmt.Errorf("migrating to schema version %d: %v", m.version, err)
+		}
+		if err := setSchemaVersion(db, m.version); err != nil {
+			return err
+		}
+		l.Infof("Migrated database to schema version %d in %v", m.version, time.Since(t0))
+	}
+	return nil
+}
+
+// setSchemaVersion records the version as miscData(db).PutInt64 would, but
+// returns the error.
+func setSchemaVersion(db Storage, version int) error {
+	var val [8]byte
+	binary.BigEndian.PutUint64(val[:], uint64(version))
+	return db.Put(append([]byte{KeyTypeMiscData}, schemaVersionKey...), val[:])
+}
+
+// migrateV0V1 repairs the global version lists and creates the size
+// counters of every folder.
+func migrateV0V1(db Storage) error {
+	folders := ldbListFolders(db)
+	for i, folder := range folders {
+		l.Infof("Migrating folder %q (%d/%d)", folder, i+1, len(folders))
+
+		ldbCheckGlobals(db, []byte(folder))
+
+		var device protocol.DeviceID
+		have := make(map[protocol.DeviceID]Counts)
+		ldbWithAllFolderTruncated(db, []byte(folder), func(dev []byte, f FileInfoTruncated) bool {
+			if !f.IsInvalid() {
+				copy(device[:], dev)
+				c := have[device]
+				c.add(f, 1)
+				have[device] = c
+			}
+			return true
+		})
+		ldbRebuildSizes(db, []byte(folder), have)
+	}
+	return nil
+}
+
+// migrateV1V2 rewrites the file records to refer to their block lists,
+// which are stored apart.
+func migrateV1V2(db Storage) error {
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	dbi := snap.NewIterator(PrefixRange([]byte{KeyTypeDevice}))
+	defer dbi.Release()
+
+	batch := new(Batch)
+	for dbi.Next() {
+		if bs := dbi.Value(); len(bs) > 0 && bs[0] == fileRecordFormat {
+			continue
+		}
+		var f protocol.FileInfo
+		if err := f.UnmarshalXDR(dbi.Value()); err != nil {
+			return err
+		}
+		batch.Put(dbi.Key(), ldbMarshalFile(batch, f))
+		if batch.Len() > batchFlushSize {
+			if err := ldbWriteFiles(db, batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := dbi.Error(); err != nil {
+		return err
+	}
+	return ldbWriteFiles(db, batch)
+}
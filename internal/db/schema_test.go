@@ -0,0 +1,236 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestMigrateEmpty(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, needed, err := MigrationNeeded(ldb); v != SchemaVersion || needed || err != nil {
+		t.Errorf("empty database: version %d, needed %v, err %v", v, needed, err)
+	}
+	if err := Migrate(ldb); err != nil {
+		t.Fatal(err)
+	}
+	if v, empty := schemaVersion(ldb); v != SchemaVersion || empty {
+		t.Errorf("version %d, empty %v after migrating empty database", v, empty)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSchemaVersion(ldb, SchemaVersion+1)
+	if _, _, err := MigrationNeeded(ldb); err == nil {
+		t.Error("unexpected nil error for newer database")
+	}
+	if err := Migrate(ldb); err == nil {
+		t.Error("unexpected nil error migrating newer database")
+	}
+}
+
+func TestMigrateOrder(t *testing.T) {
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldb.Put([]byte{KeyTypeGlobal}, nil) // not empty
+
+	var ran []int
+	fail := 3
+	step := func(version int) func(Storage) error {
+		return func(db Storage) error {
+			if version == fail {
+				return errors.New("failed")
+			}
+			ran = append(ran, version)
+			return nil
+		}
+	}
+	ms := []migration{
+		{1, "one", step(1)},
+		{2, "two", step(2)},
+		{3, "three", step(3)},
+		{4, "four", step(4)},
+	}
+
+	// A failed migration stops at the last completed step
+
+	if err := migrate(ldb, 0, ms); err == nil {
+		t.Error("unexpected nil error from failing migration")
+	}
+	if !reflect.DeepEqual(ran, []int{1, 2}) {
+		t.Errorf("ran %v, expected [1 2]", ran)
+	}
+	version, _ := schemaVersion(ldb)
+	if version != 2 {
+		t.Errorf("version %d after failed migration, expected 2", version)
+	}
+
+	// ... and resumes from there
+
+	ran = nil
+	fail = 0
+	if err := migrate(ldb, version, ms); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ran, []int{3, 4}) {
+		t.Errorf("ran %v, expected [3 4]", ran)
+	}
+	if version, _ := schemaVersion(ldb); version != 4 {
+		t.Errorf("version %d after migration, expected 4", version)
+	}
+}
+
+// testdata/index-v0.11.0.db is a leveldb database written by Syncthing
+// before the schema version was recorded, as found in existing
+// installations. It holds two folders, "default" and "other", with files
+// from the local device and one remote device. testdata/schema-v0.journal
+// holds the same records in the journal format, for the other backends.
+func TestMigrateV0Fixture(t *testing.T) {
+	testMigrateV0(t, openFixture(t, "testdata/schema-v0.journal"))
+}
+
+func TestMigrateLevelDBFixture(t *testing.T) {
+	if testBackend != "leveldb" {
+		t.Skip("leveldb fixture is only opened with the leveldb backend")
+	}
+
+	// The fixture is copied, as opening the database changes it.
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir("testdata/index-v0.11.0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(filepath.Join("testdata/index-v0.11.0.db", file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file.Name()), bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb, err := OpenLevelDB(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	testMigrateV0(t, ldb)
+}
+
+// testMigrateV0 migrates the pre-versioning fixture database and checks the
+// result.
+func testMigrateV0(t *testing.T, ldb Storage) {
+	version, needed, err := MigrationNeeded(ldb)
+	if version != 0 || !needed || err != nil {
+		t.Fatalf("version %d, needed %v, err %v", version, needed, err)
+	}
+	if err := Migrate(ldb); err != nil {
+		t.Fatal(err)
+	}
+	if version, needed, err := MigrationNeeded(ldb); version != SchemaVersion || needed || err != nil {
+		t.Errorf("after migration: version %d, needed %v, err %v", version, needed, err)
+	}
+
+	remote, _ := protocol.DeviceIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
+	expected := map[string]struct {
+		global, need Counts
+		have         map[protocol.DeviceID]Counts
+	}{
+		"default": {
+			global: Counts{Files: 5, Directories: 1, Symlinks: 1, Deleted: 1, Bytes: 1704192},
+			need:   Counts{Files: 2, Bytes: 786432},
+			have: map[protocol.DeviceID]Counts{
+				protocol.LocalDeviceID: {Files: 4, Directories: 1, Symlinks: 1, Deleted: 1, Bytes: 1048832},
+				remote:                 {Files: 3, Directories: 1, Bytes: 1179776},
+			},
+		},
+		"other": {
+			global: Counts{Files: 2, Bytes: 786432},
+			need:   Counts{Files: 1, Bytes: 131072},
+			have: map[protocol.DeviceID]Counts{
+				protocol.LocalDeviceID: {Files: 1, Bytes: 655360},
+				remote:                 {Files: 1, Bytes: 131072},
+			},
+		},
+	}
+
+	for folder, e := range expected {
+		sizes, ok := ldbLoadSizes(ldb, []byte(folder))
+		if !ok {
+			t.Errorf("%s: no size counters after migration", folder)
+			continue
+		}
+		if sizes.global != e.global {
+			t.Errorf("%s: global %+v != %+v", folder, sizes.global, e.global)
+		}
+		if sizes.need != e.need {
+			t.Errorf("%s: need %+v != %+v", folder, sizes.need, e.need)
+		}
+		if !sizes.haveEquals(e.have) {
+			t.Errorf("%s: have %+v != %+v", folder, sizes.have, e.have)
+		}
+	}
+
+	// The files are untouched
+
+	f, ok := ldbGet(ldb, []byte("default"), protocol.LocalDeviceID[:], []byte("a"))
+	if !ok || len(f.Blocks) != 3 {
+		t.Errorf("file a not as expected after migration: %v", f)
+	}
+}
+
+// openFixture returns a Storage of the backend under test with the contents
+// of the journal fixture.
+func openFixture(t *testing.T, path string) Storage {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := OpenJournalStorage(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fixture.Close()
+
+	ldb, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Copy(ldb, fixture); err != nil {
+		t.Fatal(err)
+	}
+	return ldb
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+)
+
+// A selection is a set of paths, in wire format, that the local device
+// syncs out of a folder. An empty selection selects everything.
+type selection []string
+
+func newSelection(paths []string) selection {
+	var sel selection
+	for _, path := range paths {
+		path = strings.Trim(osutil.NormalizedFilename(path), "/")
+		if path == "" || path == "." {
+			// The root of the folder selects everything.
+			return nil
+		}
+		sel = append(sel, path)
+	}
+	return sel
+}
+
+// selects returns true if the name is one of the selected paths, is below
+// one of them, or is a parent directory of one of them.
+func (s selection) selects(name string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, path := range s {
+		switch {
+		case name == path:
+			return true
+		case len(name) > len(path) && name[len(path)] == '/' && strings.HasPrefix(name, path):
+			return true
+		case len(path) > len(name) && path[len(name)] == '/' && strings.HasPrefix(path, name):
+			return true
+		}
+	}
+	return false
+}
@@ -16,15 +16,16 @@ import (
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/sync"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type FileSet struct {
 	localVersion map[protocol.DeviceID]int64
 	mutex        sync.Mutex
 	folder       string
-	db           *leveldb.DB
+	db           Storage
 	blockmap     *BlockMap
+	selection    selection // what the local device needs; protected by mutex
+	sizes        *folderSizes
 }
 
 // FileIntf is the set of methods implemented by both protocol.FileInfo and
@@ -43,7 +44,7 @@ type FileIntf interface {
 // continue iteration, false to stop.
 type Iterator func(f FileIntf) bool
 
-func NewFileSet(folder string, db *leveldb.DB) *FileSet {
+func NewFileSet(folder string, db Storage) *FileSet {
 	var s = FileSet{
 		localVersion: make(map[protocol.DeviceID]int64),
 		folder:       folder,
@@ -52,14 +53,20 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 		mutex:        sync.NewMutex(),
 	}
 
-	ldbCheckGlobals(db, []byte(folder))
+	repaired := ldbCheckGlobals(db, []byte(folder))
 
 	var deviceID protocol.DeviceID
+	have := make(map[protocol.DeviceID]Counts)
 	ldbWithAllFolderTruncated(db, []byte(folder), func(device []byte, f FileInfoTruncated) bool {
 		copy(deviceID[:], device)
 		if f.LocalVersion > s.localVersion[deviceID] {
 			s.localVersion[deviceID] = f.LocalVersion
 		}
+		if !f.IsInvalid() {
+			c := have[deviceID]
+			c.add(f, 1)
+			have[deviceID] = c
+		}
 		return true
 	})
 	if debug {
@@ -67,6 +74,23 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 	}
 	clock(s.localVersion[protocol.LocalDeviceID])
 
+	// The size counters are created on first start. As we have just counted
+	// the files of each device, check those against the stored counters;
+	// if they disagree the database was changed behind our back and we
+	// count everything again.
+	sizes, ok := ldbLoadSizes(db, []byte(folder))
+	switch {
+	case !ok:
+		if debug {
+			l.Debugf("creating size counters for %q", folder)
+		}
+		sizes = ldbRebuildSizes(db, []byte(folder), have)
+	case repaired || !sizes.haveEquals(have):
+		l.Infof("db repair: recounting the files of folder %q", folder)
+		sizes = ldbRebuildSizes(db, []byte(folder), have)
+	}
+	s.sizes = sizes
+
 	return &s
 }
 
@@ -77,7 +101,7 @@ func (s *FileSet) Replace(device protocol.DeviceID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.localVersion[device] = ldbReplace(s.db, []byte(s.folder), device[:], fs)
+	s.localVersion[device] = ldbReplace(s.db, s.sizes, []byte(s.folder), device[:], fs)
 	if len(fs) == 0 {
 		// Reset the local version if all files were removed.
 		s.localVersion[device] = 0
@@ -95,7 +119,7 @@ func (s *FileSet) ReplaceWithDelete(device protocol.DeviceID, fs []protocol.File
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if lv := ldbReplaceWithDelete(s.db, []byte(s.folder), device[:], fs, myID); lv > s.localVersion[device] {
+	if lv := ldbReplaceWithDelete(s.db, s.sizes, []byte(s.folder), device[:], fs, myID); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
 	if device == protocol.LocalDeviceID {
@@ -124,7 +148,7 @@ func (s *FileSet) Update(device protocol.DeviceID, fs []protocol.FileInfo) {
 		s.blockmap.Discard(discards)
 		s.blockmap.Update(updates)
 	}
-	if lv := ldbUpdate(s.db, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
+	if lv := ldbUpdate(s.db, s.sizes, []byte(s.folder), device[:], fs); lv > s.localVersion[device] {
 		s.localVersion[device] = lv
 	}
 }
@@ -133,14 +157,14 @@ func (s *FileSet) WithNeed(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithNeed(%v)", s.folder, device)
 	}
-	ldbWithNeed(s.db, []byte(s.folder), device[:], false, nativeFileIterator(fn))
+	ldbWithNeed(s.db, []byte(s.folder), device[:], false, s.selectionFor(device), nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithNeedTruncated(device protocol.DeviceID, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithNeedTruncated(%v)", s.folder, device)
 	}
-	ldbWithNeed(s.db, []byte(s.folder), device[:], true, nativeFileIterator(fn))
+	ldbWithNeed(s.db, []byte(s.folder), device[:], true, s.selectionFor(device), nativeFileIterator(fn))
 }
 
 func (s *FileSet) WithHave(device protocol.DeviceID, fn Iterator) {
@@ -171,6 +195,22 @@ func (s *FileSet) WithGlobalTruncated(fn Iterator) {
 	ldbWithGlobal(s.db, []byte(s.folder), nil, true, nativeFileIterator(fn))
 }
 
+// WithSelectedGlobalTruncated iterates over the global files that are
+// selected for syncing by the local device.
+func (s *FileSet) WithSelectedGlobalTruncated(fn Iterator) {
+	if debug {
+		l.Debugf("%s WithSelectedGlobalTruncated()", s.folder)
+	}
+	sel := s.selectionFor(protocol.LocalDeviceID)
+	fn = nativeFileIterator(fn)
+	ldbWithGlobal(s.db, []byte(s.folder), nil, true, func(f FileIntf) bool {
+		if !sel.selects(f.(FileInfoTruncated).Name) {
+			return true
+		}
+		return fn(f)
+	})
+}
+
 func (s *FileSet) WithPrefixedGlobalTruncated(prefix string, fn Iterator) {
 	if debug {
 		l.Debugf("%s WithPrefixedGlobalTruncated()", s.folder, prefix)
@@ -208,6 +248,72 @@ func (s *FileSet) Availability(file string) []protocol.DeviceID {
 	return ldbAvailability(s.db, []byte(s.folder), []byte(osutil.NormalizedFilename(file)))
 }
 
+// SetSelection limits the files needed by the local device to the given
+// paths, the files below them and their parent directories. An empty list
+// selects all files.
+func (s *FileSet) SetSelection(paths []string) {
+	sel := newSelection(paths)
+	s.mutex.Lock()
+	s.selection = sel
+	s.mutex.Unlock()
+}
+
+// Selected returns true if the file is selected for syncing by the local
+// device.
+func (s *FileSet) Selected(file string) bool {
+	return s.selectionFor(protocol.LocalDeviceID).selects(osutil.NormalizedFilename(file))
+}
+
+// selectionFor returns the selection that applies to the files needed by
+// the device. Only the local device has a selection.
+func (s *FileSet) selectionFor(device protocol.DeviceID) selection {
+	if device != protocol.LocalDeviceID {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.selection
+}
+
+// GlobalSize returns the counts of the global files that are selected for
+// syncing by the local device.
+func (s *FileSet) GlobalSize() Counts {
+	sel := s.selectionFor(protocol.LocalDeviceID)
+	if len(sel) == 0 {
+		return s.sizes.globalCounts()
+	}
+
+	// The counters cover all files; count the selected ones.
+	var c Counts
+	ldbWithGlobal(s.db, []byte(s.folder), nil, true, func(f FileIntf) bool {
+		if sel.selects(f.(FileInfoTruncated).Name) {
+			c.add(f, 1)
+		}
+		return true
+	})
+	return c
+}
+
+// LocalSize returns the counts of the valid files announced by the device.
+func (s *FileSet) LocalSize(device protocol.DeviceID) Counts {
+	return s.sizes.haveCounts(device)
+}
+
+// NeedSize returns the counts of the files needed by the local device.
+func (s *FileSet) NeedSize() Counts {
+	sel := s.selectionFor(protocol.LocalDeviceID)
+	if len(sel) == 0 {
+		return s.sizes.needCounts()
+	}
+
+	var c Counts
+	ldbWithNeed(s.db, []byte(s.folder), protocol.LocalDeviceID[:], true, sel, func(f FileIntf) bool {
+		c.add(f, 1)
+		return true
+	})
+	return c
+}
+
 func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -215,13 +321,13 @@ func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 }
 
 // ListFolders returns the folder IDs seen in the database.
-func ListFolders(db *leveldb.DB) []string {
+func ListFolders(db Storage) []string {
 	return ldbListFolders(db)
 }
 
 // DropFolder clears out all information related to the given folder from the
 // database.
-func DropFolder(db *leveldb.DB, folder string) {
+func DropFolder(db Storage, folder string) {
 	ldbDropFolder(db, []byte(folder))
 	bm := &BlockMap{
 		db:     db,
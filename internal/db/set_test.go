@@ -9,14 +9,13 @@ package db_test
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 var remoteDevice0, remoteDevice1 protocol.DeviceID
@@ -97,7 +96,7 @@ func (l fileList) String() string {
 
 func TestGlobalSet(t *testing.T) {
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -256,7 +255,7 @@ func TestGlobalSet(t *testing.T) {
 }
 
 func TestNeedWithInvalid(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -296,7 +295,7 @@ func TestNeedWithInvalid(t *testing.T) {
 }
 
 func TestUpdateToInvalid(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -331,7 +330,7 @@ func TestUpdateToInvalid(t *testing.T) {
 }
 
 func TestInvalidAvailability(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -372,7 +371,7 @@ func TestInvalidAvailability(t *testing.T) {
 }
 
 func TestLocalDeleted(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -446,7 +445,7 @@ func TestLocalDeleted(t *testing.T) {
 }
 
 func Benchmark10kReplace(b *testing.B) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -469,7 +468,7 @@ func Benchmark10kUpdateChg(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -501,7 +500,7 @@ func Benchmark10kUpdateSme(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -527,7 +526,7 @@ func Benchmark10kNeed2k(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -560,7 +559,7 @@ func Benchmark10kHaveFullList(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -593,7 +592,7 @@ func Benchmark10kGlobal(b *testing.B) {
 		remote = append(remote, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: protocol.Vector{{ID: myID, Value: 1000}}})
 	}
 
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -621,7 +620,7 @@ func Benchmark10kGlobal(b *testing.B) {
 }
 
 func TestGlobalReset(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -662,7 +661,7 @@ func TestGlobalReset(t *testing.T) {
 }
 
 func TestNeed(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -702,8 +701,59 @@ func TestNeed(t *testing.T) {
 	}
 }
 
+func TestNeedSelection(t *testing.T) {
+	ldb, err := db.OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := db.NewFileSet("test", ldb)
+	m.SetSelection([]string{"photos/2015/", "docs"})
+
+	remote := []protocol.FileInfo{
+		{Name: "docs", Version: protocol.Vector{{ID: myID, Value: 1000}}, Flags: protocol.FlagDirectory},
+		{Name: "docs/a", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "docsx", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "music/b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "photos", Version: protocol.Vector{{ID: myID, Value: 1000}}, Flags: protocol.FlagDirectory},
+		{Name: "photos/2014/c", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+		{Name: "photos/2015", Version: protocol.Vector{{ID: myID, Value: 1000}}, Flags: protocol.FlagDirectory},
+		{Name: "photos/2015/d", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+	}
+
+	shouldNeed := []protocol.FileInfo{
+		remote[0], remote[1], remote[4], remote[6], remote[7],
+	}
+
+	m.Replace(remoteDevice0, remote)
+
+	need := needList(m, protocol.LocalDeviceID)
+	sort.Sort(fileList(need))
+	sort.Sort(fileList(shouldNeed))
+	if fmt.Sprint(need) != fmt.Sprint(shouldNeed) {
+		t.Errorf("Need incorrect;\n%v !=\n%v", need, shouldNeed)
+	}
+
+	if !m.Selected("photos/2015/d") || m.Selected("photos/2014/c") {
+		t.Error("Incorrect selection of single files")
+	}
+
+	// The selection applies only to what the local device needs.
+
+	if need := needList(m, remoteDevice1); len(need) != len(remote) {
+		t.Errorf("Remote device should need all %d files, not %d", len(remote), len(need))
+	}
+
+	// An empty selection selects everything.
+
+	m.SetSelection(nil)
+	if need := needList(m, protocol.LocalDeviceID); len(need) != len(remote) {
+		t.Errorf("Should need all %d files, not %d", len(remote), len(need))
+	}
+}
+
 func TestLocalVersion(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -742,7 +792,7 @@ func TestLocalVersion(t *testing.T) {
 }
 
 func TestListDropFolder(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -793,7 +843,7 @@ func TestListDropFolder(t *testing.T) {
 }
 
 func TestGlobalNeedWithInvalid(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -833,7 +883,7 @@ func TestGlobalNeedWithInvalid(t *testing.T) {
 }
 
 func TestLongPath(t *testing.T) {
-	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb, err := db.OpenTestStorage()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -861,3 +911,160 @@ func TestLongPath(t *testing.T) {
 			gf[0].Name, local[0].Name)
 	}
 }
+
+// countFiles returns the counts of the files, as the size counters should
+// have them.
+func countFiles(fs []protocol.FileInfo, skipInvalid bool) db.Counts {
+	var c db.Counts
+	for _, f := range fs {
+		if skipInvalid && f.IsInvalid() {
+			continue
+		}
+		switch {
+		case f.IsDeleted():
+			c.Deleted++
+		case f.IsSymlink():
+			c.Symlinks++
+		case f.IsDirectory():
+			c.Directories++
+		default:
+			c.Files++
+		}
+		c.Bytes += f.Size()
+	}
+	return c
+}
+
+func checkSizes(t *testing.T, s *db.FileSet, when string) {
+	if c, e := s.GlobalSize(), countFiles(globalList(s), false); c != e {
+		t.Errorf("%s: global size %+v != expected %+v", when, c, e)
+	}
+	if c, e := s.NeedSize(), countFiles(needList(s, protocol.LocalDeviceID), false); c != e {
+		t.Errorf("%s: need size %+v != expected %+v", when, c, e)
+	}
+	for _, device := range []protocol.DeviceID{protocol.LocalDeviceID, remoteDevice0, remoteDevice1} {
+		if c, e := s.LocalSize(device), countFiles(haveList(s, device), true); c != e {
+			t.Errorf("%s: local size of %v %+v != expected %+v", when, device, c, e)
+		}
+	}
+}
+
+func randomFiles(rnd *rand.Rand, id uint64) []protocol.FileInfo {
+	var fs []protocol.FileInfo
+	for i := 0; i < 50; i++ {
+		if rnd.Intn(3) == 0 {
+			continue
+		}
+		f := protocol.FileInfo{
+			Name:    fmt.Sprintf("dir/file%d", i),
+			Version: protocol.Vector{{ID: id, Value: uint64(1 + rnd.Intn(3))}},
+		}
+		switch rnd.Intn(6) {
+		case 0:
+			f.Flags = protocol.FlagDeleted
+		case 1:
+			f.Flags = protocol.FlagDirectory
+		case 2:
+			f.Flags = protocol.FlagSymlink
+		case 3:
+			f.Flags = protocol.FlagInvalid
+		default:
+			f.Blocks = genBlocks(1 + rnd.Intn(4))
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+func TestSizes(t *testing.T) {
+	ldb, err := db.OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+	checkSizes(t, s, "empty")
+
+	rnd := rand.New(rand.NewSource(42))
+	devices := []protocol.DeviceID{protocol.LocalDeviceID, remoteDevice0, remoteDevice1}
+	for i := 0; i < 100; i++ {
+		device := devices[rnd.Intn(len(devices))]
+		id := uint64(rnd.Intn(len(devices)) + 1)
+		fs := randomFiles(rnd, id)
+		var op string
+		switch rnd.Intn(3) {
+		case 0:
+			op = "Replace"
+			s.Replace(device, fs)
+		case 1:
+			op = "ReplaceWithDelete"
+			s.ReplaceWithDelete(device, fs, myID)
+		default:
+			op = "Update"
+			s.Update(device, fs)
+		}
+		checkSizes(t, s, fmt.Sprintf("%d: %s(%v)", i, op, device))
+		if t.Failed() {
+			return
+		}
+	}
+
+	// The counters are kept in the database
+
+	global, need, local := s.GlobalSize(), s.NeedSize(), s.LocalSize(protocol.LocalDeviceID)
+	s = db.NewFileSet("test", ldb)
+	if c := s.GlobalSize(); c != global {
+		t.Errorf("global size %+v != %+v after reopen", c, global)
+	}
+	if c := s.NeedSize(); c != need {
+		t.Errorf("need size %+v != %+v after reopen", c, need)
+	}
+	if c := s.LocalSize(protocol.LocalDeviceID); c != local {
+		t.Errorf("local size %+v != %+v after reopen", c, local)
+	}
+}
+
+func TestSizesRebuild(t *testing.T) {
+	ldb, err := db.OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(42))
+	s := db.NewFileSet("test", ldb)
+	s.Replace(protocol.LocalDeviceID, randomFiles(rnd, myID))
+	s.Replace(remoteDevice0, randomFiles(rnd, 2))
+
+	sizeKeys := func() [][]byte {
+		var keys [][]byte
+		it := ldb.NewIterator(db.PrefixRange([]byte{db.KeyTypeSizes}))
+		defer it.Release()
+		for it.Next() {
+			keys = append(keys, append([]byte(nil), it.Key()...))
+		}
+		return keys
+	}
+
+	// Counters missing, as when starting with an older database
+
+	for _, key := range sizeKeys() {
+		ldb.Delete(key)
+	}
+	s = db.NewFileSet("test", ldb)
+	checkSizes(t, s, "rebuilt")
+
+	// Counters out of date
+
+	for _, key := range sizeKeys() {
+		ldb.Put(key, db.Counts{Files: 42}.MustMarshalXDR())
+	}
+	s = db.NewFileSet("test", ldb)
+	checkSizes(t, s, "repaired")
+
+	// Dropping the folder removes the counters
+
+	db.DropFolder(ldb, "test")
+	if keys := sizeKeys(); len(keys) != 0 {
+		t.Errorf("%d size counters left after dropping the folder", len(keys))
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	sizeKindGlobal = iota // the global files
+	sizeKindNeed          // the files needed by the local device
+	sizeKindHave          // the valid files announced by a device
+)
+
+// sizeKey returns a byte slice encoding the following information:
+//	   keyTypeSizes (1 byte)
+//	   folder (64 bytes)
+//	   kind (1 byte)
+//	   device (32 bytes, zero unless kind is sizeKindHave)
+func sizeKey(folder []byte, kind byte, device []byte) []byte {
+	k := make([]byte, 1+64+1+32)
+	k[0] = KeyTypeSizes
+	if len(folder) > 64 {
+		panic("folder name too long")
+	}
+	copy(k[1:], folder)
+	k[1+64] = kind
+	copy(k[1+64+1:], device)
+	return k
+}
+
+// folderSizes are the counters of a folder. They are kept in memory and
+// written to the database in the same batches as the changes to the files
+// they count, so that the two never disagree.
+type folderSizes struct {
+	folder []byte
+	global Counts
+	need   Counts
+	have   map[protocol.DeviceID]Counts
+	mut    sync.Mutex
+}
+
+func newFolderSizes(folder []byte) *folderSizes {
+	return &folderSizes{
+		folder: folder,
+		have:   make(map[protocol.DeviceID]Counts),
+		mut:    sync.NewMutex(),
+	}
+}
+
+// ldbLoadSizes returns the counters stored for the folder, and false if
+// there are none.
+func ldbLoadSizes(db Storage, folder []byte) (*folderSizes, bool) {
+	s := newFolderSizes(folder)
+	found := false
+
+	dbi := db.NewIterator(PrefixRange(sizeKey(folder, 0, nil)[:1+64]))
+	defer dbi.Release()
+
+	for dbi.Next() {
+		var c Counts
+		if err := c.UnmarshalXDR(dbi.Value()); err != nil {
+			panic(err)
+		}
+		key := dbi.Key()
+		switch key[1+64] {
+		case sizeKindGlobal:
+			s.global = c
+			found = true
+		case sizeKindNeed:
+			s.need = c
+		case sizeKindHave:
+			s.have[protocol.DeviceIDFromBytes(key[1+64+1:])] = c
+		}
+	}
+
+	return s, found
+}
+
+// ldbRebuildSizes counts the files in the folder and stores the result.
+// The counts of the files announced by each device are given.
+func ldbRebuildSizes(db Storage, folder []byte, have map[protocol.DeviceID]Counts) *folderSizes {
+	s := newFolderSizes(folder)
+	for device, c := range have {
+		s.have[device] = c
+	}
+	ldbWithGlobal(db, folder, nil, true, func(f FileIntf) bool {
+		s.global.add(f, 1)
+		return true
+	})
+	ldbWithNeed(db, folder, protocol.LocalDeviceID[:], true, nil, func(f FileIntf) bool {
+		s.need.add(f, 1)
+		return true
+	})
+
+	batch := new(Batch)
+	ldbDropSizes(db, batch, folder)
+	s.writeTo(batch)
+	if err := db.Write(batch); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ldbDropSizes removes all counters of the folder.
+func ldbDropSizes(db Storage, batch dbWriter, folder []byte) {
+	dbi := db.NewIterator(PrefixRange(sizeKey(folder, 0, nil)[:1+64]))
+	defer dbi.Release()
+	for dbi.Next() {
+		batch.Delete(dbi.Key())
+	}
+}
+
+// writeTo puts the current counters in the batch.
+func (s *folderSizes) writeTo(batch dbWriter) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	batch.Put(sizeKey(s.folder, sizeKindGlobal, nil), s.global.MustMarshalXDR())
+	batch.Put(sizeKey(s.folder, sizeKindNeed, nil), s.need.MustMarshalXDR())
+	for device, c := range s.have {
+		batch.Put(sizeKey(s.folder, sizeKindHave, device[:]), c.MustMarshalXDR())
+	}
+}
+
+// addFile adds (sign 1) or removes (sign -1) what the file with the given
+// name, as seen by the reader, contributes to the counters: to the files
+// of the device, to the global files and to the files needed by the local
+// device.
+func (s *folderSizes) addFile(db dbReader, device, name []byte, sign int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if bs, err := db.Get(deviceKey(s.folder, device, name)); err == nil {
+		var f FileInfoTruncated
+		if err := f.UnmarshalXDR(bs); err != nil {
+			panic(err)
+		}
+		if !f.IsInvalid() {
+			id := protocol.DeviceIDFromBytes(device)
+			c := s.have[id]
+			c.add(f, sign)
+			s.have[id] = c
+		}
+	} else if err != ErrNotFound {
+		panic(err)
+	}
+
+	bs, err := db.Get(globalKey(s.folder, name))
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	var vl versionList
+	if err := vl.UnmarshalXDR(bs); err != nil {
+		panic(err)
+	}
+	if len(vl.versions) == 0 {
+		return
+	}
+
+	// The files of the versions equal to the global one, which are the
+	// candidates for the global and the needed file. A nil file means the
+	// global list is inconsistent; ldbCheckGlobals repairs that, and the
+	// counters are rebuilt, on the next start.
+	var candidates []*FileInfoTruncated
+	for _, v := range vl.versions {
+		if !v.version.Equal(vl.versions[0].version) {
+			break
+		}
+		bs, err := db.Get(deviceKey(s.folder, v.device, name))
+		if err != nil {
+			candidates = append(candidates, nil)
+			continue
+		}
+		f := new(FileInfoTruncated)
+		if err := f.UnmarshalXDR(bs); err != nil {
+			panic(err)
+		}
+		candidates = append(candidates, f)
+	}
+
+	if candidates[0] != nil {
+		s.global.add(*candidates[0], sign)
+	}
+
+	// The same rules as in ldbWithNeed, for the local device.
+	have, need := false, false
+	for _, v := range vl.versions {
+		if bytes.Equal(v.device, protocol.LocalDeviceID[:]) {
+			have = true
+			need = !v.version.GreaterEqual(vl.versions[0].version)
+			break
+		}
+	}
+	if !need && have {
+		return
+	}
+	for _, f := range candidates {
+		if f == nil || f.IsInvalid() {
+			continue
+		}
+		if f.IsDeleted() && !have {
+			return
+		}
+		s.need.add(*f, sign)
+		return
+	}
+}
+
+func (s *folderSizes) globalCounts() Counts {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.global
+}
+
+func (s *folderSizes) needCounts() Counts {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.need
+}
+
+func (s *folderSizes) haveCounts(device protocol.DeviceID) Counts {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.have[device]
+}
+
+// haveEquals returns true if the counters of the files of each device are
+// the given ones.
+func (s *folderSizes) haveEquals(have map[protocol.DeviceID]Counts) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for device, c := range s.have {
+		if c != have[device] {
+			return false
+		}
+	}
+	for device, c := range have {
+		if s.have[device] != c {
+			return false
+		}
+	}
+	return true
+}
+
+// A sizeBatch is a batch that keeps the counters up to date with the
+// changes it carries. The records written since the batch was last written
+// to the database are kept, so that the files can be counted as they are
+// before and after each change.
+type sizeBatch struct {
+	*Batch
+	db      Storage
+	sizes   *folderSizes
+	pending map[string][]byte // the records not yet written to db; nil when deleted
+}
+
+func newSizeBatch(db Storage, sizes *folderSizes) *sizeBatch {
+	return &sizeBatch{
+		Batch:   new(Batch),
+		db:      db,
+		sizes:   sizes,
+		pending: make(map[string][]byte),
+	}
+}
+
+func (b *sizeBatch) Put(key, value []byte) {
+	b.Batch.Put(key, value)
+	b.pending[string(key)] = value
+}
+
+func (b *sizeBatch) Delete(key []byte) {
+	b.Batch.Delete(key)
+	b.pending[string(key)] = nil
+}
+
+// Get returns the record as it is with the changes in the batch applied.
+func (b *sizeBatch) Get(key []byte) ([]byte, error) {
+	if v, ok := b.pending[string(key)]; ok {
+		if v == nil {
+			return nil, ErrNotFound
+		}
+		return v, nil
+	}
+	return b.db.Get(key)
+}
+
+// fileChanging is called before changing the file of the device, and
+// fileChanged afterwards, to update the counters for the change.
+func (b *sizeBatch) fileChanging(device, name []byte) {
+	b.sizes.addFile(b, device, name, -1)
+}
+
+func (b *sizeBatch) fileChanged(device, name []byte) {
+	b.sizes.addFile(b, device, name, 1)
+}
+
+// write writes the batch, along with the current counters, and resets it.
+func (b *sizeBatch) write() {
+	b.sizes.writeTo(b.Batch)
+	if debugDB {
+		l.Debugf("db.Write %p", b.Batch)
+	}
+	if err := ldbWriteFiles(b.db, b.Batch); err != nil {
+		panic(err)
+	}
+	b.Batch.Reset()
+	b.pending = make(map[string][]byte)
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import "errors"
+
+// ErrNotFound is returned by Get when there is no value for the key.
+var ErrNotFound = errors.New("db: key not found")
+
+// A Storage is an ordered key-value store. Keys are ordered bytewise.
+// Values and keys passed to a Storage may be reused by the caller once the
+// call returns; values and keys returned by a Storage must not be modified.
+type Storage interface {
+	Reader
+
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	// Write applies all changes in the batch atomically.
+	Write(batch *Batch) error
+
+	// NewSnapshot returns a consistent, read only view of the current
+	// state. The snapshot must be released when no longer needed.
+	NewSnapshot() (Snapshot, error)
+
+	Close() error
+}
+
+// A Compacter is a Storage that can reclaim the space taken by deleted and
+// overwritten records.
+type Compacter interface {
+	Compact() error
+}
+
+// A Reader reads values from a Storage or a Snapshot.
+type Reader interface {
+	// Get returns the value for the key, or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+
+	// NewIterator returns an iterator over the keys in the range, in
+	// order. The iterator must be released when no longer needed.
+	NewIterator(r Range) StorageIterator
+}
+
+// A Snapshot is a read only view of a Storage at some point in time.
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// A StorageIterator walks over a range of keys. Next must be called before the
+// first key is available. The key and value are valid until the next call
+// to Next.
+type StorageIterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+// A Range is the keys from Start (inclusive) to Limit (exclusive). A nil
+// Start is before all keys, a nil Limit after all keys.
+type Range struct {
+	Start []byte
+	Limit []byte
+}
+
+// PrefixRange returns the range of the keys that have the prefix.
+func PrefixRange(prefix []byte) Range {
+	var limit []byte
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if c := prefix[i]; c < 0xff {
+			limit = make([]byte, i+1)
+			copy(limit, prefix)
+			limit[i] = c + 1
+			break
+		}
+	}
+	return Range{Start: prefix, Limit: limit}
+}
+
+// A Batch is a list of changes to apply to a Storage at once.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put records that the key should be set to the value.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+// Delete records that the key should be removed.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:    append([]byte(nil), key...),
+		delete: true,
+	})
+}
+
+// Len returns the number of changes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all changes from the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Copy writes all records in src to dst, as of the time Copy is called.
+func Copy(dst, src Storage) error {
+	snap, err := src.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	it := snap.NewIterator(Range{})
+	defer it.Release()
+
+	batch := new(Batch)
+	for it.Next() {
+		batch.Put(it.Key(), it.Value())
+		if batch.Len() > batchFlushSize {
+			if err := dst.Write(batch); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return dst.Write(batch)
+}
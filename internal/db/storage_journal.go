@@ -0,0 +1,470 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// journalStorage is an on disk Storage. All records are kept in memory, as
+// in memoryStorage, and every batch written is appended to a journal file
+// that is replayed when the storage is opened. The journal is rewritten
+// from memory when it has grown to several times the size of the records
+// it holds.
+//
+// The journal is a sequence of entries, one per batch:
+//
+//	length of the data (4 bytes)
+//	CRC32 of the data (4 bytes)
+//	data: a sequence of
+//	    op (1 byte, journalPut or journalDelete)
+//	    key length (uvarint), key
+//	    value length (uvarint), value (journalPut only)
+//
+// An incomplete or damaged entry at the end of the journal, as left by a
+// crash during a write, is discarded. The journal file is locked while it is
+// open, so that it is never used by two processes at once.
+//
+// As all records are kept in memory and the journal is replayed on every
+// open, the journal storage is only suited to small databases. Journals
+// holding more than journalMaxLive bytes of records are refused.
+type journalStorage struct {
+	mem    *memoryStorage
+	path   string
+	fd     *os.File
+	size   int64 // of the journal
+	live   int64 // size of the records in memory
+	err    error // set when a failed write could not be undone
+	warned bool  // about the records growing past journalMaxLive
+	mut    sync.Mutex
+}
+
+const (
+	journalPut    = 1
+	journalDelete = 2
+
+	journalCompactMin    = 4 << 20 // don't compact journals smaller than this
+	journalCompactFactor = 4       // compact when the journal is this many times the size of the records
+	journalCompactEntry  = 1 << 20 // compacted journals are written in entries of about this size
+
+	journalMaxEntry = 1 << 30   // largest entry, and batch, accepted
+	journalMaxLive  = 256 << 20 // largest size of the records of a journal that is opened
+)
+
+var (
+	errJournalEntry  = errors.New("damaged journal entry")
+	errJournalClosed = errors.New("journal storage is closed")
+	errJournalLocked = errors.New("journal is locked by another process")
+	errJournalLarge  = errors.New("batch too large for the journal")
+	errJournalFull   = errors.New("database too large for the journal backend; use leveldb")
+
+	errIncompleteSnapshot = errors.New("incomplete database snapshot")
+)
+
+// OpenJournalStorage opens, or creates, the journal Storage at the path.
+func OpenJournalStorage(path string) (Storage, error) {
+	s := &journalStorage{
+		mem:  newMemoryStorage(),
+		path: path,
+		mut:  sync.NewMutex(),
+	}
+
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockJournal(fd); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	valid, err := readJournal(fd, info.Size(), s.apply)
+	if err != nil && err != errJournalEntry {
+		fd.Close()
+		return nil, err
+	}
+	if s.live > journalMaxLive {
+		fd.Close()
+		return nil, errJournalFull
+	}
+	if err == errJournalEntry {
+		l.Infof("Discarding %d bytes of damaged journal at the end of %s", info.Size()-valid, path)
+		if err := fd.Truncate(valid); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	if _, err := fd.Seek(valid, 0); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	s.fd = fd
+	s.size = valid
+	return s, nil
+}
+
+// readJournal calls fn with the changes of each entry in the journal of the
+// given size, or of unknown size when negative, and returns the length of
+// the part that was read. The error is errJournalEntry if the journal ends
+// with an incomplete or damaged entry.
+func readJournal(r io.Reader, size int64, fn func(ops []batchOp)) (int64, error) {
+	br := bufio.NewReader(r)
+	var valid int64
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return valid, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return valid, errJournalEntry
+		} else if err != nil {
+			return valid, err
+		}
+		// The length is not covered by the CRC, so it is checked before
+		// anything is allocated for it.
+		length := int64(binary.BigEndian.Uint32(hdr[0:]))
+		if length > journalMaxEntry || size >= 0 && length > size-valid-int64(len(hdr)) {
+			return valid, errJournalEntry
+		}
+		data, err := readJournalData(br, length)
+		if err != nil {
+			return valid, err
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:]) {
+			return valid, errJournalEntry
+		}
+		ops, err := decodeJournalEntry(data)
+		if err != nil {
+			return valid, err
+		}
+		fn(ops)
+		valid += int64(len(hdr) + len(data))
+	}
+}
+
+// readJournalData reads length bytes of entry data from r. The buffer grows
+// with the data read, so that the length of a damaged entry in a journal of
+// unknown size does not allocate more than the data there is.
+func readJournalData(r io.Reader, length int64) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, length); err == io.EOF {
+		return nil, errJournalEntry
+	} else if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *journalStorage) Get(key []byte) ([]byte, error) {
+	return s.mem.Get(key)
+}
+
+func (s *journalStorage) NewIterator(r Range) StorageIterator {
+	return s.mem.NewIterator(r)
+}
+
+func (s *journalStorage) NewSnapshot() (Snapshot, error) {
+	return s.mem.NewSnapshot()
+}
+
+func (s *journalStorage) Put(key, value []byte) error {
+	var b Batch
+	b.Put(key, value)
+	return s.Write(&b)
+}
+
+func (s *journalStorage) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return s.Write(&b)
+}
+
+func (s *journalStorage) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.fd == nil {
+		return errJournalClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+
+	entry := encodeJournalEntry(batch.ops)
+	if len(entry) > journalMaxEntry {
+		return errJournalLarge
+	}
+	if _, err := s.fd.Write(entry); err != nil {
+		// Entries after a partial one are lost on replay, so the partial
+		// entry is removed. If that fails too, no more is written.
+		if terr := s.fd.Truncate(s.size); terr != nil {
+			s.err = terr
+		} else if _, serr := s.fd.Seek(s.size, 0); serr != nil {
+			s.err = serr
+		}
+		return err
+	}
+	s.size += int64(len(entry))
+	s.apply(batch.ops)
+
+	if s.live > journalMaxLive && !s.warned {
+		l.Warnf("The database in %s has grown too large for the journal backend and will not open again; use leveldb", s.path)
+		s.warned = true
+	}
+
+	if s.size > journalCompactMin && s.size > journalCompactFactor*s.live {
+		return s.compact()
+	}
+	return nil
+}
+
+// apply applies the changes to the records in memory, keeping track of
+// their size.
+func (s *journalStorage) apply(ops []batchOp) {
+	sizes := make(map[string]int64, len(ops)) // of the keys changed earlier in the batch
+	for _, op := range ops {
+		old, ok := sizes[string(op.key)]
+		if !ok {
+			if v, err := s.mem.Get(op.key); err == nil {
+				old = int64(len(op.key) + len(v))
+			}
+		}
+		var size int64
+		if !op.delete {
+			size = int64(len(op.key) + len(op.value))
+		}
+		s.live += size - old
+		sizes[string(op.key)] = size
+	}
+	s.mem.Write(&Batch{ops: ops})
+}
+
+// compact writes the records in memory to a new journal that replaces the
+// current one. The records are written in entries of a bounded size, as one
+// entry could be too large to allocate, or to hold its length.
+func (s *journalStorage) compact() error {
+	tmp := s.path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockJournal(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	size, err := writeJournal(fd, s.mem.current())
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err != nil {
+		fd.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// The journal must be closed before it can be replaced on Windows.
+	s.fd.Close()
+	if err := osutil.Rename(tmp, s.path); err != nil {
+		fd.Close()
+		s.fd, _ = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if s.fd != nil {
+			lockJournal(s.fd)
+		}
+		return err
+	}
+	if err := osutil.SyncDir(filepath.Dir(s.path)); err != nil {
+		l.Infof("Syncing the directory of %s: %v", s.path, err)
+	}
+
+	s.fd = fd
+	s.size = size
+	return nil
+}
+
+// writeJournal writes all records in the storage to w, as entries of about
+// journalCompactEntry bytes, and returns the number of bytes written.
+func writeJournal(w io.Writer, src Reader) (int64, error) {
+	it := src.NewIterator(Range{})
+	defer it.Release()
+
+	bw := bufio.NewWriter(w)
+	var size int64
+	var ops []batchOp
+	var opsSize int
+	flush := func() error {
+		entry := encodeJournalEntry(ops)
+		ops = ops[:0]
+		opsSize = 0
+		n, err := bw.Write(entry)
+		size += int64(n)
+		return err
+	}
+	for it.Next() {
+		// The key and value are only valid until the next call to Next.
+		ops = append(ops, batchOp{
+			key:   append([]byte(nil), it.Key()...),
+			value: append([]byte(nil), it.Value()...),
+		})
+		opsSize += len(it.Key()) + len(it.Value())
+		if opsSize >= journalCompactEntry {
+			if err := flush(); err != nil {
+				return size, err
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return size, err
+	}
+	if len(ops) > 0 {
+		if err := flush(); err != nil {
+			return size, err
+		}
+	}
+	return size, bw.Flush()
+}
+
+// Compact rewrites the journal to hold only the current records.
+func (s *journalStorage) Compact() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.fd == nil {
+		return errJournalClosed
+	}
+	return s.compact()
+}
+
+func (s *journalStorage) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.fd == nil {
+		return nil
+	}
+	err := s.fd.Close()
+	s.fd = nil
+	return err
+}
+
+// WriteSnapshot writes all records in src, as of the time it is called, to
+// w. The snapshot is in the format of the journal storage; it can be read
+// back with ReadSnapshot, or opened with OpenJournalStorage. It ends with an
+// empty entry, which journals never otherwise have, so that a snapshot cut
+// short between two entries is not taken as complete.
+func WriteSnapshot(w io.Writer, src Storage) error {
+	snap, err := src.NewSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	if _, err := writeJournal(w, snap); err != nil {
+		return err
+	}
+	_, err = w.Write(encodeJournalEntry(nil))
+	return err
+}
+
+// ReadSnapshot writes the records in the snapshot read from r to dst. An
+// error is returned if the snapshot is incomplete or damaged, in which case
+// some of the records may have been written.
+func ReadSnapshot(r io.Reader, dst Storage) error {
+	var werr error
+	complete := false
+	_, err := readJournal(r, -1, func(ops []batchOp) {
+		complete = len(ops) == 0
+		if werr == nil {
+			werr = dst.Write(&Batch{ops: ops})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	if !complete {
+		return errIncompleteSnapshot
+	}
+	return nil
+}
+
+func encodeJournalEntry(ops []batchOp) []byte {
+	buf := make([]byte, 8, 8+len(ops)*32)
+	var tmp [binary.MaxVarintLen64]byte
+	for _, op := range ops {
+		if op.delete {
+			buf = append(buf, journalDelete)
+		} else {
+			buf = append(buf, journalPut)
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.key)))]...)
+		buf = append(buf, op.key...)
+		if !op.delete {
+			buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.value)))]...)
+			buf = append(buf, op.value...)
+		}
+	}
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(buf)-8))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+func decodeJournalEntry(data []byte) ([]batchOp, error) {
+	var ops []batchOp
+	for len(data) > 0 {
+		op := data[0]
+		data = data[1:]
+
+		key, rest, err := journalBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch op {
+		case journalDelete:
+			ops = append(ops, batchOp{key: key, delete: true})
+		case journalPut:
+			value, rest, err := journalBytes(data)
+			if err != nil {
+				return nil, err
+			}
+			data = rest
+			ops = append(ops, batchOp{key: key, value: value})
+		default:
+			return nil, errJournalEntry
+		}
+	}
+	return ops, nil
+}
+
+// journalBytes returns the length prefixed byte slice at the start of data,
+// and what follows it.
+func journalBytes(data []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return nil, nil, errJournalEntry
+	}
+	return data[n : n+int(length)], data[n+int(length):], nil
+}
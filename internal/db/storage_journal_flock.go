@@ -0,0 +1,24 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux android darwin freebsd dragonfly netbsd openbsd
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockJournal takes an exclusive lock on the journal file, which is held
+// until the file is closed. It fails if another process holds the lock.
+func lockJournal(fd *os.File) error {
+	err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errJournalLocked
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!android,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd,!windows
+
+package db
+
+import "os"
+
+// lockJournal does nothing, as file locks are not supported on this
+// platform.
+func lockJournal(fd *os.File) error {
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// lockJournal takes an exclusive lock on the journal file, which is held
+// until the file is closed. It fails if another process holds the lock.
+// The lock covers the last possible byte of the file rather than its
+// contents, as locked ranges cannot be read through other handles.
+func lockJournal(fd *os.File) error {
+	var ol syscall.Overlapped
+	ol.Offset = 0xfffffffe
+	ol.OffsetHigh = 0x7fffffff
+	r, _, err := procLockFileEx.Call(fd.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errLockViolation {
+		return errJournalLocked
+	}
+	return err
+}
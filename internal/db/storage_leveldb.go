@@ -0,0 +1,108 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDBStorage is the default Storage, a goleveldb database.
+type levelDBStorage struct {
+	db *leveldb.DB
+}
+
+// NewLevelDBStorage returns a Storage using the already open database.
+func NewLevelDBStorage(ldb *leveldb.DB) Storage {
+	return levelDBStorage{ldb}
+}
+
+// OpenLevelDB opens, or creates, the database at the path. A corrupted
+// database is recovered.
+func OpenLevelDB(path string, opts *opt.Options) (Storage, error) {
+	ldb, err := leveldb.OpenFile(path, opts)
+	if err != nil && errors.IsCorrupted(err) {
+		ldb, err = leveldb.RecoverFile(path, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return levelDBStorage{ldb}, nil
+}
+
+func (s levelDBStorage) Get(key []byte) ([]byte, error) {
+	return levelDBGet(s.db, key)
+}
+
+func (s levelDBStorage) NewIterator(r Range) StorageIterator {
+	return s.db.NewIterator(&util.Range{Start: r.Start, Limit: r.Limit}, nil)
+}
+
+func (s levelDBStorage) Put(key, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+func (s levelDBStorage) Delete(key []byte) error {
+	return s.db.Delete(key, nil)
+}
+
+func (s levelDBStorage) Write(batch *Batch) error {
+	lb := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			lb.Delete(op.key)
+		} else {
+			lb.Put(op.key, op.value)
+		}
+	}
+	return s.db.Write(lb, nil)
+}
+
+func (s levelDBStorage) NewSnapshot() (Snapshot, error) {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return levelDBSnapshot{snap}, nil
+}
+
+// Compact compacts the whole database.
+func (s levelDBStorage) Compact() error {
+	return s.db.CompactRange(util.Range{})
+}
+
+func (s levelDBStorage) Close() error {
+	return s.db.Close()
+}
+
+type levelDBSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s levelDBSnapshot) Get(key []byte) ([]byte, error) {
+	return levelDBGet(s.snap, key)
+}
+
+func (s levelDBSnapshot) NewIterator(r Range) StorageIterator {
+	return s.snap.NewIterator(&util.Range{Start: r.Start, Limit: r.Limit}, nil)
+}
+
+func (s levelDBSnapshot) Release() {
+	s.snap.Release()
+}
+
+func levelDBGet(r interface {
+	Get([]byte, *opt.ReadOptions) ([]byte, error)
+}, key []byte) ([]byte, error) {
+	bs, err := r.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return bs, err
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"hash/fnv"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// memoryStorage is a Storage that keeps everything in memory. The records
+// are kept in a treap that is never modified in place; a write copies the
+// path to each changed node, and a snapshot is just the root at the time it
+// was taken.
+type memoryStorage struct {
+	root *memoryNode
+	mut  sync.RWMutex
+}
+
+type memoryNode struct {
+	key         []byte
+	value       []byte
+	prio        uint32
+	left, right *memoryNode
+}
+
+// NewMemoryStorage returns a new, empty, Storage that lives in memory.
+func NewMemoryStorage() Storage {
+	return newMemoryStorage()
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		mut: sync.NewRWMutex(),
+	}
+}
+
+func (s *memoryStorage) current() memorySnapshot {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return memorySnapshot{s.root}
+}
+
+func (s *memoryStorage) Get(key []byte) ([]byte, error) {
+	return s.current().Get(key)
+}
+
+func (s *memoryStorage) NewIterator(r Range) StorageIterator {
+	return s.current().NewIterator(r)
+}
+
+func (s *memoryStorage) Put(key, value []byte) error {
+	var b Batch
+	b.Put(key, value)
+	return s.Write(&b)
+}
+
+func (s *memoryStorage) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return s.Write(&b)
+}
+
+func (s *memoryStorage) Write(batch *Batch) error {
+	s.mut.Lock()
+	root := s.root
+	for _, op := range batch.ops {
+		if op.delete {
+			root = root.remove(op.key)
+		} else {
+			root = root.insert(op.key, op.value, memoryPriority(op.key))
+		}
+	}
+	s.root = root
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *memoryStorage) NewSnapshot() (Snapshot, error) {
+	return s.current(), nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+// memoryPriority returns the treap priority of the key. A hash keeps the
+// tree balanced as long as the keys don't conspire against it.
+func memoryPriority(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+// insert returns the tree with the key set to the value.
+func (n *memoryNode) insert(key, value []byte, prio uint32) *memoryNode {
+	if n == nil {
+		return &memoryNode{key: key, value: value, prio: prio}
+	}
+
+	c := *n
+	switch cmp := bytes.Compare(key, n.key); {
+	case cmp == 0:
+		c.value = value
+	case cmp < 0:
+		c.left = n.left.insert(key, value, prio)
+		if c.left.prio > c.prio {
+			// Rotate right; both nodes are fresh copies.
+			l := c.left
+			c.left = l.right
+			l.right = &c
+			return l
+		}
+	default:
+		c.right = n.right.insert(key, value, prio)
+		if c.right.prio > c.prio {
+			// Rotate left
+			r := c.right
+			c.right = r.left
+			r.left = &c
+			return r
+		}
+	}
+	return &c
+}
+
+// remove returns the tree without the key.
+func (n *memoryNode) remove(key []byte) *memoryNode {
+	if n == nil {
+		return nil
+	}
+
+	switch cmp := bytes.Compare(key, n.key); {
+	case cmp == 0:
+		return memoryMerge(n.left, n.right)
+	case cmp < 0:
+		l := n.left.remove(key)
+		if l == n.left {
+			return n // not found
+		}
+		c := *n
+		c.left = l
+		return &c
+	default:
+		r := n.right.remove(key)
+		if r == n.right {
+			return n
+		}
+		c := *n
+		c.right = r
+		return &c
+	}
+}
+
+// memoryMerge returns the tree with the nodes of both trees, where all keys
+// in a are less than those in b.
+func memoryMerge(a, b *memoryNode) *memoryNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.prio > b.prio:
+		c := *a
+		c.right = memoryMerge(a.right, b)
+		return &c
+	default:
+		c := *b
+		c.left = memoryMerge(a, b.left)
+		return &c
+	}
+}
+
+type memorySnapshot struct {
+	root *memoryNode
+}
+
+func (s memorySnapshot) Get(key []byte) ([]byte, error) {
+	n := s.root
+	for n != nil {
+		switch cmp := bytes.Compare(key, n.key); {
+		case cmp == 0:
+			return n.value, nil
+		case cmp < 0:
+			n = n.left
+		default:
+			n = n.right
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s memorySnapshot) NewIterator(r Range) StorageIterator {
+	it := &memoryIterator{limit: r.Limit}
+
+	// Stack the path to the first key in the range.
+	n := s.root
+	for n != nil {
+		if r.Start == nil || bytes.Compare(n.key, r.Start) >= 0 {
+			it.stack = append(it.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return it
+}
+
+func (s memorySnapshot) Release() {}
+
+// memoryIterator walks the tree in order. The stack holds the nodes whose
+// key and right subtree remain to be visited.
+type memoryIterator struct {
+	stack []*memoryNode
+	cur   *memoryNode
+	limit []byte
+}
+
+func (it *memoryIterator) Next() bool {
+	if len(it.stack) == 0 {
+		it.cur = nil
+		return false
+	}
+
+	it.cur = it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	if it.limit != nil && bytes.Compare(it.cur.key, it.limit) >= 0 {
+		it.cur = nil
+		it.stack = nil
+		return false
+	}
+
+	for n := it.cur.right; n != nil; n = n.left {
+		it.stack = append(it.stack, n)
+	}
+	return true
+}
+
+func (it *memoryIterator) Key() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.key
+}
+
+func (it *memoryIterator) Value() []byte {
+	if it.cur == nil {
+		return nil
+	}
+	return it.cur.value
+}
+
+func (it *memoryIterator) Error() error {
+	return nil
+}
+
+func (it *memoryIterator) Release() {
+	it.cur = nil
+	it.stack = nil
+}
@@ -0,0 +1,622 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// The tests in this package run once for each storage backend. The backend
+// is selected by STTESTDBBACKEND; when it is unset the tests run against
+// leveldb, and then the test binary is run again for each of the others.
+var (
+	testBackends = []string{"leveldb", "memory", "journal"}
+	testBackend  = os.Getenv("STTESTDBBACKEND")
+	testDir      string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	testDir, err = ioutil.TempDir("", "syncthing-db-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if testBackend != "" {
+		ret := m.Run()
+		os.RemoveAll(testDir)
+		os.Exit(ret)
+	}
+
+	testBackend = testBackends[0]
+	ret := m.Run()
+	os.RemoveAll(testDir)
+
+	for _, backend := range testBackends[1:] {
+		fmt.Printf("Testing with the %s backend\n", backend)
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), "STTESTDBBACKEND="+backend)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			ret = 1
+		}
+	}
+
+	os.Exit(ret)
+}
+
+// OpenTestStorage returns a new, empty, Storage of the backend under test.
+func OpenTestStorage() (Storage, error) {
+	switch testBackend {
+	case "leveldb":
+		ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return NewLevelDBStorage(ldb), nil
+	case "memory":
+		return NewMemoryStorage(), nil
+	case "journal":
+		dir, err := ioutil.TempDir(testDir, "")
+		if err != nil {
+			return nil, err
+		}
+		return OpenJournalStorage(filepath.Join(dir, "journal"))
+	default:
+		return nil, fmt.Errorf("unknown backend %q", testBackend)
+	}
+}
+
+func storageKeys(t *testing.T, r Reader, rng Range) []string {
+	it := r.NewIterator(rng)
+	defer it.Release()
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key())+"="+string(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestStorageOperations(t *testing.T) {
+	s, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Get([]byte("a")); err != ErrNotFound {
+		t.Errorf("Get on empty storage returned %v, not ErrNotFound", err)
+	}
+
+	for _, k := range []string{"b", "a", "ab", "c", "\xff", "\xff\xff"} {
+		if err := s.Put([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete([]byte("nonexistent")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := s.Get([]byte("ab")); err != nil || string(v) != "ab" {
+		t.Errorf("Get(ab) returned %q, %v", v, err)
+	}
+	if _, err := s.Get([]byte("c")); err != ErrNotFound {
+		t.Errorf("Get on deleted key returned %v, not ErrNotFound", err)
+	}
+
+	tests := []struct {
+		rng  Range
+		keys []string
+	}{
+		{Range{}, []string{"a=a", "ab=ab", "b=b", "\xff=\xff", "\xff\xff=\xff\xff"}},
+		{Range{Start: []byte("ab")}, []string{"ab=ab", "b=b", "\xff=\xff", "\xff\xff=\xff\xff"}},
+		{Range{Start: []byte("aa"), Limit: []byte("b")}, []string{"ab=ab"}},
+		{Range{Limit: []byte("a")}, nil},
+		{PrefixRange([]byte("a")), []string{"a=a", "ab=ab"}},
+		{PrefixRange([]byte("\xff")), []string{"\xff=\xff", "\xff\xff=\xff\xff"}},
+		{PrefixRange([]byte("x")), nil},
+	}
+	for i, tc := range tests {
+		if keys := storageKeys(t, s, tc.rng); fmt.Sprint(keys) != fmt.Sprint(tc.keys) {
+			t.Errorf("%d: iterated %q, expected %q", i, keys, tc.keys)
+		}
+	}
+}
+
+func TestStorageBatch(t *testing.T) {
+	s, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put([]byte("a"), []byte("1"))
+	s.Put([]byte("b"), []byte("1"))
+
+	key := []byte("c")
+	val := []byte("1")
+	var b Batch
+	b.Put(key, val)
+	b.Delete([]byte("a"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Put([]byte("b"), []byte("3"))
+	b.Put([]byte("d"), []byte("1"))
+	b.Delete([]byte("d"))
+
+	// The batch keeps its own copy of keys and values
+	key[0] = 'x'
+	val[0] = 'x'
+
+	if b.Len() != 6 {
+		t.Errorf("batch length %d != 6", b.Len())
+	}
+	if err := s.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"b=3", "c=1"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("iterated %q, expected %q", keys, expected)
+	}
+
+	b.Reset()
+	if b.Len() != 0 {
+		t.Errorf("batch length %d != 0 after reset", b.Len())
+	}
+}
+
+func TestStorageSnapshot(t *testing.T) {
+	s, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put([]byte("a"), []byte("1"))
+	s.Put([]byte("b"), []byte("1"))
+
+	snap, err := s.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Release()
+
+	s.Put([]byte("a"), []byte("2"))
+	s.Delete([]byte("b"))
+	s.Put([]byte("c"), []byte("2"))
+
+	if v, err := snap.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("snapshot Get(a) returned %q, %v", v, err)
+	}
+	if _, err := snap.Get([]byte("c")); err != ErrNotFound {
+		t.Errorf("snapshot Get(c) returned %v, not ErrNotFound", err)
+	}
+	expected := []string{"a=1", "b=1"}
+	if keys := storageKeys(t, snap, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("snapshot iterated %q, expected %q", keys, expected)
+	}
+	expected = []string{"a=2", "c=2"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("storage iterated %q, expected %q", keys, expected)
+	}
+}
+
+func TestMemoryStorageMany(t *testing.T) {
+	s := NewMemoryStorage()
+
+	// Insert in an order that is neither sorted nor reverse sorted, then
+	// delete every other key.
+	const n = 10000
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("%05d", (i*7919)%n))
+		s.Put(k, k)
+	}
+	for i := 0; i < n; i += 2 {
+		s.Delete([]byte(fmt.Sprintf("%05d", i)))
+	}
+
+	it := s.NewIterator(Range{})
+	i := 1
+	for it.Next() {
+		if k := fmt.Sprintf("%05d", i); string(it.Key()) != k || string(it.Value()) != k {
+			t.Fatalf("iterated %q=%q, expected %q", it.Key(), it.Value(), k)
+		}
+		i += 2
+	}
+	it.Release()
+	if i != n+1 {
+		t.Errorf("iterated %d keys, expected %d", i/2, n/2)
+	}
+}
+
+func TestJournalStorageReopen(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put([]byte("a"), []byte("1"))
+	s.Put([]byte("b"), []byte("1"))
+	var b Batch
+	b.Delete([]byte("a"))
+	b.Put([]byte("c"), []byte("1"))
+	s.Write(&b)
+	s.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := info.Size()
+
+	// Simulate a crash in the middle of writing a batch by appending an
+	// incomplete entry.
+	partial := encodeJournalEntry([]batchOp{{key: []byte("d"), value: []byte("1")}})
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write(partial[:len(partial)-1])
+	fd.Close()
+
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"b=1", "c=1"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("iterated %q after reopen, expected %q", keys, expected)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != complete {
+		t.Errorf("damaged entry not discarded; size %d != %d", info.Size(), complete)
+	}
+
+	// Writes after the damaged entry was discarded are kept
+	s.Put([]byte("e"), []byte("1"))
+	s.Close()
+
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expected = []string{"b=1", "c=1", "e=1"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("iterated %q after second reopen, expected %q", keys, expected)
+	}
+}
+
+func TestJournalStorageDamagedLength(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put([]byte("a"), []byte("1"))
+	s.Close()
+
+	// An entry claiming far more data than the journal holds
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, journalPut})
+	fd.Close()
+
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expected := []string{"a=1"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("iterated %q after reopen, expected %q", keys, expected)
+	}
+
+	// The same in a snapshot, whose size is not known up front
+	snap := append(encodeJournalEntry([]batchOp{{key: []byte("b"), value: []byte("1")}}), 0x3f, 0xff, 0xff, 0xf0, 0, 0, 0, 0, journalPut)
+	if err := ReadSnapshot(bytes.NewReader(snap), newMemoryStorage()); err != errJournalEntry {
+		t.Errorf("reading a damaged snapshot returned %v, expected %v", err, errJournalEntry)
+	}
+}
+
+func TestJournalStorageFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put([]byte("a"), []byte("1"))
+
+	// A journal that can neither be written nor truncated
+	js := s.(*journalStorage)
+	js.fd.Close()
+	js.fd, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put([]byte("b"), []byte("1")); err == nil {
+		t.Fatal("write to a read only journal succeeded")
+	}
+	if js.err == nil {
+		t.Error("storage not failed after a write that could not be undone")
+	}
+	if err := s.Put([]byte("c"), []byte("1")); err != js.err {
+		t.Errorf("write to a failed journal returned %v, expected %v", err, js.err)
+	}
+	s.Close()
+
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	expected := []string{"a=1"}
+	if keys := storageKeys(t, s, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("iterated %q after reopen, expected %q", keys, expected)
+	}
+}
+
+func TestJournalStorageCompact(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the same few keys until the journal is far larger than
+	// what it holds, so that it gets compacted.
+	val := bytes.Repeat([]byte{'x'}, 1024)
+	for i := 0; i < 2*journalCompactMin/len(val); i++ {
+		s.Put([]byte(fmt.Sprintf("%02d", i%10)), val)
+	}
+	s.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > journalCompactMin {
+		t.Errorf("journal not compacted; size %d", info.Size())
+	}
+
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if keys := storageKeys(t, s, Range{}); len(keys) != 10 {
+		t.Errorf("%d keys after compaction, expected 10", len(keys))
+	}
+}
+
+func TestJournalStorageCompactEntries(t *testing.T) {
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val := bytes.Repeat([]byte{'x'}, 1024)
+	n := 3 * journalCompactEntry / len(val)
+	var b Batch
+	for i := 0; i < n; i++ {
+		b.Put([]byte(fmt.Sprintf("%05d", i)), val)
+	}
+	s.Write(&b)
+	if err := s.(Compacter).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The compacted journal holds the records in several bounded entries
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, keys := 0, 0
+	_, err = readJournal(fd, -1, func(ops []batchOp) {
+		entries++
+		keys += len(ops)
+	})
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries < 3 || keys != n {
+		t.Errorf("compacted journal has %d keys in %d entries, expected %d keys in at least 3", keys, entries, n)
+	}
+}
+
+func TestJournalStorageLocked(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		t.Skip("journal locking not tested on", runtime.GOOS)
+	}
+
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal")
+
+	s, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournalStorage(path); err != errJournalLocked {
+		t.Errorf("opening a journal in use returned %v, expected %v", err, errJournalLocked)
+	}
+
+	// The compacted journal is locked as well
+	s.Put([]byte("a"), []byte("1"))
+	if err := s.(Compacter).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournalStorage(path); err != errJournalLocked {
+		t.Errorf("opening a compacted journal in use returned %v, expected %v", err, errJournalLocked)
+	}
+
+	s.Close()
+	s, err = OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestSnapshotRoundtrip(t *testing.T) {
+	src, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var expected []string
+	for i := 0; i < 3*batchFlushSize; i++ {
+		k := fmt.Sprintf("%04d", i)
+		src.Put([]byte(k), []byte(k))
+		expected = append(expected, k+"="+k)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := ReadSnapshot(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+	if keys := storageKeys(t, dst, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("restored %d keys, expected %d", len(keys), len(expected))
+	}
+
+	// The snapshot can be opened as a journal
+
+	dir, err := ioutil.TempDir(testDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "snapshot")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	js, err := OpenJournalStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.Close()
+	if keys := storageKeys(t, js, Range{}); fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("journal has %d keys, expected %d", len(keys), len(expected))
+	}
+}
+
+func TestSnapshotIncomplete(t *testing.T) {
+	src, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	src.Put([]byte("a"), []byte("1"))
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	bs := buf.Bytes()
+	marker := len(encodeJournalEntry(nil))
+
+	for _, cut := range []int{len(bs) - marker, len(bs) - marker - 1, 4} {
+		dst, err := OpenTestStorage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ReadSnapshot(bytes.NewReader(bs[:cut]), dst); err == nil {
+			t.Errorf("unexpected nil error reading snapshot cut at %d of %d bytes", cut, len(bs))
+		}
+		dst.Close()
+	}
+}
+
+func TestStorageCompact(t *testing.T) {
+	s, err := OpenTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, ok := s.(Compacter)
+	if !ok {
+		t.Skipf("the %s backend does not compact", testBackend)
+	}
+
+	for i := 0; i < 1000; i++ {
+		s.Put([]byte(fmt.Sprintf("%03d", i%100)), []byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 100; i += 2 {
+		s.Delete([]byte(fmt.Sprintf("%03d", i)))
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := storageKeys(t, s, Range{})
+	if len(keys) != 50 {
+		t.Fatalf("%d keys after compaction, expected 50", len(keys))
+	}
+	for i, k := range keys {
+		if e := fmt.Sprintf("%03d=%d", 2*i+1, 900+2*i+1); k != e {
+			t.Errorf("%q after compaction, expected %q", k, e)
+		}
+	}
+}
@@ -13,7 +13,17 @@ type FileInfoTruncated struct {
 	ActualSize int64
 }
 
+// UnmarshalXDR decodes a file record from the database, without reading the
+// block list.
 func (f *FileInfoTruncated) UnmarshalXDR(bs []byte) error {
+	if len(bs) > 0 && bs[0] == fileRecordFormat {
+		var rec fileRecord
+		err := rec.UnmarshalXDR(bs[1:])
+		f.FileInfo = rec.fileInfo()
+		f.ActualSize = rec.size
+		return err
+	}
+
 	err := f.FileInfo.UnmarshalXDR(bs)
 	f.ActualSize = f.FileInfo.Size()
 	f.FileInfo.Blocks = nil
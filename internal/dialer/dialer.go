@@ -0,0 +1,244 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package dialer dials outgoing TCP connections, either directly or through
+// a SOCKS5 or HTTP(S) CONNECT proxy.
+package dialer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The time allowed for connecting to and negotiating with the proxy.
+const proxyTimeout = 30 * time.Second
+
+// The ports of proxies given without one, by scheme. These are also the
+// supported schemes.
+var defaultProxyPorts = map[string]string{
+	"socks5":  "1080",
+	"socks5h": "1080", // SOCKS5 resolving host names at the proxy, as we always do
+	"http":    "80",
+	"https":   "443", // HTTP CONNECT over TLS to the proxy
+}
+
+// A Dialer dials outgoing connections, going through a proxy when one is
+// configured. The zero Dialer dials directly.
+type Dialer struct {
+	proxy    *url.URL // nil for direct connections
+	noProxy  []string // hosts, domains and networks to dial directly
+	fallback bool     // dial directly when the proxy fails
+
+	clientOnce sync.Once
+	client     *http.Client // returned by HTTPClient
+}
+
+// New returns a Dialer for the given proxy, which should be an URL of the
+// form "scheme://[user:pass@]host[:port]", with a scheme of socks5, socks5h,
+// http or https. When proxy is empty it is taken from the ALL_PROXY,
+// HTTPS_PROXY or HTTP_PROXY environment variables, in that order, and the
+// hosts listed in NO_PROXY are dialed directly; a proxy from the environment
+// that can't be used is warned about and connections are dialed directly.
+// If fallback is set, connections that can't be established through the
+// proxy are attempted directly instead.
+func New(proxy string, fallback bool) (*Dialer, error) {
+	d := &Dialer{
+		fallback: fallback,
+	}
+
+	if proxy != "" {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			return nil, err
+		}
+		d.proxy = u
+		return d, nil
+	}
+
+	for _, host := range strings.Split(getenv("NO_PROXY"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			d.noProxy = append(d.noProxy, host)
+		}
+	}
+	if proxy = getenv("ALL_PROXY", "HTTPS_PROXY", "HTTP_PROXY"); proxy != "" {
+		u, err := parseProxy(proxy)
+		if err != nil {
+			l.Warnln("Ignoring the proxy set in the environment, dialing directly:", err)
+			return d, nil
+		}
+		d.proxy = u
+	}
+	return d, nil
+}
+
+// parseProxy parses the proxy URL, filling in the default port of the
+// scheme when there is none.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		// Plain "host:port", as often seen in the environment variables.
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	defPort, ok := defaultProxyPorts[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = strings.Trim(u.Host, "[]"), ""
+	}
+	if host == "" {
+		return nil, fmt.Errorf("proxy address %q has no host", u.Host)
+	}
+	if port == "" {
+		port = defPort
+	}
+	u.Host = net.JoinHostPort(host, port)
+	return u, nil
+}
+
+// Proxy returns the address of the proxy, or the empty string when dialing
+// directly.
+func (d *Dialer) Proxy() string {
+	if d.proxy == nil {
+		return ""
+	}
+	return d.proxy.Scheme + "://" + d.proxy.Host
+}
+
+// Dial connects to the given address. Only TCP networks go through the
+// proxy.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	if !d.useProxy(network, addr) {
+		return net.Dial(network, addr)
+	}
+
+	conn, err := d.dialProxy(network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	if debug {
+		l.Debugf("dial %s via %s: %v", addr, d.Proxy(), err)
+	}
+	if d.fallback {
+		return net.Dial(network, addr)
+	}
+	return nil, err
+}
+
+// HTTPClient returns the HTTP client that makes its connections through the
+// dialer. The same client, and its idle connections, is returned on every
+// call.
+func (d *Dialer) HTTPClient() *http.Client {
+	d.clientOnce.Do(func() {
+		d.client = &http.Client{
+			Transport: &http.Transport{
+				Dial:                d.Dial,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		}
+	})
+	return d.client
+}
+
+func (d *Dialer) dialProxy(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, d.proxy.Host, proxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if d.proxy.Scheme == "https" {
+		host, _, _ := net.SplitHostPort(d.proxy.Host)
+		tc := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(conn, addr, d.proxy.User)
+	case "http", "https":
+		err = httpConnect(conn, addr, d.proxy.User)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if debug {
+		l.Debugf("connected to %s via %s", addr, d.Proxy())
+	}
+	return conn, nil
+}
+
+func (d *Dialer) useProxy(network, addr string) bool {
+	if d.proxy == nil {
+		return false
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, np := range d.noProxy {
+		if np == "*" {
+			return false
+		}
+		if _, ipnet, err := net.ParseCIDR(np); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		np = strings.ToLower(np)
+		if h, _, err := net.SplitHostPort(np); err == nil {
+			np = h
+		}
+		if host == np || strings.HasSuffix(host, "."+strings.TrimPrefix(np, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getenv returns the value of the first of the given environment variables
+// that is set, in either upper or lower case.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if v := os.Getenv(strings.ToLower(name)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, from RFC 1928 and RFC 1929
+const (
+	socks5Version        = 5
+	socks5AuthNone       = 0
+	socks5AuthPassword   = 2
+	socks5CmdConnect     = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5PasswordVer    = 1
+	socks5ReplySucceeded = 0
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect to
+// addr.
+func socks5Connect(conn net.Conn, addr string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("socks5: bad port %q", portStr)
+	}
+
+	// Method negotiation
+	methods := []byte{socks5AuthNone}
+	if user != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	req := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", resp[0])
+	}
+	switch resp[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		if err := socks5Authenticate(conn, user); err != nil {
+			return err
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	// The connect request
+	req = []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name %q too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply, which ends with the bound address that we don't care about
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected protocol version %d", hdr[0])
+	}
+	if rep := int(hdr[1]); rep != socks5ReplySucceeded {
+		if rep < len(socks5Errors) {
+			return fmt.Errorf("socks5: %s", socks5Errors[rep])
+		}
+		return fmt.Errorf("socks5: unknown error %d", rep)
+	}
+
+	var skip int
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		skip = net.IPv4len
+	case socks5AddrIPv6:
+		skip = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", hdr[3])
+	}
+	bound := make([]byte, skip+2)
+	_, err = io.ReadFull(conn, bound)
+	return err
+}
+
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) error {
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return errors.New("socks5: user name or password too long")
+	}
+
+	req := []byte{socks5PasswordVer, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn to connect to
+// addr using the CONNECT method.
+func httpConnect(conn net.Conn, addr string, user *url.Userinfo) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		fmt.Fprintf(&buf, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	buf.WriteString("\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// Read the response header one byte at a time, as anything after it
+	// belongs to the tunneled connection and must not end up in a buffer.
+	hdr, err := readHeader(conn)
+	if err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(hdr)), nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http proxy: %s", resp.Status)
+	}
+	return nil
+}
+
+// The longest response header we accept from an HTTP proxy
+const maxHeaderLen = 8192
+
+func readHeader(r io.Reader) ([]byte, error) {
+	var hdr []byte
+	var b [1]byte
+	for len(hdr) < maxHeaderLen {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, b[0])
+		if bytes.HasSuffix(hdr, []byte("\r\n\r\n")) {
+			return hdr, nil
+		}
+	}
+	return nil, errors.New("http proxy: response header too long")
+}
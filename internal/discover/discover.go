@@ -18,6 +18,7 @@ import (
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/beacon"
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/sync"
 )
@@ -38,8 +39,9 @@ type Discoverer struct {
 	registry     map[protocol.DeviceID][]CacheEntry
 	lastLookup   map[protocol.DeviceID]time.Time
 
-	clients []Client
-	mut     sync.RWMutex
+	clients       []Client
+	globalServers []string // nil when global discovery is stopped
+	mut           sync.RWMutex
 }
 
 type CacheEntry struct {
@@ -143,6 +145,7 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	}
 
 	d.extPort = extPort
+	d.globalServers = servers
 	pkt := d.announcementPkt()
 	wg := sync.NewWaitGroup()
 	clients := make(chan Client, len(servers))
@@ -178,6 +181,54 @@ func (d *Discoverer) stopGlobal() {
 		client.Stop()
 	}
 	d.clients = []Client{}
+	d.globalServers = nil
+}
+
+// SetExternalPort sets the port to announce, as set up by a port mapping
+// on the gateway. The global announcements are restarted if they are
+// running and the port has changed.
+func (d *Discoverer) SetExternalPort(port uint16) {
+	d.mut.Lock()
+	changed := port != d.extPort
+	d.extPort = port
+	servers := d.globalServers
+	d.mut.Unlock()
+
+	if changed && servers != nil {
+		d.StartGlobal(servers, port)
+	}
+}
+
+// Changed implements config.Handler. Changes to the listen addresses and the
+// global discovery settings are applied immediately. Local discovery
+// settings require a restart.
+func (d *Discoverer) Changed(cfg config.Configuration) error {
+	opts := cfg.Options
+
+	d.mut.Lock()
+	addrsChanged := !stringsEqual(d.listenAddrs, opts.ListenAddress)
+	extPort := d.extPort
+	if addrsChanged && extPort == firstPort(d.listenAddrs) {
+		// The external port is the same as the local one, i.e. there is
+		// no port mapping in place. Follow the change.
+		extPort = firstPort(opts.ListenAddress)
+		d.extPort = extPort
+	}
+	d.listenAddrs = opts.ListenAddress
+	running := d.globalServers != nil
+	serversChanged := !stringsEqual(d.globalServers, opts.GlobalAnnServers)
+	d.mut.Unlock()
+
+	switch {
+	case !opts.GlobalAnnEnabled && running:
+		l.Infoln("Stopping global discovery announcements")
+		d.StopGlobal()
+	case opts.GlobalAnnEnabled && (!running || serversChanged || addrsChanged):
+		l.Infoln("Starting global discovery announcements")
+		d.StartGlobal(opts.GlobalAnnServers, extPort)
+	}
+
+	return nil
 }
 
 func (d *Discoverer) ExtAnnounceOK() map[string]bool {
@@ -313,15 +364,19 @@ func (d *Discoverer) announcementPkt() *Announce {
 }
 
 func (d *Discoverer) sendLocalAnnouncements() {
-	var addrs = resolveAddrs(d.listenAddrs)
-
-	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
-	}
-	msg := pkt.MustMarshalXDR()
-
 	for {
+		// The listen addresses may change at runtime, so the packet is
+		// rebuilt for every announcement.
+		d.mut.RLock()
+		addrs := resolveAddrs(d.listenAddrs)
+		d.mut.RUnlock()
+
+		pkt := Announce{
+			Magic: AnnouncementMagic,
+			This:  Device{d.myID[:], addrs},
+		}
+		msg := pkt.MustMarshalXDR()
+
 		for _, b := range d.beacons {
 			b.Send(msg)
 		}
@@ -458,3 +513,28 @@ func resolveAddrs(addrs []string) []Address {
 	}
 	return raddrs
 }
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// firstPort returns the port of the first of the given listen addresses, or
+// zero if there is no such port.
+func firstPort(addrs []string) uint16 {
+	if len(addrs) == 0 {
+		return 0
+	}
+	addr, err := net.ResolveTCPAddr("tcp", addrs[0])
+	if err != nil {
+		return 0
+	}
+	return uint16(addr.Port)
+}
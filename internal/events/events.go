@@ -35,6 +35,9 @@ const (
 	DownloadProgress
 	FolderSummary
 	FolderCompletion
+	FolderErrors
+	FolderScrubProgress
+	FileCorrupted
 
 	AllEvents = (1 << iota) - 1
 )
@@ -75,6 +78,12 @@ func (t EventType) String() string {
 		return "FolderSummary"
 	case FolderCompletion:
 		return "FolderCompletion"
+	case FolderErrors:
+		return "FolderErrors"
+	case FolderScrubProgress:
+		return "FolderScrubProgress"
+	case FileCorrupted:
+		return "FileCorrupted"
 	default:
 		return "Unknown"
 	}
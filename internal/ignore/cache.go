@@ -14,7 +14,7 @@ type cache struct {
 }
 
 type cacheEntry struct {
-	value  bool
+	value  Result
 	access time.Time
 }
 
@@ -33,7 +33,7 @@ func (c *cache) clean(d time.Duration) {
 	}
 }
 
-func (c *cache) get(key string) (result, ok bool) {
+func (c *cache) get(key string) (result Result, ok bool) {
 	res, ok := c.entries[key]
 	if ok {
 		res.access = time.Now()
@@ -42,7 +42,7 @@ func (c *cache) get(key string) (result, ok bool) {
 	return res.value, ok
 }
 
-func (c *cache) set(key string, val bool) {
+func (c *cache) set(key string, val Result) {
 	c.entries[key] = cacheEntry{val, time.Now()}
 }
 
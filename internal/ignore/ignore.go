@@ -23,19 +23,58 @@ import (
 )
 
 type Pattern struct {
-	match   *regexp.Regexp
-	include bool
+	match     *regexp.Regexp
+	include   bool
+	deletable bool // the (?d) prefix; see Result.IsDeletable
+	origin    Origin
+}
+
+// The Origin of a pattern is the line of the ignore file it was read from.
+type Origin struct {
+	File string `json:"file"`
+	Line int    `json:"line"` // starting at 1
+	Text string `json:"text"` // the line as written
+}
+
+func (o Origin) String() string {
+	return fmt.Sprintf("%s:%d", o.File, o.Line)
 }
 
 func (p Pattern) String() string {
-	if p.include {
-		return p.match.String()
+	ret := p.match.String()
+	if !p.include {
+		ret = "(?exclude)" + ret
+	}
+	if p.deletable {
+		ret = "(?d)" + ret
 	}
-	return "(?exclude)" + p.match.String()
+	return ret
+}
+
+// A Result is the outcome of matching a file against the patterns.
+type Result uint8
+
+const (
+	resultInclude Result = 1 << iota
+	resultDeletable
+	resultNotMatched Result = 0
+)
+
+// IsIgnored returns true if the file is ignored.
+func (r Result) IsIgnored() bool {
+	return r&resultInclude != 0
+}
+
+// IsDeletable returns true if the file is ignored by a pattern with the
+// (?d) prefix, meaning that it may be removed when it is all that prevents
+// the deletion of its directory.
+func (r Result) IsDeletable() bool {
+	return r.IsIgnored() && r&resultDeletable != 0
 }
 
 type Matcher struct {
 	patterns  []Pattern
+	shared    string // ignore file included after the loaded one, if set
 	withCache bool
 	matches   *cache
 	curHash   string
@@ -55,6 +94,15 @@ func New(withCache bool) *Matcher {
 	return m
 }
 
+// SetShared sets an ignore file whose patterns are added after those of
+// every loaded file, as if it were included at the end. A missing shared
+// file is not an error. The patterns are read on the next Load or Parse.
+func (m *Matcher) SetShared(file string) {
+	m.mut.Lock()
+	m.shared = file
+	m.mut.Unlock()
+}
+
 func (m *Matcher) Load(file string) error {
 	// No locking, Parse() does the locking
 
@@ -78,6 +126,14 @@ func (m *Matcher) Parse(r io.Reader, file string) error {
 	// Error is saved and returned at the end. We process the patterns
 	// (possibly blank) anyway.
 
+	if m.shared != "" && !seen[m.shared] {
+		shared, serr := loadIgnoreFile(m.shared, seen)
+		if serr != nil && !os.IsNotExist(serr) && err == nil {
+			err = serr
+		}
+		patterns = append(patterns, shared...)
+	}
+
 	newHash := hashPatterns(patterns)
 	if newHash == m.curHash {
 		// We've already loaded exactly these patterns.
@@ -93,16 +149,22 @@ func (m *Matcher) Parse(r io.Reader, file string) error {
 	return err
 }
 
-func (m *Matcher) Match(file string) (result bool) {
+// Match returns true if the file is ignored.
+func (m *Matcher) Match(file string) bool {
+	return m.Result(file).IsIgnored()
+}
+
+// Result returns the outcome of matching the file against the patterns.
+func (m *Matcher) Result(file string) (result Result) {
 	if m == nil {
-		return false
+		return resultNotMatched
 	}
 
 	m.mut.Lock()
 	defer m.mut.Unlock()
 
 	if len(m.patterns) == 0 {
-		return false
+		return resultNotMatched
 	}
 
 	if m.matches != nil {
@@ -121,12 +183,71 @@ func (m *Matcher) Match(file string) (result bool) {
 	// Check all the patterns for a match.
 	for _, pattern := range m.patterns {
 		if pattern.match.MatchString(file) {
-			return pattern.include
+			if !pattern.include {
+				return resultNotMatched
+			}
+			if pattern.deletable {
+				return resultInclude | resultDeletable
+			}
+			return resultInclude
 		}
 	}
 
-	// Default to false.
-	return false
+	// Default to not matched.
+	return resultNotMatched
+}
+
+// A MatchInfo describes a pattern that matches a file.
+type MatchInfo struct {
+	Pattern string `json:"pattern"` // the compiled pattern
+	Ignores bool   `json:"ignores"` // false for ! patterns
+	Origin  Origin `json:"origin"`
+}
+
+// An Explanation tells why a file is or is not ignored.
+type Explanation struct {
+	Ignored   bool        `json:"ignored"`
+	Deletable bool        `json:"deletable"`
+	Decision  *MatchInfo  `json:"decision"` // the first matching pattern, which decides; nil if none matches
+	Others    []MatchInfo `json:"others"`   // the other matching lines, in order
+}
+
+// Explain matches the file against all patterns and returns the outcome,
+// the deciding pattern and the other patterns that match. Each line of an
+// ignore file results in several patterns; only the first matching pattern
+// of each line is included.
+func (m *Matcher) Explain(file string) Explanation {
+	exp := Explanation{
+		Others: []MatchInfo{},
+	}
+	if m == nil {
+		return exp
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	seen := make(map[Origin]bool)
+	for _, pattern := range m.patterns {
+		if seen[pattern.origin] || !pattern.match.MatchString(file) {
+			continue
+		}
+		seen[pattern.origin] = true
+
+		info := MatchInfo{
+			Pattern: pattern.String(),
+			Ignores: pattern.include,
+			Origin:  pattern.origin,
+		}
+		if exp.Decision == nil {
+			exp.Decision = &info
+			exp.Ignored = pattern.include
+			exp.Deletable = pattern.include && pattern.deletable
+		} else {
+			exp.Others = append(exp.Others, info)
+		}
+	}
+	return exp
 }
 
 // Patterns return a list of the loaded regexp patterns, as strings
@@ -146,6 +267,10 @@ func (m *Matcher) Patterns() []string {
 }
 
 func (m *Matcher) Hash() string {
+	if m == nil {
+		return ""
+	}
+
 	m.mut.Lock()
 	defer m.mut.Unlock()
 	return m.curHash
@@ -198,34 +323,49 @@ func loadIgnoreFile(file string, seen map[string]bool) ([]Pattern, error) {
 
 func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]Pattern, error) {
 	var patterns []Pattern
+	var origin Origin
 
 	addPattern := func(line string) error {
-		include := true
-		if strings.HasPrefix(line, "!") {
-			line = line[1:]
-			include = false
+		include, deletable := true, false
+	prefixes:
+		for {
+			// The prefixes may be given in any order.
+			switch {
+			case strings.HasPrefix(line, "!") && include:
+				line = line[1:]
+				include = false
+			case strings.HasPrefix(line, "(?d)") && !deletable:
+				line = line[4:]
+				deletable = true
+			case strings.HasPrefix(line, "(?i)(?d)") && !deletable:
+				// Leave (?i) to fnmatch.
+				line = "(?i)" + line[8:]
+				deletable = true
+			default:
+				break prefixes
+			}
 		}
 
 		if strings.HasPrefix(line, "/") {
 			// Pattern is rooted in the current dir only
 			exp, err := fnmatch.Convert(line[1:], fnmatch.PathName)
 			if err != nil {
-				return fmt.Errorf("Invalid pattern %q in ignore file", line)
+				return fmt.Errorf("Invalid pattern %q in ignore file at %s", line, origin)
 			}
-			patterns = append(patterns, Pattern{exp, include})
+			patterns = append(patterns, Pattern{exp, include, deletable, origin})
 		} else if strings.HasPrefix(line, "**/") {
 			// Add the pattern as is, and without **/ so it matches in current dir
 			exp, err := fnmatch.Convert(line, fnmatch.PathName)
 			if err != nil {
-				return fmt.Errorf("Invalid pattern %q in ignore file", line)
+				return fmt.Errorf("Invalid pattern %q in ignore file at %s", line, origin)
 			}
-			patterns = append(patterns, Pattern{exp, include})
+			patterns = append(patterns, Pattern{exp, include, deletable, origin})
 
 			exp, err = fnmatch.Convert(line[3:], fnmatch.PathName)
 			if err != nil {
-				return fmt.Errorf("Invalid pattern %q in ignore file", line)
+				return fmt.Errorf("Invalid pattern %q in ignore file at %s", line, origin)
 			}
-			patterns = append(patterns, Pattern{exp, include})
+			patterns = append(patterns, Pattern{exp, include, deletable, origin})
 		} else if strings.HasPrefix(line, "#include ") {
 			includeFile := filepath.Join(filepath.Dir(currentFile), line[len("#include "):])
 			includes, err := loadIgnoreFile(includeFile, seen)
@@ -238,23 +378,26 @@ func parseIgnoreFile(fd io.Reader, currentFile string, seen map[string]bool) ([]
 			// current directory and subdirs.
 			exp, err := fnmatch.Convert(line, fnmatch.PathName)
 			if err != nil {
-				return fmt.Errorf("Invalid pattern %q in ignore file", line)
+				return fmt.Errorf("Invalid pattern %q in ignore file at %s", line, origin)
 			}
-			patterns = append(patterns, Pattern{exp, include})
+			patterns = append(patterns, Pattern{exp, include, deletable, origin})
 
 			exp, err = fnmatch.Convert("**/"+line, fnmatch.PathName)
 			if err != nil {
-				return fmt.Errorf("Invalid pattern %q in ignore file", line)
+				return fmt.Errorf("Invalid pattern %q in ignore file at %s", line, origin)
 			}
-			patterns = append(patterns, Pattern{exp, include})
+			patterns = append(patterns, Pattern{exp, include, deletable, origin})
 		}
 		return nil
 	}
 
 	scanner := bufio.NewScanner(fd)
 	var err error
+	lineNo := 0
 	for scanner.Scan() {
+		lineNo++
 		line := strings.TrimSpace(scanner.Text())
+		origin = Origin{File: currentFile, Line: lineNo, Text: line}
 		switch {
 		case line == "":
 			continue
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -509,3 +510,152 @@ func TestHashOfEmpty(t *testing.T) {
 		t.Error("there are more than zero patterns")
 	}
 }
+
+func TestDeletable(t *testing.T) {
+	stignore := `
+	(?d)/foo
+	(?i)(?d)bar
+	!(?d)baz
+	qux
+	`
+	pats := New(true)
+	err := pats.Parse(bytes.NewBufferString(stignore), ".stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		f         string
+		ignored   bool
+		deletable bool
+	}{
+		{"foo", true, true},
+		{"foo/sub", true, true},
+		{"dir/foo", false, false},
+		{"BAR", true, true},
+		{"baz", false, false},
+		{"qux", true, false},
+		{"dir/qux", true, false},
+	}
+
+	// Twice, to check the cached results as well.
+	for i := 0; i < 2; i++ {
+		for _, tc := range tests {
+			res := pats.Result(tc.f)
+			if res.IsIgnored() != tc.ignored || res.IsDeletable() != tc.deletable {
+				t.Errorf("Incorrect result for %q; ignored %v deletable %v", tc.f, res.IsIgnored(), res.IsDeletable())
+			}
+			if pats.Match(tc.f) != tc.ignored {
+				t.Errorf("Incorrect match for %q", tc.f)
+			}
+		}
+	}
+
+	// The deletable flag is part of the hash.
+
+	other := New(false)
+	err = other.Parse(bytes.NewBufferString(strings.Replace(stignore, "(?d)", "", -1)), ".stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pats.Hash() == other.Hash() {
+		t.Error("Hash should differ with and without deletable patterns")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	pats := New(true)
+	err := pats.Load("testdata/.stignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stignore := filepath.Join("testdata", ".stignore")
+	excludes := filepath.Join("testdata", "excludes")
+
+	// A pattern from an included file
+
+	exp := pats.Explain("dir2/dfile")
+	if !exp.Ignored || exp.Decision == nil {
+		t.Fatalf("dir2/dfile should be ignored: %+v", exp)
+	}
+	if o := exp.Decision.Origin; o.File != excludes || o.Line != 1 || o.Text != "dir2/dfile" {
+		t.Errorf("Incorrect origin %+v", o)
+	}
+
+	// Lines that match further down are listed, but only once each
+
+	pats = New(false)
+	err = pats.Parse(bytes.NewBufferString("!bfile\n\n*file\nbfile\n"), stignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = pats.Explain("bfile")
+	if exp.Ignored || exp.Decision == nil || exp.Decision.Ignores || exp.Decision.Origin.Line != 1 {
+		t.Errorf("bfile should be unignored by line 1: %+v", exp)
+	}
+	if len(exp.Others) != 2 || exp.Others[0].Origin.Line != 3 || exp.Others[1].Origin.Line != 4 {
+		t.Errorf("Incorrect other matches %+v", exp.Others)
+	}
+
+	exp = pats.Explain("other")
+	if exp.Ignored || exp.Decision != nil || len(exp.Others) != 0 {
+		t.Errorf("Nothing should match: %+v", exp)
+	}
+}
+
+func TestSharedIgnores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := filepath.Join(dir, ".stignore")
+	shared := filepath.Join(dir, ".stignore-shared")
+	if err := ioutil.WriteFile(local, []byte("afile\n!bfile\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pats := New(true)
+	pats.SetShared(shared)
+
+	// A missing shared file is fine
+
+	if err := pats.Load(local); err != nil {
+		t.Fatal(err)
+	}
+	if !pats.Match("afile") || pats.Match("cfile") {
+		t.Error("Incorrect matches without shared file")
+	}
+	prevHash := pats.Hash()
+
+	// The shared patterns come after the local ones
+
+	if err := ioutil.WriteFile(shared, []byte("bfile\ncfile\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pats.Load(local); err != nil {
+		t.Fatal(err)
+	}
+	if !pats.Match("afile") || pats.Match("bfile") || !pats.Match("cfile") {
+		t.Error("Incorrect matches with shared file")
+	}
+	if pats.Hash() == prevHash {
+		t.Error("Hash should change with the shared file")
+	}
+	if o := pats.Explain("cfile").Decision.Origin; o.File != shared || o.Line != 2 {
+		t.Errorf("Incorrect origin %v for shared pattern", o)
+	}
+
+	// Including the shared file explicitly is not an error
+
+	if err := ioutil.WriteFile(local, []byte("#include .stignore-shared\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pats.Load(local); err != nil {
+		t.Fatal(err)
+	}
+	if !pats.Match("cfile") {
+		t.Error("Incorrect matches with included shared file")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+// deviceFileDownloadState is what a remote device has told us about one of
+// its temporary files.
+type deviceFileDownloadState struct {
+	version protocol.Vector
+	blocks  map[int32]struct{} // block indexes present in the temporary file
+}
+
+// deviceDownloadState tracks the temporary files a remote device announces
+// in DownloadProgress messages, per folder. It is safe for use from multiple
+// goroutines.
+type deviceDownloadState struct {
+	folders map[string]map[string]*deviceFileDownloadState // folder -> file name -> state
+	mut     sync.RWMutex
+}
+
+func newDeviceDownloadState() *deviceDownloadState {
+	return &deviceDownloadState{
+		folders: make(map[string]map[string]*deviceFileDownloadState),
+		mut:     sync.NewRWMutex(),
+	}
+}
+
+// Update applies the updates received for the folder.
+func (s *deviceDownloadState) Update(folder string, updates []protocol.FileDownloadProgressUpdate) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	files, ok := s.folders[folder]
+	if !ok {
+		files = make(map[string]*deviceFileDownloadState)
+		s.folders[folder] = files
+	}
+
+	for _, update := range updates {
+		switch update.UpdateType {
+		case protocol.UpdateTypeForget:
+			delete(files, update.Name)
+
+		case protocol.UpdateTypeAppend:
+			file, ok := files[update.Name]
+			if !ok || !file.version.Equal(update.Version) {
+				// A new file, or a new version of it; what we knew about the
+				// old one no longer applies.
+				file = &deviceFileDownloadState{
+					version: update.Version,
+					blocks:  make(map[int32]struct{}, len(update.BlockIndexes)),
+				}
+				files[update.Name] = file
+			}
+			for _, index := range update.BlockIndexes {
+				file.blocks[index] = struct{}{}
+			}
+		}
+	}
+}
+
+// Has returns true if the device has the given block of the given version
+// of the file in its temporary file.
+func (s *deviceDownloadState) Has(folder, name string, version protocol.Vector, index int32) bool {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	file, ok := s.folders[folder][name]
+	if !ok || !file.version.Equal(version) {
+		return false
+	}
+	_, ok = file.blocks[index]
+	return ok
+}
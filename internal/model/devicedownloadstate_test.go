@@ -0,0 +1,65 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestDeviceDownloadState(t *testing.T) {
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	s := newDeviceDownloadState()
+
+	s.Update("default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "a", Version: v1, BlockIndexes: []int32{0, 1}},
+	})
+	s.Update("default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "a", Version: v1, BlockIndexes: []int32{3}},
+	})
+
+	for _, tc := range []struct {
+		folder string
+		index  int32
+		has    bool
+	}{
+		{"default", 0, true},
+		{"default", 1, true},
+		{"default", 2, false},
+		{"default", 3, true},
+		{"other", 0, false},
+	} {
+		if has := s.Has(tc.folder, "a", v1, tc.index); has != tc.has {
+			t.Errorf("Has(%q, %d) = %v, expected %v", tc.folder, tc.index, has, tc.has)
+		}
+	}
+	if s.Has("default", "a", v2, 0) {
+		t.Error("unexpected block for another version")
+	}
+
+	// A new version replaces what we knew about the old one
+
+	s.Update("default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "a", Version: v2, BlockIndexes: []int32{2}},
+	})
+	if s.Has("default", "a", v1, 0) || s.Has("default", "a", v2, 0) {
+		t.Error("unexpected block from the old version")
+	}
+	if !s.Has("default", "a", v2, 2) {
+		t.Error("missing block of the new version")
+	}
+
+	s.Update("default", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeForget, Name: "a", Version: v2},
+	})
+	if s.Has("default", "a", v2, 2) {
+		t.Error("unexpected block of a forgotten file")
+	}
+}
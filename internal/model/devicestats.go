@@ -0,0 +1,121 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+// The traffic with the connected devices is added to their statistics this
+// often, and when a connection closes.
+const deviceStatsInterval = time.Minute
+
+// deviceTransferState is what has been added to the statistics of a device
+// of the traffic over its current connections.
+type deviceTransferState struct {
+	since   time.Time // the connected time is counted up to here
+	primary protocol.Statistics
+	extras  map[protocol.Connection]protocol.Statistics
+}
+
+// A deviceTransfer is the traffic with a device not yet added to its
+// statistics.
+type deviceTransfer struct {
+	device    protocol.DeviceID
+	in, out   int64
+	connected time.Duration
+}
+
+func newDeviceTransferState() *deviceTransferState {
+	return &deviceTransferState{
+		since:  time.Now(),
+		extras: make(map[protocol.Connection]protocol.Statistics),
+	}
+}
+
+// takeTransfer returns the traffic with the device since it was last taken,
+// and the time connected in the meantime. The caller must hold pmut for
+// writing.
+func (m *Model) takeTransfer(device protocol.DeviceID) deviceTransfer {
+	t := deviceTransfer{device: device}
+	group, ok := m.protoConn[device]
+	st, ok2 := m.transfers[device]
+	if !ok || !ok2 {
+		return t
+	}
+
+	now := time.Now()
+	t.connected = now.Sub(st.since)
+	st.since = now
+
+	cur := group.Connection.Statistics()
+	t.in += cur.InBytesTotal - st.primary.InBytesTotal
+	t.out += cur.OutBytesTotal - st.primary.OutBytesTotal
+	st.primary = cur
+
+	for _, conn := range group.Extras() {
+		e := m.takeExtraTransfer(device, conn)
+		t.in += e.in
+		t.out += e.out
+	}
+	return t
+}
+
+// takeExtraTransfer returns the traffic over the extra connection to the
+// device since it was last taken. The caller must hold pmut for writing.
+func (m *Model) takeExtraTransfer(device protocol.DeviceID, conn protocol.Connection) deviceTransfer {
+	t := deviceTransfer{device: device}
+	st, ok := m.transfers[device]
+	if !ok {
+		return t
+	}
+
+	prev := st.extras[conn]
+	cur := conn.Statistics()
+	t.in = cur.InBytesTotal - prev.InBytesTotal
+	t.out = cur.OutBytesTotal - prev.OutBytesTotal
+	st.extras[conn] = cur
+	return t
+}
+
+// recordTransfers adds the traffic with the connected devices to their
+// statistics every deviceStatsInterval, and a last time when the model is
+// stopped.
+func (m *Model) recordTransfers() {
+	ticker := time.NewTicker(deviceStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.flushTransfers()
+		case <-m.stop:
+			m.flushTransfers()
+			return
+		}
+	}
+}
+
+// flushTransfers adds the traffic with the connected devices to their
+// statistics.
+func (m *Model) flushTransfers() {
+	m.pmut.Lock()
+	ts := make([]deviceTransfer, 0, len(m.protoConn))
+	for device := range m.protoConn {
+		ts = append(ts, m.takeTransfer(device))
+	}
+	m.pmut.Unlock()
+
+	for _, t := range ts {
+		m.addTransfer(t)
+	}
+}
+
+func (m *Model) addTransfer(t deviceTransfer) {
+	m.deviceStatRef(t.device).AddTransfer(t.in, t.out, t.connected)
+}
@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -17,6 +18,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	stdsync "sync"
@@ -33,7 +35,6 @@ import (
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syncthing/syncthing/internal/versioner"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
 // How many files to send in each Index/IndexUpdate message.
@@ -50,6 +51,7 @@ type service interface {
 	Serve()
 	Stop()
 	Jobs() ([]string, []string) // In progress, Queued
+	Errors() []FileError        // Files that failed to pull
 	BringToFront(string)
 	DelayScan(d time.Duration)
 	IndexUpdated() // Remote index was updated notification
@@ -61,7 +63,7 @@ type service interface {
 
 type Model struct {
 	cfg             *config.Wrapper
-	db              *leveldb.DB
+	db              db.Storage
 	finder          *db.BlockFinder
 	progressEmitter *ProgressEmitter
 	id              protocol.DeviceID
@@ -79,18 +81,32 @@ type Model struct {
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
 	folderRunners  map[string]service                                     // folder -> puller or scanner
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	folderScrubs   map[string]*folderScrubber                             // folder -> scrubber
+	folderDone     map[string]chan struct{}                               // folder -> closed when its runner and scrubber have exited
+	folderDrops    stdsync.WaitGroup                                      // removed folders waiting to be dropped from the database
+	prevCfg        config.Configuration                                   // as of the last call to Changed
 	fmut           sync.RWMutex                                           // protects the above
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn  map[protocol.DeviceID]*protocol.Group
+	rawConn    map[protocol.DeviceID]io.Closer
+	extraConn  map[protocol.Connection]io.Closer // extra protocol connection -> raw connection
+	deviceVer  map[protocol.DeviceID]string
+	readOnlyBy map[protocol.DeviceID]map[string]bool // deviceID -> folders it shares read only with us
+	downloads  map[protocol.DeviceID]*deviceDownloadState
+	transfers  map[protocol.DeviceID]*deviceTransferState
+	pmut       sync.RWMutex // protects protoConn, rawConn, extraConn, deviceVer, readOnlyBy, downloads and transfers
 
 	addedFolder bool
 	started     bool
 
 	reqValidationCache map[string]time.Time // folder / file name => time when confirmed to exist
 	rvmut              sync.RWMutex         // protects reqValidationCache
+
+	dbSpaceErr error      // set while the database disk is low on free space
+	dbmut      sync.Mutex // protects dbSpaceErr
+
+	recordOnce stdsync.Once // starts recordTransfers on the first connection
+	stop       chan struct{}
 }
 
 var (
@@ -100,7 +116,7 @@ var (
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local folder in any way.
-func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName, clientVersion string, ldb *leveldb.DB) *Model {
+func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName, clientVersion string, ldb db.Storage) *Model {
 	m := &Model{
 		cfg:                cfg,
 		db:                 ldb,
@@ -119,14 +135,24 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		folderIgnores:      make(map[string]*ignore.Matcher),
 		folderRunners:      make(map[string]service),
 		folderStatRefs:     make(map[string]*stats.FolderStatisticsReference),
-		protoConn:          make(map[protocol.DeviceID]protocol.Connection),
+		folderScrubs:       make(map[string]*folderScrubber),
+		folderDone:         make(map[string]chan struct{}),
+		prevCfg:            cfg.Raw().Copy(),
+		protoConn:          make(map[protocol.DeviceID]*protocol.Group),
 		rawConn:            make(map[protocol.DeviceID]io.Closer),
+		extraConn:          make(map[protocol.Connection]io.Closer),
 		deviceVer:          make(map[protocol.DeviceID]string),
+		readOnlyBy:         make(map[protocol.DeviceID]map[string]bool),
+		downloads:          make(map[protocol.DeviceID]*deviceDownloadState),
+		transfers:          make(map[protocol.DeviceID]*deviceTransferState),
 		reqValidationCache: make(map[string]time.Time),
 
 		fmut:  sync.NewRWMutex(),
 		pmut:  sync.NewRWMutex(),
 		rvmut: sync.NewRWMutex(),
+		dbmut: sync.NewMutex(),
+
+		stop: make(chan struct{}),
 	}
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
@@ -135,6 +161,12 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 	return m
 }
 
+// Stop stops the background work of the model, adding the traffic with the
+// connected devices to their statistics first. It must be called only once.
+func (m *Model) Stop() {
+	close(m.stop)
+}
+
 // StartDeadlockDetector starts a deadlock detector on the models locks which
 // causes panics in case the locks cannot be acquired in the given timeout
 // period.
@@ -160,6 +192,10 @@ func (m *Model) StartFolderRW(folder string) {
 	}
 	p := newRWFolder(m, m.shortID, cfg)
 	m.folderRunners[folder] = p
+	scrubber := newFolderScrubber(m, cfg)
+	m.folderScrubs[folder] = scrubber
+	done := make(chan struct{})
+	m.folderDone[folder] = done
 	m.fmut.Unlock()
 
 	if len(cfg.Versioning.Type) > 0 {
@@ -170,7 +206,7 @@ func (m *Model) StartFolderRW(folder string) {
 		p.versioner = factory(folder, cfg.Path(), cfg.Versioning.Params)
 	}
 
-	go p.Serve()
+	go serveFolder(done, p, scrubber)
 }
 
 // StartFolderRO starts read only processing on the current model. When in
@@ -189,15 +225,33 @@ func (m *Model) StartFolderRO(folder string) {
 	}
 	s := newROFolder(m, folder, time.Duration(cfg.RescanIntervalS)*time.Second)
 	m.folderRunners[folder] = s
+	scrubber := newFolderScrubber(m, cfg)
+	m.folderScrubs[folder] = scrubber
+	done := make(chan struct{})
+	m.folderDone[folder] = done
 	m.fmut.Unlock()
 
-	go s.Serve()
+	go serveFolder(done, s, scrubber)
+}
+
+// serveFolder runs the runner and the scrubber of a folder, and closes done
+// when both have exited.
+func serveFolder(done chan struct{}, runner service, scrubber *folderScrubber) {
+	scrubbed := make(chan struct{})
+	go func() {
+		scrubber.Serve()
+		close(scrubbed)
+	}()
+	runner.Serve()
+	<-scrubbed
+	close(done)
 }
 
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
 	ClientVersion string
+	Connections   int
 }
 
 func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
@@ -205,17 +259,19 @@ func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
 		"at":            info.At,
 		"inBytesTotal":  info.InBytesTotal,
 		"outBytesTotal": info.OutBytesTotal,
+		"compression":   info.Compression,
 		"address":       info.Address,
 		"clientVersion": info.ClientVersion,
+		"connections":   info.Connections,
 	})
 }
 
+type remoteAddrer interface {
+	RemoteAddr() net.Addr
+}
+
 // ConnectionStats returns a map with connection statistics for each connected device.
 func (m *Model) ConnectionStats() map[string]interface{} {
-	type remoteAddrer interface {
-		RemoteAddr() net.Addr
-	}
-
 	m.pmut.RLock()
 	m.fmut.RLock()
 
@@ -225,6 +281,7 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 		ci := ConnectionInfo{
 			Statistics:    conn.Statistics(),
 			ClientVersion: m.deviceVer[device],
+			Connections:   conn.Len(),
 		}
 		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
 			ci.Address = nc.RemoteAddr().String()
@@ -259,6 +316,19 @@ func (m *Model) DeviceStatistics() map[string]stats.DeviceStatistics {
 	return res
 }
 
+// DeviceHistory returns statistics about each device, including the
+// traffic of each hour between from and to.
+func (m *Model) DeviceHistory(from, to time.Time) map[string]stats.DeviceStatistics {
+	var res = make(map[string]stats.DeviceStatistics)
+	for id := range m.cfg.Devices() {
+		sr := m.deviceStatRef(id)
+		st := sr.GetStatistics()
+		st.History = sr.GetHistory(from, to)
+		res[id.String()] = st
+	}
+	return res
+}
+
 // FolderStatistics returns statistics about each folder
 func (m *Model) FolderStatistics() map[string]stats.FolderStatistics {
 	var res = make(map[string]stats.FolderStatistics)
@@ -328,18 +398,13 @@ func sizeOfFile(f db.FileIntf) (files, deleted int, bytes int64) {
 }
 
 // GlobalSize returns the number of files, deleted files and total bytes for all
-// files in the global model.
+// files in the global model that are selected for syncing.
 func (m *Model) GlobalSize(folder string) (nfiles, deleted int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		c := rf.GlobalSize()
+		return int(c.Items()), int(c.Deleted), c.Bytes
 	}
 	return
 }
@@ -350,16 +415,8 @@ func (m *Model) LocalSize(folder string) (nfiles, deleted int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithHaveTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
-			if f.IsInvalid() {
-				return true
-			}
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs
-			deleted += de
-			bytes += by
-			return true
-		})
+		c := rf.LocalSize(protocol.LocalDeviceID)
+		return int(c.Items()), int(c.Deleted), c.Bytes
 	}
 	return
 }
@@ -369,12 +426,9 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
-		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
-			fs, de, by := sizeOfFile(f)
-			nfiles += fs + de
-			bytes += by
-			return true
-		})
+		c := rf.NeedSize()
+		nfiles = int(c.Items() + c.Deleted)
+		bytes = c.Bytes
 	}
 	bytes -= m.progressEmitter.BytesCompleted(folder)
 	if debug {
@@ -474,6 +528,7 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
 	runner := m.folderRunners[folder]
+	readOnly := m.folderCfgs[folder].DeviceReadOnly(deviceID)
 	m.fmut.RUnlock()
 
 	if runner != nil {
@@ -504,6 +559,10 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		}
 	}
 
+	if readOnly {
+		invalidateFiles(fs)
+	}
+
 	files.Replace(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -534,6 +593,7 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	m.fmut.RLock()
 	files := m.folderFiles[folder]
 	runner, ok := m.folderRunners[folder]
+	readOnly := m.folderCfgs[folder].DeviceReadOnly(deviceID)
 	m.fmut.RUnlock()
 
 	if !ok {
@@ -558,6 +618,10 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 		}
 	}
 
+	if readOnly {
+		invalidateFiles(fs)
+	}
+
 	files.Update(deviceID, fs)
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
@@ -573,6 +637,10 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
+	return m.folderSharedWithLocked(folder, deviceID)
+}
+
+func (m *Model) folderSharedWithLocked(folder string, deviceID protocol.DeviceID) bool {
 	for _, nfolder := range m.deviceFolders[deviceID] {
 		if nfolder == folder {
 			return true
@@ -599,8 +667,35 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		event["addr"] = conn.RemoteAddr().String()
 	}
 
+	readOnly := make(map[string]bool)
+	for _, folder := range cm.Folders {
+		for _, device := range folder.Devices {
+			if bytes.Equal(device.ID, m.id[:]) && device.Flags&protocol.FlagShareReadOnly != 0 {
+				l.Infof("Device %v shares folder %q read only; changes we make will not be accepted by it", deviceID, folder.ID)
+				readOnly[folder.ID] = true
+			}
+		}
+	}
+	m.readOnlyBy[deviceID] = readOnly
+
+	// Devices that understand download progress get to know about our
+	// temporary files, and tell us about theirs.
+	downloadProgress := cm.GetOption("downloadProgress") != ""
+	if downloadProgress {
+		m.downloads[deviceID] = newDeviceDownloadState()
+	}
+	conn, connected := m.protoConn[deviceID]
+
 	m.pmut.Unlock()
 
+	if downloadProgress && connected {
+		m.progressEmitter.temporaryIndexSubscribe(conn, func() []string {
+			m.fmut.RLock()
+			defer m.fmut.RUnlock()
+			return append([]string(nil), m.deviceFolders[deviceID]...)
+		})
+	}
+
 	events.Default.Log(events.DeviceConnected, event)
 
 	l.Infof(`Device %s client is "%s %s"`, deviceID, cm.ClientName, cm.ClientVersion)
@@ -625,7 +720,10 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 			// If we don't have this folder yet, skip it. Ideally, we'd
 			// offer up something in the GUI to create the folder, but for the
 			// moment we only handle folders that we already have.
-			if _, ok := m.folderDevices[folder.ID]; !ok {
+			m.fmut.RLock()
+			_, ok := m.folderDevices[folder.ID]
+			m.fmut.RUnlock()
+			if !ok {
 				continue
 			}
 
@@ -639,9 +737,10 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 					l.Infof("Adding device %v to config (vouched for by introducer %v)", id, deviceID)
 					newDeviceCfg := config.DeviceConfiguration{
-						DeviceID:    id,
-						Compression: m.cfg.Devices()[deviceID].Compression,
-						Addresses:   []string{"dynamic"},
+						DeviceID:     id,
+						Compression:  m.cfg.Devices()[deviceID].Compression,
+						Addresses:    []string{"dynamic"},
+						IntroducedBy: &deviceID,
 					}
 
 					// The introducers' introducers are also our introducers.
@@ -654,10 +753,12 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 					changed = true
 				}
 
+				m.fmut.Lock()
 				for _, er := range m.deviceFolders[id] {
 					if er == folder.ID {
 						// We already share the folder with this device, so
 						// nothing to do.
+						m.fmut.Unlock()
 						continue nextDevice
 					}
 				}
@@ -669,16 +770,23 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 				m.deviceFolders[id] = append(m.deviceFolders[id], folder.ID)
 				m.folderDevices[folder.ID] = append(m.folderDevices[folder.ID], id)
+				m.fmut.Unlock()
 
 				folderCfg := m.cfg.Folders()[folder.ID]
 				folderCfg.Devices = append(folderCfg.Devices, config.FolderDeviceConfiguration{
-					DeviceID: id,
+					DeviceID:     id,
+					IntroducedBy: &deviceID,
 				})
 				m.cfg.SetFolder(folderCfg)
 
 				changed = true
 			}
 		}
+
+		// Remove what the introducer once gave us, but no longer announces.
+		if m.handleDeintroductions(deviceID, cm) {
+			changed = true
+		}
 	}
 
 	if changed {
@@ -686,6 +794,86 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	}
 }
 
+// handleDeintroductions removes the folder shares and devices that were
+// added by the given introducer, but that it no longer announces. Anything
+// the user has edited since has no IntroducedBy set and is left alone.
+// Returns true if the configuration was changed.
+func (m *Model) handleDeintroductions(introducerID protocol.DeviceID, cm protocol.ClusterConfigMessage) bool {
+	announced := make(map[string]map[protocol.DeviceID]bool, len(cm.Folders))
+	announcedDevices := make(map[protocol.DeviceID]bool)
+	for _, folder := range cm.Folders {
+		devices := make(map[protocol.DeviceID]bool, len(folder.Devices))
+		for _, device := range folder.Devices {
+			id := protocol.DeviceIDFromBytes(device.ID)
+			devices[id] = true
+			announcedDevices[id] = true
+		}
+		announced[folder.ID] = devices
+	}
+
+	var changed bool
+	stillShared := make(map[protocol.DeviceID]bool)
+
+	for _, folderCfg := range m.cfg.Folders() {
+		kept := make([]config.FolderDeviceConfiguration, 0, len(folderCfg.Devices))
+		for _, device := range folderCfg.Devices {
+			if device.IntroducedBy != nil && *device.IntroducedBy == introducerID && !announced[folderCfg.ID][device.DeviceID] {
+				l.Infof("Removing device %v from share %q (no longer vouched for by introducer %v)", device.DeviceID, folderCfg.ID, introducerID)
+				m.unshareFolder(folderCfg.ID, device.DeviceID)
+				continue
+			}
+			kept = append(kept, device)
+			stillShared[device.DeviceID] = true
+		}
+
+		if len(kept) != len(folderCfg.Devices) {
+			folderCfg.Devices = kept
+			m.cfg.SetFolder(folderCfg)
+			changed = true
+		}
+	}
+
+	for id, deviceCfg := range m.cfg.Devices() {
+		if deviceCfg.IntroducedBy == nil || *deviceCfg.IntroducedBy != introducerID || announcedDevices[id] || stillShared[id] {
+			continue
+		}
+
+		l.Infof("Removing device %v from config (no longer vouched for by introducer %v)", id, introducerID)
+		m.cfg.RemoveDevice(id)
+		changed = true
+	}
+
+	return changed
+}
+
+// unshareFolder removes the given device from the sharing list of the given
+// folder in the model and forgets the index it announced for it. The
+// configuration is not touched.
+func (m *Model) unshareFolder(folder string, deviceID protocol.DeviceID) {
+	m.fmut.Lock()
+	defer m.fmut.Unlock()
+
+	folders := m.deviceFolders[deviceID][:0]
+	for _, f := range m.deviceFolders[deviceID] {
+		if f != folder {
+			folders = append(folders, f)
+		}
+	}
+	m.deviceFolders[deviceID] = folders
+
+	devices := m.folderDevices[folder][:0]
+	for _, d := range m.folderDevices[folder] {
+		if d != deviceID {
+			devices = append(devices, d)
+		}
+	}
+	m.folderDevices[folder] = devices
+
+	if fs, ok := m.folderFiles[folder]; ok {
+		fs.Replace(deviceID, nil)
+	}
+}
+
 // Close removes the peer from the model and closes the underlying connection if possible.
 // Implements the protocol.Model interface.
 func (m *Model) Close(device protocol.DeviceID, err error) {
@@ -702,21 +890,80 @@ func (m *Model) Close(device protocol.DeviceID, err error) {
 	}
 	m.fmut.RUnlock()
 
+	transfer := m.takeTransfer(device)
+	delete(m.transfers, device)
+
 	conn, ok := m.rawConn[device]
 	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
-			// If the underlying connection is a *tls.Conn, Close() does more
-			// than it says on the tin. Specifically, it sends a TLS alert
-			// message, which might block forever if the connection is dead
-			// and we don't have a deadline site.
-			conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+		closeRawConn(conn)
+	}
+	if group, ok := m.protoConn[device]; ok {
+		// The extra connections are of no use without the primary one.
+		for _, extra := range group.Extras() {
+			if conn, ok := m.extraConn[extra]; ok {
+				closeRawConn(conn)
+			}
+			delete(m.extraConn, extra)
 		}
-		conn.Close()
 	}
 	delete(m.protoConn, device)
 	delete(m.rawConn, device)
 	delete(m.deviceVer, device)
+	delete(m.readOnlyBy, device)
+	delete(m.downloads, device)
+	m.pmut.Unlock()
+
+	m.addTransfer(transfer)
+	m.progressEmitter.temporaryIndexUnsubscribe(device)
+}
+
+// ExtraClosed is called when an extra connection to a device is closed.
+// Implements the protocol.ExtraModel interface.
+func (m *Model) ExtraClosed(conn protocol.Connection, err error) {
+	device := conn.ID()
+	l.Infof("Extra connection to %s closed: %v", device, err)
+
+	m.pmut.Lock()
+	transfer := m.takeExtraTransfer(device, conn)
+	if st, ok := m.transfers[device]; ok {
+		delete(st.extras, conn)
+	}
+	if group, ok := m.protoConn[device]; ok {
+		group.RemoveExtra(conn)
+	}
+	if raw, ok := m.extraConn[conn]; ok {
+		closeRawConn(raw)
+	}
+	delete(m.extraConn, conn)
 	m.pmut.Unlock()
+
+	m.addTransfer(transfer)
+}
+
+// closeRawConn closes the given connection without risking to block on a
+// dead connection.
+func closeRawConn(conn io.Closer) {
+	if conn, ok := conn.(*tls.Conn); ok {
+		// If the underlying connection is a *tls.Conn, Close() does more
+		// than it says on the tin. Specifically, it sends a TLS alert
+		// message, which might block forever if the connection is dead
+		// and we don't have a deadline site.
+		conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	}
+	conn.Close()
+}
+
+// disconnect closes the underlying connection to the given device, if we
+// are connected. The protocol layer notices this and calls Close() in due
+// course, which takes care of the cleanup.
+func (m *Model) disconnect(device protocol.DeviceID, reason string) {
+	m.pmut.RLock()
+	conn, ok := m.rawConn[device]
+	m.pmut.RUnlock()
+	if ok {
+		l.Infof("Disconnecting from %s: %s", device, reason)
+		closeRawConn(conn)
+	}
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -731,11 +978,15 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, protocol.ErrNoSuchFile
 	}
 
-	if flags != 0 {
-		// We don't currently support or expect any flags.
+	if flags&^protocol.FlagRequestTemporary != 0 {
+		// We don't currently support or expect any other flags.
 		return nil, fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
 	}
 
+	if flags&protocol.FlagRequestTemporary != 0 {
+		return m.requestTemporary(deviceID, folder, name, offset, size, hash)
+	}
+
 	// Verify that the requested file exists in the local model. We only need
 	// to validate this file if we haven't done so recently, so we keep a
 	// cache of successfull results. "Recently" can be quite a long time, as
@@ -828,6 +1079,61 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	return buf, nil
 }
 
+// requestTemporary serves a block from the temporary file of a file we are
+// pulling. Only blocks matching the expected hash are returned, as the rest
+// of the temporary file may not have been written yet.
+func (m *Model) requestTemporary(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte) ([]byte, error) {
+	if debug {
+		l.Debugf("%v REQ(in; temporary): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
+	}
+
+	m.fmut.RLock()
+	folderFiles, ok := m.folderFiles[folder]
+	folderPath := m.folderCfgs[folder].Path()
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	// We only have temporary files for files in the global index; this also
+	// keeps the request from pointing elsewhere.
+	if _, ok := folderFiles.GetGlobalTruncated(name); !ok {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	fd, err := os.Open(filepath.Join(folderPath, defTempNamer.TempName(name)))
+	if err != nil {
+		return nil, protocol.ErrNoSuchFile
+	}
+	defer fd.Close()
+
+	buf := make([]byte, size)
+	if _, err := fd.ReadAt(buf, offset); err != nil {
+		return nil, protocol.ErrNoSuchFile
+	}
+	if _, err := scanner.VerifyBuffer(buf, protocol.BlockInfo{Size: int32(size), Hash: hash}); err != nil {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	return buf, nil
+}
+
+// DownloadProgress records which blocks of its temporary files the device
+// has, so that we can pull them from it.
+func (m *Model) DownloadProgress(deviceID protocol.DeviceID, folder string, updates []protocol.FileDownloadProgressUpdate, flags uint32, options []protocol.Option) {
+	if !m.folderSharedWith(folder, deviceID) {
+		return
+	}
+
+	m.pmut.RLock()
+	downloads, ok := m.downloads[deviceID]
+	m.pmut.RUnlock()
+
+	if ok {
+		downloads.Update(folder, updates)
+	}
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
@@ -910,6 +1216,19 @@ func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
 	return lines, patterns, nil
 }
 
+// ExplainIgnore tells why the file in the folder is or is not ignored,
+// according to the currently loaded ignore patterns.
+func (m *Model) ExplainIgnore(folder, file string) (ignore.Explanation, error) {
+	m.fmut.RLock()
+	ignores, ok := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return ignore.Explanation{}, fmt.Errorf("Folder %s does not exist", folder)
+	}
+
+	return ignores.Explain(file), nil
+}
+
 func (m *Model) SetIgnores(folder string, content []string) error {
 	cfg, ok := m.folderCfgs[folder]
 	if !ok {
@@ -957,11 +1276,15 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	if _, ok := m.protoConn[deviceID]; ok {
 		panic("add existing device")
 	}
-	m.protoConn[deviceID] = protoConn
+	m.protoConn[deviceID] = protocol.NewGroup(protoConn)
 	if _, ok := m.rawConn[deviceID]; ok {
 		panic("add existing device")
 	}
 	m.rawConn[deviceID] = rawConn
+	m.transfers[deviceID] = newDeviceTransferState()
+	m.recordOnce.Do(func() {
+		go m.recordTransfers()
+	})
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
@@ -974,7 +1297,48 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
-	m.deviceWasSeen(deviceID)
+	var addr string
+	if nc, ok := rawConn.(remoteAddrer); ok {
+		addr = nc.RemoteAddr().String()
+	}
+	m.deviceStatRef(deviceID).WasConnected(addr)
+}
+
+// AddExtraConnection adds an extra connection, created with
+// protocol.NewExtraConnection, to a device that we are already connected
+// to. Block requests to the device are spread over its extra connections,
+// while index data stays on the primary connection. An error is returned,
+// and the caller should close the connection, if there is no primary
+// connection to the device.
+func (m *Model) AddExtraConnection(rawConn io.Closer, protoConn protocol.Connection) error {
+	deviceID := protoConn.ID()
+
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+
+	group, ok := m.protoConn[deviceID]
+	if !ok {
+		return fmt.Errorf("not connected to %s", deviceID)
+	}
+	if _, ok := m.extraConn[protoConn]; ok {
+		panic("add existing extra connection")
+	}
+	m.extraConn[protoConn] = rawConn
+	group.AddExtra(protoConn)
+	return nil
+}
+
+// Connections returns the number of connections, primary and extra, that we
+// have to the given device.
+func (m *Model) Connections(deviceID protocol.DeviceID) int {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	group, ok := m.protoConn[deviceID]
+	if !ok {
+		return 0
+	}
+	return group.Len()
 }
 
 func (m *Model) deviceStatRef(deviceID protocol.DeviceID) *stats.DeviceStatisticsReference {
@@ -1104,8 +1468,14 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 
 func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
-	m.folderFiles[folder].Update(protocol.LocalDeviceID, fs)
+	files, ok := m.folderFiles[folder]
 	m.fmut.RUnlock()
+	if !ok {
+		// The folder has been removed while we were working on it.
+		return
+	}
+	files.Update(protocol.LocalDeviceID, fs)
+
 	m.rvmut.Lock()
 	for _, f := range fs {
 		delete(m.reqValidationCache, folder+"/"+f.Name)
@@ -1145,6 +1515,7 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	m.fmut.Lock()
 	m.folderCfgs[cfg.ID] = cfg
 	m.folderFiles[cfg.ID] = db.NewFileSet(cfg.ID, m.db)
+	m.folderFiles[cfg.ID].SetSelection(cfg.SelectedPaths)
 
 	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, len(cfg.Devices))
 	for i, device := range cfg.Devices {
@@ -1153,6 +1524,9 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	}
 
 	ignores := ignore.New(m.cfg.Options().CacheIgnoredFiles)
+	if cfg.SharedIgnores != "" {
+		ignores.SetShared(filepath.Join(cfg.Path(), cfg.SharedIgnores))
+	}
 	_ = ignores.Load(filepath.Join(cfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
 	m.folderIgnores[cfg.ID] = ignores
 
@@ -1160,6 +1534,206 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	m.fmut.Unlock()
 }
 
+// RemoveFolder stops the given folder and forgets about it. Its data is
+// dropped from the database in the background once the folder has stopped.
+// Devices sharing the folder are disconnected, so that they learn about the
+// change when they reconnect.
+func (m *Model) RemoveFolder(folder string) {
+	m.fmut.Lock()
+	runner, ok := m.folderRunners[folder]
+	if ok {
+		runner.Stop()
+	}
+	if scrubber, ok := m.folderScrubs[folder]; ok {
+		scrubber.Stop()
+	}
+
+	devices := m.folderDevices[folder]
+	for _, device := range devices {
+		folders := m.deviceFolders[device][:0]
+		for _, f := range m.deviceFolders[device] {
+			if f != folder {
+				folders = append(folders, f)
+			}
+		}
+		m.deviceFolders[device] = folders
+	}
+
+	if ignores, ok := m.folderIgnores[folder]; ok {
+		ignores.Stop()
+	}
+
+	delete(m.folderCfgs, folder)
+	delete(m.folderFiles, folder)
+	delete(m.folderDevices, folder)
+	delete(m.folderIgnores, folder)
+	delete(m.folderRunners, folder)
+	delete(m.folderStatRefs, folder)
+	delete(m.folderScrubs, folder)
+	done := m.folderDone[folder]
+	delete(m.folderDone, folder)
+	m.fmut.Unlock()
+
+	// The runner and scrubber may still be using the folder's files in the
+	// database, which must not be dropped under their feet. They can take a
+	// while to exit, so we don't wait for them here.
+	m.folderDrops.Add(1)
+	go func() {
+		if done != nil {
+			<-done
+		}
+		db.DropFolder(m.db, folder)
+		m.folderDrops.Done()
+	}()
+
+	for _, device := range devices {
+		if device != m.id {
+			m.disconnect(device, fmt.Sprintf("folder %q was removed", folder))
+		}
+	}
+}
+
+// Changed implements config.Handler. Removed folders are stopped and
+// dropped, folders are unshared from devices no longer selected, and removed
+// or ignored devices are disconnected. Other changes are either read from
+// the configuration when needed or require a restart.
+func (m *Model) Changed(cfg config.Configuration) error {
+	// This is called from the configuration wrapper, so we must not call
+	// back into it here.
+
+	// Only what was removed since the previous configuration is acted upon.
+	// The model may already be ahead of the configuration we are given, as
+	// when an introducer adds shares, and those must be left alone.
+	m.fmut.Lock()
+	prev := m.prevCfg
+	m.prevCfg = cfg
+	m.fmut.Unlock()
+
+	toFolders := configFolderDevices(cfg)
+
+	type share struct {
+		folder string
+		device protocol.DeviceID
+	}
+	var removedFolders []string
+	var removedShares []share
+
+	m.fmut.RLock()
+	for folder, prevShared := range configFolderDevices(prev) {
+		if _, ok := m.folderCfgs[folder]; !ok {
+			continue
+		}
+		devices, ok := toFolders[folder]
+		if !ok {
+			removedFolders = append(removedFolders, folder)
+			continue
+		}
+		for device := range prevShared {
+			if !devices[device] && m.folderSharedWithLocked(folder, device) {
+				removedShares = append(removedShares, share{folder, device})
+			}
+		}
+	}
+	m.fmut.RUnlock()
+
+	for _, folder := range removedFolders {
+		l.Infof("Folder %q was removed from the configuration; stopping", folder)
+		m.RemoveFolder(folder)
+	}
+
+	for _, folderCfg := range cfg.Folders {
+		m.updateSelection(folderCfg)
+	}
+
+	for _, share := range removedShares {
+		l.Infof("Folder %q is no longer shared with device %v", share.folder, share.device)
+		m.unshareFolder(share.folder, share.device)
+		m.disconnect(share.device, fmt.Sprintf("folder %q is no longer shared", share.folder))
+	}
+
+	toDevices := configDevices(cfg)
+	prevDevices := configDevices(prev)
+
+	m.pmut.RLock()
+	var removedDevices []protocol.DeviceID
+	for device := range m.protoConn {
+		if prevDevices[device] && !toDevices[device] {
+			removedDevices = append(removedDevices, device)
+		}
+	}
+	m.pmut.RUnlock()
+
+	for _, device := range removedDevices {
+		m.disconnect(device, "device was removed from the configuration")
+	}
+
+	return nil
+}
+
+// configFolderDevices returns the devices each folder in the configuration
+// is shared with.
+func configFolderDevices(cfg config.Configuration) map[string]map[protocol.DeviceID]bool {
+	folders := make(map[string]map[protocol.DeviceID]bool, len(cfg.Folders))
+	for _, folderCfg := range cfg.Folders {
+		devices := make(map[protocol.DeviceID]bool, len(folderCfg.Devices))
+		for _, device := range folderCfg.Devices {
+			devices[device.DeviceID] = true
+		}
+		folders[folderCfg.ID] = devices
+	}
+	return folders
+}
+
+// configDevices returns the devices in the configuration that are not
+// ignored.
+func configDevices(cfg config.Configuration) map[protocol.DeviceID]bool {
+	devices := make(map[protocol.DeviceID]bool, len(cfg.Devices))
+	for _, deviceCfg := range cfg.Devices {
+		devices[deviceCfg.DeviceID] = true
+	}
+	for _, device := range cfg.IgnoredDevices {
+		delete(devices, device)
+	}
+	return devices
+}
+
+// updateSelection applies a change of the paths selected for syncing in the
+// folder. The folder is rescanned, so that files that are no longer
+// selected are invalidated, and then pulled.
+func (m *Model) updateSelection(folderCfg config.FolderConfiguration) {
+	m.fmut.Lock()
+	cur, ok := m.folderCfgs[folderCfg.ID]
+	if !ok || reflect.DeepEqual(cur.SelectedPaths, folderCfg.SelectedPaths) {
+		m.fmut.Unlock()
+		return
+	}
+	cur.SelectedPaths = folderCfg.SelectedPaths
+	m.folderCfgs[folderCfg.ID] = cur
+	files := m.folderFiles[folderCfg.ID]
+	runner := m.folderRunners[folderCfg.ID]
+	m.fmut.Unlock()
+
+	l.Infof("Selected paths for folder %q changed to %v", folderCfg.ID, folderCfg.SelectedPaths)
+	files.SetSelection(folderCfg.SelectedPaths)
+
+	if runner != nil {
+		go func() {
+			if err := m.ScanFolder(folderCfg.ID); err != nil {
+				l.Infof("Rescanning folder %q after selection change: %v", folderCfg.ID, err)
+			}
+			runner.IndexUpdated()
+		}()
+	}
+}
+
+// SelectedPaths returns the paths selected for syncing in the folder, or
+// nil if everything is synced.
+func (m *Model) SelectedPaths(folder string) []string {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.folderCfgs[folder].SelectedPaths
+}
+
 func (m *Model) ScanFolders() map[string]error {
 	m.fmut.RLock()
 	folders := make([]string, 0, len(m.folderCfgs))
@@ -1202,7 +1776,7 @@ func (m *Model) ScanFolder(folder string) error {
 	return m.ScanFolderSubs(folder, nil)
 }
 
-func (m *Model) ScanFolderSubs(folder string, subs []string) error {
+func (m *Model) ScanFolderSubs(folder string, subs []string) (err error) {
 	for i, sub := range subs {
 		sub = osutil.NativeFilename(sub)
 		if p := filepath.Clean(filepath.Join(folder, sub)); !strings.HasPrefix(p, folder) {
@@ -1225,6 +1799,11 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 		return errors.New("no such folder")
 	}
 
+	scan := stats.ScanStatistics{Started: time.Now()}
+	defer func() {
+		m.folderStatRef(folder).ScanCompleted(scan, err)
+	}()
+
 	_ = ignores.Load(filepath.Join(folderCfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
 
 	// Required to make sure that we start indexing at a directory we're already
@@ -1254,6 +1833,7 @@ nextSub:
 		Dir:           folderCfg.Path(),
 		Subs:          subs,
 		Matcher:       ignores,
+		Selected:      fs.Selected,
 		BlockSize:     protocol.BlockSize,
 		TempNamer:     defTempNamer,
 		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
@@ -1291,6 +1871,10 @@ nextSub:
 		}
 		batch = append(batch, f)
 		blocksHandled += len(f.Blocks)
+		if !f.IsDirectory() && !f.IsDeleted() && !f.IsSymlink() {
+			scan.FilesHashed++
+			scan.BytesHashed += f.Size()
+		}
 	}
 
 	if err := m.CheckFolderHealth(folder); err != nil {
@@ -1330,8 +1914,9 @@ nextSub:
 				batch = batch[:0]
 			}
 
-			if ignores.Match(f.Name) || symlinkInvalid(f.IsSymlink()) {
-				// File has been ignored or an unsupported symlink. Set invalid bit.
+			if ignores.Match(f.Name) || !fs.Selected(f.Name) || symlinkInvalid(f.IsSymlink()) {
+				// File has been ignored, is outside of the selected paths or
+				// is an unsupported symlink. Set invalid bit.
 				if debug {
 					l.Debugln("setting invalid bit on ignored", f)
 				}
@@ -1412,6 +1997,10 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   "downloadProgress",
+				Value: "1",
+			},
 		},
 	}
 
@@ -1424,11 +2013,13 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 			// DeviceID is a value type, but with an underlying array. Copy it
 			// so we don't grab aliases to the same array later on in device[:]
 			device := device
-			// TODO: Set read only bit when relevant
 			cn := protocol.Device{
 				ID:    device[:],
 				Flags: protocol.FlagShareTrusted,
 			}
+			if m.folderCfgs[folder].DeviceReadOnly(device) {
+				cn.Flags = protocol.FlagShareReadOnly
+			}
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
 			}
@@ -1441,6 +2032,21 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 	return cm
 }
 
+// ReadOnlyBy returns the connected devices that share the folder read only
+// with us, i.e. that do not accept the changes we make to it.
+func (m *Model) ReadOnlyBy(folder string) []protocol.DeviceID {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	var devices []protocol.DeviceID
+	for device, folders := range m.readOnlyBy {
+		if folders[folder] {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
 func (m *Model) State(folder string) (string, time.Time, error) {
 	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
@@ -1618,6 +2224,38 @@ func (m *Model) Availability(folder, file string) []protocol.DeviceID {
 	return availableDevices
 }
 
+// blockAvailability returns the connected devices that have the given block
+// of the file, either as part of the finished file or in the temporary file
+// of their own pull. The latter are marked in the returned map.
+func (m *Model) blockAvailability(folder string, file protocol.FileInfo, block protocol.BlockInfo) ([]protocol.DeviceID, map[protocol.DeviceID]bool) {
+	devices := m.Availability(folder, file.Name)
+	fromTemporary := make(map[protocol.DeviceID]bool)
+
+	have := make(map[protocol.DeviceID]bool, len(devices))
+	for _, device := range devices {
+		have[device] = true
+	}
+
+	index := int32(block.Offset / protocol.BlockSize)
+
+	m.pmut.RLock()
+	for device, downloads := range m.downloads {
+		if have[device] {
+			continue
+		}
+		if _, ok := m.protoConn[device]; !ok {
+			continue
+		}
+		if downloads.Has(folder, file.Name, file.Version, index) {
+			devices = append(devices, device)
+			fromTemporary[device] = true
+		}
+	}
+	m.pmut.RUnlock()
+
+	return devices, fromTemporary
+}
+
 // BringToFront bumps the given files priority in the job queue.
 func (m *Model) BringToFront(folder, file string) {
 	m.pmut.RLock()
@@ -1629,6 +2267,86 @@ func (m *Model) BringToFront(folder, file string) {
 	}
 }
 
+// A QueuedFile is an entry in the pull queue of a folder.
+type QueuedFile struct {
+	Name       string `json:"name"`
+	Priority   int    `json:"priority"`
+	Pattern    string `json:"pattern"` // The priority pattern matching the file, if any
+	InProgress bool   `json:"inProgress"`
+}
+
+// PullQueue returns the files being pulled and those queued for pulling in
+// the folder, in the order they are handled.
+func (m *Model) PullQueue(folder string) []QueuedFile {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	cfg := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+
+	files := []QueuedFile{}
+	if !ok {
+		return files
+	}
+
+	priorities, _ := newPullPriorities(cfg.Priorities) // the folder warned about invalid patterns
+	progress, queued := runner.Jobs()
+	for i, names := range [][]string{progress, queued} {
+		for _, name := range names {
+			prio, pattern := priorities.priority(name)
+			files = append(files, QueuedFile{
+				Name:       name,
+				Priority:   prio,
+				Pattern:    pattern,
+				InProgress: i == 0,
+			})
+		}
+	}
+	return files
+}
+
+// FolderErrors returns the files in the folder that failed to pull, sorted
+// by path.
+func (m *Model) FolderErrors(folder string) []FileError {
+	m.fmut.RLock()
+	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return []FileError{}
+	}
+	if errs := runner.Errors(); errs != nil {
+		return errs
+	}
+	return []FileError{}
+}
+
+// ScrubFolder starts a scrub of the folder, that is, a rehash of the files
+// that have not changed since they were scanned.
+func (m *Model) ScrubFolder(folder string) error {
+	m.fmut.RLock()
+	scrubber, ok := m.folderScrubs[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return errors.New("no such folder")
+	}
+	scrubber.Scrub()
+	return nil
+}
+
+// ScrubStatus returns the progress and findings of the current or last scrub
+// of the folder.
+func (m *Model) ScrubStatus(folder string) (ScrubStatus, error) {
+	m.fmut.RLock()
+	scrubber, ok := m.folderScrubs[folder]
+	m.fmut.RUnlock()
+
+	if !ok {
+		return ScrubStatus{}, errors.New("no such folder")
+	}
+	return scrubber.Status(), nil
+}
+
 // CheckFolderHealth checks the folder for common errors and returns the
 // current folder error, or nil if the folder is healthy.
 func (m *Model) CheckFolderHealth(id string) error {
@@ -1661,6 +2379,15 @@ func (m *Model) CheckFolderHealth(id string) error {
 		err = folder.CreateMarker()
 	}
 
+	if err == nil {
+		m.dbmut.Lock()
+		err = m.dbSpaceErr
+		m.dbmut.Unlock()
+	}
+	if err == nil && !folder.ReadOnly {
+		err = m.checkFreeSpace(folder.MinDiskFree, folder.Path(), 0)
+	}
+
 	m.fmut.RLock()
 	runner, runnerExists := m.folderRunners[folder.ID]
 	m.fmut.RUnlock()
@@ -1689,6 +2416,59 @@ func (m *Model) CheckFolderHealth(id string) error {
 	return err
 }
 
+// checkFreeSpace returns an error when writing the given number of bytes to
+// the folder path would leave less than min free space on its disk. An empty
+// min means the global minimum.
+func (m *Model) checkFreeSpace(min, path string, size int64) error {
+	if min == "" {
+		min = m.cfg.Options().MinDiskFree
+	}
+	return checkDiskSpace(min, path, size)
+}
+
+// CheckDatabaseSpace checks the free space on the disk holding the database
+// directory against the global minimum. While it is insufficient all folders
+// are stopped with an error, as updating the database may fail. They resume
+// when a later check finds enough space again.
+func (m *Model) CheckDatabaseSpace(dir string) error {
+	err := checkDiskSpace(m.cfg.Options().MinDiskFree, dir, 0)
+
+	m.dbmut.Lock()
+	prevErr := m.dbSpaceErr
+	m.dbSpaceErr = err
+	m.dbmut.Unlock()
+
+	if err != nil && prevErr == nil {
+		l.Warnln("Stopping folders -", err)
+	} else if err == nil && prevErr != nil {
+		l.Infoln("Enough free space for the database again")
+	}
+	return err
+}
+
+// checkDiskSpace returns an error when the disk holding path would have less
+// than min free space after writing size bytes to it. Disks whose free space
+// cannot be determined always pass.
+func checkDiskSpace(min string, path string, size int64) error {
+	minSize, _ := config.ParseSize(min) // validated when loading the config
+	if minSize.Value <= 0 {
+		return nil
+	}
+
+	free, total, err := osutil.DiskUsage(path)
+	if err != nil {
+		if debug {
+			l.Debugln("disk usage of", path, err)
+		}
+		return nil
+	}
+
+	if free-size < minSize.Bytes(total) {
+		return fmt.Errorf("insufficient free space on the disk holding %s (the minimum is %v)", path, minSize)
+	}
+	return nil
+}
+
 func (m *Model) ResetFolder(folder string) error {
 	for _, f := range db.ListFolders(m.db) {
 		if f == folder {
@@ -1704,6 +2484,15 @@ func (m *Model) String() string {
 	return fmt.Sprintf("model@%p", m)
 }
 
+// invalidateFiles sets the invalid flag on the files from a device whose
+// changes are not accepted, keeping them out of the global version so that
+// they are never pulled.
+func invalidateFiles(fs []protocol.FileInfo) {
+	for i := range fs {
+		fs[i].Flags |= protocol.FlagInvalid
+	}
+}
+
 func symlinkInvalid(isLink bool) bool {
 	if !symlinks.Supported && isLink {
 		SymlinkWarning.Do(func() {
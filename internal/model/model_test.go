@@ -8,21 +8,22 @@ package model
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strconv"
+	stdsync "sync"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 var device1, device2 protocol.DeviceID
@@ -89,7 +90,7 @@ func init() {
 }
 
 func TestRequest(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 
@@ -185,7 +186,7 @@ func BenchmarkIndex_100(b *testing.B) {
 }
 
 func benchmarkIndex(b *testing.B, nfiles int) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	m.StartFolderRO("default")
@@ -213,7 +214,7 @@ func BenchmarkIndexUpdate_10000_1(b *testing.B) {
 }
 
 func benchmarkIndexUpdate(b *testing.B, nfiles, nufiles int) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	m.StartFolderRO("default")
@@ -230,51 +231,68 @@ func benchmarkIndexUpdate(b *testing.B, nfiles, nufiles int) {
 	b.ReportAllocs()
 }
 
+// FakeConnection is a connection to a device that returns requestData to
+// all requests. The statistics may be changed with setStatistics while the
+// connection is in use.
 type FakeConnection struct {
 	id          protocol.DeviceID
 	requestData []byte
+	stats       protocol.Statistics
+	statsMut    stdsync.Mutex // protects stats
 }
 
-func (FakeConnection) Close() error {
+func (*FakeConnection) Close() error {
 	return nil
 }
 
-func (f FakeConnection) ID() protocol.DeviceID {
+func (f *FakeConnection) ID() protocol.DeviceID {
 	return f.id
 }
 
-func (f FakeConnection) Name() string {
+func (f *FakeConnection) Name() string {
 	return ""
 }
 
-func (f FakeConnection) Option(string) string {
+func (f *FakeConnection) Option(string) string {
 	return ""
 }
 
-func (FakeConnection) Index(string, []protocol.FileInfo, uint32, []protocol.Option) error {
+func (*FakeConnection) Index(string, []protocol.FileInfo, uint32, []protocol.Option) error {
 	return nil
 }
 
-func (FakeConnection) IndexUpdate(string, []protocol.FileInfo, uint32, []protocol.Option) error {
+func (*FakeConnection) IndexUpdate(string, []protocol.FileInfo, uint32, []protocol.Option) error {
 	return nil
 }
 
-func (f FakeConnection) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
+func (f *FakeConnection) Request(folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
 	return f.requestData, nil
 }
 
-func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
+func (*FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
-func (FakeConnection) Ping() bool {
+func (*FakeConnection) DownloadProgress(string, []protocol.FileDownloadProgressUpdate, uint32, []protocol.Option) error {
+	return nil
+}
+
+func (*FakeConnection) Ping() bool {
 	return true
 }
 
-func (FakeConnection) Statistics() protocol.Statistics {
-	return protocol.Statistics{}
+func (f *FakeConnection) Statistics() protocol.Statistics {
+	f.statsMut.Lock()
+	defer f.statsMut.Unlock()
+	return f.stats
+}
+
+func (f *FakeConnection) setStatistics(stats protocol.Statistics) {
+	f.statsMut.Lock()
+	f.stats = stats
+	f.statsMut.Unlock()
 }
 
 func BenchmarkRequest(b *testing.B) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	m.ScanFolder("default")
@@ -290,7 +308,7 @@ func BenchmarkRequest(b *testing.B) {
 		}
 	}
 
-	fc := FakeConnection{
+	fc := &FakeConnection{
 		id:          device1,
 		requestData: []byte("some data to return"),
 	}
@@ -324,7 +342,7 @@ func TestDeviceRename(t *testing.T) {
 		},
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(config.Wrap("tmpconfig.xml", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	if cfg.Devices[0].Name != "" {
 		t.Errorf("Device already has a name")
@@ -390,7 +408,7 @@ func TestClusterConfig(t *testing.T) {
 		},
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 
 	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(cfg.Folders[0])
@@ -443,6 +461,381 @@ func TestClusterConfig(t *testing.T) {
 	}
 }
 
+func TestReadOnlyDevice(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, ReadOnly: true},
+			},
+		},
+	}
+
+	db := db.NewMemoryStorage()
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	cm := m.clusterConfig(device1)
+	r := cm.Folders[0]
+	if r.Devices[0].Flags != protocol.FlagShareTrusted {
+		t.Errorf("Device1 should be flagged as trusted, not 0x%x", r.Devices[0].Flags)
+	}
+	if r.Devices[1].Flags != protocol.FlagShareReadOnly {
+		t.Errorf("Device2 should be flagged as read only, not 0x%x", r.Devices[1].Flags)
+	}
+
+	// Changes from the read only device are not something we need, but
+	// the same changes from a trusted device are.
+
+	files := []protocol.FileInfo{
+		{Name: "file", Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}
+	m.Index(device2, "folder1", files, 0, nil)
+	if files, _ := m.NeedSize("folder1"); files != 0 {
+		t.Errorf("Should not need files from read only device, need %d", files)
+	}
+	if f, ok := m.CurrentGlobalFile("folder1", "file"); ok {
+		t.Errorf("File from read only device should not be global: %v", f)
+	}
+
+	files = []protocol.FileInfo{
+		{Name: "file", Version: protocol.Vector{{ID: 42, Value: 1}}},
+	}
+	m.Index(device1, "folder1", files, 0, nil)
+	if files, _ := m.NeedSize("folder1"); files != 1 {
+		t.Errorf("Should need the file from the trusted device, need %d", files)
+	}
+
+	// We are told when a device shares a folder read only with us.
+
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{
+			{
+				ID: "folder1",
+				Devices: []protocol.Device{
+					{ID: protocol.LocalDeviceID[:], Flags: protocol.FlagShareReadOnly},
+				},
+			},
+		},
+	})
+	if ro := m.ReadOnlyBy("folder1"); len(ro) != 1 || ro[0] != device1 {
+		t.Errorf("Folder should be read only by device1, not %v", ro)
+	}
+}
+
+func TestIntroducer(t *testing.T) {
+	defer os.Remove("tmpconfig.xml")
+
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{
+		{
+			DeviceID:   device1,
+			Introducer: true,
+		},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+			},
+		},
+	}
+
+	db := db.NewMemoryStorage()
+	wrapper := config.Wrap("tmpconfig.xml", cfg)
+	m := NewModel(wrapper, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	cm := protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Folders: []protocol.Folder{
+			{
+				ID: "folder1",
+				Devices: []protocol.Device{
+					{ID: device1[:], Flags: protocol.FlagIntroducer},
+					{ID: device2[:]},
+				},
+			},
+		},
+	}
+
+	// The introducer announces device2, which should be added
+
+	m.ClusterConfig(device1, cm)
+
+	devCfg, ok := wrapper.Devices()[device2]
+	if !ok {
+		t.Fatal("Device2 should have been introduced")
+	}
+	if devCfg.IntroducedBy == nil || *devCfg.IntroducedBy != device1 {
+		t.Errorf("Device2 introduced by %v, not %v", devCfg.IntroducedBy, device1)
+	}
+	shares := wrapper.Folders()["folder1"].Devices
+	if len(shares) != 2 || shares[1].DeviceID != device2 || shares[1].IntroducedBy == nil || *shares[1].IntroducedBy != device1 {
+		t.Errorf("Incorrect folder shares after introduction: %v", shares)
+	}
+	if !m.folderSharedWith("folder1", device2) {
+		t.Error("Folder1 should be shared with device2")
+	}
+
+	// The introducer stops announcing device2, which should be removed again
+
+	cm.Folders[0].Devices = cm.Folders[0].Devices[:1]
+	m.ClusterConfig(device1, cm)
+
+	if _, ok := wrapper.Devices()[device2]; ok {
+		t.Error("Device2 should have been removed")
+	}
+	if shares := wrapper.Folders()["folder1"].Devices; len(shares) != 1 {
+		t.Errorf("Incorrect folder shares after removal: %v", shares)
+	}
+	if m.folderSharedWith("folder1", device2) {
+		t.Error("Folder1 should not be shared with device2")
+	}
+}
+
+func TestIntroducerEditedDevice(t *testing.T) {
+	defer os.Remove("tmpconfig.xml")
+
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{
+		{
+			DeviceID:   device1,
+			Introducer: true,
+		},
+		{
+			// Introduced by device1, but since edited by the user
+			DeviceID: device2,
+			Name:     "edited",
+		},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2},
+			},
+		},
+	}
+
+	db := db.NewMemoryStorage()
+	wrapper := config.Wrap("tmpconfig.xml", cfg)
+	m := NewModel(wrapper, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+
+	cm := protocol.ClusterConfigMessage{
+		ClientName:    "syncthing",
+		ClientVersion: "v0.11.0",
+		Folders: []protocol.Folder{
+			{
+				ID: "folder1",
+				Devices: []protocol.Device{
+					{ID: device1[:], Flags: protocol.FlagIntroducer},
+				},
+			},
+		},
+	}
+
+	m.ClusterConfig(device1, cm)
+
+	if _, ok := wrapper.Devices()[device2]; !ok {
+		t.Error("Edited device2 should not have been removed")
+	}
+	if !m.folderSharedWith("folder1", device2) {
+		t.Error("Folder1 should still be shared with device2")
+	}
+}
+
+func TestConfigChangeRemovesFolder(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:      "folder1",
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+			},
+		},
+		{
+			ID:      "folder2",
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+			},
+		},
+	}
+
+	ldb := db.NewMemoryStorage()
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(cfg.Folders[0])
+	m.AddFolder(cfg.Folders[1])
+	m.Index(device1, "folder1", genFiles(10), 0, nil)
+	m.Index(device1, "folder2", genFiles(10), 0, nil)
+
+	// A runner that is busy pulling, which must not hold up the change
+	busy := make(chan struct{})
+	m.folderDone["folder1"] = busy
+
+	newCfg := cfg.Copy()
+	newCfg.Folders = newCfg.Folders[1:]
+	changed := make(chan struct{})
+	go func() {
+		m.Changed(newCfg)
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Changed waits for the runner of the removed folder")
+	}
+
+	if m.folderSharedWith("folder1", device1) {
+		t.Error("Removed folder should not be shared")
+	}
+	if !m.folderSharedWith("folder2", device1) {
+		t.Error("Remaining folder should still be shared")
+	}
+	if files, _, _ := m.GlobalSize("folder1"); files != 0 {
+		t.Errorf("Removed folder should be empty, not %d files", files)
+	}
+	if files, _, _ := m.GlobalSize("folder2"); files != 10 {
+		t.Errorf("Remaining folder should have 10 files, not %d", files)
+	}
+
+	close(busy)
+	m.folderDrops.Wait()
+	for _, folder := range db.ListFolders(ldb) {
+		if folder == "folder1" {
+			t.Error("Removed folder should have been dropped from the database")
+		}
+	}
+}
+
+func TestConfigChangeKeepsNewerShares(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:      "folder1",
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+			},
+		},
+	}
+
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db.NewMemoryStorage())
+	m.AddFolder(cfg.Folders[0])
+
+	// The share is added to the model, as by an introducer, before the
+	// configuration that has it reaches Changed.
+	m.fmut.Lock()
+	m.deviceFolders[device2] = append(m.deviceFolders[device2], "folder1")
+	m.folderDevices["folder1"] = append(m.folderDevices["folder1"], device2)
+	m.fmut.Unlock()
+
+	m.Changed(cfg.Copy())
+	if !m.folderSharedWith("folder1", device2) {
+		t.Error("Share not yet in the configuration should be kept")
+	}
+
+	withShare := cfg.Copy()
+	withShare.Devices = append(withShare.Devices, config.DeviceConfiguration{DeviceID: device2})
+	withShare.Folders[0].Devices = append(withShare.Folders[0].Devices, config.FolderDeviceConfiguration{DeviceID: device2})
+	m.Changed(withShare)
+	if !m.folderSharedWith("folder1", device2) {
+		t.Error("Configured share should be kept")
+	}
+
+	m.Changed(cfg.Copy())
+	if m.folderSharedWith("folder1", device2) {
+		t.Error("Share removed from the configuration should be removed")
+	}
+	if !m.folderSharedWith("folder1", device1) {
+		t.Error("Remaining share should be kept")
+	}
+}
+
+func TestExtraConnections(t *testing.T) {
+	ldb := db.NewMemoryStorage()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	extra := &FakeConnection{
+		id:          device1,
+		requestData: []byte("extra"),
+	}
+	if err := m.AddExtraConnection(extra, extra); err == nil {
+		t.Error("Extra connection should be refused without a primary connection")
+	}
+
+	fc := &FakeConnection{
+		id:          device1,
+		requestData: []byte("primary"),
+	}
+	m.AddConnection(fc, fc)
+	if err := m.AddExtraConnection(extra, extra); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Connections(device1); n != 2 {
+		t.Errorf("Expected 2 connections, not %d", n)
+	}
+
+	data, err := m.requestGlobal(device1, "default", "foo", 0, 32, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "extra" {
+		t.Errorf("Request should have been sent over the extra connection, got %q", data)
+	}
+
+	stats := m.ConnectionStats()["connections"].(map[string]ConnectionInfo)
+	if n := stats[device1.String()].Connections; n != 2 {
+		t.Errorf("Expected 2 connections in statistics, not %d", n)
+	}
+
+	m.ExtraClosed(extra, errors.New("test"))
+	if n := m.Connections(device1); n != 1 {
+		t.Errorf("Expected 1 connection, not %d", n)
+	}
+	if !m.ConnectedTo(device1) {
+		t.Error("Closing the extra connection should not disconnect the device")
+	}
+
+	data, err = m.requestGlobal(device1, "default", "foo", 0, 32, nil, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "primary" {
+		t.Errorf("Request should have been sent over the primary connection, got %q", data)
+	}
+
+	if err := m.AddExtraConnection(extra, extra); err != nil {
+		t.Fatal(err)
+	}
+	m.Close(device1, errors.New("test"))
+	if n := m.Connections(device1); n != 0 {
+		t.Errorf("Expected no connections, not %d", n)
+	}
+	if len(m.extraConn) != 0 {
+		t.Error("Extra connections should be dropped with the primary connection")
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	arrEqual := func(a, b []string) bool {
 		if len(a) != len(b) {
@@ -461,7 +854,7 @@ func TestIgnores(t *testing.T) {
 	ioutil.WriteFile("testdata/.stfolder", nil, 0644)
 	ioutil.WriteFile("testdata/.stignore", []byte(".*\nquux\n"), 0644)
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	m.StartFolderRO("default")
@@ -535,7 +928,7 @@ func TestIgnores(t *testing.T) {
 }
 
 func TestRefuseUnknownBits(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -572,7 +965,7 @@ func TestRefuseUnknownBits(t *testing.T) {
 }
 
 func TestROScanRecovery(t *testing.T) {
-	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb := db.NewMemoryStorage()
 	set := db.NewFileSet("default", ldb)
 	set.Update(protocol.LocalDeviceID, []protocol.FileInfo{
 		{Name: "dummyfile"},
@@ -656,7 +1049,7 @@ func TestROScanRecovery(t *testing.T) {
 }
 
 func TestRWScanRecovery(t *testing.T) {
-	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	ldb := db.NewMemoryStorage()
 	set := db.NewFileSet("default", ldb)
 	set.Update(protocol.LocalDeviceID, []protocol.FileInfo{
 		{Name: "dummyfile"},
@@ -740,7 +1133,7 @@ func TestRWScanRecovery(t *testing.T) {
 }
 
 func TestGlobalDirectoryTree(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -989,7 +1382,7 @@ func TestGlobalDirectoryTree(t *testing.T) {
 }
 
 func TestGlobalDirectorySelfFixing(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -1162,7 +1555,7 @@ func BenchmarkTree_100_10(b *testing.B) {
 }
 
 func benchmarkTree(b *testing.B, n1, n2 int) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	m.ScanFolder("default")
@@ -1176,3 +1569,126 @@ func benchmarkTree(b *testing.B, n1, n2 int) {
 	}
 	b.ReportAllocs()
 }
+
+func TestDeviceTransferStatistics(t *testing.T) {
+	ldb := db.NewMemoryStorage()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	fc := &FakeConnection{id: device1}
+	m.AddConnection(fc, fc)
+	fc.setStatistics(protocol.Statistics{InBytesTotal: 100, OutBytesTotal: 200})
+	m.flushTransfers()
+
+	extra := &FakeConnection{id: device1}
+	if err := m.AddExtraConnection(extra, extra); err != nil {
+		t.Fatal(err)
+	}
+	extra.setStatistics(protocol.Statistics{InBytesTotal: 10, OutBytesTotal: 20})
+	m.ExtraClosed(extra, errors.New("test"))
+
+	fc.setStatistics(protocol.Statistics{InBytesTotal: 150, OutBytesTotal: 300})
+	m.Close(device1, errors.New("test"))
+
+	st := m.DeviceStatistics()[device1.String()]
+	if st.InBytesTotal != 160 || st.OutBytesTotal != 320 || st.Connections != 1 {
+		t.Errorf("Incorrect statistics after first connection: %+v", st)
+	}
+
+	// The counters continue over a new connection, whose own counters
+	// start from zero
+
+	fc = &FakeConnection{id: device1, stats: protocol.Statistics{InBytesTotal: 5, OutBytesTotal: 5}}
+	m.AddConnection(fc, fc)
+	m.Close(device1, errors.New("test"))
+
+	res := m.DeviceHistory(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	st = res[device1.String()]
+	if st.InBytesTotal != 165 || st.OutBytesTotal != 325 || st.Connections != 2 {
+		t.Errorf("Incorrect statistics after second connection: %+v", st)
+	}
+	var in, out int64
+	for _, h := range st.History {
+		in += h.InBytes
+		out += h.OutBytes
+	}
+	if in != 165 || out != 325 {
+		t.Errorf("Incorrect history: %+v", st.History)
+	}
+	if h := res[device2.String()].History; len(h) != 0 {
+		t.Errorf("Unexpected history for device2: %+v", h)
+	}
+}
+
+func TestDeviceTransferHistoryRetention(t *testing.T) {
+	ldb := db.NewMemoryStorage()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	// Hours a year and a day ago, stored the way the statistics store them
+
+	ns := db.NewNamespacedKV(ldb, string([]byte{db.KeyTypeDeviceStatistic})+device1.String())
+	var bs [8]byte
+	for _, age := range []time.Duration{365 * 24 * time.Hour, 24 * time.Hour} {
+		binary.BigEndian.PutUint64(bs[:], uint64(time.Now().Add(-age).Truncate(time.Hour).Unix()))
+		ns.PutBytes("hour/"+string(bs[:]), make([]byte, 24))
+	}
+
+	fc := &FakeConnection{id: device1, stats: protocol.Statistics{InBytesTotal: 100, OutBytesTotal: 200}}
+	m.AddConnection(fc, fc)
+	m.Close(device1, errors.New("test"))
+
+	st := m.DeviceHistory(time.Now().Add(-2*365*24*time.Hour), time.Now().Add(time.Hour))[device1.String()]
+	if len(st.History) != 2 {
+		t.Fatalf("Incorrect history, expected the day old and the current hour: %+v", st.History)
+	}
+	if age := time.Since(st.History[0].Hour); age < 23*time.Hour || age > 26*time.Hour {
+		t.Errorf("Incorrect oldest hour %v", st.History[0].Hour)
+	}
+	m.Stop()
+}
+
+func TestFolderStatistics(t *testing.T) {
+	ldb := db.NewMemoryStorage()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+
+	// A runner that is not started, so that the scans are only ours
+	p := newRWFolder(m, 0, defaultFolderConfig)
+	m.folderRunners["default"] = p
+
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	st := m.FolderStatistics()["default"]
+	if st.LastScan.Started.IsZero() || st.LastScan.Finished.Before(st.LastScan.Started) {
+		t.Errorf("Incorrect scan times: %+v", st.LastScan)
+	}
+	// bar, foo, empty and ~syncthing~file.tmp
+	if st.LastScan.FilesHashed != 4 || st.LastScan.BytesHashed != 17+1<<20 {
+		t.Errorf("Incorrect hashing statistics after first scan: %+v", st.LastScan)
+	}
+
+	// Nothing has changed, so nothing is hashed the second time
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	st = m.FolderStatistics()["default"]
+	if st.LastScan.FilesHashed != 0 || st.LastScan.BytesHashed != 0 || st.Errors.Scan != 0 {
+		t.Errorf("Incorrect statistics after second scan: %+v", st)
+	}
+
+	p.pullerIteration(m.folderIgnores["default"])
+	st = m.FolderStatistics()["default"]
+	if st.LastPull.Result != "ok" || st.LastPull.Changed != 0 || st.LastPull.Finished.IsZero() {
+		t.Errorf("Incorrect pull statistics: %+v", st.LastPull)
+	}
+
+	// Statistics are persisted in the database
+	m = NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+	st2 := m.FolderStatistics()["default"]
+	if !st2.LastScan.Started.Equal(st.LastScan.Started) || !st2.LastPull.Finished.Equal(st.LastPull.Finished) || st2.LastPull.Result != st.LastPull.Result {
+		t.Errorf("Statistics not persisted: %+v != %+v", st2, st)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/fnmatch"
+)
+
+type pullPriority struct {
+	pattern  string
+	priority int
+	match    *regexp.Regexp
+	base     bool // match against the file name only
+}
+
+// pullPriorities are the compiled priority patterns of a folder. The first
+// matching pattern decides the priority of a file.
+type pullPriorities []pullPriority
+
+// newPullPriorities compiles the priority patterns. Invalid patterns are
+// skipped, and the first error is returned along with the valid patterns.
+func newPullPriorities(cfg []config.PullPriority) (pullPriorities, error) {
+	var ps pullPriorities
+	var firstErr error
+	for _, c := range cfg {
+		// Patterns with a slash match the path relative to the folder root,
+		// others the file name in any directory.
+		pattern := strings.TrimPrefix(c.Pattern, "/")
+		base := !strings.Contains(c.Pattern, "/")
+
+		exp, err := fnmatch.Convert(pattern, fnmatch.PathName)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid priority pattern %q: %v", c.Pattern, err)
+			}
+			continue
+		}
+		ps = append(ps, pullPriority{
+			pattern:  c.Pattern,
+			priority: c.Priority,
+			match:    exp,
+			base:     base,
+		})
+	}
+	return ps, firstErr
+}
+
+// priority returns the priority of the file and the pattern that decided it,
+// or zero and the empty string if no pattern matches.
+func (ps pullPriorities) priority(name string) (int, string) {
+	for _, p := range ps {
+		s := name
+		if p.base {
+			s = filepath.Base(name)
+		}
+		if p.match.MatchString(s) {
+			return p.priority, p.pattern
+		}
+	}
+	return 0, ""
+}
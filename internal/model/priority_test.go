@@ -0,0 +1,55 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestPullPriorities(t *testing.T) {
+	ps, err := newPullPriorities([]config.PullPriority{
+		{Pattern: "*.doc", Priority: 10},
+		{Pattern: "/config/*", Priority: 5},
+		{Pattern: "renders/**", Priority: -1},
+		{Pattern: "[", Priority: 100},
+		{Pattern: "*", Priority: 1},
+	})
+	if err == nil {
+		t.Error("Unexpected nil error for invalid pattern")
+	}
+	if len(ps) != 4 {
+		t.Fatalf("Unexpected number of valid patterns %d", len(ps))
+	}
+
+	cases := []struct {
+		name     string
+		priority int
+		pattern  string
+	}{
+		{"report.doc", 10, "*.doc"},
+		{"a/b/report.doc", 10, "*.doc"},
+		{"config/app.ini", 5, "/config/*"},
+		{"sub/config/app.ini", 1, "*"},
+		{"renders/scene1/final.mkv", -1, "renders/**"},
+		{"renders/notes.doc", 10, "*.doc"},
+		{"video.mkv", 1, "*"},
+	}
+
+	for _, tc := range cases {
+		prio, pattern := ps.priority(filepath.FromSlash(tc.name))
+		if prio != tc.priority || pattern != tc.pattern {
+			t.Errorf("%s: got priority %d from %q, expected %d from %q", tc.name, prio, pattern, tc.priority, tc.pattern)
+		}
+	}
+
+	if prio, pattern := pullPriorities(nil).priority("file"); prio != 0 || pattern != "" {
+		t.Errorf("Unexpected priority %d from %q without patterns", prio, pattern)
+	}
+}
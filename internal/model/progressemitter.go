@@ -11,16 +11,18 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/sync"
 )
 
 type ProgressEmitter struct {
-	registry map[string]*sharedPullerState
-	interval time.Duration
-	last     map[string]map[string]*pullerProgress
-	mut      sync.Mutex
+	registry    map[string]*sharedPullerState
+	interval    time.Duration
+	last        map[string]map[string]*pullerProgress
+	subscribers map[protocol.DeviceID]*progressSubscriber
+	mut         sync.Mutex
 
 	timer *time.Timer
 
@@ -31,17 +33,103 @@ type ProgressEmitter struct {
 // DownloadProgress events every interval.
 func NewProgressEmitter(cfg *config.Wrapper) *ProgressEmitter {
 	t := &ProgressEmitter{
-		stop:     make(chan struct{}),
-		registry: make(map[string]*sharedPullerState),
-		last:     make(map[string]map[string]*pullerProgress),
-		timer:    time.NewTimer(time.Millisecond),
-		mut:      sync.NewMutex(),
+		stop:        make(chan struct{}),
+		registry:    make(map[string]*sharedPullerState),
+		last:        make(map[string]map[string]*pullerProgress),
+		subscribers: make(map[protocol.DeviceID]*progressSubscriber),
+		timer:       time.NewTimer(time.Millisecond),
+		mut:         sync.NewMutex(),
 	}
 	t.Changed(cfg.Raw())
 	cfg.Subscribe(t)
 	return t
 }
 
+// A progressSubscriber is a device that is told which blocks of our
+// temporary files are present, so that it can request them from us.
+type progressSubscriber struct {
+	conn    protocol.Connection
+	folders func() []string                              // the folders currently shared with the device
+	sent    map[string]map[string]*sentFileDownloadState // folder -> file name -> state
+}
+
+// sentFileDownloadState is what we have told a subscriber about one of our
+// temporary files.
+type sentFileDownloadState struct {
+	version protocol.Vector
+	blocks  int // the number of available blocks sent so far
+}
+
+type progressMessage struct {
+	conn    protocol.Connection
+	folder  string
+	updates []protocol.FileDownloadProgressUpdate
+}
+
+// updates returns the changes to the temporary files in the folder since the
+// last call, as messages to the subscriber.
+func (s *progressSubscriber) updates(folder string, registry map[string]*sharedPullerState) []protocol.FileDownloadProgressUpdate {
+	sent, ok := s.sent[folder]
+	if !ok {
+		sent = make(map[string]*sentFileDownloadState)
+		s.sent[folder] = sent
+	}
+
+	var updates []protocol.FileDownloadProgressUpdate
+	current := make(map[string]struct{})
+	for _, puller := range registry {
+		if puller.folder != folder {
+			continue
+		}
+		name := puller.file.Name
+		current[name] = struct{}{}
+
+		available := puller.Available()
+		prev, ok := sent[name]
+		if !ok || !prev.version.Equal(puller.file.Version) {
+			// A new version replaces what the device knows about the old one.
+			prev = &sentFileDownloadState{version: puller.file.Version}
+			sent[name] = prev
+		}
+		if len(available) > prev.blocks {
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType:   protocol.UpdateTypeAppend,
+				Name:         name,
+				Version:      puller.file.Version,
+				BlockIndexes: available[prev.blocks:],
+			})
+			prev.blocks = len(available)
+		}
+	}
+
+	for name := range sent {
+		if _, ok := current[name]; !ok {
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType: protocol.UpdateTypeForget,
+				Name:       name,
+			})
+			delete(sent, name)
+		}
+	}
+
+	return updates
+}
+
+// forgetUnshared forgets what was sent about the folders that are no longer
+// shared with the subscriber, so that all of it is sent again should they be
+// shared again.
+func (s *progressSubscriber) forgetUnshared(folders []string) {
+	shared := make(map[string]struct{}, len(folders))
+	for _, folder := range folders {
+		shared[folder] = struct{}{}
+	}
+	for folder := range s.sent {
+		if _, ok := shared[folder]; !ok {
+			delete(s.sent, folder)
+		}
+	}
+}
+
 // Serve starts the progress emitter which starts emitting DownloadProgress
 // events as the progress happens.
 func (t *ProgressEmitter) Serve() {
@@ -53,6 +141,20 @@ func (t *ProgressEmitter) Serve() {
 			}
 			return
 		case <-t.timer.C:
+			// The shared folders are looked up on each round, as sharing
+			// changes while connected, and without holding our lock, as the
+			// model takes it while holding its own.
+			t.mut.Lock()
+			subs := make([]*progressSubscriber, 0, len(t.subscribers))
+			for _, sub := range t.subscribers {
+				subs = append(subs, sub)
+			}
+			t.mut.Unlock()
+			folders := make([][]string, len(subs))
+			for i, sub := range subs {
+				folders[i] = sub.folders()
+			}
+
 			t.mut.Lock()
 			if debug {
 				l.Debugln("progress emitter: timer - looking after", len(t.registry))
@@ -73,10 +175,32 @@ func (t *ProgressEmitter) Serve() {
 			} else if debug {
 				l.Debugln("progress emitter: nothing new")
 			}
+			var messages []progressMessage
+			for i, sub := range subs {
+				if t.subscribers[sub.conn.ID()] != sub {
+					// Unsubscribed in the meantime
+					continue
+				}
+				sub.forgetUnshared(folders[i])
+				for _, folder := range folders[i] {
+					if updates := sub.updates(folder, t.registry); len(updates) > 0 {
+						messages = append(messages, progressMessage{sub.conn, folder, updates})
+					}
+				}
+			}
 			if len(t.registry) != 0 {
 				t.timer.Reset(t.interval)
 			}
 			t.mut.Unlock()
+
+			// Sending may block on slow connections, so do it without
+			// holding up the pullers registering with us.
+			for _, msg := range messages {
+				if debug {
+					l.Debugf("progress emitter: sending %d updates for %q to %v", len(msg.updates), msg.folder, msg.conn.ID())
+				}
+				msg.conn.DownloadProgress(msg.folder, msg.updates, 0, nil)
+			}
 		}
 	}
 }
@@ -94,6 +218,26 @@ func (t *ProgressEmitter) Changed(cfg config.Configuration) error {
 	return nil
 }
 
+// temporaryIndexSubscribe starts sending the progress of our temporary
+// files over the connection, in the folders returned by folders at the time
+// of each update. It is called without the emitter's lock held.
+func (t *ProgressEmitter) temporaryIndexSubscribe(conn protocol.Connection, folders func() []string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.subscribers[conn.ID()] = &progressSubscriber{
+		conn:    conn,
+		folders: folders,
+		sent:    make(map[string]map[string]*sentFileDownloadState),
+	}
+}
+
+// temporaryIndexUnsubscribe stops sending progress to the device.
+func (t *ProgressEmitter) temporaryIndexUnsubscribe(device protocol.DeviceID) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	delete(t.subscribers, device)
+}
+
 // Stop stops the emitter.
 func (t *ProgressEmitter) Stop() {
 	t.stop <- struct{}{}
@@ -10,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/sync"
@@ -59,7 +60,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.copyDone()
+	s.copyDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -74,7 +75,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.pullDone()
+	s.pullDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -85,3 +86,28 @@ func TestProgressEmitter(t *testing.T) {
 	expectTimeout(w, t)
 
 }
+
+func TestProgressSubscriberReshare(t *testing.T) {
+	s := &sharedPullerState{
+		folder:    "default",
+		file:      protocol.FileInfo{Name: "file", Version: protocol.Vector{{ID: 1, Value: 1}}},
+		available: []int32{0, 1},
+		mut:       sync.NewMutex(),
+	}
+	registry := map[string]*sharedPullerState{"default/file": s}
+	sub := &progressSubscriber{sent: make(map[string]map[string]*sentFileDownloadState)}
+
+	if updates := sub.updates("default", registry); len(updates) != 1 || len(updates[0].BlockIndexes) != 2 {
+		t.Fatalf("Incorrect first updates %+v", updates)
+	}
+	if updates := sub.updates("default", registry); len(updates) != 0 {
+		t.Fatalf("Unexpected updates without change: %+v", updates)
+	}
+
+	// The folder is unshared and shared again; everything is sent again
+	sub.forgetUnshared(nil)
+	sub.forgetUnshared([]string{"default"})
+	if updates := sub.updates("default", registry); len(updates) != 1 || len(updates[0].BlockIndexes) != 2 {
+		t.Errorf("Incorrect updates after sharing again %+v", updates)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/events"
+)
+
+// A file that failed to pull is not retried until pullErrorBackoff has
+// passed, doubled for every further consecutive failure up to
+// maxPullErrorBackoff.
+const (
+	pullErrorBackoff    = nextPullIntv
+	maxPullErrorBackoff = time.Hour
+)
+
+// A FileError is the latest failure to pull a file.
+type FileError struct {
+	Path     string    `json:"path"`
+	Stage    string    `json:"stage"` // where in the puller the file failed
+	Err      string    `json:"error"`
+	Failures int       `json:"failures"` // consecutive failures
+	Time     time.Time `json:"time"`
+	Retry    time.Time `json:"retry"` // the file is not pulled again before this
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int {
+	return len(l)
+}
+
+func (l fileErrorList) Less(a, b int) bool {
+	return l[a].Path < l[b].Path
+}
+
+func (l fileErrorList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+// pullErrorDelay returns the time to wait before pulling a file again after
+// the given number of consecutive failures.
+func pullErrorDelay(failures int) time.Duration {
+	d := pullErrorBackoff
+	for i := 1; i < failures && d < maxPullErrorBackoff; i++ {
+		d *= 2
+	}
+	if d > maxPullErrorBackoff {
+		d = maxPullErrorBackoff
+	}
+	return d
+}
+
+// newError records that the file failed to pull at the given stage.
+func (p *rwFolder) newError(path, stage string, err error) {
+	now := time.Now()
+
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	if p.errors == nil {
+		p.errors = make(map[string]FileError)
+	}
+	e := p.errors[path]
+	e.Path = path
+	e.Stage = stage
+	e.Err = err.Error()
+	e.Failures++
+	e.Time = now
+	e.Retry = now.Add(pullErrorDelay(e.Failures))
+	p.errors[path] = e
+	p.errorsChanged = true
+
+	if debug {
+		l.Debugf("%v %s failed at %s (%d times), retry at %v: %v", p, path, stage, e.Failures, e.Retry, err)
+	}
+}
+
+// clearError forgets the failures of the file, which has been pulled or is
+// no longer needed.
+func (p *rwFolder) clearError(path string) {
+	p.errorsMut.Lock()
+	if _, ok := p.errors[path]; ok {
+		delete(p.errors, path)
+		p.errorsChanged = true
+	}
+	p.errorsMut.Unlock()
+}
+
+// backingOff returns true if the file has failed and should not be pulled
+// again yet.
+func (p *rwFolder) backingOff(path string) bool {
+	p.errorsMut.Lock()
+	e, ok := p.errors[path]
+	p.errorsMut.Unlock()
+	return ok && time.Now().Before(e.Retry)
+}
+
+// errorPaths returns the set of files with failures.
+func (p *rwFolder) errorPaths() map[string]struct{} {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	paths := make(map[string]struct{}, len(p.errors))
+	for path := range p.errors {
+		paths[path] = struct{}{}
+	}
+	return paths
+}
+
+// Errors returns the files that failed to pull, sorted by path.
+func (p *rwFolder) Errors() []FileError {
+	p.errorsMut.Lock()
+	defer p.errorsMut.Unlock()
+
+	errs := make(fileErrorList, 0, len(p.errors))
+	for _, e := range p.errors {
+		errs = append(errs, e)
+	}
+	sort.Sort(errs)
+	return errs
+}
+
+// emitErrors sends a FolderErrors event if the failures have changed since
+// the last one.
+func (p *rwFolder) emitErrors() {
+	p.errorsMut.Lock()
+	changed := p.errorsChanged
+	p.errorsChanged = false
+	p.errorsMut.Unlock()
+
+	if changed {
+		events.Default.Log(events.FolderErrors, map[string]interface{}{
+			"folder": p.folder,
+			"errors": p.Errors(),
+		})
+	}
+}
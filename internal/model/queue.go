@@ -23,6 +23,7 @@ type jobQueueEntry struct {
 	name     string
 	size     int64
 	modified int64
+	priority int
 }
 
 func newJobQueue() *jobQueue {
@@ -33,7 +34,7 @@ func newJobQueue() *jobQueue {
 
 func (q *jobQueue) Push(file string, size, modified int64) {
 	q.mut.Lock()
-	q.queued = append(q.queued, jobQueueEntry{file, size, modified})
+	q.queued = append(q.queued, jobQueueEntry{file, size, modified, 0})
 	q.mut.Unlock()
 }
 
@@ -137,6 +138,19 @@ func (q *jobQueue) SortNewestFirst() {
 	sort.Sort(sort.Reverse(oldestFirst(q.queued)))
 }
 
+// SortPriority moves files with a higher priority, as given by the
+// priority function, before those with a lower one. The order of files with
+// the same priority is kept.
+func (q *jobQueue) SortPriority(priority func(name string) int) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for i := range q.queued {
+		q.queued[i].priority = priority(q.queued[i].name)
+	}
+	sort.Stable(highestPriorityFirst(q.queued))
+}
+
 // The usual sort.Interface boilerplate
 
 type smallestFirst []jobQueueEntry
@@ -150,3 +164,9 @@ type oldestFirst []jobQueueEntry
 func (q oldestFirst) Len() int           { return len(q) }
 func (q oldestFirst) Less(a, b int) bool { return q[a].modified < q[b].modified }
 func (q oldestFirst) Swap(a, b int)      { q[a], q[b] = q[b], q[a] }
+
+type highestPriorityFirst []jobQueueEntry
+
+func (q highestPriorityFirst) Len() int           { return len(q) }
+func (q highestPriorityFirst) Less(a, b int) bool { return q[a].priority > q[b].priority }
+func (q highestPriorityFirst) Swap(a, b int)      { q[a], q[b] = q[b], q[a] }
@@ -248,6 +248,27 @@ func TestSortByAge(t *testing.T) {
 	}
 }
 
+func TestSortByPriority(t *testing.T) {
+	q := newJobQueue()
+	q.Push("render.mkv", 0, 0)
+	q.Push("a.doc", 0, 0)
+	q.Push("b.txt", 0, 0)
+	q.Push("c.doc", 0, 0)
+	q.Push("d.txt", 0, 0)
+
+	prios := map[string]int{"a.doc": 10, "c.doc": 10, "render.mkv": -1}
+	q.SortPriority(func(name string) int {
+		return prios[name]
+	})
+
+	_, actual := q.Jobs()
+	expected := []string{"a.doc", "c.doc", "b.txt", "d.txt", "render.mkv"}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("SortPriority(): %#v != %#v", actual, expected)
+	}
+}
+
 func BenchmarkJobQueueBump(b *testing.B) {
 	files := genFiles(b.N)
 
@@ -120,6 +120,10 @@ func (s *roFolder) Jobs() ([]string, []string) {
 	return nil, nil
 }
 
+func (s *roFolder) Errors() []FileError {
+	return nil
+}
+
 func (s *roFolder) DelayScan(next time.Duration) {
 	s.delayScan <- next
 }
@@ -22,6 +22,7 @@ import (
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/sync"
 	"github.com/syncthing/syncthing/internal/versioner"
@@ -70,6 +71,11 @@ type rwFolder struct {
 	pullers     int
 	shortID     uint64
 	order       config.PullOrder
+	sharedIgn   bool   // the folder has a shared ignore file, which may change when pulling
+	minDiskFree string // empty for the global setting
+	fsync       bool   // flush pulled files and their directories to disk
+	verify      bool   // rehash pulled files before moving them into place
+	priorities  pullPriorities
 
 	stop        chan struct{}
 	queue       *jobQueue
@@ -78,9 +84,24 @@ type rwFolder struct {
 	pullTimer   *time.Timer
 	delayScan   chan time.Duration
 	remoteIndex chan struct{} // An index update was received, we should re-evaluate needs
+
+	spaceErr    error // set when a file could not be pulled for lack of disk space
+	spaceNeeded int64 // the space needed by the smallest such file
+
+	pullStats stats.PullStatistics // of the current puller iteration, counted by the finisher
+
+	errors        map[string]FileError // files that failed to pull
+	errorsChanged bool                 // since the last FolderErrors event
+	errorsMut     sync.Mutex           // protects the above
+	backedOff     int                  // files left out of the last iteration, as they failed recently
 }
 
 func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFolder {
+	priorities, err := newPullPriorities(cfg.Priorities)
+	if err != nil {
+		l.Warnf("Folder %q: %v", cfg.ID, err)
+	}
+
 	return &rwFolder{
 		stateTracker: stateTracker{
 			folder: cfg.ID,
@@ -99,6 +120,11 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		pullers:     cfg.Pullers,
 		shortID:     shortID,
 		order:       cfg.Order,
+		sharedIgn:   cfg.SharedIgnores != "",
+		minDiskFree: cfg.MinDiskFree,
+		fsync:       cfg.Fsync,
+		verify:      cfg.VerifyPulled,
+		priorities:  priorities,
 
 		stop:        make(chan struct{}),
 		queue:       newJobQueue(),
@@ -106,6 +132,8 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		scanTimer:   time.NewTimer(time.Millisecond), // The first scan should be done immediately.
 		delayScan:   make(chan time.Duration),
 		remoteIndex: make(chan struct{}, 1), // This needs to be 1-buffered so that we queue a notification if we're busy doing a pull when it comes.
+
+		errorsMut: sync.NewMutex(),
 	}
 }
 
@@ -174,6 +202,21 @@ func (p *rwFolder) Serve() {
 				continue
 			}
 
+			if err := p.checkPendingSpace(); err != nil {
+				if debug {
+					l.Debugln(p, "skip (disk space)", err)
+				}
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+			if err := p.model.CheckFolderHealth(p.folder); err != nil {
+				if debug {
+					l.Debugln(p, "skip (folder error)", err)
+				}
+				p.pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
 			p.model.fmut.RLock()
 			curIgnores := p.model.folderIgnores[p.folder]
 			p.model.fmut.RUnlock()
@@ -211,11 +254,41 @@ func (p *rwFolder) Serve() {
 					l.Debugln(p, "changed", changed)
 				}
 
+				select {
+				case <-p.stop:
+					return
+				default:
+				}
+
+				if changed > 0 && p.sharedIgn {
+					p.reloadSharedIgnores(curIgnores)
+				}
+
+				if p.spaceErr != nil {
+					// Some files did not fit on the disk. Stop pulling
+					// until there is space for at least one of them.
+					l.Warnf("Folder %q: pausing puller - %v", p.folder, p.spaceErr)
+					p.setError(p.spaceErr)
+					p.pullTimer.Reset(nextPullIntv)
+					break
+				}
+
 				if changed == 0 {
 					// No files were changed by the puller, so we are in
 					// sync. Remember the local version number and
 					// schedule a resync a little bit into the future.
 
+					if p.backedOff > 0 {
+						// Files that failed recently were left out, so we
+						// are not in sync yet. Keep prevVer to try them
+						// again when their backoff has passed.
+						if debug {
+							l.Debugln(p, p.backedOff, "files backing off; next pull in", nextPullIntv)
+						}
+						p.pullTimer.Reset(nextPullIntv)
+						break
+					}
+
 					if lv := p.model.RemoteLocalVersion(p.folder); lv < curVer {
 						// There's a corner case where the device we needed
 						// files from disconnected during the puller
@@ -249,12 +322,19 @@ func (p *rwFolder) Serve() {
 					break
 				}
 			}
-			p.setState(FolderIdle)
+			if p.spaceErr == nil {
+				p.setState(FolderIdle)
+			}
 
 		// The reason for running the scanner from within the puller is that
 		// this is the easiest way to make sure we are not doing both at the
 		// same time.
 		case <-p.scanTimer.C:
+			if err := p.checkPendingSpace(); err != nil {
+				l.Infoln("Skipping folder", p.folder, "scan due to folder error:", err)
+				rescheduleScan()
+				continue
+			}
 			if err := p.model.CheckFolderHealth(p.folder); err != nil {
 				l.Infoln("Skipping folder", p.folder, "scan due to folder error:", err)
 				rescheduleScan()
@@ -289,6 +369,34 @@ func (p *rwFolder) Serve() {
 	}
 }
 
+// reloadSharedIgnores reloads the ignore patterns, as the shared ignore file
+// may just have been pulled. If they changed, a scan is scheduled to pick
+// up the new patterns; the puller does so by itself on the next pull.
+func (p *rwFolder) reloadSharedIgnores(ignores *ignore.Matcher) {
+	prevHash := ignores.Hash()
+	_ = ignores.Load(filepath.Join(p.dir, ".stignore")) // Ignore error, there might not be an .stignore
+	if ignores.Hash() != prevHash {
+		l.Infof("Ignore patterns for folder %q changed by the shared ignore file; rescanning", p.folder)
+		p.scanTimer.Reset(0)
+	}
+}
+
+// checkPendingSpace returns an error as long as there is not enough disk
+// space to pull the smallest file that did not fit during an earlier pull.
+func (p *rwFolder) checkPendingSpace() error {
+	if p.spaceErr == nil {
+		return nil
+	}
+	if err := p.model.checkFreeSpace(p.minDiskFree, p.dir, p.spaceNeeded); err != nil {
+		p.setError(err)
+		return err
+	}
+	l.Infof("Folder %q has enough free disk space again", p.folder)
+	p.spaceErr = nil
+	p.spaceNeeded = 0
+	return nil
+}
+
 func (p *rwFolder) Stop() {
 	close(p.stop)
 }
@@ -313,6 +421,14 @@ func (p *rwFolder) String() string {
 // might have failed). One puller iteration handles all files currently
 // flagged as needed in the folder.
 func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
+	p.model.fmut.RLock()
+	folderFiles, ok := p.model.folderFiles[p.folder]
+	p.model.fmut.RUnlock()
+	if !ok {
+		// The folder has been removed; there is nothing left to pull.
+		return 0
+	}
+
 	pullChan := make(chan pullBlockState)
 	copyChan := make(chan copyBlocksState)
 	finisherChan := make(chan *sharedPullerState)
@@ -322,6 +438,8 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	pullWg := sync.NewWaitGroup()
 	doneWg := sync.NewWaitGroup()
 
+	p.pullStats = stats.PullStatistics{Started: time.Now()}
+
 	if debug {
 		l.Debugln(p, "c", p.copiers, "p", p.pullers)
 	}
@@ -359,10 +477,6 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		doneWg.Done()
 	}()
 
-	p.model.fmut.RLock()
-	folderFiles := p.model.folderFiles[p.folder]
-	p.model.fmut.RUnlock()
-
 	// !!!
 	// WithNeed takes a database snapshot (by necessity). By the time we've
 	// handled a bunch of files it might have become out of date and we might
@@ -370,6 +484,10 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	// !!!
 
 	changed := 0
+	p.backedOff = 0
+
+	// The failures of files that are no longer needed are forgotten below.
+	staleErrors := p.errorPaths()
 
 	fileDeletions := map[string]protocol.FileInfo{}
 	dirDeletions := []protocol.FileInfo{}
@@ -418,6 +536,14 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		default:
 			// A new or changed file or symlink. This is the only case where we
 			// do stuff concurrently in the background
+			delete(staleErrors, file.Name)
+			if p.backingOff(file.Name) {
+				if debug {
+					l.Debugln(p, "backing off", file.Name)
+				}
+				p.backedOff++
+				return true
+			}
 			p.queue.Push(file.Name, file.Size(), file.Modified)
 		}
 
@@ -442,10 +568,30 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 		p.queue.SortOldestFirst()
 	}
 
+	// Priority patterns take precedence over the pull order
+
+	if len(p.priorities) > 0 {
+		p.queue.SortPriority(func(name string) int {
+			prio, _ := p.priorities.priority(name)
+			return prio
+		})
+	}
+
 	// Process the file queue
 
+	stopped := false
+
 nextFile:
 	for {
+		select {
+		case <-p.stop:
+			// The folder is being removed. Finish the files already
+			// started and leave the rest.
+			stopped = true
+			break nextFile
+		default:
+		}
+
 		fileName, ok := p.queue.Pop()
 		if !ok {
 			break
@@ -503,6 +649,10 @@ nextFile:
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if stopped {
+		fileDeletions, dirDeletions = nil, nil
+	}
+
 	for _, file := range fileDeletions {
 		if debug {
 			l.Debugln("Deleting file", file.Name)
@@ -515,13 +665,24 @@ nextFile:
 		if debug {
 			l.Debugln("Deleting dir", dir.Name)
 		}
-		p.deleteDir(dir)
+		p.deleteDir(dir, ignores)
 	}
 
 	// Wait for db updates to complete
 	close(p.dbUpdates)
 	updateWg.Wait()
 
+	for path := range staleErrors {
+		p.clearError(path)
+	}
+	p.emitErrors()
+
+	p.pullStats.Changed = int64(changed)
+	if p.spaceErr != nil {
+		p.pullStats.Error = p.spaceErr.Error()
+	}
+	p.model.folderStatRef(p.folder).PullCompleted(p.pullStats)
+
 	return changed
 }
 
@@ -609,7 +770,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 }
 
 // deleteDir attempts to delete the given directory
-func (p *rwFolder) deleteDir(file protocol.FileInfo) {
+func (p *rwFolder) deleteDir(file protocol.FileInfo, matcher *ignore.Matcher) {
 	var err error
 	events.Default.Log(events.ItemStarted, map[string]interface{}{
 		"folder": p.folder,
@@ -628,13 +789,33 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 	}()
 
 	realName := filepath.Join(p.dir, file.Name)
-	// Delete any temporary files lying around in the directory
+	// Delete any temporary files lying around in the directory. Ignored
+	// files that are marked deletable are removed as well, if they are all
+	// that stands in the way of deleting the directory.
 	dir, _ := os.Open(realName)
 	if dir != nil {
 		files, _ := dir.Readdirnames(-1)
-		for _, file := range files {
-			if defTempNamer.IsTemporary(file) {
-				osutil.InWritableDir(osutil.Remove, filepath.Join(realName, file))
+		dir.Close()
+
+		var deletable []string
+		onlyDeletable := true
+		for _, dirFile := range files {
+			switch {
+			case defTempNamer.IsTemporary(dirFile):
+				osutil.InWritableDir(osutil.Remove, filepath.Join(realName, dirFile))
+			case matcher.Result(filepath.Join(file.Name, dirFile)).IsDeletable():
+				deletable = append(deletable, dirFile)
+			default:
+				onlyDeletable = false
+			}
+		}
+
+		if onlyDeletable {
+			for _, dirFile := range deletable {
+				if debug {
+					l.Debugln(p, "removing deletable ignored", filepath.Join(file.Name, dirFile))
+				}
+				osutil.InWritableDir(os.RemoveAll, filepath.Join(realName, dirFile))
 			}
 		}
 	}
@@ -804,6 +985,11 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		} else {
 			err = p.shortcutFile(file)
 		}
+		if err != nil {
+			p.newError(file.Name, "shortcut", err)
+		} else {
+			p.clearError(file.Name)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -822,6 +1008,7 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 
 	reused := 0
 	var blocks []protocol.BlockInfo
+	var available []int32
 
 	// Check for an old temporary file which might have some blocks we could
 	// reuse.
@@ -837,10 +1024,12 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		}
 
 		// Since the blocks are already there, we don't need to get them.
-		for _, block := range file.Blocks {
+		for i, block := range file.Blocks {
 			_, ok := existingBlocks[block.String()]
 			if !ok {
 				blocks = append(blocks, block)
+			} else {
+				available = append(available, int32(i))
 			}
 		}
 
@@ -852,11 +1041,41 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 			// sharedpuller not to panic when it fails to exclusively create a
 			// file which already exists
 			os.Remove(tempName)
+			available = nil
 		}
 	} else {
 		blocks = file.Blocks
 	}
 
+	var size int64
+	for _, block := range blocks {
+		size += int64(block.Size)
+	}
+	if err := p.model.checkFreeSpace(p.minDiskFree, p.dir, size); err != nil {
+		// Leave the file to a later pull, when there is enough space.
+		if debug {
+			l.Debugln(p, "no space for", file.Name, err)
+		}
+		if p.spaceErr == nil || size < p.spaceNeeded {
+			p.spaceNeeded = size
+		}
+		p.spaceErr = err
+		p.queue.Done(file.Name)
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   file.Name,
+			"error":  err,
+			"type":   "file",
+			"action": "update",
+		})
+		return
+	}
+
+	var reusedBytes int64
+	for _, i := range available {
+		reusedBytes += int64(file.Blocks[i].Size)
+	}
+
 	s := sharedPullerState{
 		file:        file,
 		folder:      p.folder,
@@ -865,8 +1084,10 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		copyTotal:   len(blocks),
 		copyNeeded:  len(blocks),
 		reused:      reused,
+		reusedBytes: reusedBytes,
 		ignorePerms: p.ignorePermissions(file),
 		version:     curFile.Version,
+		available:   available,
 		mut:         sync.NewMutex(),
 	}
 
@@ -1002,7 +1223,7 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				}
 				pullChan <- ps
 			} else {
-				state.copyDone()
+				state.copyDone(block)
 			}
 		}
 		out <- state.sharedPullerState
@@ -1024,7 +1245,7 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 		}
 
 		var lastError error
-		potentialDevices := p.model.Availability(p.folder, state.file.Name)
+		potentialDevices, fromTemporary := p.model.blockAvailability(p.folder, state.file, state.block)
 		for {
 			// Select the least busy device to pull the block from. If we found no
 			// feasible device at all, fail the block (and in the long run, the
@@ -1041,10 +1262,17 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 
 			potentialDevices = removeDevice(potentialDevices, selected)
 
+			// Devices that are pulling the file themselves serve the block
+			// from their temporary file.
+			var flags uint32
+			if fromTemporary[selected] {
+				flags = protocol.FlagRequestTemporary
+			}
+
 			// Fetch the block, while marking the selected device as in use so that
 			// leastBusy can select another device when someone else asks.
 			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
+			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, flags, nil)
 			activity.done(selected)
 			if lastError != nil {
 				continue
@@ -1062,7 +1290,7 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			if err != nil {
 				state.fail("save", err)
 			} else {
-				state.pullDone()
+				state.pullDone(state.block)
 			}
 			break
 		}
@@ -1070,8 +1298,7 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 	}
 }
 
-func (p *rwFolder) performFinish(state *sharedPullerState) {
-	var err error
+func (p *rwFolder) performFinish(state *sharedPullerState) (err error) {
 	defer func() {
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
@@ -1082,6 +1309,32 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 		})
 	}()
 
+	// Make sure the new file is complete, and on disk, before it replaces
+	// the old one
+	if p.verify {
+		if err = p.verifyTemp(state); err != nil {
+			l.Warnln("Puller: final:", err)
+			return
+		}
+	}
+	if p.fsync {
+		start := time.Now()
+		err = osutil.SyncFile(state.tempName)
+		if err == nil {
+			// The directory entry of the new file, too. Not all
+			// filesystems can sync directories, so this is not a reason
+			// to fail the file.
+			if derr := osutil.SyncDir(filepath.Dir(state.tempName)); derr != nil {
+				l.Warnf("Puller (folder %q, file %q): final: syncing directory: %v", p.folder, state.file.Name, derr)
+			}
+		}
+		p.pullStats.FsyncSeconds += time.Since(start).Seconds()
+		if err != nil {
+			l.Warnln("Puller: final: syncing:", err)
+			return
+		}
+	}
+
 	// Set the correct permission bits on the new file
 	if !p.ignorePermissions(state.file) {
 		err = os.Chmod(state.tempName, os.FileMode(state.file.Flags&0777))
@@ -1141,7 +1394,7 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 		content, err := ioutil.ReadFile(state.realName)
 		if err != nil {
 			l.Warnln("Puller: final: reading symlink:", err)
-			return
+			return err
 		}
 
 		// Remove the file, and replace it with a symlink.
@@ -1151,12 +1404,44 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 		}, state.realName)
 		if err != nil {
 			l.Warnln("Puller: final: creating symlink:", err)
-			return
+			return err
+		}
+	}
+
+	// Make the rename durable. The file is in place already, so a failure
+	// here is not a reason to keep it out of the index.
+	if p.fsync {
+		start := time.Now()
+		if err := osutil.SyncDir(filepath.Dir(state.realName)); err != nil {
+			l.Warnf("Puller (folder %q, file %q): final: syncing directory: %v", p.folder, state.file.Name, err)
 		}
+		p.pullStats.FsyncSeconds += time.Since(start).Seconds()
 	}
 
 	// Record the updated file in the index
 	p.dbUpdates <- state.file
+	return nil
+}
+
+// verifyTemp rehashes the temporary file against the blocks of the new
+// file.
+func (p *rwFolder) verifyTemp(state *sharedPullerState) error {
+	start := time.Now()
+	defer func() {
+		p.pullStats.FilesVerified++
+		p.pullStats.VerifySeconds += time.Since(start).Seconds()
+	}()
+
+	fd, err := os.Open(state.tempName)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if err := scanner.Verify(fd, protocol.BlockSize, state.file.Blocks); err != nil {
+		return fmt.Errorf("verifying %q: %v", state.file.Name, err)
+	}
+	return nil
 }
 
 func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
@@ -1167,13 +1452,22 @@ func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 			}
 			if err != nil {
 				l.Warnln("Puller: final:", err)
+				p.newError(state.file.Name, "close", err)
+				p.pullStats.FilesFailed++
 				continue
 			}
 
 			p.queue.Done(state.file.Name)
-			if state.failed() == nil {
-				p.performFinish(state)
+			network, reused := state.transferred()
+			p.pullStats.NetworkBytes += network
+			p.pullStats.ReusedBytes += reused
+			if stage, failure := state.failure(); failure == nil {
+				if err = p.performFinish(state); err != nil {
+					p.newError(state.file.Name, "finish", err)
+				}
 			} else {
+				err = failure
+				p.newError(state.file.Name, stage, err)
 				events.Default.Log(events.ItemFinished, map[string]interface{}{
 					"folder": p.folder,
 					"item":   state.file.Name,
@@ -1182,6 +1476,12 @@ func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 					"action": "update",
 				})
 			}
+			if err != nil {
+				p.pullStats.FilesFailed++
+			} else {
+				p.clearError(state.file.Name)
+				p.pullStats.FilesPulled++
+			}
 			if p.progressEmitter != nil {
 				p.progressEmitter.Deregister(state)
 			}
@@ -7,16 +7,19 @@
 package model
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/scanner"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syncthing/syncthing/internal/sync"
 )
 
 func init() {
@@ -66,7 +69,7 @@ func TestHandleFile(t *testing.T) {
 	requiredFile := existingFile
 	requiredFile.Blocks = blocks[1:]
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	// Update index
@@ -120,7 +123,7 @@ func TestHandleFileWithTemp(t *testing.T) {
 	requiredFile := existingFile
 	requiredFile.Blocks = blocks[1:]
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	// Update index
@@ -150,6 +153,67 @@ func TestHandleFileWithTemp(t *testing.T) {
 	}
 }
 
+func TestHandleFileNoSpace(t *testing.T) {
+	file := protocol.FileInfo{
+		Name:   "filex",
+		Blocks: blocks[1:],
+	}
+
+	db := db.NewMemoryStorage()
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	p := rwFolder{
+		stateTracker: stateTracker{
+			folder: "default",
+			mut:    sync.NewMutex(),
+		},
+		folder:      "default",
+		dir:         "testdata",
+		model:       m,
+		queue:       newJobQueue(),
+		minDiskFree: "100%",
+	}
+
+	copyChan := make(chan copyBlocksState, 1)
+
+	// No disk is ever completely free, so the file should be skipped
+	p.handleFile(file, copyChan, nil)
+
+	select {
+	case <-copyChan:
+		t.Fatal("Unexpected copy of a file that doesn't fit on the disk")
+	default:
+	}
+	if p.spaceErr == nil {
+		t.Fatal("Unexpected nil space error")
+	}
+	if p.spaceNeeded != 8*0x20000 {
+		t.Errorf("Unexpected space needed %d", p.spaceNeeded)
+	}
+
+	if err := p.checkPendingSpace(); err == nil {
+		t.Error("Unexpected nil error while space is still insufficient")
+	}
+	if state, _, _ := p.getState(); state != FolderError {
+		t.Errorf("Unexpected folder state %v", state)
+	}
+
+	// Once there is enough space, the folder may pull again
+	p.minDiskFree = "0"
+	if err := p.checkPendingSpace(); err != nil {
+		t.Error("Unexpected error with enough space:", err)
+	}
+	if p.spaceErr != nil || p.spaceNeeded != 0 {
+		t.Error("Space error should be cleared")
+	}
+
+	p.handleFile(file, copyChan, nil)
+	if cs := <-copyChan; len(cs.blocks) != 8 {
+		t.Errorf("Unexpected count of copy blocks: %d != 8", len(cs.blocks))
+	}
+}
+
 func TestCopierFinder(t *testing.T) {
 	// After diff between required and existing we should:
 	// Copy: 1, 2, 3, 4, 6, 7, 8
@@ -180,7 +244,7 @@ func TestCopierFinder(t *testing.T) {
 	requiredFile.Blocks = blocks[1:]
 	requiredFile.Name = "file2"
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 	// Update index
@@ -255,7 +319,7 @@ func TestCopierCleanup(t *testing.T) {
 		return true
 	}
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -304,7 +368,7 @@ func TestCopierCleanup(t *testing.T) {
 // Make sure that the copier routine hashes the content when asked, and pulls
 // if it fails to find the block.
 func TestLastResortPulling(t *testing.T) {
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -376,7 +440,7 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 	}
 	defer os.Remove("testdata/" + defTempNamer.TempName("filex"))
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
@@ -390,6 +454,7 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 		model:           m,
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		errorsMut:       sync.NewMutex(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -464,7 +529,7 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 	}
 	defer os.Remove("testdata/" + defTempNamer.TempName("filex"))
 
-	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	db := db.NewMemoryStorage()
 	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
 	m.AddFolder(defaultFolderConfig)
 
@@ -477,6 +542,7 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		model:           m,
 		queue:           newJobQueue(),
 		progressEmitter: emitter,
+		errorsMut:       sync.NewMutex(),
 	}
 
 	// queue.Done should be called by the finisher routine
@@ -520,6 +586,10 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 			t.Fatal("Still registered", len(p.progressEmitter.registry), len(p.queue.progress), len(p.queue.queued))
 		}
 
+		if errs := p.Errors(); len(errs) != 1 || errs[0].Path != "filex" || errs[0].Stage != "pull" || errs[0].Failures != 1 {
+			t.Errorf("Incorrect pull errors: %+v", errs)
+		}
+
 		// Doing it again should have no effect
 		finisherChan <- state
 		time.Sleep(100 * time.Millisecond)
@@ -531,3 +601,159 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestPullErrorBackoff(t *testing.T) {
+	p := rwFolder{
+		folder:    "default",
+		errorsMut: sync.NewMutex(),
+	}
+
+	p.newError("file", "pull", errNoDevice)
+	if !p.backingOff("file") || p.backingOff("other") {
+		t.Error("Incorrect backoff after first failure")
+	}
+	first := p.Errors()[0]
+	if d := first.Retry.Sub(first.Time); d != pullErrorBackoff {
+		t.Errorf("Retry after %v, expected %v", d, pullErrorBackoff)
+	}
+
+	p.newError("file", "finish", errors.New("test"))
+	errs := p.Errors()
+	if len(errs) != 1 || errs[0].Stage != "finish" || errs[0].Err != "test" || errs[0].Failures != 2 {
+		t.Fatalf("Incorrect errors after second failure: %+v", errs)
+	}
+	if d := errs[0].Retry.Sub(errs[0].Time); d != 2*pullErrorBackoff {
+		t.Errorf("Retry after %v, expected %v", d, 2*pullErrorBackoff)
+	}
+	if d := pullErrorDelay(100); d != maxPullErrorBackoff {
+		t.Errorf("Delay after 100 failures is %v, expected %v", d, maxPullErrorBackoff)
+	}
+
+	p.clearError("file")
+	if len(p.Errors()) != 0 || p.backingOff("file") {
+		t.Error("Error not cleared")
+	}
+}
+
+func TestDeleteDirDeletableIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a/.DS_Store", "b/.DS_Store", "b/keep"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ignores := ignore.New(false)
+	if err := ignores.Parse(bytes.NewBufferString("(?d).DS_Store\nkeep\n"), ".stignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := rwFolder{
+		folder:    "default",
+		dir:       dir,
+		dbUpdates: make(chan protocol.FileInfo, 2),
+	}
+
+	// The directory holding only a deletable ignored file is removed, the
+	// one also holding a plain ignored file is left alone.
+
+	p.deleteDir(protocol.FileInfo{Name: "a", Flags: protocol.FlagDirectory | protocol.FlagDeleted}, ignores)
+	p.deleteDir(protocol.FileInfo{Name: "b", Flags: protocol.FlagDirectory | protocol.FlagDeleted}, ignores)
+
+	if _, err := os.Lstat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Error("Directory a should have been removed:", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "b", ".DS_Store")); err != nil {
+		t.Error("The deletable file in b should have been kept:", err)
+	}
+	if l := len(p.dbUpdates); l != 1 {
+		t.Errorf("Expected one database update, got %d", l)
+	}
+}
+
+func TestVerifyPulledFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []byte("the new contents")
+	blocks, err := scanner.Blocks(bytes.NewReader(contents), protocol.BlockSize, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := protocol.FileInfo{
+		Name:     "file",
+		Flags:    0644,
+		Modified: time.Now().Unix(),
+		Blocks:   blocks,
+	}
+
+	p := rwFolder{
+		folder:    "default",
+		dir:       dir,
+		fsync:     true,
+		verify:    true,
+		dbUpdates: make(chan protocol.FileInfo, 1),
+	}
+	state := &sharedPullerState{
+		file:     file,
+		tempName: filepath.Join(dir, defTempNamer.TempName("file")),
+		realName: filepath.Join(dir, "file"),
+		mut:      sync.NewMutex(),
+	}
+
+	// A temporary file that does not match the blocks is not moved into
+	// place
+
+	if err := ioutil.WriteFile(state.tempName, []byte("the bad contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err == nil {
+		t.Error("Unexpected nil error for corrupted file")
+	}
+	if _, err := os.Stat(state.realName); !os.IsNotExist(err) {
+		t.Error("Corrupted file moved into place")
+	}
+	if len(p.dbUpdates) != 0 {
+		t.Error("Corrupted file recorded in the index")
+	}
+
+	if err := ioutil.WriteFile(state.tempName, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.performFinish(state); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := ioutil.ReadFile(state.realName); !bytes.Equal(bs, contents) {
+		t.Errorf("File contains %q", bs)
+	}
+	if len(p.dbUpdates) != 1 {
+		t.Error("File not recorded in the index")
+	}
+	if p.pullStats.FilesVerified != 2 {
+		t.Errorf("%d files verified, expected 2", p.pullStats.FilesVerified)
+	}
+}
+
+func TestPullerIterationStopped(t *testing.T) {
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db.NewMemoryStorage())
+	m.AddFolder(defaultFolderConfig)
+	m.Index(device1, "default", genFiles(3), 0, nil)
+
+	// A folder being removed leaves the files it has not started on
+	p := newRWFolder(m, 0, defaultFolderConfig)
+	p.Stop()
+	p.pullerIteration(m.folderIgnores["default"])
+
+	if _, queued := p.Jobs(); len(queued) != 3 {
+		t.Errorf("Incorrect queue after stop: %v", queued)
+	}
+}
@@ -0,0 +1,537 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/scanner"
+	"github.com/syncthing/syncthing/internal/stats"
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+const (
+	scrubInitialDelay = 10 * time.Minute // before the first scrub of a folder that has never been scrubbed
+	scrubIdleCheck    = 5 * time.Second  // how often to check whether a busy folder has become idle
+	scrubProgressIntv = 2 * time.Second  // FolderScrubProgress events are sent at most this often
+)
+
+var (
+	errScrubStopped  = errors.New("scrub stopped")
+	errFileChanged   = errors.New("file changed during repair")
+	errNoSameVersion = errors.New("no device has the same version of the file")
+	errFolderBusy    = errors.New("folder is syncing the file")
+)
+
+// A ScrubStatus is the progress and findings of the current or last scrub
+// of a folder.
+type ScrubStatus struct {
+	Scrubbing    bool          `json:"scrubbing"`
+	Started      time.Time     `json:"started"`
+	Finished     time.Time     `json:"finished"`
+	Next         time.Time     `json:"next"` // zero when not scheduled
+	FilesTotal   int64         `json:"filesTotal"`
+	FilesChecked int64         `json:"filesChecked"`
+	BytesTotal   int64         `json:"bytesTotal"`
+	BytesChecked int64         `json:"bytesChecked"`
+	Corrupted    []CorruptFile `json:"corrupted"`
+}
+
+// A CorruptFile is a file whose contents do not match its blocks in the
+// index, although it has not been changed since it was scanned.
+type CorruptFile struct {
+	Path        string    `json:"path"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+	Repaired    bool      `json:"repaired"`
+	RepairError string    `json:"repairError,omitempty"`
+}
+
+// A folderScrubber rehashes the files of a folder that have not changed
+// since they were last scanned. The scanner goes by size and modification
+// time, so corruption on disk is otherwise never noticed. Files are checked
+// one at a time, and only while the folder is idle.
+type folderScrubber struct {
+	model    *Model
+	folder   string
+	dir      string
+	interval time.Duration
+	repair   bool
+	bucket   *ratelimit.Bucket
+	mtimes   *db.VirtualMtimeRepo
+
+	stop chan struct{}
+	now  chan struct{}
+
+	status ScrubStatus
+	mut    sync.Mutex // protects status
+}
+
+func newFolderScrubber(m *Model, cfg config.FolderConfiguration) *folderScrubber {
+	s := &folderScrubber{
+		model:    m,
+		folder:   cfg.ID,
+		dir:      cfg.Path(),
+		interval: time.Duration(cfg.ScrubIntervalS) * time.Second,
+		repair:   cfg.ScrubRepair,
+		mtimes:   db.NewVirtualMtimeRepo(m.db, cfg.ID),
+		stop:     make(chan struct{}),
+		now:      make(chan struct{}, 1),
+		mut:      sync.NewMutex(),
+	}
+	if cfg.ScrubMaxKbps > 0 {
+		s.bucket = ratelimit.NewBucketWithRate(float64(1000*cfg.ScrubMaxKbps), int64(5*1000*cfg.ScrubMaxKbps))
+	}
+	return s
+}
+
+func (s *folderScrubber) Serve() {
+	if debug {
+		l.Debugln(s, "starting")
+		defer l.Debugln(s, "exiting")
+	}
+
+	// Without an interval we only scrub on request
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	if s.interval > 0 {
+		timer = time.NewTimer(s.firstDelay())
+		timerC = timer.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.now:
+		case <-timerC:
+		}
+
+		if err := s.scrub(); err == errScrubStopped {
+			return
+		}
+
+		if timer != nil {
+			timer.Stop()
+			select {
+			case <-timer.C:
+			default:
+			}
+			timer.Reset(s.interval)
+			s.mut.Lock()
+			s.status.Next = time.Now().Add(s.interval)
+			s.mut.Unlock()
+		}
+	}
+}
+
+func (s *folderScrubber) Stop() {
+	close(s.stop)
+}
+
+// Scrub starts a scrub now, unless one is already running or requested.
+func (s *folderScrubber) Scrub() {
+	select {
+	case s.now <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the progress and findings of the current or last scrub.
+func (s *folderScrubber) Status() ScrubStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	st := s.status
+	st.Corrupted = append([]CorruptFile{}, s.status.Corrupted...)
+	return st
+}
+
+func (s *folderScrubber) String() string {
+	return fmt.Sprintf("scrubber/%s@%p", s.folder, s)
+}
+
+// firstDelay returns the time until the first scrub, counting from the end
+// of the last one.
+func (s *folderScrubber) firstDelay() time.Duration {
+	d := scrubInitialDelay
+	if last := s.model.folderStatRef(s.folder).GetLastScrub(); !last.Finished.IsZero() {
+		d = last.Finished.Add(s.interval).Sub(time.Now())
+		if d < time.Minute {
+			d = time.Minute
+		}
+	}
+
+	s.mut.Lock()
+	s.status.Next = time.Now().Add(d)
+	s.mut.Unlock()
+	return d
+}
+
+// scrub checks every file of the folder.
+func (s *folderScrubber) scrub() error {
+	s.model.fmut.RLock()
+	fs, ok := s.model.folderFiles[s.folder]
+	s.model.fmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	var bytes int64
+	fs.WithHaveTruncated(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(db.FileInfoTruncated)
+		if !f.IsDeleted() && !f.IsInvalid() && !f.IsDirectory() && !f.IsSymlink() {
+			names = append(names, f.Name)
+			bytes += f.Size()
+		}
+		return true
+	})
+
+	if debug {
+		l.Debugf("%v scrubbing %d files, %d bytes", s, len(names), bytes)
+	}
+
+	s.mut.Lock()
+	s.status = ScrubStatus{
+		Scrubbing:  true,
+		Started:    time.Now(),
+		FilesTotal: int64(len(names)),
+		BytesTotal: bytes,
+	}
+	s.mut.Unlock()
+	s.emitProgress()
+
+	lastProgress := time.Now()
+	var err error
+	for _, name := range names {
+		if err = s.waitIdle(); err != nil {
+			break
+		}
+
+		f, ok := s.model.CurrentFolderFile(s.folder, name)
+		if !ok {
+			continue
+		}
+		checked, corruption := s.scrubFile(f)
+		if corruption != nil {
+			s.corrupted(f, corruption)
+		}
+
+		s.mut.Lock()
+		if checked {
+			s.status.FilesChecked++
+			s.status.BytesChecked += f.Size()
+		}
+		s.mut.Unlock()
+
+		if time.Since(lastProgress) > scrubProgressIntv {
+			s.emitProgress()
+			lastProgress = time.Now()
+		}
+	}
+
+	s.mut.Lock()
+	s.status.Scrubbing = false
+	s.status.Finished = time.Now()
+	scrub := stats.ScrubStatistics{
+		Started:      s.status.Started,
+		Finished:     s.status.Finished,
+		FilesChecked: s.status.FilesChecked,
+		BytesChecked: s.status.BytesChecked,
+		Corrupted:    int64(len(s.status.Corrupted)),
+	}
+	for _, c := range s.status.Corrupted {
+		if c.Repaired {
+			scrub.Repaired++
+		}
+	}
+	s.mut.Unlock()
+
+	if err != nil {
+		return err
+	}
+	s.model.folderStatRef(s.folder).ScrubCompleted(scrub)
+	s.emitProgress()
+	return nil
+}
+
+// waitIdle returns when the folder is neither scanning nor syncing, or an
+// error when the scrubber is stopped first.
+func (s *folderScrubber) waitIdle() error {
+	for {
+		select {
+		case <-s.stop:
+			return errScrubStopped
+		default:
+		}
+
+		s.model.fmut.RLock()
+		runner, ok := s.model.folderRunners[s.folder]
+		s.model.fmut.RUnlock()
+		if !ok {
+			return errScrubStopped
+		}
+		if state, _, _ := runner.getState(); state == FolderIdle {
+			return nil
+		}
+
+		select {
+		case <-s.stop:
+			return errScrubStopped
+		case <-time.After(scrubIdleCheck):
+		}
+	}
+}
+
+// scrubFile rehashes the file if it is unchanged since it was scanned, and
+// returns whether it was checked and the mismatch found, if any.
+func (s *folderScrubber) scrubFile(f protocol.FileInfo) (bool, error) {
+	if f.IsDeleted() || f.IsInvalid() || f.IsDirectory() || f.IsSymlink() {
+		return false, nil
+	}
+
+	path := filepath.Join(s.dir, f.Name)
+	info, ok := s.unchanged(path, f)
+	if !ok {
+		// The scanner will pick up the change
+		return false, nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		if debug {
+			l.Debugln(s, "skipping", f.Name, err)
+		}
+		return false, nil
+	}
+	err = scanner.Verify(&limitedReader{fd, s.bucket}, protocol.BlockSize, f.Blocks)
+	fd.Close()
+	if err == nil {
+		return true, nil
+	}
+
+	// A change while we were reading is not corruption
+	if cur, ok := s.unchanged(path, f); !ok || !cur.ModTime().Equal(info.ModTime()) {
+		return false, nil
+	}
+	if cur, ok := s.model.CurrentFolderFile(s.folder, f.Name); !ok || !cur.Version.Equal(f.Version) {
+		return false, nil
+	}
+	return true, err
+}
+
+// unchanged returns the file info of path, and whether it has the size and
+// modification time of the file in the index.
+func (s *folderScrubber) unchanged(path string, f protocol.FileInfo) (os.FileInfo, bool) {
+	info, err := osutil.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != f.Size() {
+		return nil, false
+	}
+	return info, s.mtimes.GetMtime(f.Name, info.ModTime()).Unix() == f.Modified
+}
+
+// corrupted reports the corruption of the file, and repairs it if so
+// configured.
+func (s *folderScrubber) corrupted(f protocol.FileInfo, corruption error) {
+	l.Warnf("Scrub (folder %q, file %q): contents do not match the index: %v", s.folder, f.Name, corruption)
+
+	c := CorruptFile{
+		Path:  f.Name,
+		Error: corruption.Error(),
+		Time:  time.Now(),
+	}
+	if s.repair {
+		if err := s.repairFile(f); err != nil {
+			l.Warnf("Scrub (folder %q, file %q): repair: %v", s.folder, f.Name, err)
+			c.RepairError = err.Error()
+		} else {
+			l.Infof("Scrub (folder %q, file %q): repaired", s.folder, f.Name)
+			c.Repaired = true
+		}
+	}
+
+	s.mut.Lock()
+	s.status.Corrupted = append(s.status.Corrupted, c)
+	s.mut.Unlock()
+
+	events.Default.Log(events.FileCorrupted, map[string]interface{}{
+		"folder":      s.folder,
+		"item":        c.Path,
+		"error":       c.Error,
+		"repaired":    c.Repaired,
+		"repairError": c.RepairError,
+	})
+}
+
+// repairFile pulls the blocks of the file that do not match their hashes
+// from the devices that have the same version of the file, and replaces the
+// file with the repaired copy. The copy gets the mode and modification time
+// of the original, so that the scanner sees no change. The repair is given
+// up when the folder starts syncing or the puller wants the file.
+func (s *folderScrubber) repairFile(f protocol.FileInfo) error {
+	if g, ok := s.model.CurrentGlobalFile(s.folder, f.Name); !ok || !g.Version.Equal(f.Version) {
+		return errNoSameVersion
+	}
+	if s.syncing(f.Name) {
+		return errFolderBusy
+	}
+
+	path := filepath.Join(s.dir, f.Name)
+	info, ok := s.unchanged(path, f)
+	if !ok {
+		return errFileChanged
+	}
+
+	tempName := filepath.Join(s.dir, scrubTempName(f.Name))
+	if err := osutil.Copy(path, tempName); err != nil {
+		return err
+	}
+	defer os.Remove(tempName)
+
+	fd, err := os.OpenFile(tempName, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner.PopulateOffsets(f.Blocks)
+	buf := make([]byte, protocol.BlockSize)
+	for _, block := range f.Blocks {
+		buf = buf[:block.Size]
+		if _, err := fd.ReadAt(buf, block.Offset); err == nil {
+			if _, err := scanner.VerifyBuffer(buf, block); err == nil {
+				continue
+			}
+		}
+
+		if s.syncing(f.Name) {
+			return errFolderBusy
+		}
+		data, err := s.pullBlock(f, block)
+		if err != nil {
+			return fmt.Errorf("block at offset %d: %v", block.Offset, err)
+		}
+		if _, err := fd.WriteAt(data, block.Offset); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fd.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if err := scanner.Verify(fd, protocol.BlockSize, f.Blocks); err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tempName, info.Mode()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tempName, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	if s.syncing(f.Name) {
+		return errFolderBusy
+	}
+	if cur, ok := s.unchanged(path, f); !ok || !cur.ModTime().Equal(info.ModTime()) {
+		return errFileChanged
+	}
+	return osutil.Rename(tempName, path)
+}
+
+// syncing returns whether the folder is no longer idle, or the file is being
+// or about to be pulled, in which case the file must be left alone.
+func (s *folderScrubber) syncing(name string) bool {
+	s.model.fmut.RLock()
+	runner, ok := s.model.folderRunners[s.folder]
+	s.model.fmut.RUnlock()
+	if !ok {
+		return true
+	}
+	if state, _, _ := runner.getState(); state != FolderIdle {
+		return true
+	}
+
+	progress, queued := runner.Jobs()
+	for _, jobs := range [][]string{progress, queued} {
+		for _, job := range jobs {
+			if job == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// scrubTempName returns the name of the temporary file used to repair the
+// file. It is taken as temporary by the scanner, but never clashes with the
+// names of the puller's temporary files, which all end in ".tmp".
+func scrubTempName(name string) string {
+	return defTempNamer.TempName(name) + ".scrub"
+}
+
+// pullBlock requests the block from the devices that have the file.
+func (s *folderScrubber) pullBlock(f protocol.FileInfo, block protocol.BlockInfo) ([]byte, error) {
+	err := errNoDevice
+	for _, device := range s.model.Availability(s.folder, f.Name) {
+		var buf []byte
+		buf, err = s.model.requestGlobal(device, s.folder, f.Name, block.Offset, int(block.Size), block.Hash, 0, nil)
+		if err != nil {
+			continue
+		}
+		if _, err = scanner.VerifyBuffer(buf, block); err != nil {
+			continue
+		}
+		return buf, nil
+	}
+	return nil, err
+}
+
+func (s *folderScrubber) emitProgress() {
+	s.mut.Lock()
+	data := map[string]interface{}{
+		"folder":       s.folder,
+		"scrubbing":    s.status.Scrubbing,
+		"filesTotal":   s.status.FilesTotal,
+		"filesChecked": s.status.FilesChecked,
+		"bytesTotal":   s.status.BytesTotal,
+		"bytesChecked": s.status.BytesChecked,
+		"corrupted":    len(s.status.Corrupted),
+	}
+	s.mut.Unlock()
+
+	events.Default.Log(events.FolderScrubProgress, data)
+}
+
+// A limitedReader reads at the rate of the bucket, if any.
+type limitedReader struct {
+	r      io.Reader
+	bucket *ratelimit.Bucket
+}
+
+func (r *limitedReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	if r.bucket != nil {
+		r.bucket.Wait(int64(n))
+	}
+	return n, err
+}
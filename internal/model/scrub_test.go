@@ -0,0 +1,173 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/db"
+)
+
+// setupScrubTest returns a model with a scanned folder in a new directory
+// holding the file "file" with the given contents, and a scrubber for it.
+func setupScrubTest(t *testing.T, contents []byte, repair bool) (*Model, *folderScrubber, string) {
+	dir, err := ioutil.TempDir("", "syncthing-scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{".stfolder": nil, "file": contents} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := defaultFolderConfig
+	cfg.RawPath = dir
+	cfg.ScrubRepair = repair
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db.NewMemoryStorage())
+	m.AddFolder(cfg)
+	// A runner that is not started, and so stays idle
+	m.folderRunners[cfg.ID] = newROFolder(m, cfg.ID, time.Minute)
+	if err := m.ScanFolder(cfg.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return m, newFolderScrubber(m, cfg), dir
+}
+
+// corrupt overwrites the start of the file, keeping its modification time.
+func corrupt(t *testing.T, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("rot"), 0)
+	fd.Close()
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubFindsCorruption(t *testing.T) {
+	_, s, dir := setupScrubTest(t, []byte("some file contents"), false)
+	defer os.RemoveAll(dir)
+
+	if err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.FilesChecked != 1 || len(st.Corrupted) != 0 {
+		t.Fatalf("Incorrect status of clean scrub: %+v", st)
+	}
+
+	corrupt(t, filepath.Join(dir, "file"))
+	if err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if st.Scrubbing || st.FilesChecked != 1 || len(st.Corrupted) != 1 || st.Corrupted[0].Path != "file" || st.Corrupted[0].Repaired {
+		t.Fatalf("Incorrect status after corruption: %+v", st)
+	}
+
+	// A changed file is left to the scanner
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.FilesChecked != 0 || len(st.Corrupted) != 0 {
+		t.Fatalf("Incorrect status after change: %+v", st)
+	}
+
+	if last := s.model.FolderStatistics()["default"].LastScrub; last.Finished.IsZero() || last.FilesChecked != 0 {
+		t.Errorf("Incorrect scrub statistics: %+v", last)
+	}
+}
+
+func TestScrubRepair(t *testing.T) {
+	contents := []byte("some file contents")
+	m, s, dir := setupScrubTest(t, contents, true)
+	defer os.RemoveAll(dir)
+
+	// device1 has the same version of the file
+	f, _ := m.CurrentFolderFile("default", "file")
+	fc := &FakeConnection{id: device1, requestData: contents}
+	m.AddConnection(fc, fc)
+	m.Index(device1, "default", []protocol.FileInfo{f}, 0, nil)
+
+	path := filepath.Join(dir, "file")
+	before, _ := os.Stat(path)
+	corrupt(t, path)
+
+	if err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if len(st.Corrupted) != 1 || !st.Corrupted[0].Repaired {
+		t.Fatalf("File not repaired: %+v", st)
+	}
+
+	bs, _ := ioutil.ReadFile(path)
+	if !bytes.Equal(bs, contents) {
+		t.Errorf("Repaired file contains %q", bs)
+	}
+	if after, _ := os.Stat(path); !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("Modification time changed from %v to %v", before.ModTime(), after.ModTime())
+	}
+	if _, err := os.Stat(filepath.Join(dir, scrubTempName("file"))); !os.IsNotExist(err) {
+		t.Error("Temporary file left behind")
+	}
+}
+
+func TestScrubRepairQueuedFile(t *testing.T) {
+	contents := []byte("some file contents")
+	m, s, dir := setupScrubTest(t, contents, true)
+	defer os.RemoveAll(dir)
+
+	f, _ := m.CurrentFolderFile("default", "file")
+	fc := &FakeConnection{id: device1, requestData: contents}
+	m.AddConnection(fc, fc)
+	m.Index(device1, "default", []protocol.FileInfo{f}, 0, nil)
+
+	// The puller has the file queued, and its temporary file in place
+	p := newRWFolder(m, m.shortID, defaultFolderConfig)
+	p.queue.Push("file", 0, 0)
+	m.fmut.Lock()
+	m.folderRunners["default"] = p
+	m.fmut.Unlock()
+	pullerTemp := filepath.Join(dir, defTempNamer.TempName("file"))
+	if err := ioutil.WriteFile(pullerTemp, []byte("puller"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "file")
+	corrupt(t, path)
+	if err := s.scrub(); err != nil {
+		t.Fatal(err)
+	}
+	st := s.Status()
+	if len(st.Corrupted) != 1 || st.Corrupted[0].Repaired || st.Corrupted[0].RepairError != errFolderBusy.Error() {
+		t.Fatalf("Queued file should not be repaired: %+v", st)
+	}
+	if bs, _ := ioutil.ReadFile(path); bytes.Equal(bs, contents) {
+		t.Error("Queued file was replaced")
+	}
+	if bs, _ := ioutil.ReadFile(pullerTemp); string(bs) != "puller" {
+		t.Errorf("Temporary file of the puller was changed to %q", bs)
+	}
+}
@@ -24,18 +24,23 @@ type sharedPullerState struct {
 	folder      string
 	tempName    string
 	realName    string
-	reused      int // Number of blocks reused from temporary file
+	reused      int   // Number of blocks reused from temporary file
+	reusedBytes int64 // Size of the blocks reused from temporary file
 	ignorePerms bool
 	version     protocol.Vector // The current (old) version
 
 	// Mutable, must be locked for access
 	err        error      // The first error we hit
+	errStage   string     // Where we hit it
 	fd         *os.File   // The fd of the temp file
 	copyTotal  int        // Total number of copy actions for the whole job
 	pullTotal  int        // Total number of pull actions for the whole job
 	copyOrigin int        // Number of blocks copied from the original file
 	copyNeeded int        // Number of copy actions still pending
 	pullNeeded int        // Number of block pulls still pending
+	available  []int32    // Indexes of the blocks present in the temp file, in the order they arrived
+	copiedB    int64      // Bytes copied from local files
+	pulledB    int64      // Bytes pulled from the network
 	mut        sync.Mutex // Protects the above
 }
 
@@ -164,6 +169,7 @@ func (s *sharedPullerState) failLocked(context string, err error) {
 
 	l.Infof("Puller (folder %q, file %q): %s: %v", s.folder, s.file.Name, context, err)
 	s.err = err
+	s.errStage = context
 }
 
 func (s *sharedPullerState) failed() error {
@@ -173,9 +179,19 @@ func (s *sharedPullerState) failed() error {
 	return s.err
 }
 
-func (s *sharedPullerState) copyDone() {
+// failure returns the first error and the context it was hit in.
+func (s *sharedPullerState) failure() (string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.errStage, s.err
+}
+
+func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.copyNeeded--
+	s.copiedB += int64(block.Size)
+	s.available = append(s.available, int32(block.Offset/protocol.BlockSize))
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
@@ -200,15 +216,25 @@ func (s *sharedPullerState) pullStarted() {
 	s.mut.Unlock()
 }
 
-func (s *sharedPullerState) pullDone() {
+func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.pullNeeded--
+	s.pulledB += int64(block.Size)
+	s.available = append(s.available, int32(block.Offset/protocol.BlockSize))
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+// transferred returns the number of bytes of the file pulled from the
+// network, and the number reused from local files.
+func (s *sharedPullerState) transferred() (network, reused int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.pulledB, s.copiedB + s.reusedBytes
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -230,6 +256,16 @@ func (s *sharedPullerState) finalClose() (bool, error) {
 	return false, nil
 }
 
+// Available returns the indexes of the blocks present in the temp file. New
+// blocks are always added at the end.
+func (s *sharedPullerState) Available() []int32 {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	available := make([]int32, len(s.available))
+	copy(available, s.available)
+	return available
+}
+
 // Returns the momentarily progress for the puller
 func (s *sharedPullerState) Progress() *pullerProgress {
 	s.mut.Lock()
@@ -0,0 +1,88 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errNoGateway = errors.New("no default gateway found")
+
+// parseRoutes finds the default gateway in a routing table in the format of
+// /proc/net/route, where addresses are hex encoded 32 bit numbers holding
+// the address bytes in the given (host) byte order.
+func parseRoutes(r io.Reader, order binary.ByteOrder) (net.IP, error) {
+	const rtfGateway = 0x2
+
+	sc := bufio.NewScanner(r)
+	sc.Scan() // skip the header
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&rtfGateway == 0 {
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := make(net.IP, 4)
+		order.PutUint32(ip, uint32(addr))
+		return ip, nil
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errNoGateway
+}
+
+// parseNetstat finds the default gateway in the output of "netstat -rn" on
+// BSD systems and Mac OS X, where its line starts with "default".
+func parseNetstat(r io.Reader) (net.IP, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || fields[0] != "default" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errNoGateway
+}
+
+// parseRoutePrint finds the default gateway in the output of "route print"
+// on Windows, as the gateway of the route to 0.0.0.0/0.
+func parseRoutePrint(r io.Reader) (net.IP, error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 3 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if ip := net.ParseIP(fields[2]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errNoGateway
+}
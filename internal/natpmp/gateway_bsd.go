@@ -0,0 +1,25 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build darwin freebsd dragonfly netbsd openbsd
+
+package natpmp
+
+import (
+	"bytes"
+	"net"
+	"os/exec"
+)
+
+// DefaultGateway returns the IPv4 address of the default gateway, as listed
+// by netstat.
+func DefaultGateway() (net.IP, error) {
+	out, err := exec.Command("netstat", "-rn", "-f", "inet").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseNetstat(bytes.NewReader(out))
+}
@@ -0,0 +1,35 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"unsafe"
+)
+
+// DefaultGateway returns the IPv4 address of the default gateway, as found
+// in /proc/net/route.
+func DefaultGateway() (net.IP, error) {
+	fd, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parseRoutes(fd, hostByteOrder())
+}
+
+// hostByteOrder returns the byte order of the machine we run on.
+func hostByteOrder() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
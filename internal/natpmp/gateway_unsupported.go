@@ -0,0 +1,21 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build !linux,!darwin,!freebsd,!dragonfly,!netbsd,!openbsd,!windows
+
+package natpmp
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// DefaultGateway returns an error, as finding the default gateway is not
+// supported on this platform.
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("default gateway discovery not supported on " + runtime.GOOS)
+}
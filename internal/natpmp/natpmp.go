@@ -0,0 +1,235 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package natpmp implements a client for setting up port mappings on a
+// gateway using PCP (RFC 6887), or NAT-PMP (RFC 6886) for gateways that
+// don't speak PCP.
+package natpmp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Port is the UDP port that gateways listen on for both protocols.
+const Port = 5351
+
+type Protocol int
+
+const (
+	TCP Protocol = 6
+	UDP Protocol = 17
+)
+
+// Mapping methods
+const (
+	MethodPCP    = "pcp"
+	MethodNATPMP = "nat-pmp"
+)
+
+// A Mapping is a port mapping set up on the gateway.
+type Mapping struct {
+	Method       string // MethodPCP or MethodNATPMP
+	Protocol     Protocol
+	InternalPort int
+	ExternalPort int
+	ExternalIP   net.IP
+	Lifetime     time.Duration // as granted by the gateway
+}
+
+var (
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errTimeout            = errors.New("no response from gateway")
+)
+
+// NAT-PMP result codes
+var natpmpResults = []string{
+	"success",
+	"unsupported version",
+	"not authorized or refused",
+	"network failure",
+	"out of resources",
+	"unsupported opcode",
+}
+
+// A Client talks to one gateway. The same Client should be used to renew
+// and remove the mappings it has set up, as PCP gateways only accept those
+// from the client that set up the mapping.
+type Client struct {
+	gateway *net.UDPAddr
+	timeout time.Duration
+	nonce   [12]byte // identifies our PCP mappings
+}
+
+// NewClient returns a client for the given gateway, giving up on requests
+// that have not been answered within the timeout.
+func NewClient(gateway net.IP, timeout time.Duration) *Client {
+	c := &Client{
+		gateway: &net.UDPAddr{IP: gateway, Port: Port},
+		timeout: timeout,
+	}
+	rand.Read(c.nonce[:])
+	return c
+}
+
+// Gateway returns the address of the gateway.
+func (c *Client) Gateway() net.IP {
+	return c.gateway.IP
+}
+
+// Map asks the gateway to map an external port to the given internal port
+// for the given lifetime, preferably the suggested external port. PCP is
+// tried first, and NAT-PMP if the gateway doesn't answer PCP requests.
+func (c *Client) Map(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	m, err := c.mapPCP(proto, internalPort, suggestedPort, lifetime)
+	if err == errUnsupportedVersion || err == errTimeout {
+		if debug {
+			l.Debugf("natpmp: PCP mapping on %s: %v; trying NAT-PMP", c.gateway, err)
+		}
+		m, err = c.mapNATPMP(proto, internalPort, suggestedPort, lifetime)
+	}
+	return m, err
+}
+
+// Unmap removes a mapping that was set up by Map.
+func (c *Client) Unmap(m Mapping) error {
+	var err error
+	switch m.Method {
+	case MethodPCP:
+		_, err = c.mapPCP(m.Protocol, m.InternalPort, 0, 0)
+	case MethodNATPMP:
+		_, err = c.mapNATPMP(m.Protocol, m.InternalPort, 0, 0)
+	default:
+		err = fmt.Errorf("unknown mapping method %q", m.Method)
+	}
+	return err
+}
+
+// ExternalAddress returns the external address of the gateway, as reported
+// over NAT-PMP.
+func (c *Client) ExternalAddress() (net.IP, error) {
+	resp, err := c.roundTrip([]byte{0, 0}, func(resp []byte) bool {
+		return len(resp) >= 12 && resp[0] == 0 && resp[1] == 128
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := natpmpResult(resp); err != nil {
+		return nil, err
+	}
+	return net.IP(append([]byte(nil), resp[8:12]...)), nil
+}
+
+func (c *Client) mapNATPMP(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	var op byte
+	switch proto {
+	case UDP:
+		op = 1
+	case TCP:
+		op = 2
+	default:
+		return Mapping{}, fmt.Errorf("unsupported protocol %d", proto)
+	}
+
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(req[6:], uint16(suggestedPort))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+
+	resp, err := c.roundTrip(req, func(resp []byte) bool {
+		return len(resp) >= 16 && resp[0] == 0 && resp[1] == 128+op &&
+			int(binary.BigEndian.Uint16(resp[8:])) == internalPort
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+	if err := natpmpResult(resp); err != nil {
+		return Mapping{}, err
+	}
+
+	m := Mapping{
+		Method:       MethodNATPMP,
+		Protocol:     proto,
+		InternalPort: internalPort,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}
+	if lifetime > 0 {
+		// NAT-PMP mapping responses don't include the external address.
+		if m.ExternalIP, err = c.ExternalAddress(); err != nil {
+			return Mapping{}, err
+		}
+	}
+	return m, nil
+}
+
+func natpmpResult(resp []byte) error {
+	code := int(binary.BigEndian.Uint16(resp[2:]))
+	if code == 0 {
+		return nil
+	}
+	if code < len(natpmpResults) {
+		return fmt.Errorf("nat-pmp: %s", natpmpResults[code])
+	}
+	return fmt.Errorf("nat-pmp: unknown result code %d", code)
+}
+
+// roundTrip sends the request to the gateway and returns the first response
+// accepted by the valid function. The request is retransmitted at doubling
+// intervals, starting at 250 ms as per the RFCs, until the timeout expires.
+func (c *Client) roundTrip(req []byte, valid func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, c.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return roundTripConn(conn, req, valid, c.timeout)
+}
+
+func roundTripConn(conn *net.UDPConn, req []byte, valid func([]byte) bool, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	interval := 250 * time.Millisecond
+	buf := make([]byte, 1100) // the largest PCP message
+
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		next := time.Now().Add(interval)
+		if next.After(deadline) {
+			next = deadline
+		}
+		interval *= 2
+
+		conn.SetReadDeadline(next)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if err, ok := err.(net.Error); ok && err.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n >= 4 && buf[0] == 0 && req[0] != 0 && binary.BigEndian.Uint16(buf[2:]) == 1 {
+				// A NAT-PMP gateway telling us it doesn't understand our
+				// PCP request.
+				return nil, errUnsupportedVersion
+			}
+			if valid(buf[:n]) {
+				return append([]byte(nil), buf[:n]...), nil
+			}
+		}
+	}
+
+	return nil, errTimeout
+}
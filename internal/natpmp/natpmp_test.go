@@ -0,0 +1,275 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/internal/sync"
+)
+
+var externalIP = net.IPv4(192, 0, 2, 1).To4()
+
+// fakeGateway answers PCP MAP requests when pcp is set, and NAT-PMP
+// requests otherwise. Mappings are granted on the suggested external port,
+// or the internal port when none is suggested.
+type fakeGateway struct {
+	conn     *net.UDPConn
+	pcp      bool
+	lifetime uint32     // the last requested lifetime
+	mut      sync.Mutex // protects lifetime
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{conn: conn, pcp: pcp, mut: sync.NewMutex()}
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) client() *Client {
+	c := NewClient(net.IPv4(127, 0, 0, 1), time.Second)
+	c.gateway.Port = g.conn.LocalAddr().(*net.UDPAddr).Port
+	return c
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+
+		var resp []byte
+		switch {
+		case req[0] == pcpVersion && g.pcp:
+			resp = g.pcpMap(req)
+		case req[0] == pcpVersion:
+			// NAT-PMP gateways answer with an unsupported version error
+			resp = []byte{0, 128 + req[1], 0, 1, 0, 0, 0, 0}
+		case req[0] == 0 && !g.pcp:
+			resp = g.natpmp(req)
+		default:
+			continue
+		}
+		g.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func (g *fakeGateway) setLifetime(lifetime uint32) {
+	g.mut.Lock()
+	g.lifetime = lifetime
+	g.mut.Unlock()
+}
+
+// lastLifetime returns the lifetime of the last mapping request.
+func (g *fakeGateway) lastLifetime() uint32 {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	return g.lifetime
+}
+
+func (g *fakeGateway) pcpMap(req []byte) []byte {
+	g.setLifetime(binary.BigEndian.Uint32(req[4:]))
+
+	resp := make([]byte, pcpHeaderLen+pcpMapLen)
+	resp[0] = pcpVersion
+	resp[1] = pcpResponse | pcpOpMap
+	copy(resp[4:8], req[4:8])
+	copy(resp[pcpHeaderLen:], req[pcpHeaderLen:pcpHeaderLen+20])
+
+	payload := resp[pcpHeaderLen:]
+	port := binary.BigEndian.Uint16(req[pcpHeaderLen+18:])
+	if port == 0 {
+		port = binary.BigEndian.Uint16(req[pcpHeaderLen+16:])
+	}
+	binary.BigEndian.PutUint16(payload[18:], port)
+	copy(payload[20:36], externalIP.To16())
+	return resp
+}
+
+func (g *fakeGateway) natpmp(req []byte) []byte {
+	if req[1] == 0 {
+		resp := make([]byte, 12)
+		resp[1] = 128
+		copy(resp[8:], externalIP)
+		return resp
+	}
+
+	g.setLifetime(binary.BigEndian.Uint32(req[8:]))
+
+	resp := make([]byte, 16)
+	resp[1] = 128 + req[1]
+	copy(resp[8:10], req[4:6])
+	port := binary.BigEndian.Uint16(req[6:])
+	if port == 0 {
+		port = binary.BigEndian.Uint16(req[4:])
+	}
+	binary.BigEndian.PutUint16(resp[10:], port)
+	copy(resp[12:16], req[8:12])
+	return resp
+}
+
+func TestMapPCP(t *testing.T) {
+	g := newFakeGateway(t, true)
+	defer g.conn.Close()
+	c := g.client()
+
+	m, err := c.Map(TCP, 22000, 23456, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Method != MethodPCP {
+		t.Errorf("Unexpected method %q", m.Method)
+	}
+	if m.ExternalPort != 23456 || m.InternalPort != 22000 {
+		t.Errorf("Unexpected ports %d -> %d", m.ExternalPort, m.InternalPort)
+	}
+	if !m.ExternalIP.Equal(externalIP) {
+		t.Errorf("Unexpected external IP %v", m.ExternalIP)
+	}
+	if m.Lifetime != time.Hour {
+		t.Errorf("Unexpected lifetime %v", m.Lifetime)
+	}
+
+	if err := c.Unmap(m); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := g.lastLifetime(); lifetime != 0 {
+		t.Errorf("Unmap should request a zero lifetime, not %d", lifetime)
+	}
+}
+
+func TestMapNATPMP(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	c := g.client()
+
+	m, err := c.Map(TCP, 22000, 0, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Method != MethodNATPMP {
+		t.Errorf("Unexpected method %q", m.Method)
+	}
+	if m.ExternalPort != 22000 {
+		t.Errorf("Unexpected external port %d", m.ExternalPort)
+	}
+	if !m.ExternalIP.Equal(externalIP) {
+		t.Errorf("Unexpected external IP %v", m.ExternalIP)
+	}
+	if m.Lifetime != 2*time.Hour {
+		t.Errorf("Unexpected lifetime %v", m.Lifetime)
+	}
+
+	if err := c.Unmap(m); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := g.lastLifetime(); lifetime != 0 {
+		t.Errorf("Unmap should request a zero lifetime, not %d", lifetime)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := NewClient(net.IPv4(127, 0, 0, 1), 600*time.Millisecond)
+	c.gateway.Port = conn.LocalAddr().(*net.UDPAddr).Port
+
+	t0 := time.Now()
+	if _, err := c.Map(TCP, 22000, 0, time.Hour); err != errTimeout {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	// PCP and then NAT-PMP should each have waited for the timeout.
+	if d := time.Since(t0); d < 1200*time.Millisecond || d > 3*time.Second {
+		t.Errorf("Unexpected time until giving up: %v", d)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+`
+	ip, err := parseRoutes(strings.NewReader(routes), binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Unexpected gateway %v", ip)
+	}
+
+	// The same table on a big endian host
+	routes = strings.Replace(routes, "0101A8C0", "C0A80101", 1)
+	ip, err = parseRoutes(strings.NewReader(routes), binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Unexpected gateway %v on big endian host", ip)
+	}
+
+	if _, err := parseRoutes(strings.NewReader(strings.SplitN(routes, "\n", 3)[0]), binary.LittleEndian); err != errNoGateway {
+		t.Errorf("Expected no gateway, got %v", err)
+	}
+}
+
+func TestParseNetstat(t *testing.T) {
+	routes := `Routing tables
+
+Internet:
+Destination        Gateway            Flags        Refs      Use   Netif Expire
+default            192.168.1.1        UGSc           12        0     en0
+127                127.0.0.1          UCS             0        0     lo0
+`
+	ip, err := parseNetstat(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Unexpected gateway %v", ip)
+	}
+
+	if _, err := parseNetstat(strings.NewReader(strings.SplitN(routes, "default", 2)[0])); err != errNoGateway {
+		t.Errorf("Expected no gateway, got %v", err)
+	}
+}
+
+func TestParseRoutePrint(t *testing.T) {
+	routes := `===========================================================================
+IPv4 Route Table
+===========================================================================
+Active Routes:
+Network Destination        Netmask          Gateway       Interface  Metric
+          0.0.0.0          0.0.0.0      192.168.1.1    192.168.1.100     25
+===========================================================================
+`
+	ip, err := parseRoutePrint(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Unexpected gateway %v", ip)
+	}
+
+	if _, err := parseRoutePrint(strings.NewReader(strings.SplitN(routes, "Active", 2)[0])); err != errNoGateway {
+		t.Errorf("Expected no gateway, got %v", err)
+	}
+}
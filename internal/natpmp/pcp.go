@@ -0,0 +1,102 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package natpmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	pcpVersion   = 2
+	pcpOpMap     = 1
+	pcpResponse  = 0x80
+	pcpHeaderLen = 24
+	pcpMapLen    = 36
+)
+
+// PCP result codes
+var pcpResults = []string{
+	"success",
+	"unsupported version",
+	"not authorized",
+	"malformed request",
+	"unsupported opcode",
+	"unsupported option",
+	"malformed option",
+	"network failure",
+	"no resources",
+	"unsupported protocol",
+	"user exceeded quota",
+	"cannot provide external",
+	"address mismatch",
+	"excessive remote peers",
+}
+
+func (c *Client) mapPCP(proto Protocol, internalPort, suggestedPort int, lifetime time.Duration) (Mapping, error) {
+	conn, err := net.DialUDP("udp", nil, c.gateway)
+	if err != nil {
+		return Mapping{}, err
+	}
+	defer conn.Close()
+
+	// The request header carries our own address as seen by the gateway,
+	// the MAP payload what we would like to have mapped.
+	req := make([]byte, pcpHeaderLen+pcpMapLen)
+	req[0] = pcpVersion
+	req[1] = pcpOpMap
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], conn.LocalAddr().(*net.UDPAddr).IP.To16())
+
+	payload := req[pcpHeaderLen:]
+	copy(payload[0:12], c.nonce[:])
+	payload[12] = byte(proto)
+	binary.BigEndian.PutUint16(payload[16:], uint16(internalPort))
+	binary.BigEndian.PutUint16(payload[18:], uint16(suggestedPort))
+	copy(payload[20:36], net.IPv6zero)
+	if lifetime > 0 {
+		// An IPv4 mapped unspecified address lets the gateway pick the
+		// external IPv4 address.
+		copy(payload[20:36], net.IPv4zero.To16())
+	}
+
+	resp, err := roundTripConn(conn, req, func(resp []byte) bool {
+		return len(resp) >= pcpHeaderLen+pcpMapLen &&
+			resp[0] == pcpVersion && resp[1] == pcpResponse|pcpOpMap &&
+			bytes.Equal(resp[pcpHeaderLen:pcpHeaderLen+12], c.nonce[:])
+	}, c.timeout)
+	if err != nil {
+		return Mapping{}, err
+	}
+
+	if code := int(resp[3]); code != 0 {
+		if code == 1 {
+			return Mapping{}, errUnsupportedVersion
+		}
+		if code < len(pcpResults) {
+			return Mapping{}, fmt.Errorf("pcp: %s", pcpResults[code])
+		}
+		return Mapping{}, fmt.Errorf("pcp: unknown result code %d", code)
+	}
+
+	payload = resp[pcpHeaderLen:]
+	ip := net.IP(append([]byte(nil), payload[20:36]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return Mapping{
+		Method:       MethodPCP,
+		Protocol:     proto,
+		InternalPort: internalPort,
+		ExternalPort: int(binary.BigEndian.Uint16(payload[18:])),
+		ExternalIP:   ip,
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second,
+	}, nil
+}
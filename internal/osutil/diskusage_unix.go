@@ -0,0 +1,23 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build linux android darwin freebsd dragonfly
+
+package osutil
+
+import "syscall"
+
+// DiskUsage returns the number of bytes available to us and the total size
+// of the disk holding the given path.
+func DiskUsage(path string) (free, total int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	// Bavail is the number of blocks available to unprivileged users, as
+	// opposed to Bfree which includes the blocks reserved for root.
+	return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
@@ -106,6 +106,37 @@ func Remove(path string) error {
 	return os.Remove(path)
 }
 
+// SyncFile flushes the contents of the given file to disk.
+func SyncFile(path string) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// SyncDir flushes the given directory to disk, making the creation, removal
+// or renaming of the files in it durable. Directories cannot be synced on
+// Windows, where this does nothing.
+func SyncDir(path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func ExpandTilde(path string) (string, error) {
 	if path == "~" {
 		return getHomeDir()
@@ -7,6 +7,7 @@
 package osutil_test
 
 import (
+	"io/ioutil"
 	"os"
 	"runtime"
 	"testing"
@@ -164,3 +165,37 @@ func TestInWritableDirWindowsRename(t *testing.T) {
 		}
 	}
 }
+
+func TestDiskUsage(t *testing.T) {
+	free, total, err := osutil.DiskUsage(".")
+	if err != nil {
+		t.Skip("disk usage not available:", err)
+	}
+	if total <= 0 || free < 0 || free > total {
+		t.Errorf("Unexpected disk usage: %d free of %d", free, total)
+	}
+
+	if _, _, err := osutil.DiskUsage("testdata/does/not/exist"); err == nil {
+		t.Error("Unexpected nil error for nonexistent path")
+	}
+}
+
+func TestSync(t *testing.T) {
+	os.RemoveAll("testdata")
+	defer os.RemoveAll("testdata")
+
+	os.Mkdir("testdata", 0700)
+	if err := ioutil.WriteFile("testdata/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := osutil.SyncFile("testdata/file"); err != nil {
+		t.Error(err)
+	}
+	if err := osutil.SyncDir("testdata"); err != nil {
+		t.Error(err)
+	}
+	if err := osutil.SyncFile("testdata/does/not/exist"); err == nil {
+		t.Error("Unexpected nil error for nonexistent file")
+	}
+}
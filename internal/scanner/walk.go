@@ -47,6 +47,9 @@ type Walker struct {
 	BlockSize int
 	// If Matcher is not nil, it is used to identify files to ignore which were specified by the user.
 	Matcher *ignore.Matcher
+	// If Selected is not nil, files and directories for which it returns
+	// false are skipped.
+	Selected func(name string) bool
 	// If TempNamer is not nil, it is used to ignore temporary files when walking.
 	TempNamer TempNamer
 	// Number of hours to keep temporary files for
@@ -161,7 +164,8 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 		}
 
 		if sn := filepath.Base(rn); sn == ".stignore" || sn == ".stfolder" ||
-			strings.HasPrefix(rn, ".stversions") || w.Matcher.Match(rn) {
+			strings.HasPrefix(rn, ".stversions") || w.Matcher.Match(rn) ||
+			(w.Selected != nil && !w.Selected(rn)) {
 			// An ignored file
 			if debug {
 				l.Debugln("ignored:", rn)
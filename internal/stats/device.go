@@ -7,27 +7,45 @@
 package stats
 
 import (
+	"encoding/binary"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/db"
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syncthing/syncthing/internal/sync"
 )
 
 type DeviceStatistics struct {
-	LastSeen time.Time `json:"lastSeen"`
+	LastSeen         time.Time        `json:"lastSeen"`
+	LastAddress      string           `json:"lastAddress"`
+	Connections      int64            `json:"connections"`      // number of connections made
+	ConnectedSeconds int64            `json:"connectedSeconds"` // total time connected
+	InBytesTotal     int64            `json:"inBytesTotal"`
+	OutBytesTotal    int64            `json:"outBytesTotal"`
+	History          []DeviceTransfer `json:"history,omitempty"`
+}
+
+// A DeviceTransfer is the traffic with a device during the hour starting
+// at Hour.
+type DeviceTransfer struct {
+	Hour             time.Time `json:"hour"`
+	InBytes          int64     `json:"inBytes"`
+	OutBytes         int64     `json:"outBytes"`
+	ConnectedSeconds int64     `json:"connectedSeconds"`
 }
 
 type DeviceStatisticsReference struct {
 	ns     *db.NamespacedKV
 	device protocol.DeviceID
+	mut    sync.Mutex // serializes the updates of the counters
 }
 
-func NewDeviceStatisticsReference(ldb *leveldb.DB, device protocol.DeviceID) *DeviceStatisticsReference {
+func NewDeviceStatisticsReference(ldb db.Storage, device protocol.DeviceID) *DeviceStatisticsReference {
 	prefix := string(db.KeyTypeDeviceStatistic) + device.String()
 	return &DeviceStatisticsReference{
 		ns:     db.NewNamespacedKV(ldb, prefix),
 		device: device,
+		mut:    sync.NewMutex(),
 	}
 }
 
@@ -51,8 +69,119 @@ func (s *DeviceStatisticsReference) WasSeen() {
 	s.ns.PutTime("lastSeen", time.Now())
 }
 
+// WasConnected records a new connection to the device at the address.
+func (s *DeviceStatisticsReference) WasConnected(address string) {
+	if debug {
+		l.Debugln("stats.DeviceStatisticsReference.WasConnected:", s.device, address)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	n, _ := s.ns.Int64("connections")
+	s.ns.PutInt64("connections", n+1)
+	if address != "" {
+		s.ns.PutString("lastAddress", address)
+	}
+	s.ns.PutTime("lastSeen", time.Now())
+}
+
+// AddTransfer adds the traffic with the device, and the time connected to
+// it, since the last call to the totals and to the current hour. The hours
+// older than historyRetention are removed.
+func (s *DeviceStatisticsReference) AddTransfer(in, out int64, connected time.Duration) {
+	if in == 0 && out == 0 && connected == 0 {
+		return
+	}
+	if debug {
+		l.Debugln("stats.DeviceStatisticsReference.AddTransfer:", s.device, in, out, connected)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for key, val := range map[string]int64{
+		"inBytesTotal":  in,
+		"outBytesTotal": out,
+		"connectedNs":   int64(connected),
+	} {
+		n, _ := s.ns.Int64(key)
+		s.ns.PutInt64(key, n+val)
+	}
+
+	hour := time.Now().Truncate(time.Hour)
+	key := hourKey(hour)
+	bs, _ := s.ns.Bytes(key)
+	t := decodeTransfer(hour, bs)
+	t.InBytes += in
+	t.OutBytes += out
+	t.ConnectedSeconds += int64(connected / time.Second)
+	s.ns.PutBytes(key, encodeTransfer(t))
+
+	var old []string
+	s.ns.Iterate(hourKeyPrefix, hourKey(hour.Add(-historyRetention)), func(key string, _ []byte) bool {
+		old = append(old, key)
+		return true
+	})
+	for _, key := range old {
+		s.ns.Delete(key)
+	}
+}
+
 func (s *DeviceStatisticsReference) GetStatistics() DeviceStatistics {
-	return DeviceStatistics{
-		LastSeen: s.GetLastSeen(),
+	var st DeviceStatistics
+	st.LastSeen = s.GetLastSeen()
+	st.LastAddress, _ = s.ns.String("lastAddress")
+	st.Connections, _ = s.ns.Int64("connections")
+	connected, _ := s.ns.Int64("connectedNs")
+	st.ConnectedSeconds = int64(time.Duration(connected) / time.Second)
+	st.InBytesTotal, _ = s.ns.Int64("inBytesTotal")
+	st.OutBytesTotal, _ = s.ns.Int64("outBytesTotal")
+	return st
+}
+
+// GetHistory returns the traffic of the hours that overlap the time from
+// from to to, leaving out the hours without any traffic.
+func (s *DeviceStatisticsReference) GetHistory(from, to time.Time) []DeviceTransfer {
+	var res []DeviceTransfer
+	s.ns.Iterate(hourKey(from.Truncate(time.Hour)), hourKey(to), func(key string, val []byte) bool {
+		hour := time.Unix(int64(binary.BigEndian.Uint64([]byte(key[len(hourKeyPrefix):]))), 0)
+		res = append(res, decodeTransfer(hour, val))
+		return true
+	})
+	return res
+}
+
+// The traffic of each hour is stored under hourKeyPrefix and the start of
+// the hour, in Unix seconds, as eight big endian bytes so that the hours
+// sort in order.
+const hourKeyPrefix = "hour/"
+
+// historyRetention is how long the traffic of each hour is kept.
+const historyRetention = 90 * 24 * time.Hour
+
+func hourKey(hour time.Time) string {
+	var bs [8]byte
+	if hour.Unix() > 0 {
+		binary.BigEndian.PutUint64(bs[:], uint64(hour.Unix()))
+	}
+	return hourKeyPrefix + string(bs[:])
+}
+
+func encodeTransfer(t DeviceTransfer) []byte {
+	bs := make([]byte, 24)
+	binary.BigEndian.PutUint64(bs, uint64(t.InBytes))
+	binary.BigEndian.PutUint64(bs[8:], uint64(t.OutBytes))
+	binary.BigEndian.PutUint64(bs[16:], uint64(t.ConnectedSeconds))
+	return bs
+}
+
+func decodeTransfer(hour time.Time, bs []byte) DeviceTransfer {
+	t := DeviceTransfer{Hour: hour}
+	if len(bs) == 24 {
+		t.InBytes = int64(binary.BigEndian.Uint64(bs))
+		t.OutBytes = int64(binary.BigEndian.Uint64(bs[8:]))
+		t.ConnectedSeconds = int64(binary.BigEndian.Uint64(bs[16:]))
 	}
+	return t
 }
@@ -10,16 +10,21 @@ import (
 	"time"
 
 	"github.com/syncthing/syncthing/internal/db"
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syncthing/syncthing/internal/sync"
 )
 
 type FolderStatistics struct {
-	LastFile LastFile `json:"lastFile"`
+	LastFile  LastFile        `json:"lastFile"`
+	LastScan  ScanStatistics  `json:"lastScan"`
+	LastPull  PullStatistics  `json:"lastPull"`
+	LastScrub ScrubStatistics `json:"lastScrub"`
+	Errors    ErrorCounts     `json:"errors"`
 }
 
 type FolderStatisticsReference struct {
 	ns     *db.NamespacedKV
 	folder string
+	mut    sync.Mutex // serializes the updates of the counters
 }
 
 type LastFile struct {
@@ -27,11 +32,65 @@ type LastFile struct {
 	Filename string    `json:"filename"`
 }
 
-func NewFolderStatisticsReference(ldb *leveldb.DB, folder string) *FolderStatisticsReference {
+// ScanStatistics describe a scan of the folder.
+type ScanStatistics struct {
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"`
+	Duration    float64   `json:"duration"` // seconds
+	FilesHashed int64     `json:"filesHashed"`
+	BytesHashed int64     `json:"bytesHashed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// PullStatistics describe a puller iteration of the folder. The bytes of
+// the pulled files come either from the network, or are reused from files
+// already present locally.
+type PullStatistics struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Result       string    `json:"result"` // "ok" or "errors"
+	Error        string    `json:"error,omitempty"`
+	Changed      int64     `json:"changed"` // items handled, including deletes
+	FilesPulled  int64     `json:"filesPulled"`
+	FilesFailed  int64     `json:"filesFailed"`
+	NetworkBytes int64     `json:"networkBytes"`
+	ReusedBytes  int64     `json:"reusedBytes"`
+
+	// The cost of the durability options of the folder
+	FilesVerified int64   `json:"filesVerified"`
+	VerifySeconds float64 `json:"verifySeconds"`
+	FsyncSeconds  float64 `json:"fsyncSeconds"`
+}
+
+// ScrubStatistics describe a rehash of the unchanged files of the folder.
+type ScrubStatistics struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	FilesChecked int64     `json:"filesChecked"`
+	BytesChecked int64     `json:"bytesChecked"`
+	Corrupted    int64     `json:"corrupted"`
+	Repaired     int64     `json:"repaired"`
+}
+
+// The PullStatistics results
+const (
+	PullResultOK     = "ok"
+	PullResultErrors = "errors"
+)
+
+// ErrorCounts are the number of failed scans and of files that failed to
+// pull, over the lifetime of the folder.
+type ErrorCounts struct {
+	Scan int64 `json:"scan"`
+	Pull int64 `json:"pull"`
+}
+
+func NewFolderStatisticsReference(ldb db.Storage, folder string) *FolderStatisticsReference {
 	prefix := string(db.KeyTypeFolderStatistic) + folder
 	return &FolderStatisticsReference{
 		ns:     db.NewNamespacedKV(ldb, prefix),
 		folder: folder,
+		mut:    sync.NewMutex(),
 	}
 }
 
@@ -58,8 +117,149 @@ func (s *FolderStatisticsReference) ReceivedFile(filename string) {
 	s.ns.PutString("lastFileName", filename)
 }
 
+// ScanCompleted records the scan, which failed if err is not nil.
+func (s *FolderStatisticsReference) ScanCompleted(scan ScanStatistics, err error) {
+	if scan.Finished.IsZero() {
+		scan.Finished = time.Now()
+	}
+	scan.Duration = scan.Finished.Sub(scan.Started).Seconds()
+	if err != nil {
+		scan.Error = err.Error()
+	}
+	if debug {
+		l.Debugf("stats.FolderStatisticsReference.ScanCompleted: %s %+v", s.folder, scan)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.ns.PutTime("scanStarted", scan.Started)
+	s.ns.PutTime("scanFinished", scan.Finished)
+	s.ns.PutInt64("scanFilesHashed", scan.FilesHashed)
+	s.ns.PutInt64("scanBytesHashed", scan.BytesHashed)
+	s.ns.PutString("scanError", scan.Error)
+	if err != nil {
+		n, _ := s.ns.Int64("scanErrors")
+		s.ns.PutInt64("scanErrors", n+1)
+	}
+}
+
+// PullCompleted records the puller iteration. The result is set from the
+// number of failed files and the error.
+func (s *FolderStatisticsReference) PullCompleted(pull PullStatistics) {
+	if pull.Finished.IsZero() {
+		pull.Finished = time.Now()
+	}
+	pull.Result = PullResultOK
+	if pull.FilesFailed > 0 || pull.Error != "" {
+		pull.Result = PullResultErrors
+	}
+	if debug {
+		l.Debugf("stats.FolderStatisticsReference.PullCompleted: %s %+v", s.folder, pull)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.ns.PutTime("pullStarted", pull.Started)
+	s.ns.PutTime("pullFinished", pull.Finished)
+	s.ns.PutString("pullResult", pull.Result)
+	s.ns.PutString("pullError", pull.Error)
+	for key, val := range map[string]int64{
+		"pullChanged":       pull.Changed,
+		"pullFilesPulled":   pull.FilesPulled,
+		"pullFilesFailed":   pull.FilesFailed,
+		"pullNetworkBytes":  pull.NetworkBytes,
+		"pullReusedBytes":   pull.ReusedBytes,
+		"pullFilesVerified": pull.FilesVerified,
+		"pullVerifyNs":      int64(pull.VerifySeconds * float64(time.Second)),
+		"pullFsyncNs":       int64(pull.FsyncSeconds * float64(time.Second)),
+	} {
+		s.ns.PutInt64(key, val)
+	}
+	if pull.FilesFailed > 0 {
+		n, _ := s.ns.Int64("pullErrors")
+		s.ns.PutInt64("pullErrors", n+pull.FilesFailed)
+	}
+}
+
+// ScrubCompleted records the scrub.
+func (s *FolderStatisticsReference) ScrubCompleted(scrub ScrubStatistics) {
+	if debug {
+		l.Debugf("stats.FolderStatisticsReference.ScrubCompleted: %s %+v", s.folder, scrub)
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.ns.PutTime("scrubStarted", scrub.Started)
+	s.ns.PutTime("scrubFinished", scrub.Finished)
+	for key, val := range map[string]int64{
+		"scrubFilesChecked": scrub.FilesChecked,
+		"scrubBytesChecked": scrub.BytesChecked,
+		"scrubCorrupted":    scrub.Corrupted,
+		"scrubRepaired":     scrub.Repaired,
+	} {
+		s.ns.PutInt64(key, val)
+	}
+}
+
+func (s *FolderStatisticsReference) GetLastScan() ScanStatistics {
+	var scan ScanStatistics
+	scan.Started, _ = s.ns.Time("scanStarted")
+	scan.Finished, _ = s.ns.Time("scanFinished")
+	if !scan.Started.IsZero() {
+		scan.Duration = scan.Finished.Sub(scan.Started).Seconds()
+	}
+	scan.FilesHashed, _ = s.ns.Int64("scanFilesHashed")
+	scan.BytesHashed, _ = s.ns.Int64("scanBytesHashed")
+	scan.Error, _ = s.ns.String("scanError")
+	return scan
+}
+
+func (s *FolderStatisticsReference) GetLastPull() PullStatistics {
+	var pull PullStatistics
+	pull.Started, _ = s.ns.Time("pullStarted")
+	pull.Finished, _ = s.ns.Time("pullFinished")
+	pull.Result, _ = s.ns.String("pullResult")
+	pull.Error, _ = s.ns.String("pullError")
+	pull.Changed, _ = s.ns.Int64("pullChanged")
+	pull.FilesPulled, _ = s.ns.Int64("pullFilesPulled")
+	pull.FilesFailed, _ = s.ns.Int64("pullFilesFailed")
+	pull.NetworkBytes, _ = s.ns.Int64("pullNetworkBytes")
+	pull.ReusedBytes, _ = s.ns.Int64("pullReusedBytes")
+	pull.FilesVerified, _ = s.ns.Int64("pullFilesVerified")
+	verify, _ := s.ns.Int64("pullVerifyNs")
+	pull.VerifySeconds = time.Duration(verify).Seconds()
+	fsync, _ := s.ns.Int64("pullFsyncNs")
+	pull.FsyncSeconds = time.Duration(fsync).Seconds()
+	return pull
+}
+
+func (s *FolderStatisticsReference) GetLastScrub() ScrubStatistics {
+	var scrub ScrubStatistics
+	scrub.Started, _ = s.ns.Time("scrubStarted")
+	scrub.Finished, _ = s.ns.Time("scrubFinished")
+	scrub.FilesChecked, _ = s.ns.Int64("scrubFilesChecked")
+	scrub.BytesChecked, _ = s.ns.Int64("scrubBytesChecked")
+	scrub.Corrupted, _ = s.ns.Int64("scrubCorrupted")
+	scrub.Repaired, _ = s.ns.Int64("scrubRepaired")
+	return scrub
+}
+
+func (s *FolderStatisticsReference) GetErrors() ErrorCounts {
+	var errs ErrorCounts
+	errs.Scan, _ = s.ns.Int64("scanErrors")
+	errs.Pull, _ = s.ns.Int64("pullErrors")
+	return errs
+}
+
 func (s *FolderStatisticsReference) GetStatistics() FolderStatistics {
 	return FolderStatistics{
-		LastFile: s.GetLastFile(),
+		LastFile:  s.GetLastFile(),
+		LastScan:  s.GetLastScan(),
+		LastPull:  s.GetLastPull(),
+		LastScrub: s.GetLastScrub(),
+		Errors:    s.GetErrors(),
 	}
 }
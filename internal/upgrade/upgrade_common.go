@@ -10,6 +10,7 @@ package upgrade
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
@@ -34,12 +35,19 @@ var (
 	ErrUpgradeUnsupported = errors.New("upgrade unsupported")
 	ErrUpgradeInProgress  = errors.New("upgrade already in progress")
 	upgradeUnlocked       = make(chan bool, 1)
+	httpClient            = http.DefaultClient
 )
 
 func init() {
 	upgradeUnlocked <- true
 }
 
+// SetHTTPClient sets the HTTP client used to look for and download releases,
+// such as one that goes through a proxy.
+func SetHTTPClient(client *http.Client) {
+	httpClient = client
+}
+
 func To(rel Release) error {
 	select {
 	case <-upgradeUnlocked:
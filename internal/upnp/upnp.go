@@ -605,3 +605,17 @@ func (s *IGDService) GetExternalIPAddress() (net.IP, error) {
 
 	return result, nil
 }
+
+// GetExternalIPAddress returns the external IP address reported by the
+// first service on the specified InternetGatewayDevice that has one.
+func (n *IGD) GetExternalIPAddress() (net.IP, error) {
+	var err error
+	for _, service := range n.services {
+		var ip net.IP
+		ip, err = service.GetExternalIPAddress()
+		if err == nil && ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, err
+}